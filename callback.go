@@ -0,0 +1,197 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ttrpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// RegisterService registers the methods of a service the server may call back
+// with CallPeer, making the connection usable in both directions. Services
+// must be registered before the server calls them. Streams are not supported
+// on callbacks, RegisterService panics if desc has any or if a service with
+// the same name is already registered.
+func (c *Client) RegisterService(name string, desc *ServiceDesc) {
+	if len(desc.Streams) > 0 {
+		panic(fmt.Errorf("ttrpc: service %v registered on a client has streams", name))
+	}
+	c.services.register(name, desc)
+}
+
+// handleRequest serves a call made by the server on a service registered with
+// RegisterService. Calls from the server use even stream identifiers.
+func (c *Client) handleRequest(msg *streamMessage) {
+	sid := msg.header.StreamID
+	respond := func(st *status.Status, data []byte, streaming, closeStream bool) error {
+		p, err := proto.Marshal(&Response{
+			Status:  st.Proto(),
+			Payload: data,
+		})
+		if err != nil {
+			return err
+		}
+		return c.send(sid, messageTypeResponse, 0, p)
+	}
+
+	var req Request
+	err := proto.Unmarshal(msg.payload[:msg.header.Length], &req)
+	c.channel.putmbuf(msg.payload)
+	if err == nil {
+		_, err = c.services.handle(c.ctx, &req, false, respond)
+	}
+	if err != nil {
+		st, ok := status.FromError(err)
+		if !ok {
+			st = status.Newf(codes.InvalidArgument, "unmarshal request error: %v", err)
+		}
+		if err := respond(st, nil, false, true); err != nil {
+			c.logger.Debugf("ttrpc: failed to respond to call on stream %d: %v", sid, err)
+		}
+	}
+}
+
+// CallPeer makes a unary call to a service the client of a connection
+// registered with Client.RegisterService. ctx must be the context of a server
+// handler, or derived from one, and the call is made on the connection the
+// handler was called on.
+func CallPeer(ctx context.Context, service, method string, req, resp interface{}) error {
+	p, ok := getPeer(ctx)
+	if !ok || p.calls == nil {
+		return errors.New("ttrpc: no connection to call the peer on")
+	}
+	return p.calls.call(ctx, service, method, req, resp)
+}
+
+// peerCalls tracks the calls a server makes to the client of a connection.
+type peerCalls struct {
+	codec          Codec
+	maxSendMsgSize int
+	send           func(id uint32, p []byte) error // set by the connection
+
+	mu      sync.Mutex
+	nextID  uint32
+	pending map[uint32]chan *Response
+	closed  bool
+}
+
+func newPeerCalls(codec Codec, maxSendMsgSize int) *peerCalls {
+	return &peerCalls{
+		codec:          codec,
+		maxSendMsgSize: maxSendMsgSize,
+		nextID:         2,
+		pending:        make(map[uint32]chan *Response),
+	}
+}
+
+func (pc *peerCalls) call(ctx context.Context, service, method string, req, resp interface{}) error {
+	payload, err := marshal(pc.codec, req)
+	if err != nil {
+		return err
+	}
+	p, err := pc.codec.Marshal(&Request{
+		Service:     service,
+		Method:      method,
+		Payload:     payload,
+		TimeoutNano: timeoutNano(ctx),
+	})
+	if err != nil {
+		return err
+	}
+	if err := oversizedMessageError(len(p), pc.maxSendMsgSize); err != nil {
+		return err
+	}
+
+	pc.mu.Lock()
+	if pc.closed {
+		pc.mu.Unlock()
+		return ErrClosed
+	}
+	// the identifier wraps to the reserved stream 0 once exhausted
+	if pc.nextID == 0 {
+		pc.mu.Unlock()
+		return ErrStreamIDsExhausted
+	}
+	id := pc.nextID
+	pc.nextID += 2
+	responses := make(chan *Response, 1)
+	pc.pending[id] = responses
+	pc.mu.Unlock()
+
+	defer func() {
+		pc.mu.Lock()
+		delete(pc.pending, id)
+		pc.mu.Unlock()
+	}()
+
+	if err := pc.send(id, p); err != nil {
+		return err
+	}
+
+	var (
+		cresp *Response
+		ok    bool
+	)
+	select {
+	case <-ctx.Done():
+		return fromContextError(ctx.Err())
+	case cresp, ok = <-responses:
+	}
+	if !ok {
+		return ErrClosed
+	}
+	if cresp.Status != nil && cresp.Status.Code != int32(codes.OK) {
+		return status.ErrorProto(cresp.Status)
+	}
+	return unmarshal(pc.codec, cresp.Payload, resp)
+}
+
+// receive delivers the response received on stream id to the pending call.
+func (pc *peerCalls) receive(id uint32, p []byte) error {
+	var resp Response
+	if err := pc.codec.Unmarshal(p, &resp); err != nil {
+		return err
+	}
+
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	responses, ok := pc.pending[id]
+	if !ok {
+		return fmt.Errorf("no call pending on stream %d", id)
+	}
+	delete(pc.pending, id)
+	responses <- &resp
+	return nil
+}
+
+// close fails the pending calls and any later one once the connection is
+// closed.
+func (pc *peerCalls) close() {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	pc.closed = true
+	for id, responses := range pc.pending {
+		close(responses)
+		delete(pc.pending, id)
+	}
+}
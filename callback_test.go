@@ -0,0 +1,154 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ttrpc
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net"
+	"testing"
+
+	"github.com/containerd/ttrpc/internal"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestCallPeer(t *testing.T) {
+	var (
+		ctx             = context.Background()
+		server          = mustServer(t)(NewServer())
+		addr, listener  = newTestListener(t)
+		client, cleanup = newTestClient(t, addr)
+	)
+	defer listener.Close()
+	defer cleanup()
+
+	// the server asks the client to complete the request
+	server.RegisterService(serviceName, &ServiceDesc{
+		Methods: map[string]Method{
+			"Test": func(ctx context.Context, unmarshal func(interface{}) error) (interface{}, error) {
+				var req internal.TestPayload
+				if err := unmarshal(&req); err != nil {
+					return nil, err
+				}
+				var resp internal.TestPayload
+				if err := CallPeer(ctx, "callback", "Complete", &req, &resp); err != nil {
+					return nil, err
+				}
+				resp.Foo = "server " + resp.Foo
+				return &resp, nil
+			},
+		},
+	})
+	client.RegisterService("callback", &ServiceDesc{
+		Methods: map[string]Method{
+			"Complete": func(ctx context.Context, unmarshal func(interface{}) error) (interface{}, error) {
+				var req internal.TestPayload
+				if err := unmarshal(&req); err != nil {
+					return nil, err
+				}
+				return &internal.TestPayload{Foo: "client " + req.Foo}, nil
+			},
+		},
+	})
+
+	go server.Serve(ctx, listener)
+	defer server.Shutdown(ctx)
+
+	var resp internal.TestPayload
+	if err := client.Call(ctx, serviceName, "Test", &internal.TestPayload{Foo: "foo"}, &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Foo != "server client foo" {
+		t.Fatalf("unexpected response %q", resp.Foo)
+	}
+}
+
+func TestCallPeerUnimplemented(t *testing.T) {
+	var (
+		ctx             = context.Background()
+		server          = mustServer(t)(NewServer())
+		addr, listener  = newTestListener(t)
+		client, cleanup = newTestClient(t, addr)
+		errs            = make(chan error, 1)
+	)
+	defer listener.Close()
+	defer cleanup()
+
+	server.RegisterService(serviceName, &ServiceDesc{
+		Methods: map[string]Method{
+			"Test": func(ctx context.Context, unmarshal func(interface{}) error) (interface{}, error) {
+				errs <- CallPeer(ctx, "callback", "Missing", &internal.TestPayload{}, &internal.TestPayload{})
+				return &internal.TestPayload{}, nil
+			},
+		},
+	})
+
+	go server.Serve(ctx, listener)
+	defer server.Shutdown(ctx)
+
+	if err := client.Call(ctx, serviceName, "Test", &internal.TestPayload{}, &internal.TestPayload{}); err != nil {
+		t.Fatal(err)
+	}
+	if code := status.Code(<-errs); code != codes.Unimplemented {
+		t.Fatalf("expected %v, got %v", codes.Unimplemented, code)
+	}
+
+	if err := CallPeer(ctx, "callback", "Missing", &internal.TestPayload{}, &internal.TestPayload{}); err == nil {
+		t.Fatal("expected CallPeer outside of a handler to fail")
+	}
+}
+
+func TestClientRegisterServiceStreams(t *testing.T) {
+	conn, _ := net.Pipe()
+	client := NewClient(conn)
+	defer client.Close()
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected registering streams on a client to panic")
+		}
+	}()
+	client.RegisterService("callback", &ServiceDesc{
+		Streams: map[string]Stream{"Stream": {}},
+	})
+}
+
+func TestCallPeerIDsExhausted(t *testing.T) {
+	var (
+		ctx     = context.Background()
+		calls   = newPeerCalls(codec{}, messageLengthMax)
+		sent    []uint32
+		errSend = errors.New("not sent")
+	)
+	calls.send = func(id uint32, p []byte) error {
+		sent = append(sent, id)
+		return errSend
+	}
+	calls.nextID = math.MaxUint32 - 1
+
+	if err := calls.call(ctx, "callback", "Test", &internal.TestPayload{}, &internal.TestPayload{}); !errors.Is(err, errSend) {
+		t.Fatalf("expected %v, got %v", errSend, err)
+	}
+	if err := calls.call(ctx, "callback", "Test", &internal.TestPayload{}, &internal.TestPayload{}); !errors.Is(err, ErrStreamIDsExhausted) {
+		t.Fatalf("expected %v, got %v", ErrStreamIDsExhausted, err)
+	}
+	if len(sent) != 1 || sent[0] != math.MaxUint32-1 {
+		t.Fatalf("unexpected stream ids used %v", sent)
+	}
+}
@@ -0,0 +1,98 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ttrpc
+
+import "context"
+
+// CallOption configures a single call made with Call, CallWithResult or
+// NewStream, without affecting the other calls of the client.
+type CallOption func(*callOptions)
+
+type callOptions struct {
+	metadata MD
+	codec    Codec
+
+	noFrameTimeouts bool
+}
+
+func newCallOptions(opts []CallOption) *callOptions {
+	o := &callOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// WithCallMetadata adds md to the metadata sent with the call, after any
+// metadata attached to the context with WithMetadata.
+func WithCallMetadata(md MD) CallOption {
+	return func(o *callOptions) {
+		if o.metadata == nil {
+			o.metadata = MD{}
+		}
+		for k, values := range md {
+			o.metadata.Append(k, values...)
+		}
+	}
+}
+
+// WithCallCodec sets the codec used to marshal and unmarshal the payloads of
+// the call, overriding the codec of the client. The content type configured
+// for the client is still sent, so the server must be able to decode the
+// payloads with the codec it picks for that content type.
+func WithCallCodec(codec Codec) CallOption {
+	return func(o *callOptions) {
+		o.codec = codec
+	}
+}
+
+// WithoutFrameTimeouts exempts the frames of the stream from the read and
+// write timeouts of the client, for streams where the peer may legitimately
+// stop reading for a while.
+func WithoutFrameTimeouts() CallOption {
+	return func(o *callOptions) {
+		o.noFrameTimeouts = true
+	}
+}
+
+// codecOr returns the codec set for the call or def when none is set.
+func (o *callOptions) codecOr(def Codec) Codec {
+	if o.codec != nil {
+		return o.codec
+	}
+	return def
+}
+
+type callOptionsKey struct{}
+
+// withCallOptions attaches the options of a stream to its context, as stream
+// interceptors do not pass call options along to the Streamer.
+func withCallOptions(ctx context.Context, opts []CallOption) context.Context {
+	if len(opts) == 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, callOptionsKey{}, newCallOptions(opts))
+}
+
+// getCallOptions returns the call options attached to ctx by
+// withCallOptions.
+func getCallOptions(ctx context.Context) *callOptions {
+	if o, ok := ctx.Value(callOptionsKey{}).(*callOptions); ok {
+		return o
+	}
+	return &callOptions{}
+}
@@ -18,19 +18,26 @@ package ttrpc
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"math/bits"
 	"net"
+	"os"
 	"sync"
-
-	"google.golang.org/grpc/codes"
-	"google.golang.org/grpc/status"
+	"time"
 )
 
 const (
 	messageHeaderLength = 10
 	messageLengthMax    = 4 << 20
+
+	// messageLengthReserved is the smallest length using the first header
+	// byte, which is reserved. Longer oversized messages are not discarded
+	// but treated as a corrupted frame.
+	messageLengthReserved = 1 << 24
 )
 
 type messageType uint8
@@ -39,8 +46,22 @@ const (
 	messageTypeRequest  messageType = 0x1
 	messageTypeResponse messageType = 0x2
 	messageTypeData     messageType = 0x3
+	messageTypePing     messageType = 0x4
+	messageTypePong     messageType = 0x5
+	messageTypeGoAway   messageType = 0x6
+
+	messageTypeWindowUpdate messageType = 0x7
+	messageTypeCompression  messageType = 0x8
+	messageTypeHeader       messageType = 0x9
+	messageTypeMetadata     messageType = 0xa
+	messageTypeFds          messageType = 0xb
+	messageTypeTrailer      messageType = 0xc
 )
 
+// controlStreamID is reserved for connection level messages. Streams are never
+// allocated with this identifier since client initiated streams are odd.
+const controlStreamID uint32 = 0
+
 func (mt messageType) String() string {
 	switch mt {
 	case messageTypeRequest:
@@ -49,6 +70,24 @@ func (mt messageType) String() string {
 		return "response"
 	case messageTypeData:
 		return "data"
+	case messageTypePing:
+		return "ping"
+	case messageTypePong:
+		return "pong"
+	case messageTypeGoAway:
+		return "goaway"
+	case messageTypeWindowUpdate:
+		return "window update"
+	case messageTypeCompression:
+		return "compression"
+	case messageTypeHeader:
+		return "header"
+	case messageTypeMetadata:
+		return "metadata"
+	case messageTypeFds:
+		return "fds"
+	case messageTypeTrailer:
+		return "trailer"
 	default:
 		return "unknown"
 	}
@@ -58,6 +97,7 @@ const (
 	flagRemoteClosed uint8 = 0x1
 	flagRemoteOpen   uint8 = 0x2
 	flagNoData       uint8 = 0x4
+	flagCompressed   uint8 = 0x8
 )
 
 // messageHeader represents the fixed-length message header of 10 bytes sent
@@ -93,7 +133,19 @@ func writeMessageHeader(w io.Writer, p []byte, mh messageHeader) error {
 	return err
 }
 
-var buffers sync.Pool
+const (
+	// minBufferSizeClass is the size class of the smallest pooled read
+	// buffer, 512 bytes.
+	minBufferSizeClass = 9
+	// maxBufferSizeClass is the size class of the largest pooled read
+	// buffer, matching the default maximum message length. Larger messages
+	// are read into buffers which are not reused.
+	maxBufferSizeClass = 22
+)
+
+// buffers holds a pool of read buffers for each size class, so that a message
+// is always read into a buffer less than twice its size.
+var buffers [maxBufferSizeClass - minBufferSizeClass + 1]sync.Pool
 
 type channel struct {
 	conn  net.Conn
@@ -101,14 +153,107 @@ type channel struct {
 	br    *bufio.Reader
 	hrbuf [messageHeaderLength]byte // avoid alloc when reading header
 	hwbuf [messageHeaderLength]byte
+
+	maxRecvMsgSize int
+	maxSendMsgSize int
+
+	// wmu protects bw when writes are coalesced, since buffered frames are
+	// flushed from a timer.
+	wmu            sync.Mutex
+	coalesceWindow time.Duration
+	flushTimer     *time.Timer
+	flushPending   bool
+
+	stats  *stats
+	tracer FrameTracer
+
+	// recvCompressor decompresses the messages received with the compressed
+	// flag, it is only used by recv.
+	recvCompressor Compressor
+	// sendCompressor compresses messages sent once compression has been
+	// negotiated, protected by wmu.
+	sendCompressor Compressor
+	// compressMinSize is the size from which message data is compressed,
+	// smaller messages are sent as is.
+	compressMinSize int
+
+	// readTimeout bounds the time to read a frame once its first byte has
+	// arrived and writeTimeout the time to write a frame, so that a stalled
+	// peer fails the connection. Zero disables them. Frames of the streams
+	// for which untimed returns true are exempt.
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+	untimed      func(streamID uint32) bool
+	// flushUntimed is set when buffered frames of an untimed stream are
+	// waiting for the flush timer, protected by wmu.
+	flushUntimed bool
+	// buffered is the number of frames waiting for the flush timer,
+	// protected by wmu.
+	buffered int
+
+	// rights passes file descriptors on unix sockets, it is nil for other
+	// connections. Descriptors are only received when acceptFds is set, the
+	// kernel discards them otherwise.
+	rights    *unixRights
+	acceptFds bool
 }
 
 func newChannel(conn net.Conn) *channel {
-	return &channel{
-		conn: conn,
-		bw:   bufio.NewWriter(conn),
-		br:   bufio.NewReader(conn),
+	ch := &channel{
+		conn:           conn,
+		bw:             bufio.NewWriter(conn),
+		maxRecvMsgSize: messageLengthMax,
+		maxSendMsgSize: messageLengthMax,
+	}
+	ch.setReader(conn)
+	return ch
+}
+
+// setReader reads frames from conn. When file descriptors are accepted on a
+// unix socket, it is read with recvmsg to receive the descriptors passed along
+// the frames.
+func (ch *channel) setReader(conn net.Conn) {
+	if ch.rights != nil {
+		ch.rights.close()
+	}
+	ch.rights = newUnixRights(conn)
+	var r io.Reader = conn
+	if ch.rights != nil && ch.acceptFds {
+		r = ch.rights
 	}
+	if ch.br == nil {
+		ch.br = bufio.NewReader(r)
+	} else {
+		ch.br.Reset(r)
+	}
+}
+
+// reset the channel to read and write on conn. The caller must make sure no
+// send or recv is in progress.
+func (ch *channel) reset(conn net.Conn) {
+	ch.wmu.Lock()
+	defer ch.wmu.Unlock()
+	ch.conn = conn
+	ch.bw.Reset(conn)
+	ch.setReader(conn)
+	// buffered frames are lost with the previous connection
+	ch.stats.writesPending(-ch.buffered)
+	ch.buffered = 0
+	// compression is negotiated again on the new connection
+	ch.sendCompressor = nil
+}
+
+// setSendCompressor compresses the messages sent from now on with compressor.
+func (ch *channel) setSendCompressor(compressor Compressor) {
+	ch.wmu.Lock()
+	defer ch.wmu.Unlock()
+	ch.sendCompressor = compressor
+}
+
+// setWriteBufferSize replaces the write buffer with one of the given size. It
+// must be called before the channel is used.
+func (ch *channel) setWriteBufferSize(n int) {
+	ch.bw = bufio.NewWriterSize(ch.conn, n)
 }
 
 // recv a message from the channel. The returned buffer contains the message.
@@ -116,19 +261,42 @@ func newChannel(conn net.Conn) *channel {
 // If a valid grpc status is returned, the message header
 // returned will be valid and caller should send that along to
 // the correct consumer. The bytes on the underlying channel
-// will be discarded.
+// will be discarded. Messages larger than the configured maximum
+// are reported with an *OversizedMessageErr, which carries such a status.
 func (ch *channel) recv() (messageHeader, []byte, error) {
+	if ch.readTimeout > 0 {
+		// the connection may legitimately be idle between frames, only
+		// the frame itself must arrive in time
+		if _, err := ch.br.Peek(1); err != nil {
+			return messageHeader{}, nil, err
+		}
+		ch.conn.SetReadDeadline(time.Now().Add(ch.readTimeout))
+		defer ch.conn.SetReadDeadline(time.Time{})
+	}
+
 	mh, err := readMessageHeader(ch.hrbuf[:], ch.br)
 	if err != nil {
 		return messageHeader{}, nil, err
 	}
+	ch.stats.received(messageHeaderLength)
+	ch.trace(FrameReceived, mh)
 
-	if mh.Length > uint32(messageLengthMax) {
+	if ch.readTimeout > 0 && ch.isUntimed(mh.StreamID) {
+		ch.conn.SetReadDeadline(time.Time{})
+	}
+
+	if mh.Length > uint32(ch.maxRecvMsgSize) {
+		if mh.Length >= messageLengthReserved {
+			// reading on would only consume garbage from a corrupted or
+			// hostile peer
+			return messageHeader{}, nil, fmt.Errorf("message length %d exceeds the maximum of %d: %w", mh.Length, ch.maxRecvMsgSize, ErrProtocol)
+		}
 		if _, err := ch.br.Discard(int(mh.Length)); err != nil {
 			return mh, nil, fmt.Errorf("failed to discard after receiving oversized message: %w", err)
 		}
+		ch.stats.received(int(mh.Length))
 
-		return mh, nil, status.Errorf(codes.ResourceExhausted, "message length %v exceed maximum message size of %v", mh.Length, messageLengthMax)
+		return mh, nil, oversizedMessageError(int(mh.Length), ch.maxRecvMsgSize)
 	}
 
 	var p []byte
@@ -137,46 +305,228 @@ func (ch *channel) recv() (messageHeader, []byte, error) {
 		if _, err := io.ReadFull(ch.br, p); err != nil {
 			return messageHeader{}, nil, fmt.Errorf("failed reading message: %w", err)
 		}
+		ch.stats.received(len(p))
+	}
+
+	if mh.Flags&flagCompressed != 0 {
+		if ch.recvCompressor == nil || !compressible(mh.Type) {
+			ch.putmbuf(p)
+			return messageHeader{}, nil, fmt.Errorf("unexpected compressed %q message: %w", mh.Type, ErrProtocol)
+		}
+		d, err := ch.decompress(ch.recvCompressor, p, ch.maxRecvMsgSize)
+		ch.putmbuf(p)
+		if err != nil {
+			if _, ok := err.(*OversizedMessageErr); ok {
+				return mh, nil, err
+			}
+			return messageHeader{}, nil, fmt.Errorf("failed decompressing message: %w", err)
+		}
+		// the message is handled as if it was sent uncompressed
+		mh.Length = uint32(len(d))
+		mh.Flags &^= flagCompressed
+		p = d
 	}
 
 	return mh, p, nil
 }
 
 func (ch *channel) send(streamID uint32, t messageType, flags uint8, p []byte) error {
-	if len(p) > messageLengthMax {
-		return OversizedMessageError(len(p))
-	}
+	ch.stats.writesPending(1)
+	ch.wmu.Lock()
+	defer ch.wmu.Unlock()
+	buffered := false
+	defer func() {
+		if !buffered {
+			ch.stats.writesPending(-1)
+		}
+	}()
 
-	if err := writeMessageHeader(ch.bw, ch.hwbuf[:], messageHeader{Length: uint32(len(p)), StreamID: streamID, Type: t, Flags: flags}); err != nil {
+	if err := oversizedMessageError(len(p), ch.maxSendMsgSize); err != nil {
 		return err
 	}
 
+	if ch.sendCompressor != nil && len(p) > 0 && len(p) >= ch.compressMinSize && compressible(t) {
+		c, err := compress(ch.sendCompressor, p)
+		if err != nil {
+			return fmt.Errorf("failed compressing message: %w", err)
+		}
+		p = c
+		flags |= flagCompressed
+	}
+
+	untimed := ch.isUntimed(streamID)
+	if ch.writeTimeout > 0 {
+		ch.setWriteDeadline(untimed || ch.flushUntimed)
+	}
+
+	mh := messageHeader{Length: uint32(len(p)), StreamID: streamID, Type: t, Flags: flags}
+	if err := writeMessageHeader(ch.bw, ch.hwbuf[:], mh); err != nil {
+		return ch.writeError(err)
+	}
+	ch.trace(FrameSent, mh)
+
 	if len(p) > 0 {
 		_, err := ch.bw.Write(p)
 		if err != nil {
-			return err
+			return ch.writeError(err)
 		}
 	}
 
-	return ch.bw.Flush()
+	if ch.coalesceWindow > 0 {
+		ch.flushUntimed = ch.flushUntimed || untimed
+		ch.buffered++
+		buffered = true
+		ch.scheduleFlush()
+	} else if err := ch.bw.Flush(); err != nil {
+		return ch.writeError(err)
+	}
+	ch.stats.sent(messageHeaderLength + len(p))
+	return nil
 }
 
-func (ch *channel) getmbuf(size int) []byte {
-	// we can't use the standard New method on pool because we want to allocate
-	// based on size.
-	b, ok := buffers.Get().(*[]byte)
-	if !ok || cap(*b) < size {
-		// TODO(stevvooe): It may be better to allocate these in fixed length
-		// buckets to reduce fragmentation but its not clear that would help
-		// with performance. An ilogb approach or similar would work well.
-		bb := make([]byte, size)
-		b = &bb
+// sendFds passes fds to the peer with a fds message on the stream. Buffered
+// frames are written out first, as the descriptors must be sent along the first
+// byte of the message.
+func (ch *channel) sendFds(streamID uint32, fds []int) error {
+	if ch.rights == nil {
+		return errors.New("ttrpc: file descriptors can only be passed on unix sockets")
+	}
+	if len(fds) > maxFds {
+		return fmt.Errorf("ttrpc: cannot pass %d file descriptors, the maximum is %d", len(fds), maxFds)
+	}
+
+	ch.wmu.Lock()
+	defer ch.wmu.Unlock()
+
+	if ch.writeTimeout > 0 {
+		ch.setWriteDeadline(ch.isUntimed(streamID) || ch.flushUntimed)
+	}
+	if err := ch.bw.Flush(); err != nil {
+		return ch.writeError(err)
+	}
+	ch.stats.writesPending(-ch.buffered)
+	ch.buffered = 0
+
+	p := binary.BigEndian.AppendUint32(nil, uint32(len(fds)))
+	mh := messageHeader{Length: uint32(len(p)), StreamID: streamID, Type: messageTypeFds}
+	var b bytes.Buffer
+	writeMessageHeader(&b, ch.hwbuf[:], mh)
+	b.Write(p)
+	if err := ch.rights.write(b.Bytes(), fds); err != nil {
+		return ch.writeError(err)
+	}
+	ch.trace(FrameSent, mh)
+	ch.stats.sent(b.Len())
+	return nil
+}
+
+// recvFds returns the file descriptors passed with the fds message p, in the
+// order they were sent.
+func (ch *channel) recvFds(p []byte) ([]int, error) {
+	if len(p) != 4 {
+		return nil, fmt.Errorf("invalid fds message: %w", ErrProtocol)
+	}
+	if !ch.acceptFds {
+		// discarded when read
+		return nil, nil
+	}
+	if ch.rights == nil {
+		return nil, fmt.Errorf("unexpected fds message on a connection which is not a unix socket: %w", ErrProtocol)
+	}
+	return ch.rights.take(int(binary.BigEndian.Uint32(p)))
+}
+
+// isUntimed returns whether the frames of the stream are exempt from the read
+// and write timeouts.
+func (ch *channel) isUntimed(streamID uint32) bool {
+	return streamID != controlStreamID && ch.untimed != nil && ch.untimed(streamID)
+}
+
+// setWriteDeadline bounds the following writes by the write timeout, or
+// clears the deadline for untimed writes. The caller must hold wmu.
+func (ch *channel) setWriteDeadline(untimed bool) {
+	var deadline time.Time
+	if !untimed {
+		deadline = time.Now().Add(ch.writeTimeout)
+	}
+	ch.conn.SetWriteDeadline(deadline)
+}
+
+// writeError closes the connection when a write timed out, since the
+// buffered writer cannot be used anymore and a stalled peer must not keep the
+// connection around. The caller must hold wmu.
+func (ch *channel) writeError(err error) error {
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		ch.conn.Close()
+	}
+	return err
+}
+
+// scheduleFlush arranges for buffered frames to be flushed once the coalesce
+// window has passed, unless a flush is already pending. Frames which do not fit
+// in the buffer are written out immediately by the buffered writer. The caller
+// must hold wmu.
+func (ch *channel) scheduleFlush() {
+	if ch.flushPending {
+		return
+	}
+	ch.flushPending = true
+	if ch.flushTimer == nil {
+		ch.flushTimer = time.AfterFunc(ch.coalesceWindow, ch.flush)
 	} else {
-		*b = (*b)[:size]
+		ch.flushTimer.Reset(ch.coalesceWindow)
 	}
-	return *b
 }
 
+// flush writes out buffered frames. Since the frames were already reported as
+// sent, a failed flush closes the connection so that the reader notices.
+func (ch *channel) flush() {
+	ch.wmu.Lock()
+	defer ch.wmu.Unlock()
+	if !ch.flushPending {
+		return
+	}
+	ch.flushPending = false
+	if ch.writeTimeout > 0 {
+		ch.setWriteDeadline(ch.flushUntimed)
+	}
+	ch.flushUntimed = false
+	if err := ch.bw.Flush(); err != nil {
+		ch.conn.Close()
+	}
+	ch.stats.writesPending(-ch.buffered)
+	ch.buffered = 0
+}
+
+// getmbuf returns a buffer of size bytes for reading a message, reusing a
+// buffer returned with putmbuf when possible.
+func (ch *channel) getmbuf(size int) []byte {
+	class := bufferSizeClass(size)
+	if class > maxBufferSizeClass {
+		return make([]byte, size)
+	}
+	if b, ok := buffers[class-minBufferSizeClass].Get().(*[]byte); ok {
+		return (*b)[:size]
+	}
+	return make([]byte, size, 1<<class)
+}
+
+// putmbuf returns a buffer obtained from getmbuf for reuse. The buffer must not
+// be referenced once returned.
 func (ch *channel) putmbuf(p []byte) {
-	buffers.Put(&p)
+	class := bits.Len(uint(cap(p))) - 1
+	if class < minBufferSizeClass || class > maxBufferSizeClass || cap(p) != 1<<class {
+		return
+	}
+	buffers[class-minBufferSizeClass].Put(&p)
+}
+
+// bufferSizeClass returns the size class of the smallest pooled buffer which
+// can hold size bytes. Buffers in size class n have a capacity of 1<<n bytes.
+func bufferSizeClass(size int) int {
+	class := bits.Len(uint(size - 1))
+	if class < minBufferSizeClass {
+		class = minBufferSizeClass
+	}
+	return class
 }
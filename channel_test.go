@@ -17,12 +17,16 @@
 package ttrpc
 
 import (
+	"bufio"
 	"bytes"
 	"errors"
 	"io"
 	"net"
+	"os"
 	"reflect"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
@@ -113,3 +117,378 @@ func TestMessageOversize(t *testing.T) {
 		t.Fatalf("expected grpc status code: %v != %v", status.Code(), codes.ResourceExhausted)
 	}
 }
+
+func TestMessageOversizeConfigured(t *testing.T) {
+	var (
+		w, r = net.Pipe()
+		wch  = newChannel(w)
+		rch  = newChannel(r)
+		msg  = []byte("a message longer than sixteen bytes")
+		errs = make(chan error, 1)
+	)
+	defer w.Close()
+	defer r.Close()
+
+	wch.maxSendMsgSize = 16
+	err := wch.send(1, 1, 0, msg)
+	var oerr *OversizedMessageErr
+	if !errors.As(err, &oerr) {
+		t.Fatalf("expected oversized message error, got %v", err)
+	}
+	if oerr.RejectedLength() != len(msg) || oerr.MaximumLength() != 16 {
+		t.Fatalf("unexpected lengths in error: %d/%d", oerr.RejectedLength(), oerr.MaximumLength())
+	}
+
+	wch.maxSendMsgSize = messageLengthMax
+	rch.maxRecvMsgSize = 16
+	go func() {
+		errs <- wch.send(1, 1, 0, msg)
+	}()
+
+	_, _, err = rch.recv()
+	if !errors.As(err, &oerr) {
+		t.Fatalf("expected oversized message error, got %v", err)
+	}
+	if oerr.RejectedLength() != len(msg) || oerr.MaximumLength() != 16 {
+		t.Fatalf("unexpected lengths in error: %d/%d", oerr.RejectedLength(), oerr.MaximumLength())
+	}
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("expected grpc status code: %v != %v", status.Code(err), codes.ResourceExhausted)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+}
+
+type countingConn struct {
+	net.Conn
+	writes atomic.Int32
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	c.writes.Add(1)
+	return c.Conn.Write(p)
+}
+
+func TestWriteCoalescing(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		window time.Duration
+		writes int32
+	}{
+		{name: "Disabled", writes: 3},
+		{name: "Enabled", window: 10 * time.Millisecond, writes: 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var (
+				w, r     = net.Pipe()
+				conn     = &countingConn{Conn: w}
+				wch      = newChannel(conn)
+				rch      = newChannel(r)
+				messages = [][]byte{
+					[]byte("hello"),
+					[]byte("this is a test"),
+					[]byte("of write coalescing"),
+				}
+				received = make(chan []byte, len(messages))
+				errs     = make(chan error, 1)
+			)
+			defer w.Close()
+			defer r.Close()
+
+			wch.coalesceWindow = tc.window
+			go func() {
+				for range messages {
+					_, p, err := rch.recv()
+					if err != nil {
+						errs <- err
+						return
+					}
+					received <- p
+				}
+			}()
+
+			for i, msg := range messages {
+				if err := wch.send(uint32(i), messageTypeData, 0, msg); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// coalesced messages are written once the window has passed
+			for _, msg := range messages {
+				select {
+				case p := <-received:
+					if !bytes.Equal(p, msg) {
+						t.Fatalf("unexpected message %q, expected %q", p, msg)
+					}
+				case err := <-errs:
+					t.Fatal(err)
+				case <-time.After(time.Second):
+					t.Fatal("timed out waiting for message")
+				}
+			}
+
+			if n := conn.writes.Load(); n != tc.writes {
+				t.Fatalf("unexpected number of writes %d, expected %d", n, tc.writes)
+			}
+		})
+	}
+}
+
+func TestReadBufferPool(t *testing.T) {
+	ch := newChannel(nil)
+	for _, tc := range []struct {
+		size, cap int
+	}{
+		{size: 1, cap: 512},
+		{size: 512, cap: 512},
+		{size: 513, cap: 1024},
+		{size: 4096, cap: 4096},
+		{size: messageLengthMax, cap: messageLengthMax},
+		// too large to be pooled
+		{size: messageLengthMax + 1, cap: messageLengthMax + 1},
+	} {
+		p := ch.getmbuf(tc.size)
+		if len(p) != tc.size || cap(p) != tc.cap {
+			t.Fatalf("unexpected buffer for size %d: len %d, cap %d", tc.size, len(p), cap(p))
+		}
+		ch.putmbuf(p)
+	}
+}
+
+// frameReader repeatedly returns the same encoded frame.
+type frameReader struct {
+	frame []byte
+	off   int
+}
+
+func (r *frameReader) Read(p []byte) (int, error) {
+	n := copy(p, r.frame[r.off:])
+	r.off = (r.off + n) % len(r.frame)
+	return n, nil
+}
+
+func BenchmarkChannelRecv(b *testing.B) {
+	var (
+		frame   bytes.Buffer
+		payload = bytes.Repeat([]byte("a"), 4096)
+	)
+	if err := writeMessageHeader(&frame, make([]byte, messageHeaderLength), messageHeader{
+		Length:   uint32(len(payload)),
+		StreamID: 1,
+		Type:     messageTypeData,
+	}); err != nil {
+		b.Fatal(err)
+	}
+	frame.Write(payload)
+
+	for _, tc := range []struct {
+		name   string
+		pooled bool
+	}{
+		{name: "Pooled", pooled: true},
+		{name: "Unpooled"},
+	} {
+		b.Run(tc.name, func(b *testing.B) {
+			ch := newChannel(nil)
+			ch.br = bufio.NewReader(&frameReader{frame: frame.Bytes()})
+
+			b.ReportAllocs()
+			b.SetBytes(int64(frame.Len()))
+			for i := 0; i < b.N; i++ {
+				_, p, err := ch.recv()
+				if err != nil {
+					b.Fatal(err)
+				}
+				if tc.pooled {
+					ch.putmbuf(p)
+				}
+			}
+		})
+	}
+}
+
+func TestCompressedMessage(t *testing.T) {
+	var (
+		w, r = net.Pipe()
+		wch  = newChannel(w)
+		rch  = newChannel(r)
+		msg  = bytes.Repeat([]byte("compressible "), 100)
+		errs = make(chan error, 1)
+	)
+	defer w.Close()
+	defer r.Close()
+
+	wch.setSendCompressor(NewGzipCompressor())
+	rch.recvCompressor = NewGzipCompressor()
+
+	go func() {
+		errs <- wch.send(1, messageTypeData, flagRemoteClosed, msg)
+	}()
+	mh, p, err := rch.recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	if mh.Flags != flagRemoteClosed || int(mh.Length) != len(msg) || !bytes.Equal(p, msg) {
+		t.Fatalf("unexpected message %+v", mh)
+	}
+
+	// messages under the threshold are sent uncompressed on the same stream
+	wch.compressMinSize = len(msg) + 1
+	go func() {
+		errs <- wch.send(1, messageTypeData, flagRemoteClosed, msg)
+	}()
+	mh, p, err = rch.recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	if mh.Flags != flagRemoteClosed || !bytes.Equal(p, msg) {
+		t.Fatalf("unexpected message %+v", mh)
+	}
+	wch.compressMinSize = 0
+
+	// decompressed messages are held to the receive limit
+	rch.maxRecvMsgSize = 64
+	go func() {
+		errs <- wch.send(1, messageTypeData, 0, msg)
+	}()
+	_, _, err = rch.recv()
+	var oerr *OversizedMessageErr
+	if !errors.As(err, &oerr) {
+		t.Fatalf("expected oversized message error, got %v", err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+
+	// compressed messages are a protocol error unless negotiated
+	rch.recvCompressor = nil
+	go func() {
+		errs <- wch.send(1, messageTypeData, 0, msg)
+	}()
+	if _, _, err := rch.recv(); !errors.Is(err, ErrProtocol) {
+		t.Fatalf("expected protocol error, got %v", err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMessageLengthReserved(t *testing.T) {
+	var (
+		w, r = net.Pipe()
+		rch  = newChannel(r)
+	)
+	defer w.Close()
+	defer r.Close()
+
+	go func() {
+		// a header claiming 4GB of data, which must not be read
+		w.Write([]byte{0xff, 0xff, 0xff, 0xff, 0, 0, 0, 1, byte(messageTypeRequest), 0})
+	}()
+	_, _, err := rch.recv()
+	if !errors.Is(err, ErrProtocol) {
+		t.Fatalf("expected protocol error, got %v", err)
+	}
+}
+
+func FuzzChannelRecv(f *testing.F) {
+	var buf bytes.Buffer
+	wch := newChannel(nil)
+	wch.bw = bufio.NewWriter(&buf)
+	wch.send(1, messageTypeRequest, 0, []byte("request"))
+	wch.send(1, messageTypeData, flagRemoteClosed|flagNoData, nil)
+	wch.send(controlStreamID, messageTypePing, 0, []byte{1, 2, 3, 4})
+	f.Add(buf.Bytes())
+	f.Add([]byte{0, 0, 0, 4, 0, 0, 0, 1, 1, 0, 1, 2})
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff, 0, 0, 0, 1, 1, 0})
+	f.Add([]byte{0, 0, 0, 1, 0, 0, 0, 1, 3, flagCompressed, 0})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		rch := newChannel(nil)
+		rch.br = bufio.NewReader(bytes.NewReader(data))
+		rch.maxRecvMsgSize = 1 << 10
+		for {
+			mh, p, err := rch.recv()
+			if err != nil {
+				if _, ok := status.FromError(err); ok {
+					// oversized messages are skipped
+					continue
+				}
+				return
+			}
+			if int(mh.Length) != len(p) || len(p) > rch.maxRecvMsgSize {
+				t.Fatalf("unexpected message of %d bytes with header %+v", len(p), mh)
+			}
+			rch.putmbuf(p)
+		}
+	})
+}
+
+func TestReadTimeout(t *testing.T) {
+	var (
+		w, r = net.Pipe()
+		rch  = newChannel(r)
+		ch   = newChannel(w)
+	)
+	defer w.Close()
+	defer r.Close()
+	rch.readTimeout = 50 * time.Millisecond
+
+	// idle time before a frame is not limited
+	go func() {
+		time.Sleep(2 * rch.readTimeout)
+		ch.send(1, messageTypeRequest, 0, []byte("hello"))
+	}()
+	if _, p, err := rch.recv(); err != nil {
+		t.Fatal(err)
+	} else if string(p) != "hello" {
+		t.Fatalf("unexpected message %q", p)
+	}
+
+	// but a frame stalled after its first bytes is
+	go w.Write([]byte{0, 0, 0})
+	if _, _, err := rch.recv(); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected a deadline error, got %v", err)
+	}
+}
+
+func TestWriteTimeout(t *testing.T) {
+	var (
+		w, r = net.Pipe()
+		ch   = newChannel(w)
+	)
+	defer r.Close()
+	ch.writeTimeout = 50 * time.Millisecond
+	ch.untimed = func(id uint32) bool { return id == 3 }
+
+	// an untimed stream waits for the peer to read
+	errs := make(chan error, 1)
+	go func() {
+		errs <- ch.send(3, messageTypeData, 0, []byte("hello"))
+	}()
+	time.Sleep(2 * ch.writeTimeout)
+	rch := newChannel(r)
+	if _, p, err := rch.recv(); err != nil {
+		t.Fatal(err)
+	} else if string(p) != "hello" {
+		t.Fatalf("unexpected message %q", p)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+
+	// other frames time out and close the connection
+	if err := ch.send(1, messageTypeRequest, 0, []byte("hello")); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected a deadline error, got %v", err)
+	}
+	if _, err := w.Write([]byte{0}); !errors.Is(err, io.ErrClosedPipe) {
+		t.Fatalf("expected the connection to be closed, got %v", err)
+	}
+}
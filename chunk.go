@@ -0,0 +1,87 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ttrpc
+
+import (
+	"errors"
+	"io"
+)
+
+// MessageSender is the sending half of a stream, implemented by both
+// ClientStream and StreamServer.
+type MessageSender interface {
+	SendMsg(m interface{}) error
+}
+
+// MessageReceiver is the receiving half of a stream, implemented by both
+// ClientStream and StreamServer.
+type MessageReceiver interface {
+	RecvMsg(m interface{}) error
+}
+
+// SendChunked reads r until io.EOF and sends its content on the stream as
+// a sequence of Chunk messages of at most chunkSize bytes each. It returns
+// the number of bytes sent. The stream is not closed, clients should call
+// CloseSend once SendChunked returns to let the peer's RecvChunked return.
+//
+// chunkSize must leave room for the message framing within the maximum
+// message size accepted by the peer.
+func SendChunked(stream MessageSender, r io.Reader, chunkSize int) (int64, error) {
+	if chunkSize <= 0 {
+		return 0, errors.New("ttrpc: chunk size must be positive")
+	}
+	var (
+		buf  = make([]byte, chunkSize)
+		sent int64
+	)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			if serr := stream.SendMsg(&Chunk{Data: buf[:n]}); serr != nil {
+				return sent, serr
+			}
+			sent += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return sent, nil
+		}
+		if err != nil {
+			return sent, err
+		}
+	}
+}
+
+// RecvChunked receives Chunk messages from the stream and writes their data
+// to w until the peer ends the stream. It returns the number of bytes
+// written.
+func RecvChunked(stream MessageReceiver, w io.Writer) (int64, error) {
+	var received int64
+	for {
+		var chunk Chunk
+		if err := stream.RecvMsg(&chunk); err != nil {
+			if err == io.EOF {
+				return received, nil
+			}
+			return received, err
+		}
+		n, err := w.Write(chunk.Data)
+		received += int64(n)
+		if err != nil {
+			return received, err
+		}
+	}
+}
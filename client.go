@@ -18,16 +18,17 @@ package ttrpc
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
-	"github.com/containerd/log"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/proto"
@@ -35,9 +36,25 @@ import (
 
 // Client for a ttrpc server
 type Client struct {
-	codec   codec
-	conn    net.Conn
-	channel *channel
+	codec        Codec
+	contentType  string
+	version      string
+	streamWindow uint32
+	channel      *channel
+
+	connLock sync.Mutex
+	conn     net.Conn
+	connGen  uint64 // incremented on every new connection
+	dialer   func(context.Context) (net.Conn, error)
+	backoff  Backoff
+
+	tlsConfig      *tls.Config
+	connConfigurer func(net.Conn) error
+	logger         Logger
+
+	stateLock sync.Mutex
+	state     ClientState
+	stateCh   chan struct{} // closed on state change
 
 	streamLock   sync.RWMutex
 	streams      map[streamID]*stream
@@ -51,7 +68,22 @@ type Client struct {
 	userCloseFunc   func()
 	userCloseWaitCh chan struct{}
 
-	interceptor UnaryClientInterceptor
+	interceptor       UnaryClientInterceptor
+	streamInterceptor StreamClientInterceptor
+
+	services *serviceSet // services the server may call back
+
+	compressor Compressor
+
+	defaultTimeout time.Duration
+
+	responseValidators []func(method string, resp interface{}) error
+
+	keepalive *keepalive
+	goingAway atomic.Bool
+	draining  atomic.Bool // set by Shutdown, new calls are refused
+
+	stats stats
 }
 
 // ClientOpts configures a client
@@ -64,6 +96,195 @@ func WithOnClose(onClose func()) ClientOpts {
 	}
 }
 
+// WithCodec sets the codec used to marshal and unmarshal request and response
+// payloads. By default payloads are encoded as protobuf.
+func WithCodec(codec Codec) ClientOpts {
+	return func(c *Client) {
+		c.codec = codec
+	}
+}
+
+// WithDeterministicMarshal sets the codec to the default protobuf codec with
+// deterministic marshaling, so that a message is always encoded to the same
+// bytes by a given binary, for example when payloads are hashed or signed.
+// It replaces any codec set by previous options.
+func WithDeterministicMarshal() ClientOpts {
+	return WithCodec(codec{deterministic: true})
+}
+
+// WithContentTypeCodec sets the codec used for payloads along with the
+// content type sent on each request, allowing a server with several codecs
+// registered to pick the matching one.
+func WithContentTypeCodec(contentType string, codec Codec) ClientOpts {
+	return func(c *Client) {
+		c.codec = codec
+		c.contentType = contentType
+	}
+}
+
+// WithMaxSendMessageSize sets the maximum size in bytes of a message the
+// client will send. Larger messages fail locally with an OversizedMessageErr
+// before anything is written to the connection. The default is 4MB,
+// non-positive values are ignored.
+func WithMaxSendMessageSize(n int) ClientOpts {
+	return func(c *Client) {
+		if n > 0 {
+			c.channel.maxSendMsgSize = n
+		}
+	}
+}
+
+// WithClientMaxReceiveMessageSize sets the maximum size in bytes of a message
+// the client will accept. Larger messages fail the call with a
+// ResourceExhausted status. The default is 4MB, non-positive values are
+// ignored.
+func WithClientMaxReceiveMessageSize(n int) ClientOpts {
+	return func(c *Client) {
+		if n > 0 {
+			c.channel.maxRecvMsgSize = n
+		}
+	}
+}
+
+// WithWriteBufferSize sets the size in bytes of the buffer used for writing
+// messages to the connection. The default is 4KB.
+func WithWriteBufferSize(n int) ClientOpts {
+	return func(c *Client) {
+		if n > 0 {
+			c.channel.setWriteBufferSize(n)
+		}
+	}
+}
+
+// WithWriteCoalesceWindow delays writing messages to the connection by up to
+// d so that messages sent in quick succession are written together, reducing
+// the number of syscalls at the cost of latency. Messages are written
+// immediately when d is zero, which is the default.
+func WithWriteCoalesceWindow(d time.Duration) ClientOpts {
+	return func(c *Client) {
+		c.channel.coalesceWindow = d
+	}
+}
+
+// WithFrameTracer sets a tracer called with the header of every frame the
+// client sends or receives, which helps debugging protocol issues.
+func WithFrameTracer(tracer FrameTracer) ClientOpts {
+	return func(c *Client) {
+		c.channel.tracer = tracer
+	}
+}
+
+// WithCompression compresses the messages exchanged with the server using
+// compressor. Compression is negotiated on every connection and only used once
+// the server accepted it, servers not configured with a compressor of the same
+// name keep exchanging uncompressed messages.
+func WithCompression(compressor Compressor) ClientOpts {
+	return func(c *Client) {
+		c.compressor = compressor
+		c.channel.recvCompressor = compressor
+	}
+}
+
+// WithCompressMinSize only compresses the messages the client sends with at
+// least n bytes of data, since compressing small messages costs more than it
+// saves. Each message tells whether it is compressed, so the server may use a
+// different threshold. By default all messages are compressed.
+func WithCompressMinSize(n int) ClientOpts {
+	return func(c *Client) {
+		c.channel.compressMinSize = n
+	}
+}
+
+// WithReadTimeout fails the connection when a frame takes longer than d to
+// arrive once its first byte was received, so that a peer stalling in the
+// middle of a frame does not hold the connection forever. The connection may
+// stay idle between frames. Zero, the default, disables the timeout.
+func WithReadTimeout(d time.Duration) ClientOpts {
+	return func(c *Client) {
+		c.channel.readTimeout = d
+	}
+}
+
+// WithWriteTimeout fails the connection when writing a frame takes longer than
+// d, which happens when the server stops reading. Streams which may be
+// legitimately blocked by a slow reader can opt out with
+// WithoutFrameTimeouts. Zero, the default, disables the timeout.
+func WithWriteTimeout(d time.Duration) ClientOpts {
+	return func(c *Client) {
+		c.channel.writeTimeout = d
+	}
+}
+
+// WithDefaultCallTimeout sets a timeout applied to calls and streams made
+// with a context without a deadline. Contexts which already have a deadline
+// are used as is. Calls are not given a timeout by default.
+func WithDefaultCallTimeout(d time.Duration) ClientOpts {
+	return func(c *Client) {
+		c.defaultTimeout = d
+	}
+}
+
+// WithClientVersion sends v as the API version of the client with every call
+// and stream, under VersionMetadataKey, for servers checking it with
+// WithServerAcceptVersions.
+func WithClientVersion(v string) ClientOpts {
+	return func(c *Client) {
+		c.version = v
+	}
+}
+
+// WithConnConfigurer sets a function called with the connection of the client
+// before it is used, to tune the underlying socket, for example to set
+// TCP_NODELAY. For clients created with NewClientWithDialer, it is called after
+// each dial and errors are retried like failed dials. Otherwise an error closes
+// the client.
+func WithConnConfigurer(fn func(net.Conn) error) ClientOpts {
+	return func(c *Client) {
+		c.connConfigurer = fn
+	}
+}
+
+// WithResponseValidator adds a function called with the full method name and
+// the response of every successful unary call once it is unmarshaled, to check
+// invariants of responses. The call fails with the error returned by the
+// validator. Validators are called in the order they were added.
+func WithResponseValidator(validate func(method string, resp interface{}) error) ClientOpts {
+	return func(c *Client) {
+		c.responseValidators = append(c.responseValidators, validate)
+	}
+}
+
+// WithLogger sets the logger the client logs to. By default the client logs
+// with github.com/containerd/log.
+func WithLogger(logger Logger) ClientOpts {
+	return func(c *Client) {
+		c.logger = logger
+	}
+}
+
+// WithKeepalive enables sending a ping to the server every interval. The
+// connection is closed when a ping is not answered within the timeout.
+func WithKeepalive(interval, timeout time.Duration) ClientOpts {
+	return func(c *Client) {
+		if interval <= 0 || timeout <= 0 {
+			c.keepalive = nil
+			return
+		}
+		c.keepalive = newKeepalive(interval, timeout)
+	}
+}
+
+// WithStreamWindowSize enables flow control on streams. Neither peer sends
+// more than size bytes of stream data, plus at most one message, until the
+// receiver has consumed them, so a slow receiver blocks SendMsg on the other
+// end rather than letting messages queue up. The server must support flow
+// control. A size of zero disables flow control, which is the default.
+func WithStreamWindowSize(size uint32) ClientOpts {
+	return func(c *Client) {
+		c.streamWindow = size
+	}
+}
+
 // WithUnaryClientInterceptor sets the provided client interceptor
 func WithUnaryClientInterceptor(i UnaryClientInterceptor) ClientOpts {
 	return func(c *Client) {
@@ -107,14 +328,67 @@ func chainUnaryInterceptors(interceptors []UnaryClientInterceptor, final Invoker
 	}
 }
 
+// WithStreamClientInterceptor sets the provided client stream interceptor
+func WithStreamClientInterceptor(i StreamClientInterceptor) ClientOpts {
+	return func(c *Client) {
+		c.streamInterceptor = i
+	}
+}
+
+// WithChainStreamClientInterceptor sets the provided chain of client stream
+// interceptors
+func WithChainStreamClientInterceptor(interceptors ...StreamClientInterceptor) ClientOpts {
+	return func(c *Client) {
+		if len(interceptors) == 0 {
+			return
+		}
+		if c.streamInterceptor != nil {
+			interceptors = append([]StreamClientInterceptor{c.streamInterceptor}, interceptors...)
+		}
+		c.streamInterceptor = func(
+			ctx context.Context,
+			desc *StreamDesc,
+			service, method string,
+			req interface{},
+			final Streamer,
+		) (ClientStream, error) {
+			return interceptors[0](ctx, desc, service, method, req,
+				chainStreamInterceptors(interceptors[1:], final))
+		}
+	}
+}
+
+func chainStreamInterceptors(interceptors []StreamClientInterceptor, final Streamer) Streamer {
+	if len(interceptors) == 0 {
+		return final
+	}
+	return func(
+		ctx context.Context,
+		desc *StreamDesc,
+		service, method string,
+		req interface{},
+	) (ClientStream, error) {
+		return interceptors[0](ctx, desc, service, method, req,
+			chainStreamInterceptors(interceptors[1:], final))
+	}
+}
+
 // NewClient creates a new ttrpc client using the given connection
 func NewClient(conn net.Conn, opts ...ClientOpts) *Client {
+	c := newClient(conn, ClientReady, opts...)
+	c.start()
+	return c
+}
+
+func newClient(conn net.Conn, state ClientState, opts ...ClientOpts) *Client {
 	ctx, cancel := context.WithCancel(context.Background())
 	channel := newChannel(conn)
 	c := &Client{
 		codec:           codec{},
 		conn:            conn,
 		channel:         channel,
+		state:           state,
+		stateCh:         make(chan struct{}),
 		streams:         make(map[streamID]*stream),
 		nextStreamID:    1,
 		closed:          cancel,
@@ -122,17 +396,50 @@ func NewClient(conn net.Conn, opts ...ClientOpts) *Client {
 		userCloseFunc:   func() {},
 		userCloseWaitCh: make(chan struct{}),
 	}
+	channel.stats = &c.stats
+	channel.untimed = c.untimedStream
 
 	for _, o := range opts {
 		o(c)
 	}
 
+	if c.logger == nil {
+		c.logger = defaultLogger(ctx)
+	}
+
+	if c.connConfigurer != nil && conn != nil {
+		if err := c.connConfigurer(conn); err != nil {
+			// the client is closed once it fails to read from the connection
+			c.logger.Errorf("ttrpc: failed to configure connection: %v", err)
+			conn.Close()
+		}
+	}
+
+	if c.tlsConfig != nil && conn != nil {
+		// the handshake happens on first use of the connection
+		c.conn = tls.Client(conn, c.tlsConfig)
+		channel.reset(c.conn)
+	}
+
 	if c.interceptor == nil {
 		c.interceptor = defaultClientInterceptor
 	}
+	if c.streamInterceptor == nil {
+		c.streamInterceptor = defaultStreamClientInterceptor
+	}
+	c.services = newServiceSet(&serverConfig{
+		interceptor:       defaultServerInterceptor,
+		streamInterceptor: defaultStreamServerInterceptor,
+		codec:             c.codec,
+	})
+	return c
+}
 
+func (c *Client) start() {
 	go c.run()
-	return c
+	if c.keepalive != nil {
+		go c.runKeepalive()
+	}
 }
 
 func (c *Client) send(sid uint32, mt messageType, flags uint8, b []byte) error {
@@ -141,47 +448,90 @@ func (c *Client) send(sid uint32, mt messageType, flags uint8, b []byte) error {
 	return c.channel.send(sid, mt, flags, b)
 }
 
+// CallResult describes the response received for a call made with
+// CallWithResult.
+type CallResult struct {
+	// Metadata is the metadata sent by the server with the response.
+	Metadata MD
+	// Code is the status code of the response.
+	Code codes.Code
+	// Size is the size in bytes of the response payload.
+	Size int
+}
+
 // Call makes a unary request and returns with response
-func (c *Client) Call(ctx context.Context, service, method string, req, resp interface{}) error {
-	payload, err := c.codec.Marshal(req)
+func (c *Client) Call(ctx context.Context, service, method string, req, resp interface{}, opts ...CallOption) error {
+	_, err := c.CallWithResult(ctx, service, method, req, resp, opts...)
+	return err
+}
+
+// CallWithResult makes a unary request like Call and also returns details
+// about the response. When the call fails before a response is received, the
+// result only carries the code of the returned error.
+func (c *Client) CallWithResult(ctx context.Context, service, method string, req, resp interface{}, opts ...CallOption) (CallResult, error) {
+	ctx, cancel := c.withDefaultTimeout(ctx)
+	defer cancel()
+
+	o := newCallOptions(opts)
+	codec := o.codecOr(c.codec)
+	payload, err := marshal(codec, req)
 	if err != nil {
-		return err
+		return CallResult{Code: status.Code(err)}, err
 	}
 
 	var (
 		creq = &Request{
-			Service: service,
-			Method:  method,
-			Payload: payload,
+			Service:     service,
+			Method:      method,
+			Payload:     payload,
+			ContentType: c.contentType,
 			// TODO: metadata from context
 		}
 
 		cresp = &Response{}
 	)
 
-	if metadata, ok := GetMetadata(ctx); ok {
-		metadata.setRequest(creq)
+	if err := setRequestMetadata(ctx, o, creq); err != nil {
+		return CallResult{Code: status.Code(err)}, err
 	}
+	c.setVersion(creq)
 
-	if dl, ok := ctx.Deadline(); ok {
-		creq.TimeoutNano = time.Until(dl).Nanoseconds()
-	}
+	creq.TimeoutNano = timeoutNano(ctx)
 
 	info := &UnaryClientInfo{
 		FullMethod: fullPath(service, method),
+		Service:    service,
+		Method:     method,
+		Request:    req,
+		Response:   resp,
 	}
 	if err := c.interceptor(ctx, creq, cresp, info, c.dispatch); err != nil {
-		return err
+		return CallResult{Code: status.Code(err)}, err
 	}
 
-	if err := c.codec.Unmarshal(cresp.Payload, resp); err != nil {
-		return err
+	result := CallResult{
+		Metadata: MD{},
+		Code:     codes.OK,
+		Size:     len(cresp.Payload),
 	}
+	result.Metadata.fromResponse(cresp)
+	storeResponseMetadata(ctx, result.Metadata)
 
 	if cresp.Status != nil && cresp.Status.Code != int32(codes.OK) {
-		return status.ErrorProto(cresp.Status)
+		result.Code = codes.Code(cresp.Status.Code)
+		return result, status.ErrorProto(cresp.Status)
 	}
-	return nil
+
+	if err := unmarshal(codec, cresp.Payload, resp); err != nil {
+		return result, err
+	}
+	for _, validate := range c.responseValidators {
+		if err := validate(info.FullMethod, resp); err != nil {
+			result.Code = status.Code(err)
+			return result, err
+		}
+	}
+	return result, nil
 }
 
 // StreamDesc describes the stream properties, whether the stream has
@@ -194,17 +544,105 @@ type StreamDesc struct {
 // ClientStream is used to send or recv messages on the underlying stream
 type ClientStream interface {
 	CloseSend() error
+	// SendMsg sends m to the server on a streaming client. Once the client
+	// closed its side with CloseSend or the server finished the stream, it
+	// fails with ErrStreamClosed, and RecvMsg returns the final message or
+	// status of the stream. Streams which failed, for example with the
+	// connection, return the error they failed with.
 	SendMsg(m interface{}) error
+	// RecvMsg receives the next message into m. Messages are reset before
+	// being decoded, so m may be reused for every message to avoid
+	// allocating one each time, at the cost of losing its previous content.
+	// Decoded messages never reference the buffers of the connection, so a
+	// message may be retained for as long as it is not passed to RecvMsg
+	// again.
 	RecvMsg(m interface{}) error
+	// Context returns the context of the stream, which is done once the
+	// stream has terminated: when RecvMsg has returned the final message or
+	// an error, when the connection is lost or when the context the stream
+	// was created with is done. StreamError returns the error which
+	// terminated the stream.
+	Context() context.Context
+	// Header returns the header metadata sent by the server with
+	// StreamServer.SendHeader. It blocks until the header is received, or
+	// until the first message is received when the server sends no header,
+	// in which case the header is empty.
+	Header() (MD, error)
+	// SetMetadata sends updated metadata to the server on a streaming
+	// client, for example to refresh credentials on a long-lived stream. The
+	// handler receives it with the function set with OnMetadataUpdate, after
+	// the messages sent before. Servers which do not support metadata
+	// updates ignore them.
+	SetMetadata(md MD) error
 }
 
 type clientStream struct {
 	ctx          context.Context
+	cancel       context.CancelFunc // releases the default call timeout
 	s            *stream
 	c            *Client
+	codec        Codec
 	desc         *StreamDesc
 	localClosed  bool
 	remoteClosed bool
+
+	streamCtxOnce sync.Once
+	streamCtx     context.Context
+}
+
+func (cs *clientStream) Context() context.Context {
+	cs.streamCtxOnce.Do(func() {
+		var cancel context.CancelCauseFunc
+		cs.streamCtx, cancel = context.WithCancelCause(cs.ctx)
+		go func() {
+			select {
+			case <-cs.s.recvClose:
+				cancel(cs.s.recvErr)
+			case <-cs.streamCtx.Done():
+			}
+		}()
+	})
+	return cs.streamCtx
+}
+
+// finish marks the stream as closed by the server, err is the error which
+// terminated the stream or io.EOF when it completed successfully.
+func (cs *clientStream) finish(err error) {
+	cs.s.closeWithError(err)
+	cs.c.deleteStream(cs.s)
+	cs.cancel()
+	cs.remoteClosed = true
+}
+
+// abandon releases the stream once its context is done, any message still
+// sent by the server for the stream is dropped.
+func (cs *clientStream) abandon() error {
+	err := fromContextError(cs.ctx.Err())
+	cs.s.closeWithError(err)
+	cs.c.deleteStream(cs.s)
+	cs.cancel()
+	return err
+}
+
+func (cs *clientStream) Header() (MD, error) {
+	select {
+	case <-cs.s.headerDone:
+		return cs.s.header, nil
+	default:
+	}
+	select {
+	case <-cs.s.headerDone:
+		return cs.s.header, nil
+	case <-cs.s.recvClose:
+		select {
+		case <-cs.s.headerDone:
+			return cs.s.header, nil
+		default:
+			return nil, cs.s.recvErr
+		}
+	case <-cs.ctx.Done():
+		return nil, fromContextError(cs.ctx.Err())
+	}
 }
 
 func (cs *clientStream) CloseSend() error {
@@ -222,12 +660,50 @@ func (cs *clientStream) CloseSend() error {
 	return nil
 }
 
+// sendErr returns the error of sending on the stream once it is closed, nil
+// while it is open. Streams closed by either side fail with ErrStreamClosed,
+// streams which failed otherwise, for example with the connection, with the
+// error they failed with.
+func (cs *clientStream) sendErr() error {
+	if cs.localClosed {
+		return ErrStreamClosed
+	}
+	select {
+	case <-cs.s.remoteDone:
+	default:
+		return nil
+	}
+	if cs.s.finished.Load() {
+		return ErrStreamClosed
+	}
+	return cs.s.recvErr
+}
+
+func (cs *clientStream) SetMetadata(md MD) error {
+	if !cs.desc.StreamingClient {
+		return fmt.Errorf("%w: cannot send metadata from non-streaming client", ErrProtocol)
+	}
+	if err := cs.sendErr(); err != nil {
+		return err
+	}
+	if err := md.checkReserved(); err != nil {
+		return err
+	}
+	req := &Request{}
+	md.setRequest(req)
+	p, err := proto.Marshal(req)
+	if err != nil {
+		return err
+	}
+	return filterCloseErr(cs.s.send(messageTypeMetadata, 0, p))
+}
+
 func (cs *clientStream) SendMsg(m interface{}) error {
 	if !cs.desc.StreamingClient {
 		return fmt.Errorf("%w: cannot send data from non-streaming client", ErrProtocol)
 	}
-	if cs.localClosed {
-		return ErrStreamClosed
+	if err := cs.sendErr(); err != nil {
+		return err
 	}
 
 	var (
@@ -235,12 +711,19 @@ func (cs *clientStream) SendMsg(m interface{}) error {
 		err     error
 	)
 	if m != nil {
-		payload, err = cs.c.codec.Marshal(m)
+		payload, err = marshal(cs.codec, m)
 		if err != nil {
 			return err
 		}
 	}
 
+	if err := cs.s.window.acquire(cs.ctx, cs.s.remoteDone, len(payload)); err != nil {
+		if errors.Is(err, ErrStreamClosed) {
+			return cs.sendErr()
+		}
+		return err
+	}
+
 	err = cs.s.send(messageTypeData, 0, payload)
 	if err != nil {
 		return filterCloseErr(err)
@@ -257,7 +740,7 @@ func (cs *clientStream) RecvMsg(m interface{}) error {
 	var msg *streamMessage
 	select {
 	case <-cs.ctx.Done():
-		return cs.ctx.Err()
+		return cs.abandon()
 	case <-cs.s.recvClose:
 		// If recv has a pending message, process that first
 		select {
@@ -278,54 +761,95 @@ func (cs *clientStream) RecvMsg(m interface{}) error {
 			return err
 		}
 
-		if err := cs.c.codec.Unmarshal(resp.Payload, m); err != nil {
-			return err
-		}
+		setResponseMetadata(cs.ctx, resp)
 
 		if resp.Status != nil && resp.Status.Code != int32(codes.OK) {
-			return status.ErrorProto(resp.Status)
+			err := status.ErrorProto(resp.Status)
+			cs.finish(err)
+			return err
 		}
+		cs.finish(io.EOF)
 
-		cs.c.deleteStream(cs.s)
-		cs.remoteClosed = true
-
-		return nil
+		return unmarshal(cs.codec, resp.Payload, m)
 	case messageTypeData:
 		if !cs.desc.StreamingServer {
-			cs.c.deleteStream(cs.s)
-			cs.remoteClosed = true
-			return fmt.Errorf("received data from non-streaming server: %w", ErrProtocol)
+			err := fmt.Errorf("received data from non-streaming server: %w", ErrProtocol)
+			cs.finish(err)
+			return err
 		}
 		if msg.header.Flags&flagRemoteClosed == flagRemoteClosed {
-			cs.c.deleteStream(cs.s)
-			cs.remoteClosed = true
+			storeResponseMetadata(cs.ctx, cs.s.trailer)
+			cs.finish(io.EOF)
 
 			if msg.header.Flags&flagNoData == flagNoData {
 				return io.EOF
 			}
 		}
 
-		err := cs.c.codec.Unmarshal(msg.payload[:msg.header.Length], m)
+		err := unmarshal(cs.codec, msg.payload[:msg.header.Length], m)
 		cs.c.channel.putmbuf(msg.payload)
 		if err != nil {
 			return err
 		}
+		if cs.s.window != nil && !cs.remoteClosed && msg.header.Length > 0 {
+			// the message has been consumed, allow the server to send more
+			if err := cs.s.send(messageTypeWindowUpdate, 0, encodeWindowUpdate(msg.header.Length)); err != nil {
+				return filterCloseErr(err)
+			}
+		}
 		return nil
 	default:
 		return fmt.Errorf("unexpected %q message received: %w", msg.header.Type, ErrProtocol)
 	}
 }
 
-// Close closes the ttrpc connection and underlying connection
+// Close closes the ttrpc connection and underlying connection, failing the
+// calls in progress. See Shutdown to let them finish first.
 func (c *Client) Close() error {
 	c.closeOnce.Do(func() {
 		c.closed()
+		c.setState(ClientShutdown)
 
-		c.conn.Close()
+		c.connLock.Lock()
+		if c.conn != nil {
+			c.conn.Close()
+		}
+		c.connLock.Unlock()
 	})
 	return nil
 }
 
+// Shutdown gracefully closes the client: new calls and streams fail with
+// ErrClosed while the calls and streams in progress are allowed to finish.
+// The client is closed once they are all done, or when ctx is done, in which
+// case the remaining calls fail like with Close and the context error is
+// returned.
+func (c *Client) Shutdown(ctx context.Context) error {
+	c.draining.Store(true)
+
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		c.streamLock.RLock()
+		active := len(c.streams)
+		c.streamLock.RUnlock()
+		if active == 0 {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			c.Close()
+			return ctx.Err()
+		case <-c.ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+
+	return c.Close()
+}
+
 // UserOnCloseWait is used to block until the user's on-close callback
 // finishes.
 func (c *Client) UserOnCloseWait(ctx context.Context) error {
@@ -338,7 +862,19 @@ func (c *Client) UserOnCloseWait(ctx context.Context) error {
 }
 
 func (c *Client) run() {
-	err := c.receiveLoop()
+	var err error
+	for {
+		if c.dialer != nil && !c.connect() {
+			err = ErrClosed
+			break
+		}
+		c.negotiateCompression()
+		err = c.receiveLoop()
+		if c.dialer == nil {
+			break
+		}
+		c.disconnect(err)
+	}
 	c.Close()
 	c.cleanupStreams(err)
 
@@ -346,6 +882,74 @@ func (c *Client) run() {
 	close(c.userCloseWaitCh)
 }
 
+func (c *Client) runKeepalive() {
+	for {
+		if err := c.waitReady(c.ctx); err != nil {
+			return
+		}
+		gen := c.connGeneration()
+		err := c.keepalive.run(c.ctx.Done(), func() error {
+			return c.send(controlStreamID, messageTypePing, 0, nil)
+		})
+		if err == nil {
+			return
+		}
+		c.logger.Errorf("ttrpc: keepalive failed, closing connection: %v", err)
+		c.closeConn(gen)
+		if c.dialer == nil {
+			return
+		}
+	}
+}
+
+// negotiateCompression asks the server to compress the messages exchanged on
+// the connection, when a compressor is set.
+func (c *Client) negotiateCompression() {
+	if c.compressor == nil {
+		return
+	}
+	if err := c.send(controlStreamID, messageTypeCompression, 0, []byte(c.compressor.Name())); err != nil {
+		c.logger.Debugf("ttrpc: failed to negotiate compression: %v", err)
+	}
+}
+
+// handleControl handles connection level messages sent on the control stream.
+func (c *Client) handleControl(msg *streamMessage) {
+	var payload []byte
+	if len(msg.payload) > 0 {
+		payload = append(payload, msg.payload...)
+		c.channel.putmbuf(msg.payload)
+	}
+
+	switch msg.header.Type {
+	case messageTypePing:
+		// reply without blocking the receive loop on the send lock
+		go func() {
+			if err := c.send(controlStreamID, messageTypePong, 0, payload); err != nil {
+				c.logger.Debugf("ttrpc: failed to send pong: %v", err)
+			}
+		}()
+	case messageTypePong:
+		if c.keepalive != nil {
+			c.keepalive.pong()
+		}
+	case messageTypeCompression:
+		// the server accepted compression when it replies with its name
+		if c.compressor != nil && string(payload) == c.compressor.Name() {
+			c.channel.setSendCompressor(c.compressor)
+		}
+	case messageTypeGoAway:
+		if c.dialer != nil {
+			// hold new calls until the server closes the connection and a
+			// new one is dialed
+			c.setState(ClientConnecting)
+		}
+		c.goingAway.Store(true)
+	default:
+		c.logger.Debugf("ttrpc: ignoring unexpected %q control message", msg.header.Type)
+	}
+}
+
 func (c *Client) receiveLoop() error {
 	for {
 		select {
@@ -366,18 +970,85 @@ func (c *Client) receiveLoop() error {
 					return filterCloseErr(err)
 				}
 			}
+			if err == nil && msg.header.StreamID == controlStreamID {
+				c.handleControl(msg)
+				continue
+			}
+			if err == nil && msg.header.Type == messageTypeRequest && msg.header.StreamID%2 == 0 {
+				go c.handleRequest(msg)
+				continue
+			}
+			if err == nil && msg.header.Type == messageTypeFds {
+				// the descriptors are taken even for inactive streams, so
+				// that the following messages get theirs
+				fds, err := c.channel.recvFds(msg.payload[:msg.header.Length])
+				c.channel.putmbuf(msg.payload)
+				if err != nil {
+					return err
+				}
+				if s := c.getStream(streamID(msg.header.StreamID)); s != nil {
+					s.fds.add(fds)
+				} else {
+					closeFds(fds)
+				}
+				continue
+			}
 			sid := streamID(msg.header.StreamID)
 			s := c.getStream(sid)
 			if s == nil {
-				log.G(c.ctx).WithField("stream", sid).Error("ttrpc: received message on inactive stream")
+				c.logger.Errorf("ttrpc: received message on inactive stream %d", sid)
+				continue
+			}
+
+			if err == nil && msg.header.Type == messageTypeWindowUpdate {
+				n, err := decodeWindowUpdate(msg.payload[:msg.header.Length])
+				c.channel.putmbuf(msg.payload)
+				if err != nil {
+					c.logger.Errorf("ttrpc: failed to handle message on stream %d: %v", sid, err)
+					continue
+				}
+				s.window.release(n)
+				continue
+			}
+
+			if err == nil && msg.header.Type == messageTypeHeader {
+				resp := &Response{}
+				err := proto.Unmarshal(msg.payload[:msg.header.Length], resp)
+				c.channel.putmbuf(msg.payload)
+				if err != nil {
+					c.logger.Errorf("ttrpc: failed to handle header on stream %d: %v", sid, err)
+					continue
+				}
+				md := MD{}
+				md.fromResponse(resp)
+				s.setHeader(md)
+				continue
+			}
+
+			if err == nil && msg.header.Type == messageTypeTrailer {
+				resp := &Response{}
+				err := proto.Unmarshal(msg.payload[:msg.header.Length], resp)
+				c.channel.putmbuf(msg.payload)
+				if err != nil {
+					c.logger.Errorf("ttrpc: failed to handle trailer on stream %d: %v", sid, err)
+					continue
+				}
+				// read with the final data message, received after it
+				s.trailer = MD{}
+				s.trailer.fromResponse(resp)
 				continue
 			}
 
 			if err != nil {
 				s.closeWithError(err)
 			} else {
+				if msg.header.Type == messageTypeResponse || msg.header.Flags&flagRemoteClosed != 0 {
+					s.closeRemote()
+				}
+				// the server sends the header before anything else
+				s.setHeader(MD{})
 				if err := s.receive(c.ctx, msg); err != nil {
-					log.G(c.ctx).WithFields(log.Fields{"error": err, "stream": sid}).Error("ttrpc: failed to handle message")
+					c.logger.Errorf("ttrpc: failed to handle message on stream %d: %v", sid, err)
 				}
 			}
 		}
@@ -386,13 +1057,23 @@ func (c *Client) receiveLoop() error {
 
 // createStream creates a new stream and registers it with the client
 // Introduce stream types for multiple or single response
-func (c *Client) createStream(flags uint8, b []byte) (*stream, error) {
+func (c *Client) createStream(ctx context.Context, flags uint8, window uint32, b []byte) (*stream, error) {
 	// sendLock must be held across both allocation of the stream ID and sending it across the wire.
 	// This ensures that new stream IDs sent on the wire are always increasing, which is a
 	// requirement of the TTRPC protocol.
 	// This use of sendLock could be split into another mutex that covers stream creation + first send,
 	// and just use sendLock to guard writing to the wire, but for now it seems simpler to have fewer mutexes.
-	c.sendLock.Lock()
+	for {
+		if err := c.waitReady(ctx); err != nil {
+			return nil, err
+		}
+		c.sendLock.Lock()
+		// the connection may have been lost while acquiring the lock
+		if c.State() == ClientReady {
+			break
+		}
+		c.sendLock.Unlock()
+	}
 	defer c.sendLock.Unlock()
 
 	// Check if closed since lock acquired to prevent adding
@@ -402,6 +1083,9 @@ func (c *Client) createStream(flags uint8, b []byte) (*stream, error) {
 		return nil, ErrClosed
 	default:
 	}
+	if c.goingAway.Load() {
+		return nil, ErrGoAway
+	}
 
 	var s *stream
 	if err := func() error {
@@ -416,10 +1100,28 @@ func (c *Client) createStream(flags uint8, b []byte) (*stream, error) {
 			return ErrClosed
 		default:
 		}
+		// checked with the lock held so that Shutdown sees every stream
+		// created before it started
+		if c.draining.Load() {
+			return ErrClosed
+		}
+
+		// zero once the identifiers of the connection are exhausted
+		if c.nextStreamID == 0 {
+			return ErrStreamIDsExhausted
+		}
 
 		s = newStream(c.nextStreamID, c)
+		s.window = newWindow(window)
+		s.untimed = getCallOptions(ctx).noFrameTimeouts
+		s.fds = receivedFds(ctx)
 		c.streams[s.id] = s
-		c.nextStreamID = c.nextStreamID + 2
+		if s.id == maxStreamID {
+			c.nextStreamID = 0
+		} else {
+			c.nextStreamID = c.nextStreamID + 2
+		}
+		c.stats.callStarted()
 
 		return nil
 	}(); err != nil {
@@ -427,7 +1129,10 @@ func (c *Client) createStream(flags uint8, b []byte) (*stream, error) {
 	}
 
 	if err := c.channel.send(uint32(s.id), messageTypeRequest, flags, b); err != nil {
-		return s, filterCloseErr(err)
+		// the stream is released as the caller never gets it, such as when
+		// the request is larger than the maximum send message size
+		c.deleteStream(s)
+		return nil, filterCloseErr(err)
 	}
 
 	return s, nil
@@ -435,11 +1140,21 @@ func (c *Client) createStream(flags uint8, b []byte) (*stream, error) {
 
 func (c *Client) deleteStream(s *stream) {
 	c.streamLock.Lock()
-	delete(c.streams, s.id)
+	if cur, ok := c.streams[s.id]; ok && cur == s {
+		delete(c.streams, s.id)
+		c.stats.callCompleted()
+	}
 	c.streamLock.Unlock()
 	s.closeWithError(nil)
 }
 
+// untimedStream returns whether the stream opted out of the read and write
+// timeouts.
+func (c *Client) untimedStream(id uint32) bool {
+	s := c.getStream(streamID(id))
+	return s != nil && s.untimed
+}
+
 func (c *Client) getStream(sid streamID) *stream {
 	c.streamLock.RLock()
 	s := c.streams[sid]
@@ -454,9 +1169,23 @@ func (c *Client) cleanupStreams(err error) {
 	for sid, s := range c.streams {
 		s.closeWithError(err)
 		delete(c.streams, sid)
+		c.stats.callCompleted()
 	}
 }
 
+// Stats returns a snapshot of the counters for the client connection.
+func (c *Client) Stats() Stats {
+	c.streamLock.RLock()
+	active := len(c.streams)
+	var pending int
+	for _, s := range c.streams {
+		pending += len(s.recv)
+	}
+	c.streamLock.RUnlock()
+
+	return c.stats.snapshot(active, pending)
+}
+
 // filterCloseErr rewrites EOF and EPIPE errors to ErrClosed. Use when
 // returning from call or handling errors from main read loop.
 //
@@ -490,23 +1219,46 @@ func filterCloseErr(err error) error {
 // NewStream creates a new stream with the given stream descriptor to the
 // specified service and method. If not a streaming client, the request object
 // may be provided.
-func (c *Client) NewStream(ctx context.Context, desc *StreamDesc, service, method string, req interface{}) (ClientStream, error) {
+func (c *Client) NewStream(ctx context.Context, desc *StreamDesc, service, method string, req interface{}, opts ...CallOption) (ClientStream, error) {
+	return c.streamInterceptor(withCallOptions(ctx, opts), desc, service, method, req, c.newStream)
+}
+
+func (c *Client) newStream(ctx context.Context, desc *StreamDesc, service, method string, req interface{}) (ClientStream, error) {
+	ctx, cancel := c.withDefaultTimeout(ctx)
+	cs, err := c.openStream(ctx, desc, service, method, req)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	cs.cancel = cancel
+	return cs, nil
+}
+
+func (c *Client) openStream(ctx context.Context, desc *StreamDesc, service, method string, req interface{}) (*clientStream, error) {
+	o := getCallOptions(ctx)
+	codec := o.codecOr(c.codec)
 	var payload []byte
 	if req != nil {
 		var err error
-		payload, err = c.codec.Marshal(req)
+		payload, err = marshal(codec, req)
 		if err != nil {
 			return nil, err
 		}
 	}
 
 	request := &Request{
-		Service: service,
-		Method:  method,
-		Payload: payload,
-		// TODO: metadata from context
+		Service:      service,
+		Method:       method,
+		Payload:      payload,
+		ContentType:  c.contentType,
+		TimeoutNano:  timeoutNano(ctx),
+		StreamWindow: c.streamWindow,
+	}
+	if err := setRequestMetadata(ctx, o, request); err != nil {
+		return nil, err
 	}
-	p, err := c.codec.Marshal(request)
+	c.setVersion(request)
+	p, err := proto.Marshal(request)
 	if err != nil {
 		return nil, err
 	}
@@ -517,26 +1269,39 @@ func (c *Client) NewStream(ctx context.Context, desc *StreamDesc, service, metho
 	} else {
 		flags = flagRemoteClosed
 	}
-	s, err := c.createStream(flags, p)
+	s, err := c.createStream(ctx, flags, request.StreamWindow, p)
 	if err != nil {
 		return nil, err
 	}
 
 	return &clientStream{
-		ctx:  ctx,
-		s:    s,
-		c:    c,
-		desc: desc,
+		ctx:   ctx,
+		s:     s,
+		c:     c,
+		codec: codec,
+		desc:  desc,
 	}, nil
 }
 
+// withDefaultTimeout applies the default call timeout to ctx when it has no
+// deadline.
+func (c *Client) withDefaultTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if c.defaultTimeout <= 0 {
+		return ctx, func() {}
+	}
+	if _, ok := ctx.Deadline(); ok {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, c.defaultTimeout)
+}
+
 func (c *Client) dispatch(ctx context.Context, req *Request, resp *Response) error {
-	p, err := c.codec.Marshal(req)
+	p, err := proto.Marshal(req)
 	if err != nil {
 		return err
 	}
 
-	s, err := c.createStream(0, p)
+	s, err := c.createStream(ctx, 0, 0, p)
 	if err != nil {
 		return err
 	}
@@ -545,7 +1310,7 @@ func (c *Client) dispatch(ctx context.Context, req *Request, resp *Response) err
 	var msg *streamMessage
 	select {
 	case <-ctx.Done():
-		return ctx.Err()
+		return fromContextError(ctx.Err())
 	case <-c.ctx.Done():
 		return ErrClosed
 	case <-s.recvClose:
@@ -569,3 +1334,19 @@ func (c *Client) dispatch(ctx context.Context, req *Request, resp *Response) err
 
 	return err
 }
+
+// timeoutNano returns the time remaining until the deadline of ctx, or zero if
+// ctx has no deadline. A relative timeout is sent rather than the deadline
+// itself so the server is not affected by clock skew between the peers.
+func timeoutNano(ctx context.Context) int64 {
+	dl, ok := ctx.Deadline()
+	if !ok {
+		return 0
+	}
+	timeout := time.Until(dl).Nanoseconds()
+	if timeout <= 0 {
+		// zero means no timeout, make sure an expired deadline is still sent
+		timeout = 1
+	}
+	return timeout
+}
@@ -18,10 +18,16 @@ package ttrpc
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/containerd/ttrpc/internal"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
 )
 
 func TestUserOnCloseWait(t *testing.T) {
@@ -70,3 +76,471 @@ func TestUserOnCloseWait(t *testing.T) {
 		t.Fatalf("expected error nil , but got %v", err)
 	}
 }
+
+func TestCallWithResult(t *testing.T) {
+	var (
+		ctx             = context.Background()
+		server          = mustServer(t)(NewServer())
+		addr, listener  = newTestListener(t)
+		client, cleanup = newTestClient(t, addr)
+		payload         = &internal.TestPayload{Foo: "result"}
+	)
+	defer listener.Close()
+	defer cleanup()
+
+	server.RegisterService(serviceName, &ServiceDesc{
+		Methods: map[string]Method{
+			"Test": func(ctx context.Context, unmarshal func(interface{}) error) (interface{}, error) {
+				md := MD{}
+				md.Set("server-version", "1.0")
+				if err := SetResponseMetadata(ctx, md); err != nil {
+					return nil, err
+				}
+				return payload, nil
+			},
+			"Fail": func(ctx context.Context, unmarshal func(interface{}) error) (interface{}, error) {
+				return nil, status.Error(codes.NotFound, "missing")
+			},
+		},
+	})
+
+	go server.Serve(ctx, listener)
+	defer server.Shutdown(ctx)
+
+	var resp internal.TestPayload
+	result, err := client.CallWithResult(ctx, serviceName, "Test", &internal.TestPayload{}, &resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Foo != payload.Foo {
+		t.Fatalf("unexpected response %q", resp.Foo)
+	}
+	if result.Code != codes.OK {
+		t.Fatalf("unexpected code %v", result.Code)
+	}
+	if v, ok := result.Metadata.Get("server-version"); !ok || v[0] != "1.0" {
+		t.Fatalf("unexpected response metadata: %v", result.Metadata)
+	}
+	if result.Size != proto.Size(payload) {
+		t.Fatalf("unexpected size %d, expected %d", result.Size, proto.Size(payload))
+	}
+
+	result, err = client.CallWithResult(ctx, serviceName, "Fail", &internal.TestPayload{}, &resp)
+	if status.Code(err) != codes.NotFound {
+		t.Fatalf("expected not found error, got %v", err)
+	}
+	if result.Code != codes.NotFound {
+		t.Fatalf("unexpected code %v", result.Code)
+	}
+}
+
+func TestWriteCoalesceWindow(t *testing.T) {
+	var (
+		ctx            = context.Background()
+		server         = mustServer(t)(NewServer(WithServerWriteCoalesceWindow(5*time.Millisecond), WithServerWriteBufferSize(64<<10)))
+		testImpl       = &testingServer{}
+		addr, listener = newTestListener(t)
+	)
+	defer listener.Close()
+
+	registerTestingService(server, testImpl)
+
+	go server.Serve(ctx, listener)
+	defer server.Shutdown(ctx)
+
+	client, cleanup := newTestClient(t, addr, WithWriteCoalesceWindow(5*time.Millisecond), WithWriteBufferSize(64<<10))
+	defer cleanup()
+	tclient := newTestingClient(client)
+
+	for i := 0; i < 10; i++ {
+		tp := &internal.TestPayload{Foo: "coalesced"}
+		resp, err := tclient.Test(ctx, tp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Foo != strings.Repeat(tp.Foo, 2) {
+			t.Fatalf("unexpected response %q", resp.Foo)
+		}
+	}
+}
+
+func TestDefaultCallTimeout(t *testing.T) {
+	var (
+		ctx             = context.Background()
+		server          = mustServer(t)(NewServer())
+		addr, listener  = newTestListener(t)
+		client, cleanup = newTestClient(t, addr, WithDefaultCallTimeout(50*time.Millisecond))
+	)
+	defer listener.Close()
+	defer cleanup()
+
+	server.RegisterService(serviceName, &ServiceDesc{
+		Methods: map[string]Method{
+			"Wait": func(ctx context.Context, _ func(interface{}) error) (interface{}, error) {
+				<-ctx.Done()
+				return nil, ctx.Err()
+			},
+		},
+		Streams: map[string]Stream{
+			"WaitStream": {
+				Handler: func(ctx context.Context, _ StreamServer) (interface{}, error) {
+					<-ctx.Done()
+					return nil, ctx.Err()
+				},
+				StreamingServer: true,
+			},
+		},
+	})
+	go server.Serve(ctx, listener)
+	defer server.Shutdown(ctx)
+
+	t.Run("Call", func(t *testing.T) {
+		err := client.Call(ctx, serviceName, "Wait", &internal.TestPayload{}, &internal.TestPayload{})
+		if code := status.Code(err); code != codes.DeadlineExceeded {
+			t.Fatalf("expected %v, got %v", codes.DeadlineExceeded, err)
+		}
+	})
+
+	t.Run("Stream", func(t *testing.T) {
+		stream, err := client.NewStream(ctx, &StreamDesc{StreamingServer: true}, serviceName, "WaitStream", &internal.TestPayload{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = stream.RecvMsg(&internal.TestPayload{})
+		if code := status.Code(err); code != codes.DeadlineExceeded {
+			t.Fatalf("expected %v, got %v", codes.DeadlineExceeded, err)
+		}
+	})
+
+	t.Run("ContextDeadline", func(t *testing.T) {
+		cctx, cancel := context.WithTimeout(ctx, time.Second)
+		defer cancel()
+		start := time.Now()
+		err := client.Call(cctx, serviceName, "Wait", &internal.TestPayload{}, &internal.TestPayload{})
+		if code := status.Code(err); code != codes.DeadlineExceeded {
+			t.Fatalf("expected %v, got %v", codes.DeadlineExceeded, err)
+		}
+		if elapsed := time.Since(start); elapsed < time.Second {
+			t.Fatalf("deadline of the context was replaced, call took %v", elapsed)
+		}
+	})
+}
+
+func TestStreamIDsExhausted(t *testing.T) {
+	var (
+		ctx             = context.Background()
+		server          = mustServer(t)(NewServer())
+		addr, listener  = newTestListener(t)
+		client, cleanup = newTestClient(t, addr)
+	)
+	defer listener.Close()
+	defer cleanup()
+
+	registerTestingService(server, &testingServer{})
+	go server.Serve(ctx, listener)
+	defer server.Shutdown(ctx)
+
+	client.sendLock.Lock()
+	client.nextStreamID = maxStreamID - 2
+	client.sendLock.Unlock()
+
+	// the last two identifiers of the connection remain usable
+	var resp internal.TestPayload
+	for i := 0; i < 2; i++ {
+		if err := client.Call(ctx, serviceName, "Test", &internal.TestPayload{Foo: "foo"}, &resp); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := client.Call(ctx, serviceName, "Test", &internal.TestPayload{Foo: "foo"}, &resp); !errors.Is(err, ErrStreamIDsExhausted) {
+		t.Fatalf("expected %v, got %v", ErrStreamIDsExhausted, err)
+	}
+	if _, err := client.NewStream(ctx, &StreamDesc{}, serviceName, "Test", &internal.TestPayload{}); !errors.Is(err, ErrStreamIDsExhausted) {
+		t.Fatalf("expected %v, got %v", ErrStreamIDsExhausted, err)
+	}
+}
+
+func TestResponseValidator(t *testing.T) {
+	var (
+		ctx            = context.Background()
+		server         = mustServer(t)(NewServer())
+		addr, listener = newTestListener(t)
+		methods        []string
+		invalid        = status.Error(codes.DataLoss, "empty response")
+		validate       = func(method string, resp interface{}) error {
+			methods = append(methods, method)
+			if resp.(*internal.TestPayload).Foo == "" {
+				return invalid
+			}
+			return nil
+		}
+		client, cleanup = newTestClient(t, addr, WithResponseValidator(validate))
+	)
+	defer listener.Close()
+	defer cleanup()
+
+	registerTestingService(server, &testingServer{})
+	go server.Serve(ctx, listener)
+	defer server.Shutdown(ctx)
+
+	var resp internal.TestPayload
+	if err := client.Call(ctx, serviceName, "Test", &internal.TestPayload{Foo: "foo"}, &resp); err != nil {
+		t.Fatal(err)
+	}
+	result, err := client.CallWithResult(ctx, serviceName, "Test", &internal.TestPayload{}, &resp)
+	if err != invalid {
+		t.Fatalf("expected %v, got %v", invalid, err)
+	}
+	if result.Code != codes.DataLoss {
+		t.Fatalf("unexpected result code %v", result.Code)
+	}
+	if len(methods) != 2 || methods[0] != "/"+serviceName+"/Test" {
+		t.Fatalf("unexpected validated methods %v", methods)
+	}
+}
+
+func TestContextErrorCodes(t *testing.T) {
+	var (
+		ctx             = context.Background()
+		server          = mustServer(t)(NewServer())
+		addr, listener  = newTestListener(t)
+		client, cleanup = newTestClient(t, addr)
+		local           = NewLocalClient(server)
+		started         = make(chan struct{}, 1)
+		release         = make(chan struct{})
+	)
+	defer listener.Close()
+	defer cleanup()
+
+	// the server is not told about calls cancelled by the client, release
+	// them once done
+	wait := func(ctx context.Context, _ func(interface{}) error) (interface{}, error) {
+		started <- struct{}{}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-release:
+			return nil, nil
+		}
+	}
+	server.RegisterService(serviceName, &ServiceDesc{
+		Methods: map[string]Method{
+			"Wait": wait,
+			"Timeout": func(ctx context.Context, _ func(interface{}) error) (interface{}, error) {
+				ctx, cancel := context.WithTimeout(ctx, time.Millisecond)
+				defer cancel()
+				<-ctx.Done()
+				return nil, fmt.Errorf("waiting for work: %w", ctx.Err())
+			},
+			"Cancel": func(ctx context.Context, _ func(interface{}) error) (interface{}, error) {
+				ctx, cancel := context.WithCancel(ctx)
+				cancel()
+				return nil, fmt.Errorf("waiting for work: %w", ctx.Err())
+			},
+		},
+		Streams: map[string]Stream{
+			"Stream": {
+				Handler: func(ctx context.Context, ss StreamServer) (interface{}, error) {
+					return wait(ctx, nil)
+				},
+				StreamingServer: true,
+			},
+		},
+	})
+
+	go server.Serve(ctx, listener)
+	defer server.Shutdown(ctx)
+	defer close(release)
+
+	check := func(t *testing.T, err error, code codes.Code, target error) {
+		t.Helper()
+		if status.Code(err) != code {
+			t.Fatalf("expected %v, got %v (%v)", code, status.Code(err), err)
+		}
+		if target != nil && !errors.Is(err, target) {
+			t.Fatalf("expected %v, got %v", target, err)
+		}
+	}
+	canceled := func() context.Context {
+		cctx, cancel := context.WithCancel(ctx)
+		go func() {
+			<-started
+			cancel()
+		}()
+		return cctx
+	}
+
+	t.Run("Canceled", func(t *testing.T) {
+		err := client.Call(canceled(), serviceName, "Wait", &internal.TestPayload{}, &internal.TestPayload{})
+		check(t, err, codes.Canceled, context.Canceled)
+	})
+
+	t.Run("DeadlineExceeded", func(t *testing.T) {
+		cctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+		defer cancel()
+		err := client.Call(cctx, serviceName, "Wait", &internal.TestPayload{}, &internal.TestPayload{})
+		<-started
+		// either the client or the server may notice the deadline first
+		check(t, err, codes.DeadlineExceeded, nil)
+	})
+
+	t.Run("Stream", func(t *testing.T) {
+		stream, err := client.NewStream(canceled(), &StreamDesc{StreamingServer: true}, serviceName, "Stream", &internal.TestPayload{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		check(t, stream.RecvMsg(&internal.TestPayload{}), codes.Canceled, context.Canceled)
+	})
+
+	t.Run("Local", func(t *testing.T) {
+		err := local.Call(canceled(), serviceName, "Wait", &internal.TestPayload{}, &internal.TestPayload{})
+		check(t, err, codes.Canceled, context.Canceled)
+	})
+
+	t.Run("Server", func(t *testing.T) {
+		err := client.Call(ctx, serviceName, "Timeout", &internal.TestPayload{}, &internal.TestPayload{})
+		check(t, err, codes.DeadlineExceeded, nil)
+		err = client.Call(ctx, serviceName, "Cancel", &internal.TestPayload{}, &internal.TestPayload{})
+		check(t, err, codes.Canceled, nil)
+	})
+}
+
+func TestClientShutdown(t *testing.T) {
+	var (
+		ctx            = context.Background()
+		server         = mustServer(t)(NewServer())
+		addr, listener = newTestListener(t)
+		release        = make(chan struct{})
+		started        = make(chan struct{}, 1)
+	)
+	defer listener.Close()
+
+	server.RegisterService(serviceName, &ServiceDesc{
+		Methods: map[string]Method{
+			"Wait": func(ctx context.Context, _ func(interface{}) error) (interface{}, error) {
+				started <- struct{}{}
+				select {
+				case <-release:
+					return &internal.TestPayload{Foo: "done"}, nil
+				case <-ctx.Done():
+					return nil, ctx.Err()
+				}
+			},
+		},
+	})
+	go server.Serve(ctx, listener)
+	defer server.Shutdown(ctx)
+
+	call := func(client *Client) chan error {
+		errs := make(chan error, 1)
+		go func() {
+			var resp internal.TestPayload
+			err := client.Call(ctx, serviceName, "Wait", &internal.TestPayload{}, &resp)
+			if err == nil && resp.Foo != "done" {
+				err = fmt.Errorf("unexpected response %q", resp.Foo)
+			}
+			errs <- err
+		}()
+		<-started
+		return errs
+	}
+
+	t.Run("Drain", func(t *testing.T) {
+		client, cleanup := newTestClient(t, addr)
+		defer cleanup()
+
+		errs := call(client)
+		shutdown := make(chan error, 1)
+		go func() {
+			shutdown <- client.Shutdown(ctx)
+		}()
+
+		// new calls are refused while the call in progress goes on
+		waitFor(t, func() bool { return client.draining.Load() })
+		if err := client.Call(ctx, serviceName, "Wait", &internal.TestPayload{}, &internal.TestPayload{}); !errors.Is(err, ErrClosed) {
+			t.Fatalf("expected %v during shutdown, got %v", ErrClosed, err)
+		}
+		select {
+		case err := <-shutdown:
+			t.Fatalf("shutdown returned with a call in progress: %v", err)
+		case <-time.After(100 * time.Millisecond):
+		}
+
+		release <- struct{}{}
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+		if err := <-shutdown; err != nil {
+			t.Fatal(err)
+		}
+		if !client.IsClosed() {
+			t.Fatal("expected the client to be closed")
+		}
+	})
+
+	t.Run("Deadline", func(t *testing.T) {
+		client, cleanup := newTestClient(t, addr)
+		defer cleanup()
+
+		errs := call(client)
+		sctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+		defer cancel()
+		if err := client.Shutdown(sctx); !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("expected %v, got %v", context.DeadlineExceeded, err)
+		}
+		if err := <-errs; !errors.Is(err, ErrClosed) {
+			t.Fatalf("expected the call in progress to fail with %v, got %v", ErrClosed, err)
+		}
+	})
+}
+
+func TestClientShutdownAfterOversizedCall(t *testing.T) {
+	var (
+		ctx             = context.Background()
+		server          = mustServer(t)(NewServer())
+		addr, listener  = newTestListener(t)
+		client, cleanup = newTestClient(t, addr, WithMaxSendMessageSize(64))
+	)
+	defer listener.Close()
+	defer cleanup()
+
+	registerTestingService(server, &testingServer{})
+	go server.Serve(ctx, listener)
+	defer server.Shutdown(ctx)
+
+	tp := &internal.TestPayload{Foo: strings.Repeat("a", 128)}
+	var oerr *OversizedMessageErr
+	if err := client.Call(ctx, serviceName, "Test", tp, tp); !errors.As(err, &oerr) {
+		t.Fatalf("expected an oversized message error, got %v", err)
+	}
+	if n := client.Stats().StreamsActive; n != 0 {
+		t.Fatalf("expected no active streams after a failed send, got %d", n)
+	}
+
+	sctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if err := client.Shutdown(sctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMessageSizeIgnoresNonPositive(t *testing.T) {
+	var (
+		ctx             = context.Background()
+		server          = mustServer(t)(NewServer(WithMaxReceiveMessageSize(0), WithServerMaxSendMessageSize(-1)))
+		testImpl        = &testingServer{}
+		addr, listener  = newTestListener(t)
+		client, cleanup = newTestClient(t, addr, WithMaxSendMessageSize(0), WithClientMaxReceiveMessageSize(-1))
+	)
+	defer listener.Close()
+	defer cleanup()
+
+	registerTestingService(server, testImpl)
+	go server.Serve(ctx, listener)
+	defer server.Shutdown(ctx)
+
+	// the default limits are kept, so calls still go through
+	tp := &internal.TestPayload{Foo: "size"}
+	if err := client.Call(ctx, serviceName, "Test", tp, tp); err != nil {
+		t.Fatal(err)
+	}
+}
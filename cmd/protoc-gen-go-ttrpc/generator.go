@@ -19,20 +19,29 @@ package main
 import (
 	"fmt"
 	"strings"
+	"time"
 
+	"github.com/containerd/ttrpc"
 	"google.golang.org/protobuf/compiler/protogen"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/known/durationpb"
 )
 
 // generator is a Go code generator that uses ttrpc.Server and ttrpc.Client.
 // Unlike the original gogo version, this doesn't generate serializers for message types and
 // let protoc-gen-go handle them.
 type generator struct {
-	out *protogen.GeneratedFile
+	out  *protogen.GeneratedFile
+	opts options
 
 	ident struct {
 		context     string
 		server      string
+		serverOpt   string
 		client      string
+		localClient string
+		md          string
 		method      string
 		stream      string
 		serviceDesc string
@@ -46,43 +55,66 @@ type generator struct {
 	}
 }
 
-func newGenerator(out *protogen.GeneratedFile) *generator {
-	gen := generator{out: out}
+// defaultTTRPCImportPath is the import path of the ttrpc package used by the
+// generated code, unless set with the ttrpc_import_path parameter.
+const defaultTTRPCImportPath protogen.GoImportPath = "github.com/containerd/ttrpc"
+
+func newGenerator(out *protogen.GeneratedFile, opts options) *generator {
+	if opts.ttrpcImportPath == "" {
+		opts.ttrpcImportPath = defaultTTRPCImportPath
+	}
+	gen := generator{out: out, opts: opts}
 	gen.ident.context = out.QualifiedGoIdent(protogen.GoIdent{
 		GoImportPath: "context",
 		GoName:       "Context",
 	})
 	gen.ident.server = out.QualifiedGoIdent(protogen.GoIdent{
-		GoImportPath: "github.com/containerd/ttrpc",
+		GoImportPath: gen.opts.ttrpcImportPath,
 		GoName:       "Server",
 	})
 	gen.ident.client = out.QualifiedGoIdent(protogen.GoIdent{
-		GoImportPath: "github.com/containerd/ttrpc",
+		GoImportPath: gen.opts.ttrpcImportPath,
 		GoName:       "Client",
 	})
+	if opts.grpcCompat {
+		gen.ident.md = out.QualifiedGoIdent(protogen.GoIdent{
+			GoImportPath: gen.opts.ttrpcImportPath,
+			GoName:       "MD",
+		})
+	}
+	if opts.genTestFake {
+		gen.ident.serverOpt = out.QualifiedGoIdent(protogen.GoIdent{
+			GoImportPath: gen.opts.ttrpcImportPath,
+			GoName:       "ServerOpt",
+		})
+		gen.ident.localClient = out.QualifiedGoIdent(protogen.GoIdent{
+			GoImportPath: gen.opts.ttrpcImportPath,
+			GoName:       "LocalClient",
+		})
+	}
 	gen.ident.method = out.QualifiedGoIdent(protogen.GoIdent{
-		GoImportPath: "github.com/containerd/ttrpc",
+		GoImportPath: gen.opts.ttrpcImportPath,
 		GoName:       "Method",
 	})
 	gen.ident.stream = out.QualifiedGoIdent(protogen.GoIdent{
-		GoImportPath: "github.com/containerd/ttrpc",
+		GoImportPath: gen.opts.ttrpcImportPath,
 		GoName:       "Stream",
 	})
 	gen.ident.serviceDesc = out.QualifiedGoIdent(protogen.GoIdent{
-		GoImportPath: "github.com/containerd/ttrpc",
+		GoImportPath: gen.opts.ttrpcImportPath,
 		GoName:       "ServiceDesc",
 	})
 	gen.ident.streamDesc = out.QualifiedGoIdent(protogen.GoIdent{
-		GoImportPath: "github.com/containerd/ttrpc",
+		GoImportPath: gen.opts.ttrpcImportPath,
 		GoName:       "StreamDesc",
 	})
 
 	gen.ident.streamServerIdent = protogen.GoIdent{
-		GoImportPath: "github.com/containerd/ttrpc",
+		GoImportPath: gen.opts.ttrpcImportPath,
 		GoName:       "StreamServer",
 	}
 	gen.ident.streamClientIdent = protogen.GoIdent{
-		GoImportPath: "github.com/containerd/ttrpc",
+		GoImportPath: gen.opts.ttrpcImportPath,
 		GoName:       "ClientStream",
 	}
 	gen.ident.streamServer = out.QualifiedGoIdent(gen.ident.streamServerIdent)
@@ -90,7 +122,7 @@ func newGenerator(out *protogen.GeneratedFile) *generator {
 	return &gen
 }
 
-func generate(plugin *protogen.Plugin, input *protogen.File, servicePrefix string) error {
+func generate(plugin *protogen.Plugin, input *protogen.File, opts options) error {
 	if len(input.Services) == 0 {
 		// Only generate a Go file if the file has some services.
 		return nil
@@ -101,14 +133,45 @@ func generate(plugin *protogen.Plugin, input *protogen.File, servicePrefix strin
 	file.P("// source: ", input.Desc.Path())
 	file.P("package ", input.GoPackageName)
 
-	gen := newGenerator(file)
+	gen := newGenerator(file, opts)
 	for _, service := range input.Services {
-		service.GoName = servicePrefix + service.GoName
+		service.GoName = opts.servicePrefix + service.GoName
 		gen.genService(service)
 	}
+	// a single service is already registered by its own Register function
+	if opts.genRegisterAll && len(input.Services) > 1 {
+		gen.genRegisterAll(input.Services)
+	}
 	return nil
 }
 
+// genRegisterAll generates RegisterAllServices, registering a single
+// implementation of all the services of the file.
+func (gen *generator) genRegisterAll(services []*protogen.Service) {
+	p := gen.out
+
+	names := make([]string, 0, len(services))
+	for _, service := range services {
+		names = append(names, service.GoName)
+	}
+	interfaceName := strings.Join(names, "And") + "Service"
+
+	p.P("// ", interfaceName, " is implemented by services serving all of ", strings.Join(names, ", "), ".")
+	p.P("type ", interfaceName, " interface {")
+	for _, service := range services {
+		p.P(service.GoName, "Service")
+	}
+	p.P("}")
+	p.P()
+	p.P("// RegisterAllServices registers svc as the implementation of all of ", strings.Join(names, ", "), ".")
+	p.P("func RegisterAllServices(srv *", gen.ident.server, ", svc ", interfaceName, ") {")
+	for _, service := range services {
+		p.P("Register", service.GoName, "Service(srv, svc)")
+	}
+	p.P("}")
+	p.P()
+}
+
 func (gen *generator) genService(service *protogen.Service) {
 	fullName := service.Desc.FullName()
 	p := gen.out
@@ -117,8 +180,25 @@ func (gen *generator) genService(service *protogen.Service) {
 	var streams []*protogen.Method
 
 	serviceName := service.GoName + "Service"
+
+	p.P("const (")
+	p.P(service.GoName, `ServiceName = "`, fullName, `"`)
+	for _, method := range service.Methods {
+		p.P(serviceName, "_", method.GoName, `_FullMethod = "/`, fullName, "/", method.Desc.Name(), `"`)
+	}
+	for _, method := range service.Methods {
+		if timeout, ok := defaultTimeout(method); ok {
+			p.P(serviceName, "_", method.GoName, "_DefaultTimeout = ", gen.duration(timeout))
+		}
+	}
+	p.P(")")
+	p.P()
+
+	// signatures of the methods of the service interface, without receiver
+	signatures := make([]string, 0, len(service.Methods))
 	p.P("type ", serviceName, " interface{")
 	for _, method := range service.Methods {
+		gen.genDeprecated(method)
 		var sendArgs, retArgs string
 		if method.Desc.IsStreamingClient() || method.Desc.IsStreamingServer() {
 			streams = append(streams, method)
@@ -126,21 +206,30 @@ func (gen *generator) genService(service *protogen.Service) {
 			if !method.Desc.IsStreamingClient() {
 				sendArgs = fmt.Sprintf("*%s, %s", p.QualifiedGoIdent(method.Input.GoIdent), sendArgs)
 			}
-			if method.Desc.IsStreamingServer() {
+			if method.Desc.IsStreamingServer() || gen.opts.grpcCompat {
 				retArgs = "error"
 			} else {
 				retArgs = fmt.Sprintf("(*%s, error)", p.QualifiedGoIdent(method.Output.GoIdent))
 			}
+			if gen.opts.grpcCompat {
+				// like grpc, the context is available from the stream
+				signatures = append(signatures, method.GoName+"("+sendArgs+") "+retArgs)
+				p.P(signatures[len(signatures)-1])
+				continue
+			}
 		} else {
 			methods = append(methods, method)
 			sendArgs = fmt.Sprintf("*%s", p.QualifiedGoIdent(method.Input.GoIdent))
 			retArgs = fmt.Sprintf("(*%s, error)", p.QualifiedGoIdent(method.Output.GoIdent))
 		}
-		p.P(method.GoName, "(", gen.ident.context, ", ", sendArgs, ") ", retArgs)
+		signatures = append(signatures, method.GoName+"("+gen.ident.context+", "+sendArgs+") "+retArgs)
+		p.P(signatures[len(signatures)-1])
 	}
 	p.P("}")
 	p.P()
 
+	gen.genUnimplemented(service, serviceName, signatures)
+
 	for _, method := range streams {
 		structName := strings.ToLower(service.GoName) + method.GoName + "Server"
 
@@ -152,17 +241,100 @@ func (gen *generator) genService(service *protogen.Service) {
 			p.P("Recv() (*", method.Input.GoIdent, ", error)")
 
 		}
+		if !method.Desc.IsStreamingServer() {
+			p.P("// SendAndClose stores the response of the stream, it is only sent")
+			p.P("// once the service method returns, and only when the method does")
+			p.P("// not return a response of its own.")
+			p.P("SendAndClose(*", method.Output.GoIdent, ") error")
+		}
+		if gen.opts.grpcCompat {
+			p.P("// SetHeader merges md into the header metadata, sent with the")
+			p.P("// first message, by SendHeader or once the service method")
+			p.P("// returns, whichever comes first.")
+			p.P("SetHeader(", gen.ident.md, ") error")
+			p.P("SendHeader(", gen.ident.md, ") error")
+			p.P("SetTrailer(", gen.ident.md, ")")
+		}
 		p.P(gen.ident.streamServer)
 		p.P("}")
 		p.P()
 
 		p.P("type ", structName, " struct {")
 		p.P(gen.ident.streamServer)
+		if !method.Desc.IsStreamingServer() {
+			p.P("resp *", method.Output.GoIdent)
+		}
+		if gen.opts.grpcCompat {
+			p.P("header ", gen.ident.md)
+			p.P("headerSent bool")
+		}
 		p.P("}")
 		p.P()
 
+		if !method.Desc.IsStreamingServer() {
+			// The response is returned by the handler once the service
+			// method returns.
+			p.P("func (x *", structName, ") SendAndClose(m *", method.Output.GoIdent, ") error {")
+			p.P("if x.resp != nil {")
+			p.P("return ", p.QualifiedGoIdent(protogen.GoIdent{GoImportPath: gen.opts.ttrpcImportPath, GoName: "ErrStreamClosed"}))
+			p.P("}")
+			p.P("x.resp = m")
+			p.P("return nil")
+			p.P("}")
+			p.P()
+		}
+
+		if gen.opts.grpcCompat {
+			errHeaderSent := p.QualifiedGoIdent(protogen.GoIdent{GoImportPath: gen.opts.ttrpcImportPath, GoName: "ErrHeaderSent"})
+			p.P("func (x *", structName, ") SetHeader(md ", gen.ident.md, ") error {")
+			p.P("if x.headerSent {")
+			p.P("return ", errHeaderSent)
+			p.P("}")
+			p.P("if x.header == nil {")
+			p.P("x.header = ", gen.ident.md, "{}")
+			p.P("}")
+			p.P("for k, v := range md {")
+			p.P("x.header.Append(k, v...)")
+			p.P("}")
+			p.P("return nil")
+			p.P("}")
+			p.P()
+
+			p.P("func (x *", structName, ") SendHeader(md ", gen.ident.md, ") error {")
+			p.P("if err := x.SetHeader(md); err != nil {")
+			p.P("return err")
+			p.P("}")
+			p.P("return x.flushHeader()")
+			p.P("}")
+			p.P()
+
+			// the header is only sent when one was set, clients not
+			// expecting any are not sent one
+			p.P("func (x *", structName, ") flushHeader() error {")
+			p.P("if x.headerSent {")
+			p.P("return nil")
+			p.P("}")
+			p.P("x.headerSent = true")
+			p.P("if x.header == nil {")
+			p.P("return nil")
+			p.P("}")
+			p.P("return x.StreamServer.SendHeader(x.header)")
+			p.P("}")
+			p.P()
+
+			p.P("func (x *", structName, ") SetTrailer(md ", gen.ident.md, ") {")
+			p.P(p.QualifiedGoIdent(protogen.GoIdent{GoImportPath: gen.opts.ttrpcImportPath, GoName: "SetResponseMetadata"}), "(x.Context(), md)")
+			p.P("}")
+			p.P()
+		}
+
 		if method.Desc.IsStreamingServer() {
 			p.P("func (x *", structName, ") Send(m *", method.Output.GoIdent, ") error {")
+			if gen.opts.grpcCompat {
+				p.P("if err := x.flushHeader(); err != nil {")
+				p.P("return err")
+				p.P("}")
+			}
 			p.P("return x.StreamServer.SendMsg(m)")
 			p.P("}")
 			p.P()
@@ -211,11 +383,36 @@ func (gen *generator) genService(service *protogen.Service) {
 				p.P("return nil, err")
 				p.P("}")
 			}
-			if method.Desc.IsStreamingServer() {
+			if gen.opts.grpcCompat {
+				p.P("x := &", structName, "{StreamServer: stream}")
+				p.P("err := svc.", method.GoName, "(", sendArg, "x)")
+				// a header set without any message sent goes ahead of the
+				// final response
+				p.P("if herr := x.flushHeader(); err == nil {")
+				p.P("err = herr")
+				p.P("}")
+				if method.Desc.IsStreamingServer() {
+					p.P("return nil, err")
+				} else {
+					p.P("if err != nil {")
+					p.P("return nil, err")
+					p.P("}")
+					p.P("return x.resp, nil")
+				}
+			} else if method.Desc.IsStreamingServer() {
 				p.P("return nil, svc.", method.GoName, "(ctx, ", sendArg, "&", structName, "{stream})")
 			} else {
-				p.P("return svc.", method.GoName, "(ctx, ", sendArg, "&", structName, "{stream})")
-
+				// a response sent with SendAndClose is used when the service
+				// method does not return one
+				p.P("x := &", structName, "{StreamServer: stream}")
+				p.P("resp, err := svc.", method.GoName, "(ctx, ", sendArg, "x)")
+				p.P("if err != nil {")
+				p.P("return nil, err")
+				p.P("}")
+				p.P("if resp == nil {")
+				p.P("return x.resp, nil")
+				p.P("}")
+				p.P("return resp, nil")
 			}
 			p.P("},")
 			if method.Desc.IsStreamingClient() {
@@ -241,11 +438,12 @@ func (gen *generator) genService(service *protogen.Service) {
 	// For consistency with ttrpc 1.0 without streaming, just use
 	// the service name if no streams are defined
 	clientInterface := serviceName
-	if len(streams) > 0 {
+	if len(streams) > 0 || gen.opts.grpcCompat {
 		clientInterface = clientType
 		// Stream client interfaces are different than the server interface
 		p.P("type ", clientInterface, " interface{")
 		for _, method := range service.Methods {
+			gen.genDeprecated(method)
 			if method.Desc.IsStreamingClient() || method.Desc.IsStreamingServer() {
 				streams = append(streams, method)
 				var sendArg string
@@ -279,53 +477,12 @@ func (gen *generator) genService(service *protogen.Service) {
 	p.P()
 
 	for _, method := range service.Methods {
-		var sendArg string
-		if !method.Desc.IsStreamingClient() {
-			sendArg = ", req *" + gen.out.QualifiedGoIdent(method.Input.GoIdent)
-		}
-
-		intName := service.GoName + "_" + method.GoName + "Client"
-		var retArg string
-		if method.Desc.IsStreamingClient() || method.Desc.IsStreamingServer() {
-			retArg = intName
-		} else {
-			retArg = "*" + gen.out.QualifiedGoIdent(method.Output.GoIdent)
-		}
-
-		p.P("func (c *", clientStructType, ") ", method.GoName,
-			"(ctx ", gen.ident.context, "", sendArg, ") ",
-			"(", retArg, ", error) {")
+		gen.genClientMethod(service, method, clientStructType)
 
 		if method.Desc.IsStreamingClient() || method.Desc.IsStreamingServer() {
-			var streamingClient, streamingServer, req string
-			if method.Desc.IsStreamingClient() {
-				streamingClient = "true"
-				req = "nil"
-			} else {
-				streamingClient = "false"
-				req = "req"
-			}
-			if method.Desc.IsStreamingServer() {
-				streamingServer = "true"
-			} else {
-				streamingServer = "false"
-			}
-			p.P("stream, err := c.client.NewStream(ctx, &", gen.ident.streamDesc, "{")
-			p.P("StreamingClient: ", streamingClient, ",")
-			p.P("StreamingServer: ", streamingServer, ",")
-			p.P("}, ", `"`+fullName+`", `, `"`+method.GoName+`", `, req, `)`)
-			p.P("if err != nil {")
-			p.P("return nil, err")
-			p.P("}")
-
+			intName := service.GoName + "_" + method.GoName + "Client"
 			structName := strings.ToLower(service.GoName) + method.GoName + "Client"
 
-			p.P("x := &", structName, "{stream}")
-
-			p.P("return x, nil")
-			p.P("}")
-			p.P()
-
 			// Create interface
 			p.P("type ", intName, " interface {")
 			if method.Desc.IsStreamingClient() {
@@ -336,6 +493,10 @@ func (gen *generator) genService(service *protogen.Service) {
 			} else {
 				p.P("CloseAndRecv() (*", method.Output.GoIdent, ", error)")
 			}
+			if gen.opts.grpcCompat {
+				p.P("Header() (", gen.ident.md, ", error)")
+				p.P("Trailer() ", gen.ident.md)
+			}
 
 			p.P(gen.ident.streamClient)
 			p.P("}")
@@ -344,9 +505,19 @@ func (gen *generator) genService(service *protogen.Service) {
 			// Create struct
 			p.P("type ", structName, " struct {")
 			p.P(gen.ident.streamClient)
+			if gen.opts.grpcCompat {
+				p.P("trailer *", gen.ident.md)
+			}
 			p.P("}")
 			p.P()
 
+			if gen.opts.grpcCompat {
+				p.P("func (x *", structName, ") Trailer() ", gen.ident.md, " {")
+				p.P("return *x.trailer")
+				p.P("}")
+				p.P()
+			}
+
 			if method.Desc.IsStreamingClient() {
 				p.P("func (x *", structName, ") Send(m *", method.Input.GoIdent, ") error {")
 				p.P("return x.", gen.ident.streamClientIdent.GoName, ".SendMsg(m)")
@@ -376,14 +547,194 @@ func (gen *generator) genService(service *protogen.Service) {
 				p.P("}")
 				p.P()
 			}
+		}
+	}
+
+	if gen.opts.genTestFake {
+		gen.genTestFake(service, serviceName, clientInterface)
+	}
+}
+
+// genClientMethod generates the method calling the server for a method of the
+// service on the client struct, which may be the client or its fake.
+func (gen *generator) genClientMethod(service *protogen.Service, method *protogen.Method, clientStructType string) {
+	fullName := service.Desc.FullName()
+	p := gen.out
+
+	var sendArg string
+	if !method.Desc.IsStreamingClient() {
+		sendArg = ", req *" + gen.out.QualifiedGoIdent(method.Input.GoIdent)
+	}
+
+	intName := service.GoName + "_" + method.GoName + "Client"
+	var retArg string
+	if method.Desc.IsStreamingClient() || method.Desc.IsStreamingServer() {
+		retArg = intName
+	} else {
+		retArg = "*" + gen.out.QualifiedGoIdent(method.Output.GoIdent)
+	}
+
+	gen.genDeprecated(method)
+	p.P("func (c *", clientStructType, ") ", method.GoName,
+		"(ctx ", gen.ident.context, "", sendArg, ") ",
+		"(", retArg, ", error) {")
+
+	if method.Desc.IsStreamingClient() || method.Desc.IsStreamingServer() {
+		var streamingClient, streamingServer, req string
+		if method.Desc.IsStreamingClient() {
+			streamingClient = "true"
+			req = "nil"
 		} else {
-			p.P("var resp ", method.Output.GoIdent)
-			p.P(`if err := c.client.Call(ctx, "`, fullName, `", "`, method.Desc.Name(), `", req, &resp); err != nil {`)
-			p.P("return nil, err")
-			p.P("}")
-			p.P("return &resp, nil")
+			streamingClient = "false"
+			req = "req"
+		}
+		if method.Desc.IsStreamingServer() {
+			streamingServer = "true"
+		} else {
+			streamingServer = "false"
+		}
+		if gen.opts.grpcCompat {
+			p.P("trailer := new(", gen.ident.md, ")")
+			p.P("ctx = ", p.QualifiedGoIdent(protogen.GoIdent{GoImportPath: gen.opts.ttrpcImportPath, GoName: "WithResponseMetadata"}), "(ctx, trailer)")
+		}
+		p.P("stream, err := c.client.NewStream(ctx, &", gen.ident.streamDesc, "{")
+		p.P("StreamingClient: ", streamingClient, ",")
+		p.P("StreamingServer: ", streamingServer, ",")
+		p.P("}, ", `"`+fullName+`", `, `"`+method.GoName+`", `, req, `)`)
+		p.P("if err != nil {")
+		p.P("return nil, err")
+		p.P("}")
+
+		structName := strings.ToLower(service.GoName) + method.GoName + "Client"
+
+		if gen.opts.grpcCompat {
+			p.P("x := &", structName, "{ClientStream: stream, trailer: trailer}")
+		} else {
+			p.P("x := &", structName, "{stream}")
+		}
+
+		p.P("return x, nil")
+		p.P("}")
+		p.P()
+	} else {
+		if _, ok := defaultTimeout(method); ok {
+			// the timeout of the method applies unless the caller set one
+			p.P("if _, ok := ctx.Deadline(); !ok {")
+			p.P("var cancel ", p.QualifiedGoIdent(protogen.GoIdent{GoImportPath: "context", GoName: "CancelFunc"}))
+			p.P("ctx, cancel = ", p.QualifiedGoIdent(protogen.GoIdent{GoImportPath: "context", GoName: "WithTimeout"}),
+				"(ctx, ", service.GoName, "Service_", method.GoName, "_DefaultTimeout)")
+			p.P("defer cancel()")
 			p.P("}")
-			p.P()
 		}
+		p.P("var resp ", method.Output.GoIdent)
+		p.P(`if err := c.client.Call(ctx, "`, fullName, `", "`, method.Desc.Name(), `", req, &resp); err != nil {`)
+		p.P("return nil, err")
+		p.P("}")
+		p.P("return &resp, nil")
+		p.P("}")
+		p.P()
+	}
+}
+
+// genUnimplemented generates an implementation of the service interface
+// failing every call with codes.Unimplemented. Services embedding it keep
+// compiling when methods are added to the service.
+func (gen *generator) genUnimplemented(service *protogen.Service, serviceName string, signatures []string) {
+	p := gen.out
+	structName := "Unimplemented" + serviceName
+	errorf := p.QualifiedGoIdent(protogen.GoIdent{
+		GoImportPath: "google.golang.org/grpc/status",
+		GoName:       "Errorf",
+	})
+	unimplemented := p.QualifiedGoIdent(protogen.GoIdent{
+		GoImportPath: "google.golang.org/grpc/codes",
+		GoName:       "Unimplemented",
+	})
+
+	p.P("// ", structName, " can be embedded in implementations of ", serviceName, " for")
+	p.P("// forward compatibility, the methods it provides fail with codes.Unimplemented.")
+	p.P("type ", structName, " struct{}")
+	p.P()
+	for i, method := range service.Methods {
+		p.P("func (", structName, ") ", signatures[i], " {")
+		err := fmt.Sprintf("%s(%s, \"method %s not implemented\")", errorf, unimplemented, method.GoName)
+		if strings.HasSuffix(signatures[i], ") error") {
+			p.P("return ", err)
+		} else {
+			p.P("return nil, ", err)
+		}
+		p.P("}")
+		p.P()
+	}
+}
+
+// defaultTimeout returns the timeout set on a method with the
+// (ttrpc.default_timeout) option.
+func defaultTimeout(method *protogen.Method) (time.Duration, bool) {
+	opts, ok := method.Desc.Options().(*descriptorpb.MethodOptions)
+	if !ok || !proto.HasExtension(opts, ttrpc.E_DefaultTimeout) {
+		return 0, false
+	}
+	timeout := proto.GetExtension(opts, ttrpc.E_DefaultTimeout).(*durationpb.Duration).AsDuration()
+	return timeout, timeout > 0
+}
+
+// duration returns a Go expression of d as a time.Duration.
+func (gen *generator) duration(d time.Duration) string {
+	unit := func(name string) string {
+		return gen.out.QualifiedGoIdent(protogen.GoIdent{GoImportPath: "time", GoName: name})
+	}
+	switch {
+	case d%time.Second == 0:
+		return fmt.Sprintf("%d * %s", d/time.Second, unit("Second"))
+	case d%time.Millisecond == 0:
+		return fmt.Sprintf("%d * %s", d/time.Millisecond, unit("Millisecond"))
+	default:
+		return fmt.Sprintf("%s(%d)", unit("Duration"), int64(d))
+	}
+}
+
+// genDeprecated marks the Go method generated for a method declared with the
+// deprecated option as deprecated, so that linters report its uses.
+func (gen *generator) genDeprecated(method *protogen.Method) {
+	if opts, ok := method.Desc.Options().(*descriptorpb.MethodOptions); ok && opts.GetDeprecated() {
+		gen.out.P("// Deprecated: Do not use.")
+	}
+}
+
+// genTestFake generates a fake of the client which calls a service
+// implementation in-process through a ttrpc.LocalClient.
+func (gen *generator) genTestFake(service *protogen.Service, serviceName, clientInterface string) {
+	p := gen.out
+
+	fakeType := strings.ToLower(service.GoName) + "ClientFake"
+	p.P("// New", service.GoName, "ClientFake returns a ", clientInterface, " which calls svc")
+	p.P("// in-process, without a connection. The server options are applied to the")
+	p.P("// server svc is registered on, for example to install interceptors.")
+	p.P("func New", service.GoName, "ClientFake(svc ", serviceName, ", opts ...", gen.ident.serverOpt, ") (", clientInterface, ", error) {")
+	p.P("srv, err := ", gen.out.QualifiedGoIdent(protogen.GoIdent{
+		GoImportPath: gen.opts.ttrpcImportPath,
+		GoName:       "NewServer",
+	}), "(opts...)")
+	p.P("if err != nil {")
+	p.P("return nil, err")
+	p.P("}")
+	p.P("Register", serviceName, "(srv, svc)")
+	p.P("return &", fakeType, "{")
+	p.P("client: ", gen.out.QualifiedGoIdent(protogen.GoIdent{
+		GoImportPath: gen.opts.ttrpcImportPath,
+		GoName:       "NewLocalClient",
+	}), "(srv),")
+	p.P("}, nil")
+	p.P("}")
+	p.P()
+
+	p.P("type ", fakeType, " struct{")
+	p.P("client *", gen.ident.localClient)
+	p.P("}")
+	p.P()
+
+	for _, method := range service.Methods {
+		gen.genClientMethod(service, method, fakeType)
 	}
 }
@@ -0,0 +1,214 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/containerd/ttrpc"
+	"google.golang.org/protobuf/compiler/protogen"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/pluginpb"
+)
+
+// testFile describes a proto file with a service made of the given methods,
+// all taking and returning the Payload message.
+func testFile(methods ...*descriptorpb.MethodDescriptorProto) *descriptorpb.FileDescriptorProto {
+	for _, method := range methods {
+		method.InputType = proto.String(".test.Payload")
+		method.OutputType = proto.String(".test.Payload")
+	}
+	return &descriptorpb.FileDescriptorProto{
+		Name:    proto.String("test.proto"),
+		Package: proto.String("test"),
+		Syntax:  proto.String("proto3"),
+		Options: &descriptorpb.FileOptions{
+			GoPackage: proto.String("example.com/test;test"),
+		},
+		MessageType: []*descriptorpb.DescriptorProto{
+			{Name: proto.String("Payload")},
+		},
+		Service: []*descriptorpb.ServiceDescriptorProto{
+			{Name: proto.String("Test"), Method: methods},
+		},
+	}
+}
+
+// runGenerator returns the code generated for file with opts.
+func runGenerator(t *testing.T, file *descriptorpb.FileDescriptorProto, opts options) string {
+	t.Helper()
+
+	plugin, err := protogen.Options{}.New(&pluginpb.CodeGeneratorRequest{
+		FileToGenerate: []string{file.GetName()},
+		ProtoFile:      []*descriptorpb.FileDescriptorProto{file},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range plugin.Files {
+		if f.Generate {
+			if err := generate(plugin, f, opts); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	resp := plugin.Response()
+	if resp.Error != nil {
+		t.Fatal(resp.GetError())
+	}
+	if len(resp.File) != 1 {
+		t.Fatalf("expected one generated file, got %d", len(resp.File))
+	}
+	return resp.File[0].GetContent()
+}
+
+func TestGenerateDeprecated(t *testing.T) {
+	for name, opts := range map[string]options{
+		"Default":    {},
+		"GRPCCompat": {grpcCompat: true},
+		"TestFake":   {genTestFake: true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			code := runGenerator(t, testFile(
+				&descriptorpb.MethodDescriptorProto{
+					Name:    proto.String("Old"),
+					Options: &descriptorpb.MethodOptions{Deprecated: proto.Bool(true)},
+				},
+				&descriptorpb.MethodDescriptorProto{
+					Name:            proto.String("OldStream"),
+					ServerStreaming: proto.Bool(true),
+					Options:         &descriptorpb.MethodOptions{Deprecated: proto.Bool(true)},
+				},
+				&descriptorpb.MethodDescriptorProto{Name: proto.String("New")},
+			), opts)
+
+			lines := strings.Split(code, "\n")
+			var deprecated int
+			for i, line := range lines[1:] {
+				if strings.TrimSpace(lines[i]) != "// Deprecated: Do not use." {
+					continue
+				}
+				if !strings.Contains(line, "Old") {
+					t.Errorf("unexpected deprecated declaration %q", line)
+				}
+				deprecated++
+			}
+			// the server interface, the client interface and the client
+			// methods are deprecated, along with the fake methods
+			expected := 6
+			if opts.genTestFake {
+				expected += 2
+			}
+			if deprecated != expected {
+				t.Errorf("expected %d deprecated declarations, got %d:\n%s", expected, deprecated, code)
+			}
+		})
+	}
+}
+
+func TestGenerateDefaultTimeout(t *testing.T) {
+	timeouts := map[string]time.Duration{
+		"Second":      5 * time.Second,
+		"Millisecond": 1500 * time.Millisecond,
+		"Nanosecond":  42,
+	}
+	var methods []*descriptorpb.MethodDescriptorProto
+	for name, timeout := range timeouts {
+		opts := &descriptorpb.MethodOptions{}
+		proto.SetExtension(opts, ttrpc.E_DefaultTimeout, durationpb.New(timeout))
+		methods = append(methods, &descriptorpb.MethodDescriptorProto{Name: proto.String(name), Options: opts})
+	}
+	methods = append(methods, &descriptorpb.MethodDescriptorProto{Name: proto.String("None")})
+	code := runGenerator(t, testFile(methods...), options{genTestFake: true})
+
+	for _, expected := range []string{
+		"TestService_Second_DefaultTimeout = 5 * time.Second",
+		"TestService_Millisecond_DefaultTimeout = 1500 * time.Millisecond",
+		"TestService_Nanosecond_DefaultTimeout = time.Duration(42)",
+	} {
+		if !strings.Contains(strings.Join(strings.Fields(code), " "), expected) {
+			t.Errorf("expected %q in the generated code:\n%s", expected, code)
+		}
+	}
+	if strings.Contains(code, "TestService_None_DefaultTimeout") {
+		t.Errorf("unexpected timeout of a method without the option:\n%s", code)
+	}
+	// the client and its fake apply the timeouts
+	if n := strings.Count(code, "context.WithTimeout("); n != 2*len(timeouts) {
+		t.Errorf("expected the timeouts to be applied %d times, got %d:\n%s", 2*len(timeouts), n, code)
+	}
+}
+
+func TestGenerateTTRPCImportPath(t *testing.T) {
+	const fork = "example.com/fork/ttrpc"
+	for name, opts := range map[string]options{
+		"Default":    {ttrpcImportPath: fork},
+		"GRPCCompat": {ttrpcImportPath: fork, grpcCompat: true},
+		"TestFake":   {ttrpcImportPath: fork, genTestFake: true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			code := runGenerator(t, testFile(
+				&descriptorpb.MethodDescriptorProto{Name: proto.String("Unary")},
+				&descriptorpb.MethodDescriptorProto{
+					Name:            proto.String("Stream"),
+					ClientStreaming: proto.Bool(true),
+					ServerStreaming: proto.Bool(true),
+				},
+			), opts)
+			if strings.Contains(code, string(defaultTTRPCImportPath)) {
+				t.Errorf("unexpected import of %s:\n%s", defaultTTRPCImportPath, code)
+			}
+			if !strings.Contains(code, `ttrpc "`+fork+`"`) {
+				t.Errorf("expected import of %s:\n%s", fork, code)
+			}
+		})
+	}
+}
+
+func TestGenerateRegisterAll(t *testing.T) {
+	file := testFile(&descriptorpb.MethodDescriptorProto{Name: proto.String("Unary")})
+	if code := runGenerator(t, file, options{genRegisterAll: true}); strings.Contains(code, "RegisterAllServices") {
+		t.Fatalf("unexpected RegisterAllServices for a single service:\n%s", code)
+	}
+
+	file.Service = append(file.Service, &descriptorpb.ServiceDescriptorProto{
+		Name: proto.String("Other"),
+		Method: []*descriptorpb.MethodDescriptorProto{{
+			Name:       proto.String("Call"),
+			InputType:  proto.String(".test.Payload"),
+			OutputType: proto.String(".test.Payload"),
+		}},
+	})
+
+	if code := runGenerator(t, file, options{}); strings.Contains(code, "RegisterAllServices") {
+		t.Fatalf("unexpected RegisterAllServices without gen_register_all:\n%s", code)
+	}
+
+	code := strings.Join(strings.Fields(runGenerator(t, file, options{genRegisterAll: true})), " ")
+	for _, expected := range []string{
+		"type TestAndOtherService interface { TestService OtherService }",
+		"func RegisterAllServices(srv *ttrpc.Server, svc TestAndOtherService) { RegisterTestService(srv, svc) RegisterOtherService(srv, svc) }",
+	} {
+		if !strings.Contains(code, expected) {
+			t.Errorf("expected %q in the generated code:\n%s", expected, code)
+		}
+	}
+}
@@ -17,16 +17,58 @@
 package main
 
 import (
+	"fmt"
+	"strconv"
+
 	"google.golang.org/protobuf/compiler/protogen"
 	"google.golang.org/protobuf/types/pluginpb"
 )
 
+// options are the parameters passed to the plugin.
+type options struct {
+	// servicePrefix is prepended to the Go names generated for services.
+	servicePrefix string
+	// genTestFake enables generating a client fake calling a service
+	// implementation in-process.
+	genTestFake bool
+	// grpcCompat makes the generated stream signatures match grpc-go.
+	grpcCompat bool
+	// genRegisterAll enables generating RegisterAllServices, registering one
+	// implementation of all the services of a file. It is only generated for
+	// files with more than one service.
+	genRegisterAll bool
+	// ttrpcImportPath is the import path of the ttrpc package used by the
+	// generated code, for forks of ttrpc.
+	ttrpcImportPath protogen.GoImportPath
+}
+
 func main() {
-	var servicePrefix string
+	var opts options
 	protogen.Options{
 		ParamFunc: func(name, value string) error {
-			if name == "prefix" {
-				servicePrefix = value
+			switch name {
+			case "prefix":
+				opts.servicePrefix = value
+			case "gen_testfake":
+				v, err := strconv.ParseBool(value)
+				if err != nil {
+					return fmt.Errorf("invalid value for %s: %w", name, err)
+				}
+				opts.genTestFake = v
+			case "grpc_compat":
+				v, err := strconv.ParseBool(value)
+				if err != nil {
+					return fmt.Errorf("invalid value for %s: %w", name, err)
+				}
+				opts.grpcCompat = v
+			case "gen_register_all":
+				v, err := strconv.ParseBool(value)
+				if err != nil {
+					return fmt.Errorf("invalid value for %s: %w", name, err)
+				}
+				opts.genRegisterAll = v
+			case "ttrpc_import_path":
+				opts.ttrpcImportPath = protogen.GoImportPath(value)
 			}
 			return nil
 		},
@@ -36,7 +78,7 @@ func main() {
 			if !f.Generate {
 				continue
 			}
-			if err := generate(gen, f, servicePrefix); err != nil {
+			if err := generate(gen, f, opts); err != nil {
 				return err
 			}
 		}
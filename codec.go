@@ -20,16 +20,46 @@ import (
 	"fmt"
 
 	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/protoadapt"
 )
 
-type codec struct{}
+// Codec marshals and unmarshals the payloads carried by ttrpc requests,
+// responses and stream messages. The request and response envelopes are always
+// encoded as protobuf.
+//
+// Unmarshal must not retain the provided byte slice after returning, as the
+// buffer is reused for later messages.
+type Codec interface {
+	Marshal(interface{}) ([]byte, error)
+	Unmarshal([]byte, interface{}) error
+}
+
+// codec is the default protobuf Codec. It supports messages generated for
+// google.golang.org/protobuf, messages generated by gogo/protobuf, which
+// marshal themselves, and legacy github.com/golang/protobuf messages, so that
+// services may mix them during a migration.
+type codec struct {
+	// deterministic sorts map entries when marshaling, see
+	// proto.MarshalOptions. It does not apply to gogo messages.
+	deterministic bool
+}
+
+// gogoMessage is implemented by messages generated by gogo/protobuf.
+type gogoMessage interface {
+	Marshal() ([]byte, error)
+	Unmarshal([]byte) error
+}
 
 func (c codec) Marshal(msg interface{}) ([]byte, error) {
 	switch v := msg.(type) {
 	case proto.Message:
-		return proto.Marshal(v)
+		return proto.MarshalOptions{Deterministic: c.deterministic}.Marshal(v)
+	case gogoMessage:
+		return v.Marshal()
+	case protoadapt.MessageV1:
+		return proto.MarshalOptions{Deterministic: c.deterministic}.Marshal(protoadapt.MessageV2Of(v))
 	default:
-		return nil, fmt.Errorf("ttrpc: cannot marshal unknown type: %T", msg)
+		return nil, fmt.Errorf("ttrpc: cannot marshal unknown type %T, it is not a protobuf message", msg)
 	}
 }
 
@@ -37,7 +67,50 @@ func (c codec) Unmarshal(p []byte, msg interface{}) error {
 	switch v := msg.(type) {
 	case proto.Message:
 		return proto.Unmarshal(p, v)
+	case gogoMessage:
+		// generated Unmarshal methods merge into the message
+		if r, ok := v.(interface{ Reset() }); ok {
+			r.Reset()
+		}
+		return v.Unmarshal(p)
+	case protoadapt.MessageV1:
+		return proto.Unmarshal(p, protoadapt.MessageV2Of(v))
+	default:
+		return fmt.Errorf("ttrpc: cannot unmarshal into unknown type %T, it is not a protobuf message", msg)
+	}
+}
+
+// RawMessage is an already encoded payload. It is sent on the wire verbatim
+// without passing through the codec, and receiving into a *RawMessage copies
+// the payload bytes without decoding them.
+//
+// No conversion happens in either direction, so the bytes must already be in
+// the encoding expected by the peer. For a request without a content type this
+// is protobuf; a client configured with WithContentTypeCodec, or a server
+// handling a request with a content type, must produce and expect bytes in
+// that content type's encoding.
+type RawMessage []byte
+
+// marshal encodes msg with codec unless it is a RawMessage.
+func marshal(codec Codec, msg interface{}) ([]byte, error) {
+	switch v := msg.(type) {
+	case RawMessage:
+		return v, nil
+	case *RawMessage:
+		if v == nil {
+			return nil, nil
+		}
+		return *v, nil
 	default:
-		return fmt.Errorf("ttrpc: cannot unmarshal into unknown type: %T", msg)
+		return codec.Marshal(msg)
+	}
+}
+
+// unmarshal decodes p into msg with codec unless msg is a *RawMessage.
+func unmarshal(codec Codec, p []byte, msg interface{}) error {
+	if v, ok := msg.(*RawMessage); ok {
+		*v = append((*v)[:0], p...)
+		return nil
 	}
+	return codec.Unmarshal(p, msg)
 }
@@ -0,0 +1,456 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ttrpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/containerd/ttrpc/internal"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(msg interface{}) ([]byte, error) {
+	return json.Marshal(msg)
+}
+
+func (jsonCodec) Unmarshal(p []byte, msg interface{}) error {
+	return json.Unmarshal(p, msg)
+}
+
+type jsonMessage struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+func TestCustomCodec(t *testing.T) {
+	var (
+		ctx             = context.Background()
+		server          = mustServer(t)(NewServer(WithServerCodec(jsonCodec{})))
+		addr, listener  = newTestListener(t)
+		client, cleanup = newTestClient(t, addr, WithCodec(jsonCodec{}))
+	)
+	defer listener.Close()
+	defer cleanup()
+
+	server.RegisterService(serviceName, &ServiceDesc{
+		Methods: map[string]Method{
+			"Echo": func(_ context.Context, unmarshal func(interface{}) error) (interface{}, error) {
+				var req jsonMessage
+				if err := unmarshal(&req); err != nil {
+					return nil, err
+				}
+				req.Count++
+				return &req, nil
+			},
+		},
+		Streams: map[string]Stream{
+			"EchoStream": {
+				Handler: func(_ context.Context, ss StreamServer) (interface{}, error) {
+					for {
+						var req jsonMessage
+						if err := ss.RecvMsg(&req); err != nil {
+							if err == io.EOF {
+								return nil, nil
+							}
+							return nil, err
+						}
+						req.Count++
+						if err := ss.SendMsg(&req); err != nil {
+							return nil, err
+						}
+					}
+				},
+				StreamingClient: true,
+				StreamingServer: true,
+			},
+		},
+	})
+
+	go server.Serve(ctx, listener)
+	defer server.Shutdown(ctx)
+
+	var resp jsonMessage
+	if err := client.Call(ctx, serviceName, "Echo", &jsonMessage{Name: "unary", Count: 1}, &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Name != "unary" || resp.Count != 2 {
+		t.Fatalf("unexpected response: %+v", resp)
+	}
+
+	stream, err := client.NewStream(ctx, &StreamDesc{true, true}, serviceName, "EchoStream", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := stream.SendMsg(&jsonMessage{Name: "stream", Count: i}); err != nil {
+			t.Fatal(err)
+		}
+		var resp jsonMessage
+		if err := stream.RecvMsg(&resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.Name != "stream" || resp.Count != i+1 {
+			t.Fatalf("unexpected response: %+v", resp)
+		}
+	}
+	if err := stream.CloseSend(); err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.RecvMsg(&resp); err != io.EOF {
+		t.Fatalf("expected io.EOF, got %v", err)
+	}
+}
+
+func TestContentTypeCodecs(t *testing.T) {
+	var (
+		ctx            = context.Background()
+		server         = mustServer(t)(NewServer(WithServerContentTypeCodec("application/json", jsonCodec{})))
+		addr, listener = newTestListener(t)
+	)
+	defer listener.Close()
+
+	server.RegisterService(serviceName, &ServiceDesc{
+		Methods: map[string]Method{
+			"Echo": func(_ context.Context, unmarshal func(interface{}) error) (interface{}, error) {
+				var req internal.TestPayload
+				if err := unmarshal(&req); err != nil {
+					return nil, err
+				}
+				return &internal.EchoPayload{Msg: req.Foo}, nil
+			},
+		},
+	})
+
+	go server.Serve(ctx, listener)
+	defer server.Shutdown(ctx)
+
+	for _, tc := range []struct {
+		name string
+		opts []ClientOpts
+	}{
+		{name: "default"},
+		{name: "json", opts: []ClientOpts{WithContentTypeCodec("application/json", jsonCodec{})}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			client, cleanup := newTestClient(t, addr, tc.opts...)
+			defer cleanup()
+
+			var resp internal.EchoPayload
+			if err := client.Call(ctx, serviceName, "Echo", &internal.TestPayload{Foo: tc.name}, &resp); err != nil {
+				t.Fatal(err)
+			}
+			if resp.Msg != tc.name {
+				t.Fatalf("unexpected response: %q != %q", resp.Msg, tc.name)
+			}
+		})
+	}
+
+	client, cleanup := newTestClient(t, addr, WithContentTypeCodec("application/unknown", jsonCodec{}))
+	defer cleanup()
+
+	var resp internal.EchoPayload
+	err := client.Call(ctx, serviceName, "Echo", &internal.TestPayload{Foo: "unknown"}, &resp)
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected InvalidArgument for unknown content type, got %v", err)
+	}
+}
+
+func TestRawMessage(t *testing.T) {
+	var (
+		ctx             = context.Background()
+		server          = mustServer(t)(NewServer())
+		addr, listener  = newTestListener(t)
+		client, cleanup = newTestClient(t, addr)
+	)
+	defer listener.Close()
+	defer cleanup()
+
+	server.RegisterService(serviceName, &ServiceDesc{
+		Methods: map[string]Method{
+			"Proxy": func(_ context.Context, unmarshal func(interface{}) error) (interface{}, error) {
+				var req RawMessage
+				if err := unmarshal(&req); err != nil {
+					return nil, err
+				}
+				return req, nil
+			},
+		},
+	})
+
+	go server.Serve(ctx, listener)
+	defer server.Shutdown(ctx)
+
+	// A typed request proxied verbatim is received as the same typed message.
+	var resp internal.TestPayload
+	if err := client.Call(ctx, serviceName, "Proxy", &internal.TestPayload{Foo: "typed"}, &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Foo != "typed" {
+		t.Fatalf("unexpected response: %q", resp.Foo)
+	}
+
+	// Raw bytes are sent and received without decoding.
+	encoded, err := proto.Marshal(&internal.TestPayload{Foo: "raw"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var raw RawMessage
+	if err := client.Call(ctx, serviceName, "Proxy", RawMessage(encoded), &raw); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(raw, encoded) {
+		t.Fatalf("unexpected raw response: %x != %x", raw, encoded)
+	}
+}
+
+func TestDeterministicMarshal(t *testing.T) {
+	fields := make(map[string]interface{})
+	for i := 0; i < 64; i++ {
+		fields[fmt.Sprintf("key%d", i)] = i
+	}
+	msg, err := structpb.NewStruct(fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected, err := proto.MarshalOptions{Deterministic: true}.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr, listener := newTestListener(t)
+	defer listener.Close()
+	client, cleanup := newTestClient(t, addr, WithDeterministicMarshal())
+	defer cleanup()
+	server := mustServer(t)(NewServer(WithServerDeterministicMarshal()))
+	for _, c := range []Codec{client.codec, server.config.codec} {
+		for i := 0; i < 10; i++ {
+			p, err := c.Marshal(msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(p, expected) {
+				t.Fatal("message was not marshaled deterministically")
+			}
+		}
+	}
+}
+
+// gogoPayload marshals itself like messages generated by gogo/protobuf, with
+// the encoding of internal.TestPayload.
+type gogoPayload struct {
+	Foo string
+}
+
+func (m *gogoPayload) Reset() {
+	*m = gogoPayload{}
+}
+
+func (m *gogoPayload) Marshal() ([]byte, error) {
+	return proto.Marshal(&internal.TestPayload{Foo: m.Foo})
+}
+
+func (m *gogoPayload) Unmarshal(p []byte) error {
+	var v internal.TestPayload
+	if err := proto.Unmarshal(p, &v); err != nil {
+		return err
+	}
+	// merge like generated code does
+	m.Foo += v.Foo
+	return nil
+}
+
+// legacyPayload is a message in the style of github.com/golang/protobuf, with
+// the encoding of internal.TestPayload.
+type legacyPayload struct {
+	Foo string `protobuf:"bytes,1,opt,name=foo,proto3"`
+}
+
+func (m *legacyPayload) Reset()         { *m = legacyPayload{} }
+func (m *legacyPayload) String() string { return m.Foo }
+func (*legacyPayload) ProtoMessage()    {}
+
+func TestCodecMessageKinds(t *testing.T) {
+	var (
+		ctx            = context.Background()
+		server         = mustServer(t)(NewServer())
+		addr, listener = newTestListener(t)
+	)
+	defer listener.Close()
+
+	server.RegisterMethod(serviceName, "Gogo", func(_ context.Context, unmarshal func(interface{}) error) (interface{}, error) {
+		var req gogoPayload
+		if err := unmarshal(&req); err != nil {
+			return nil, err
+		}
+		return &legacyPayload{Foo: req.Foo + " gogo"}, nil
+	})
+	server.RegisterMethod(serviceName, "Legacy", func(_ context.Context, unmarshal func(interface{}) error) (interface{}, error) {
+		var req legacyPayload
+		if err := unmarshal(&req); err != nil {
+			return nil, err
+		}
+		return &internal.TestPayload{Foo: req.Foo + " legacy"}, nil
+	})
+
+	go server.Serve(ctx, listener)
+	defer server.Shutdown(ctx)
+
+	client, cleanup := newTestClient(t, addr)
+	defer cleanup()
+
+	var legacy legacyPayload
+	if err := client.Call(ctx, serviceName, "Gogo", &internal.TestPayload{Foo: "v2"}, &legacy); err != nil {
+		t.Fatal(err)
+	}
+	if legacy.Foo != "v2 gogo" {
+		t.Fatalf("unexpected response %q", legacy.Foo)
+	}
+
+	// unmarshaling replaces the content of gogo messages
+	gogo := gogoPayload{Foo: "stale"}
+	if err := client.Call(ctx, serviceName, "Legacy", &gogoPayload{Foo: "gogo"}, &gogo); err != nil {
+		t.Fatal(err)
+	}
+	if gogo.Foo != "gogo legacy" {
+		t.Fatalf("unexpected response %q", gogo.Foo)
+	}
+
+	if _, err := (codec{}).Marshal(struct{}{}); err == nil {
+		t.Fatal("expected error marshaling a non-message")
+	}
+	if err := (codec{}).Unmarshal(nil, &struct{}{}); err == nil {
+		t.Fatal("expected error unmarshaling into a non-message")
+	}
+}
+
+// bytesCodec passes byte slices through verbatim.
+type bytesCodec struct{}
+
+func (bytesCodec) Marshal(msg interface{}) ([]byte, error) {
+	if p, ok := msg.([]byte); ok {
+		return p, nil
+	}
+	return nil, fmt.Errorf("cannot marshal %T", msg)
+}
+
+func (bytesCodec) Unmarshal(p []byte, msg interface{}) error {
+	if v, ok := msg.(*[]byte); ok {
+		*v = append((*v)[:0], p...)
+		return nil
+	}
+	return fmt.Errorf("cannot unmarshal into %T", msg)
+}
+
+func TestCallCodec(t *testing.T) {
+	var (
+		ctx             = context.Background()
+		server          = mustServer(t)(NewServer())
+		addr, listener  = newTestListener(t)
+		client, cleanup = newTestClient(t, addr)
+		local           = NewLocalClient(server)
+	)
+	defer listener.Close()
+	defer cleanup()
+
+	registerTestingService(server, &testingServer{})
+	server.RegisterService("echoService", &ServiceDesc{
+		Streams: map[string]Stream{
+			"Echo": {
+				Handler: func(_ context.Context, ss StreamServer) (interface{}, error) {
+					var req internal.EchoPayload
+					if err := ss.RecvMsg(&req); err != nil {
+						return nil, err
+					}
+					return nil, ss.SendMsg(&req)
+				},
+				StreamingClient: true,
+				StreamingServer: true,
+			},
+		},
+	})
+
+	go server.Serve(ctx, listener)
+	defer server.Shutdown(ctx)
+
+	req, err := proto.Marshal(&internal.TestPayload{Foo: "foo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, call := range []func(ctx context.Context, service, method string, req, resp interface{}, opts ...CallOption) error{
+		client.Call,
+		local.Call,
+	} {
+		var p []byte
+		if err := call(ctx, serviceName, "Test", req, &p, WithCallCodec(bytesCodec{})); err != nil {
+			t.Fatal(err)
+		}
+		var resp internal.TestPayload
+		if err := proto.Unmarshal(p, &resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.Foo != "foofoo" {
+			t.Fatalf("unexpected response %q", resp.Foo)
+		}
+
+		// the next calls use the codec of the client again
+		if err := call(ctx, serviceName, "Test", &internal.TestPayload{Foo: "bar"}, &resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.Foo != "barbar" {
+			t.Fatalf("unexpected response %q", resp.Foo)
+		}
+	}
+
+	for _, newStream := range []func(ctx context.Context, desc *StreamDesc, service, method string, req interface{}, opts ...CallOption) (ClientStream, error){
+		client.NewStream,
+		local.NewStream,
+	} {
+		stream, err := newStream(ctx, &StreamDesc{true, true}, "echoService", "Echo", nil, WithCallCodec(bytesCodec{}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg, err := proto.Marshal(&internal.EchoPayload{Seq: 1, Msg: "echo"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := stream.SendMsg(msg); err != nil {
+			t.Fatal(err)
+		}
+		var p []byte
+		if err := stream.RecvMsg(&p); err != nil {
+			t.Fatal(err)
+		}
+		var resp internal.EchoPayload
+		if err := proto.Unmarshal(p, &resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.Msg != "echo" {
+			t.Fatalf("unexpected stream message %v", &resp)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ttrpc
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+)
+
+// Compressor compresses the data of request, response and data messages.
+// Compression is negotiated when a client connects, by the name of the
+// compressor, so both peers must be configured with a compressor of the same
+// name, see WithCompression and WithServerCompression.
+type Compressor interface {
+	// Name identifies the compression algorithm, such as "gzip".
+	Name() string
+	// Compress returns a writer compressing the data written to it into w.
+	// Closing the writer flushes the compressed data.
+	Compress(w io.Writer) (io.WriteCloser, error)
+	// Decompress returns a reader of the data decompressed from r.
+	Decompress(r io.Reader) (io.Reader, error)
+}
+
+type gzipCompressor struct{}
+
+// NewGzipCompressor returns a Compressor named "gzip", compressing with the
+// default level of compress/gzip.
+func NewGzipCompressor() Compressor {
+	return gzipCompressor{}
+}
+
+func (gzipCompressor) Name() string {
+	return "gzip"
+}
+
+func (gzipCompressor) Compress(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriter(w), nil
+}
+
+func (gzipCompressor) Decompress(r io.Reader) (io.Reader, error) {
+	return gzip.NewReader(r)
+}
+
+// compress compresses p with compressor.
+func compress(compressor Compressor, p []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := compressor.Compress(&buf)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(p); err != nil {
+		w.Close()
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decompress decompresses p with compressor into a buffer obtained from
+// getmbuf, failing with an *OversizedMessageErr when the decompressed data is
+// larger than max.
+func (ch *channel) decompress(compressor Compressor, p []byte, max int) ([]byte, error) {
+	r, err := compressor.Decompress(bytes.NewReader(p))
+	if err != nil {
+		return nil, err
+	}
+	// read one byte more than allowed to detect oversized data without
+	// decompressing all of it
+	d, err := io.ReadAll(io.LimitReader(r, int64(max)+1))
+	if err != nil {
+		return nil, err
+	}
+	if err := oversizedMessageError(len(d), max); err != nil {
+		return nil, err
+	}
+	b := ch.getmbuf(len(d))
+	copy(b, d)
+	return b, nil
+}
+
+// compressible tells whether messages of type t may be compressed.
+func compressible(t messageType) bool {
+	return t == messageTypeRequest || t == messageTypeResponse || t == messageTypeData
+}
@@ -0,0 +1,164 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ttrpc
+
+import (
+	"context"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/containerd/ttrpc/internal"
+)
+
+// compressedFrames counts the compressed frames of each type passed to its
+// tracer.
+type compressedFrames struct {
+	requests, responses atomic.Int32
+	accepted            atomic.Bool
+}
+
+func (f *compressedFrames) trace(dir Direction, h FrameHeader) {
+	if dir != FrameReceived {
+		return
+	}
+	switch messageType(h.Type) {
+	case messageTypeCompression:
+		f.accepted.Store(h.Length > 0)
+	case messageTypeRequest:
+		if h.Flags&flagCompressed != 0 {
+			f.requests.Add(1)
+		}
+	case messageTypeResponse:
+		if h.Flags&flagCompressed != 0 {
+			f.responses.Add(1)
+		}
+	}
+}
+
+func TestCompression(t *testing.T) {
+	var (
+		ctx             = context.Background()
+		serverFrames    = &compressedFrames{}
+		clientFrames    = &compressedFrames{}
+		server          = mustServer(t)(NewServer(WithServerCompression(NewGzipCompressor()), WithServerFrameTracer(serverFrames.trace)))
+		addr, listener  = newTestListener(t)
+		client, cleanup = newTestClient(t, addr, WithCompression(NewGzipCompressor()), WithFrameTracer(clientFrames.trace))
+	)
+	defer listener.Close()
+	defer cleanup()
+
+	registerTestingService(server, &testingServer{})
+	go server.Serve(ctx, listener)
+	defer server.Shutdown(ctx)
+
+	waitFor(t, clientFrames.accepted.Load)
+
+	foo := strings.Repeat("compressible ", 1000)
+	var resp internal.TestPayload
+	if err := client.Call(ctx, serviceName, "Test", &internal.TestPayload{Foo: foo}, &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Foo != foo+foo {
+		t.Fatal("unexpected response")
+	}
+	if serverFrames.requests.Load() != 1 || clientFrames.responses.Load() != 1 {
+		t.Fatalf("expected a compressed request and response, got %d and %d", serverFrames.requests.Load(), clientFrames.responses.Load())
+	}
+}
+
+func TestCompressionNotSupported(t *testing.T) {
+	var (
+		ctx             = context.Background()
+		clientFrames    = &compressedFrames{}
+		server          = mustServer(t)(NewServer())
+		addr, listener  = newTestListener(t)
+		client, cleanup = newTestClient(t, addr, WithCompression(NewGzipCompressor()), WithFrameTracer(clientFrames.trace))
+	)
+	defer listener.Close()
+	defer cleanup()
+
+	registerTestingService(server, &testingServer{})
+	go server.Serve(ctx, listener)
+	defer server.Shutdown(ctx)
+
+	for i := 0; i < 3; i++ {
+		var resp internal.TestPayload
+		if err := client.Call(ctx, serviceName, "Test", &internal.TestPayload{Foo: "foo"}, &resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.Foo != "foofoo" {
+			t.Fatalf("unexpected response %q", resp.Foo)
+		}
+	}
+	if clientFrames.accepted.Load() || clientFrames.responses.Load() != 0 {
+		t.Fatal("expected the server to decline compression")
+	}
+}
+
+func TestCompressMinSize(t *testing.T) {
+	var (
+		ctx          = context.Background()
+		serverFrames = &compressedFrames{}
+		clientFrames = &compressedFrames{}
+		server       = mustServer(t)(NewServer(
+			WithServerCompression(NewGzipCompressor()),
+			WithServerCompressMinSize(1024),
+			WithServerFrameTracer(serverFrames.trace),
+		))
+		addr, listener  = newTestListener(t)
+		client, cleanup = newTestClient(t, addr,
+			WithCompression(NewGzipCompressor()),
+			WithCompressMinSize(1024),
+			WithFrameTracer(clientFrames.trace),
+		)
+	)
+	defer listener.Close()
+	defer cleanup()
+
+	registerTestingService(server, &testingServer{})
+	go server.Serve(ctx, listener)
+	defer server.Shutdown(ctx)
+
+	waitFor(t, clientFrames.accepted.Load)
+
+	// the request is under the threshold while the doubled response is not
+	foo := strings.Repeat("a", 600)
+	var resp internal.TestPayload
+	if err := client.Call(ctx, serviceName, "Test", &internal.TestPayload{Foo: foo}, &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Foo != foo+foo {
+		t.Fatal("unexpected response")
+	}
+	if serverFrames.requests.Load() != 0 || clientFrames.responses.Load() != 1 {
+		t.Fatalf("expected only the response to be compressed, got %d compressed requests and %d responses", serverFrames.requests.Load(), clientFrames.responses.Load())
+	}
+
+	// small and large messages are mixed on the connection
+	for _, foo := range []string{"small", strings.Repeat("large", 300)} {
+		if err := client.Call(ctx, serviceName, "Test", &internal.TestPayload{Foo: foo}, &resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.Foo != foo+foo {
+			t.Fatal("unexpected response")
+		}
+	}
+	if serverFrames.requests.Load() != 1 || clientFrames.responses.Load() != 2 {
+		t.Fatalf("unexpected compressed frames, got %d requests and %d responses", serverFrames.requests.Load(), clientFrames.responses.Load())
+	}
+}
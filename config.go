@@ -19,11 +19,49 @@ package ttrpc
 import (
 	"context"
 	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
 )
 
 type serverConfig struct {
-	handshaker  Handshaker
-	interceptor UnaryServerInterceptor
+	handshaker        Handshaker
+	connConfigurer    func(net.Conn) error
+	connWrapper       func(net.Conn) (net.Conn, error)
+	interceptor       UnaryServerInterceptor
+	streamInterceptor StreamServerInterceptor
+	codec             Codec
+	codecs            map[string]Codec
+	decorators        []ContextDecorator
+	errorHandler      func(error, net.Conn)
+	logger            Logger
+	recoverPanics     bool
+	maxRecvMsgSize    int
+	maxSendMsgSize    int
+
+	maxConcurrentStreams int
+	maxConnections       int
+	methodLimits         map[string]int
+	idleTimeout          time.Duration
+	maxAcceptBackoff     time.Duration
+
+	handlerPoolSize  int
+	handlerQueueSize int
+
+	writeBufferSize     int
+	writeCoalesceWindow time.Duration
+	readTimeout         time.Duration
+	writeTimeout        time.Duration
+
+	keepaliveInterval time.Duration
+	keepaliveTimeout  time.Duration
+
+	frameTracer     FrameTracer
+	callObserver    func(CallSummary)
+	acceptVersion   func(string) bool
+	compressors     map[string]Compressor
+	compressMinSize int
 }
 
 // ServerOpt for configuring a ttrpc server
@@ -43,6 +81,413 @@ func WithServerHandshaker(handshaker Handshaker) ServerOpt {
 	}
 }
 
+// WithServerConnConfigurer sets a function called with every accepted
+// connection before its handshake, to tune the underlying socket, for example
+// its buffer sizes. The connection is refused when the function returns an
+// error. It is also called with the connections passed to ServeConn.
+func WithServerConnConfigurer(fn func(net.Conn) error) ServerOpt {
+	return func(c *serverConfig) error {
+		c.connConfigurer = fn
+		return nil
+	}
+}
+
+// WithConnWrapper sets a function called with every accepted connection before
+// its handshake, after the function set with WithServerConnConfigurer, which
+// returns the connection to serve in its place. It allows consuming a PROXY
+// protocol header, or wrapping the connection to account for its traffic. The
+// connection is refused when the function returns an error. It is also called
+// with the connections passed to ServeConn.
+//
+// Like the handshake, the function runs before the next connection is
+// accepted, so it should bound the time it may block reading from the
+// connection, for example with a read deadline.
+//
+// Serve accepts any net.Listener, so limiting connections may also be done by
+// wrapping the listener, for example with netutil.LimitListener.
+func WithConnWrapper(fn func(net.Conn) (net.Conn, error)) ServerOpt {
+	return func(c *serverConfig) error {
+		c.connWrapper = fn
+		return nil
+	}
+}
+
+// WithServerErrorHandler sets a function called whenever the server refuses or
+// drops a connection because of an error, such as a failed handshake, a
+// malformed message or the client going away without closing the connection
+// cleanly. The connection is passed along with the error to identify the
+// client, for example by its remote address, and is already closed or about to
+// be closed.
+//
+// The function may be called concurrently for different connections and must
+// not block.
+func WithServerErrorHandler(fn func(err error, conn net.Conn)) ServerOpt {
+	return func(c *serverConfig) error {
+		c.errorHandler = fn
+		return nil
+	}
+}
+
+// WithServerLogger sets the logger the server logs to. By default the server
+// logs with github.com/containerd/log, using the logger carried by the context
+// passed to Serve.
+func WithServerLogger(logger Logger) ServerOpt {
+	return func(c *serverConfig) error {
+		if logger == nil {
+			return errors.New("logger must not be nil")
+		}
+		c.logger = logger
+		return nil
+	}
+}
+
+// WithServerCodec sets the codec used to marshal and unmarshal request and
+// response payloads. By default payloads are encoded as protobuf.
+func WithServerCodec(codec Codec) ServerOpt {
+	return func(c *serverConfig) error {
+		if codec == nil {
+			return errors.New("codec must not be nil")
+		}
+		c.codec = codec
+		return nil
+	}
+}
+
+// WithServerDeterministicMarshal sets the codec to the default protobuf codec
+// with deterministic marshaling, see WithDeterministicMarshal. It replaces any
+// codec set by previous options.
+func WithServerDeterministicMarshal() ServerOpt {
+	return WithServerCodec(codec{deterministic: true})
+}
+
+// WithServerContentTypeCodec registers a codec for requests carrying the given
+// content type. Requests without a content type use the default codec set by
+// WithServerCodec, while requests with an unregistered content type are
+// rejected with an InvalidArgument status.
+func WithServerContentTypeCodec(contentType string, codec Codec) ServerOpt {
+	return func(c *serverConfig) error {
+		if contentType == "" {
+			return errors.New("content type must not be empty")
+		}
+		if codec == nil {
+			return errors.New("codec must not be nil")
+		}
+		if _, ok := c.codecs[contentType]; ok {
+			return fmt.Errorf("codec for content type %q already registered", contentType)
+		}
+		if c.codecs == nil {
+			c.codecs = make(map[string]Codec)
+		}
+		c.codecs[contentType] = codec
+		return nil
+	}
+}
+
+// WithMaxReceiveMessageSize sets the maximum size in bytes of a message the
+// server will accept. Larger messages are rejected with a ResourceExhausted
+// status. The default is 4MB, non-positive values are ignored like with
+// WithClientMaxReceiveMessageSize.
+func WithMaxReceiveMessageSize(n int) ServerOpt {
+	return func(c *serverConfig) error {
+		if n > 0 {
+			c.maxRecvMsgSize = n
+		}
+		return nil
+	}
+}
+
+// WithServerMaxSendMessageSize sets the maximum size in bytes of a message the
+// server will send. The default is 4MB, non-positive values are ignored like
+// with WithMaxSendMessageSize.
+func WithServerMaxSendMessageSize(n int) ServerOpt {
+	return func(c *serverConfig) error {
+		if n > 0 {
+			c.maxSendMsgSize = n
+		}
+		return nil
+	}
+}
+
+// WithMaxConcurrentStreams limits the number of calls, unary or streaming, a
+// single connection may have in progress at once. Requests beyond the limit are
+// rejected with a ResourceExhausted status. Zero, the default, means no limit.
+func WithMaxConcurrentStreams(n int) ServerOpt {
+	return func(c *serverConfig) error {
+		if n < 0 {
+			return errors.New("maximum concurrent streams must not be negative")
+		}
+		c.maxConcurrentStreams = n
+		return nil
+	}
+}
+
+// WithMethodConcurrencyLimit limits the number of calls of a single method,
+// given by its full name such as "/service/Method", the server handles at once
+// across all connections. Calls beyond the limit are rejected with a
+// ResourceExhausted status carrying a RetryInfo detail, telling clients the
+// call may be retried.
+func WithMethodConcurrencyLimit(method string, n int) ServerOpt {
+	return func(c *serverConfig) error {
+		if n <= 0 {
+			return errors.New("method concurrency limit must be positive")
+		}
+		if !strings.HasPrefix(method, "/") || strings.Count(method, "/") != 2 {
+			return fmt.Errorf("invalid full method name %q", method)
+		}
+		if c.methodLimits == nil {
+			c.methodLimits = make(map[string]int)
+		}
+		c.methodLimits[method] = n
+		return nil
+	}
+}
+
+// WithHandlerPool runs unary handlers on at most size goroutines shared by all
+// connections, rather than on a new goroutine per call. Calls arriving while
+// every worker is busy are queued, see WithHandlerQueueSize, and rejected with
+// a ResourceExhausted status once the queue is full. Streams, which may run
+// for a long time, are always handled on their own goroutine and do not take
+// workers from unary calls.
+func WithHandlerPool(size int) ServerOpt {
+	return func(c *serverConfig) error {
+		if size <= 0 {
+			return errors.New("handler pool size must be positive")
+		}
+		c.handlerPoolSize = size
+		return nil
+	}
+}
+
+// WithHandlerQueueSize sets how many unary calls may wait for a worker of the
+// pool set with WithHandlerPool. It defaults to the size of the pool.
+func WithHandlerQueueSize(n int) ServerOpt {
+	return func(c *serverConfig) error {
+		if n < 0 {
+			return errors.New("handler queue size must not be negative")
+		}
+		c.handlerQueueSize = n
+		return nil
+	}
+}
+
+// WithMaxConnections limits the number of client connections the server keeps
+// open at once. Connections accepted beyond the limit are closed immediately
+// and reported to the handler set with WithServerErrorHandler as
+// ErrTooManyConnections. Zero, the default, means no limit.
+func WithMaxConnections(n int) ServerOpt {
+	return func(c *serverConfig) error {
+		if n < 0 {
+			return errors.New("maximum connections must not be negative")
+		}
+		c.maxConnections = n
+		return nil
+	}
+}
+
+// WithConnectionIdleTimeout closes connections on which nothing was received
+// from the client for the given duration, while no calls are in progress. Zero,
+// the default, keeps idle connections open.
+func WithConnectionIdleTimeout(d time.Duration) ServerOpt {
+	return func(c *serverConfig) error {
+		if d < 0 {
+			return errors.New("connection idle timeout must not be negative")
+		}
+		c.idleTimeout = d
+		return nil
+	}
+}
+
+// WithMaxAcceptBackoff caps the delay the server waits before accepting again
+// after a temporary accept error, such as running out of file descriptors. The
+// delay starts at a millisecond and doubles on every consecutive error, up to
+// d, and is reset by a successful accept. The default cap is one second.
+func WithMaxAcceptBackoff(d time.Duration) ServerOpt {
+	return func(c *serverConfig) error {
+		if d <= 0 {
+			return errors.New("maximum accept backoff must be positive")
+		}
+		c.maxAcceptBackoff = d
+		return nil
+	}
+}
+
+// WithServerWriteBufferSize sets the size in bytes of the buffer used for
+// writing messages to each connection. The default is 4KB.
+func WithServerWriteBufferSize(n int) ServerOpt {
+	return func(c *serverConfig) error {
+		if n <= 0 {
+			return errors.New("write buffer size must be positive")
+		}
+		c.writeBufferSize = n
+		return nil
+	}
+}
+
+// WithServerWriteCoalesceWindow delays writing messages to each connection by
+// up to d so that messages sent in quick succession are written together,
+// reducing the number of syscalls at the cost of latency. Messages are written
+// immediately when d is zero, which is the default.
+func WithServerWriteCoalesceWindow(d time.Duration) ServerOpt {
+	return func(c *serverConfig) error {
+		if d < 0 {
+			return errors.New("write coalesce window must not be negative")
+		}
+		c.writeCoalesceWindow = d
+		return nil
+	}
+}
+
+// WithServerReadTimeout closes a connection when a frame takes longer than d
+// to arrive once its first byte was received, so that a client stalling in the
+// middle of a frame does not hold a connection and its goroutines forever.
+// Connections may stay idle between frames. Zero, the default, disables the
+// timeout.
+func WithServerReadTimeout(d time.Duration) ServerOpt {
+	return func(c *serverConfig) error {
+		if d < 0 {
+			return errors.New("read timeout must not be negative")
+		}
+		c.readTimeout = d
+		return nil
+	}
+}
+
+// WithServerWriteTimeout closes a connection when writing a frame takes longer
+// than d, which happens when the client stops reading. Frames of streams
+// described with NoFrameTimeouts are exempt. Zero, the default, disables the
+// timeout.
+func WithServerWriteTimeout(d time.Duration) ServerOpt {
+	return func(c *serverConfig) error {
+		if d < 0 {
+			return errors.New("write timeout must not be negative")
+		}
+		c.writeTimeout = d
+		return nil
+	}
+}
+
+// WithServerKeepalive enables sending a ping to each client every interval. A
+// connection is closed when a ping is not answered within the timeout.
+func WithServerKeepalive(interval, timeout time.Duration) ServerOpt {
+	return func(c *serverConfig) error {
+		if interval <= 0 || timeout <= 0 {
+			return errors.New("keepalive interval and timeout must be positive")
+		}
+		c.keepaliveInterval = interval
+		c.keepaliveTimeout = timeout
+		return nil
+	}
+}
+
+// WithServerCompression lets clients negotiate compressing the messages of
+// their connection with compressor, see WithCompression. It may be given
+// several times to support different compressors.
+func WithServerCompression(compressor Compressor) ServerOpt {
+	return func(c *serverConfig) error {
+		if compressor == nil {
+			return errors.New("compressor must not be nil")
+		}
+		if c.compressors == nil {
+			c.compressors = make(map[string]Compressor)
+		}
+		c.compressors[compressor.Name()] = compressor
+		return nil
+	}
+}
+
+// WithServerCompressMinSize only compresses the messages the server sends with
+// at least n bytes of data, see WithCompressMinSize. By default all messages
+// are compressed.
+func WithServerCompressMinSize(n int) ServerOpt {
+	return func(c *serverConfig) error {
+		if n < 0 {
+			return errors.New("compression minimum size must not be negative")
+		}
+		c.compressMinSize = n
+		return nil
+	}
+}
+
+// WithServerFrameTracer sets a tracer called with the header of every frame
+// the server sends or receives on any connection, which helps debugging
+// protocol issues.
+func WithServerFrameTracer(tracer FrameTracer) ServerOpt {
+	return func(c *serverConfig) error {
+		c.frameTracer = tracer
+		return nil
+	}
+}
+
+// WithCallObserver sets a function called with a summary of every unary call
+// once its response is written to the connection, whether the call succeeded or
+// failed. It is called from the goroutine writing to the connection, so it must
+// not block.
+func WithCallObserver(fn func(CallSummary)) ServerOpt {
+	return func(c *serverConfig) error {
+		if fn == nil {
+			return errors.New("call observer must not be nil")
+		}
+		c.callObserver = fn
+		return nil
+	}
+}
+
+// WithServerAcceptVersions rejects the calls and streams of clients whose API
+// version, sent with WithClientVersion, is not accepted by accept. Rejected calls
+// fail with codes.FailedPrecondition before being dispatched, the connection is
+// kept. Clients which do not send a version are checked with an empty one.
+// In-process calls made with a LocalClient are not checked.
+func WithServerAcceptVersions(accept func(version string) bool) ServerOpt {
+	return func(c *serverConfig) error {
+		if accept == nil {
+			return errors.New("version predicate must not be nil")
+		}
+		c.acceptVersion = accept
+		return nil
+	}
+}
+
+// WithRequestIDGenerator assigns an ID to every call, available to handlers
+// and interceptors with RequestID and echoed to the client in the response
+// metadata under RequestIDMetadataKey. The ID sent by the client in the request
+// metadata under the same key is used when present, otherwise generate is
+// called. The ID is assigned before any context decorator is called.
+func WithRequestIDGenerator(generate func() string) ServerOpt {
+	return func(c *serverConfig) error {
+		if generate == nil {
+			return errors.New("request ID generator must not be nil")
+		}
+		c.decorators = append([]ContextDecorator{requestIDDecorator(generate)}, c.decorators...)
+		return nil
+	}
+}
+
+// WithContextDecorator adds a decorator which is called with the context of
+// every call before it is dispatched, for example to add request scoped logging
+// fields. The context passed to the decorator already carries the request
+// metadata, and the returned context is passed to the interceptors and the
+// handler. Decorators are called in the order they were added.
+func WithContextDecorator(d ContextDecorator) ServerOpt {
+	return func(c *serverConfig) error {
+		if d == nil {
+			return errors.New("context decorator must not be nil")
+		}
+		c.decorators = append(c.decorators, d)
+		return nil
+	}
+}
+
+// WithPanicRecovery makes the server recover from panics of handlers and
+// interceptors, failing the call with codes.Internal and logging the panic
+// with its stack trace instead of crashing the process. It is disabled by
+// default so that bugs are not masked.
+func WithPanicRecovery() ServerOpt {
+	return func(c *serverConfig) error {
+		c.recoverPanics = true
+		return nil
+	}
+}
+
 // WithUnaryServerInterceptor sets the provided interceptor on the server
 func WithUnaryServerInterceptor(i UnaryServerInterceptor) ServerOpt {
 	return func(c *serverConfig) error {
@@ -84,3 +529,48 @@ func chainUnaryServerInterceptors(info *UnaryServerInfo, method Method, intercep
 			chainUnaryServerInterceptors(info, method, interceptors[1:]))
 	}
 }
+
+// WithStreamServerInterceptor sets the provided stream interceptor on the
+// server. The interceptor is called once for every stream opened, before the
+// handler receives any data.
+func WithStreamServerInterceptor(i StreamServerInterceptor) ServerOpt {
+	return func(c *serverConfig) error {
+		if c.streamInterceptor != nil {
+			return errors.New("only one unchained stream interceptor allowed per server")
+		}
+		c.streamInterceptor = i
+		return nil
+	}
+}
+
+// WithChainStreamServerInterceptor sets the provided chain of server stream
+// interceptors
+func WithChainStreamServerInterceptor(interceptors ...StreamServerInterceptor) ServerOpt {
+	return func(c *serverConfig) error {
+		if len(interceptors) == 0 {
+			return nil
+		}
+		if c.streamInterceptor != nil {
+			interceptors = append([]StreamServerInterceptor{c.streamInterceptor}, interceptors...)
+		}
+		c.streamInterceptor = func(
+			ctx context.Context,
+			ss StreamServer,
+			info *StreamServerInfo,
+			stream StreamHandler) (interface{}, error) {
+			return interceptors[0](ctx, ss, info,
+				chainStreamServerInterceptors(info, stream, interceptors[1:]))
+		}
+		return nil
+	}
+}
+
+func chainStreamServerInterceptors(info *StreamServerInfo, stream StreamHandler, interceptors []StreamServerInterceptor) StreamHandler {
+	if len(interceptors) == 0 {
+		return stream
+	}
+	return func(ctx context.Context, ss StreamServer) (interface{}, error) {
+		return interceptors[0](ctx, ss, info,
+			chainStreamServerInterceptors(info, stream, interceptors[1:]))
+	}
+}
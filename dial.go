@@ -0,0 +1,89 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ttrpc
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// Dial connects to the ttrpc server at address and returns a client for the
+// connection. The context only bounds the connection attempt. The address is
+// one of:
+//
+//   - "unix:///path/to/socket" or a plain path for a unix socket
+//   - "unix+abstract://name" for a unix socket in the abstract namespace,
+//     only available on Linux
+//   - "vsock://cid:port" for a vsock socket, only available on Linux
+func Dial(ctx context.Context, address string, opts ...ClientOpts) (*Client, error) {
+	conn, err := dialAddress(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+	return NewClient(conn, opts...), nil
+}
+
+func dialAddress(ctx context.Context, address string) (net.Conn, error) {
+	scheme, rest, ok := strings.Cut(address, "://")
+	if !ok {
+		return dialUnix(ctx, address)
+	}
+	switch scheme {
+	case "unix":
+		return dialUnix(ctx, rest)
+	case "unix+abstract":
+		if runtime.GOOS != "linux" {
+			return nil, fmt.Errorf("ttrpc: abstract unix sockets are only supported on Linux: %s", address)
+		}
+		// the net package maps a leading @ to the abstract namespace
+		return dialUnix(ctx, "@"+rest)
+	case "vsock":
+		cid, port, err := parseVsockAddress(rest)
+		if err != nil {
+			return nil, fmt.Errorf("ttrpc: invalid vsock address %q: %w", address, err)
+		}
+		return dialVsock(ctx, cid, port)
+	default:
+		return nil, fmt.Errorf("ttrpc: unsupported address scheme %q", scheme)
+	}
+}
+
+func dialUnix(ctx context.Context, path string) (net.Conn, error) {
+	var d net.Dialer
+	return d.DialContext(ctx, "unix", path)
+}
+
+// parseVsockAddress parses a "cid:port" vsock address.
+func parseVsockAddress(s string) (cid, port uint32, err error) {
+	c, p, ok := strings.Cut(s, ":")
+	if !ok {
+		return 0, 0, fmt.Errorf("missing port")
+	}
+	cid64, err := strconv.ParseUint(c, 10, 32)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid cid: %w", err)
+	}
+	port64, err := strconv.ParseUint(p, 10, 32)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid port: %w", err)
+	}
+	return uint32(cid64), uint32(port64), nil
+}
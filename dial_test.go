@@ -0,0 +1,95 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ttrpc
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/containerd/ttrpc/internal"
+)
+
+func TestDial(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "ttrpc.sock")
+
+	addresses := map[string]string{
+		path:             path,
+		"unix://" + path: path,
+	}
+	if runtime.GOOS == "linux" {
+		addresses["unix+abstract://"+t.Name()] = "@" + t.Name()
+	}
+
+	for address, listen := range addresses {
+		t.Run(address, func(t *testing.T) {
+			server := mustServer(t)(NewServer())
+			registerTestingService(server, &testingServer{})
+			listener, err := net.Listen("unix", listen)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer listener.Close()
+			go server.Serve(ctx, listener)
+			defer server.Shutdown(ctx)
+
+			client, err := Dial(ctx, address)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+
+			var resp internal.TestPayload
+			if err := client.Call(ctx, serviceName, "Test", &internal.TestPayload{Foo: "foo"}, &resp); err != nil {
+				t.Fatal(err)
+			}
+			if resp.Foo != "foofoo" {
+				t.Fatalf("unexpected response %q", resp.Foo)
+			}
+		})
+	}
+}
+
+func TestDialErrors(t *testing.T) {
+	ctx := context.Background()
+	for _, address := range []string{
+		filepath.Join(t.TempDir(), "missing.sock"),
+		"tcp://localhost:1234",
+		"vsock://2",
+		"vsock://host:1024",
+	} {
+		if _, err := Dial(ctx, address); err == nil {
+			t.Errorf("expected dialing %q to fail", address)
+		}
+	}
+
+	// nothing listens on the port, the dial fails or times out depending on
+	// the vsock support of the host
+	cctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := Dial(cctx, "vsock://1:54321"); err == nil {
+		t.Error("expected vsock dial to fail")
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Error("vsock dial did not honor the context deadline")
+	}
+}
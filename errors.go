@@ -18,6 +18,7 @@ package ttrpc
 
 import (
 	"errors"
+	"fmt"
 
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
@@ -31,31 +32,89 @@ var (
 	// closed.
 	ErrClosed = errors.New("ttrpc: closed")
 
-	// ErrServerClosed is returned when the Server has closed its connection.
+	// ErrServerClosed is returned by Server.Serve after a call to Shutdown or
+	// Close, telling a graceful stop apart from a listener failure.
 	ErrServerClosed = errors.New("ttrpc: server closed")
 
+	// ErrTooManyConnections is reported to the server error handler for
+	// connections refused because the server reached the limit set with
+	// WithMaxConnections.
+	ErrTooManyConnections = errors.New("ttrpc: too many connections")
+
 	// ErrStreamClosed is when the streaming connection is closed.
 	ErrStreamClosed = errors.New("ttrpc: stream closed")
+
+	// ErrHeaderSent is returned by StreamServer.SendHeader once the header or
+	// a message was already sent on the stream.
+	ErrHeaderSent = errors.New("ttrpc: stream header already sent")
+
+	// ErrStreamIDsExhausted is returned when creating a stream on a connection
+	// which used all of its stream identifiers, after about two billion
+	// streams. Streams must be created on a new connection instead.
+	ErrStreamIDsExhausted = errors.New("ttrpc: stream identifiers of the connection exhausted")
+
+	// ErrReservedMetadataKey is returned by client calls sending metadata
+	// with a key reserved for ttrpc, see ReservedMetadataPrefix.
+	ErrReservedMetadataKey = errors.New("ttrpc: reserved metadata key")
+
+	// ErrGoAway is returned by client methods when the server is shutting
+	// down and no longer accepts new calls on the connection. Calls should be
+	// made on a new connection instead.
+	ErrGoAway = fmt.Errorf("%w: server is going away", ErrClosed)
 )
 
+// contextError is returned by client calls interrupted by their context. It
+// carries the status code matching the context error, codes.Canceled or
+// codes.DeadlineExceeded, while still matching the context error with
+// errors.Is.
+type contextError struct {
+	err error
+}
+
+// fromContextError returns the error reported for a call interrupted by a
+// context with the given error.
+func fromContextError(err error) error {
+	return &contextError{err: err}
+}
+
+func (e *contextError) Error() string {
+	return e.err.Error()
+}
+
+func (e *contextError) Unwrap() error {
+	return e.err
+}
+
+// GRPCStatus returns the status of the error, used by the status package.
+func (e *contextError) GRPCStatus() *status.Status {
+	return status.FromContextError(e.err)
+}
+
 // OversizedMessageErr is used to indicate refusal to send an oversized message.
 // It wraps a ResourceExhausted grpc Status together with the offending message
 // length.
 type OversizedMessageErr struct {
 	messageLength int
+	maximumLength int
 	err           error
 }
 
 // OversizedMessageError returns an OversizedMessageErr error for the given message
-// length if it exceeds the allowed maximum. Otherwise a nil error is returned.
+// length if it exceeds the default allowed maximum. Otherwise a nil error is
+// returned.
 func OversizedMessageError(messageLength int) error {
-	if messageLength <= messageLengthMax {
+	return oversizedMessageError(messageLength, messageLengthMax)
+}
+
+func oversizedMessageError(messageLength, maximumLength int) error {
+	if messageLength <= maximumLength {
 		return nil
 	}
 
 	return &OversizedMessageErr{
 		messageLength: messageLength,
-		err:           status.Errorf(codes.ResourceExhausted, "message length %v exceed maximum message size of %v", messageLength, messageLengthMax),
+		maximumLength: maximumLength,
+		err:           status.Errorf(codes.ResourceExhausted, "message length %v exceed maximum message size of %v", messageLength, maximumLength),
 	}
 }
 
@@ -75,6 +134,35 @@ func (e *OversizedMessageErr) RejectedLength() int {
 }
 
 // MaximumLength retrieves the maximum allowed message length that triggered the error.
-func (*OversizedMessageErr) MaximumLength() int {
-	return messageLengthMax
+func (e *OversizedMessageErr) MaximumLength() int {
+	return e.maximumLength
+}
+
+// NewAppError returns an error carrying an application defined code, along
+// with the domain defining it such as the name of the service, for errors which
+// do not map to a status code. The code and domain are attached as an AppError
+// detail of the status of the error, so they reach clients, which retrieve them
+// with AppErrorFromError. The status code of the error is codes.Unknown.
+func NewAppError(code int32, domain, msg string) error {
+	st, err := status.New(codes.Unknown, msg).WithDetails(&AppError{Code: code, Domain: domain})
+	if err != nil {
+		// only fails when the detail cannot be marshaled
+		return status.Error(codes.Unknown, msg)
+	}
+	return st.Err()
+}
+
+// AppErrorFromError returns the application error code and domain carried by
+// err, as created with NewAppError, or false when err carries none.
+func AppErrorFromError(err error) (*AppError, bool) {
+	st, ok := status.FromError(err)
+	if !ok {
+		return nil, false
+	}
+	for _, detail := range st.Details() {
+		if ae, ok := detail.(*AppError); ok {
+			return ae, true
+		}
+	}
+	return nil, false
 }
@@ -0,0 +1,59 @@
+//go:build !unix
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ttrpc
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+const maxFds = 0
+
+// unixRights is never used, file descriptors can only be passed on unix
+// platforms.
+type unixRights struct{}
+
+func newUnixRights(net.Conn) *unixRights { return nil }
+
+func (r *unixRights) Read([]byte) (int, error) {
+	return 0, errors.New("ttrpc: file descriptors are not supported on this platform")
+}
+
+func (r *unixRights) take(int) ([]int, error) {
+	return nil, errors.New("ttrpc: file descriptors are not supported on this platform")
+}
+
+func (r *unixRights) write([]byte, []int) error {
+	return errors.New("ttrpc: file descriptors are not supported on this platform")
+}
+
+func (r *unixRights) close() {}
+
+func closeFds([]int) {}
+
+type passedFds struct{}
+
+func (f *passedFds) add([]int) {}
+
+func (f *passedFds) take() []int { return nil }
+
+func withSentFds(ctx context.Context) (context.Context, *passedFds) { return ctx, nil }
+
+func receivedFds(context.Context) *passedFds { return nil }
@@ -0,0 +1,216 @@
+//go:build unix
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ttrpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// maxFds is the largest number of file descriptors passed with a message,
+// SCM_MAX_FD on Linux.
+const maxFds = 253
+
+// unixRights reads from a unix socket, collecting the file descriptors passed
+// along the data until they are taken with the message they were sent for.
+type unixRights struct {
+	uc  *net.UnixConn
+	oob []byte
+
+	mu  sync.Mutex
+	fds []int
+}
+
+func newUnixRights(conn net.Conn) *unixRights {
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return nil
+	}
+	return &unixRights{
+		uc:  uc,
+		oob: make([]byte, unix.CmsgSpace(maxFds*4)),
+	}
+}
+
+func (r *unixRights) Read(p []byte) (int, error) {
+	n, oobn, flags, _, err := r.uc.ReadMsgUnix(p, r.oob)
+	if n < 0 {
+		// reported by failed reads
+		n = 0
+	}
+	if oobn > 0 {
+		fds, perr := parseUnixRights(r.oob[:oobn])
+		r.mu.Lock()
+		r.fds = append(r.fds, fds...)
+		r.mu.Unlock()
+		if perr != nil && err == nil {
+			err = perr
+		}
+	}
+	if flags&unix.MSG_CTRUNC != 0 && err == nil {
+		// the descriptors which did not fit were closed, the following
+		// messages would be matched with the wrong ones
+		err = fmt.Errorf("file descriptors were truncated: %w", ErrProtocol)
+	}
+	return n, err
+}
+
+func parseUnixRights(oob []byte) ([]int, error) {
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing socket control message: %w", err)
+	}
+	var fds []int
+	for _, msg := range msgs {
+		if msg.Header.Level != unix.SOL_SOCKET || msg.Header.Type != unix.SCM_RIGHTS {
+			continue
+		}
+		rights, err := unix.ParseUnixRights(&msg)
+		if err != nil {
+			return fds, fmt.Errorf("failed parsing file descriptors: %w", err)
+		}
+		fds = append(fds, rights...)
+	}
+	return fds, nil
+}
+
+// take returns the first n descriptors received.
+func (r *unixRights) take(n int) ([]int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if n > len(r.fds) {
+		return nil, fmt.Errorf("expected %d file descriptors, only %d received: %w", n, len(r.fds), ErrProtocol)
+	}
+	fds := append([]int(nil), r.fds[:n]...)
+	r.fds = r.fds[n:]
+	return fds, nil
+}
+
+// write writes b in a single message passing fds along its first byte.
+func (r *unixRights) write(b []byte, fds []int) error {
+	n, _, err := r.uc.WriteMsgUnix(b, unix.UnixRights(fds...), nil)
+	if err == nil && n < len(b) {
+		_, err = r.uc.Write(b[n:])
+	}
+	return err
+}
+
+// close closes the descriptors which were not taken.
+func (r *unixRights) close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	closeFds(r.fds)
+	r.fds = nil
+}
+
+func closeFds(fds []int) {
+	for _, fd := range fds {
+		unix.Close(fd)
+	}
+}
+
+type (
+	sentFdsKey     struct{}
+	receivedFdsKey struct{}
+)
+
+// passedFds holds file descriptors passed with a call, which are owned by the
+// holder until taken.
+type passedFds struct {
+	mu  sync.Mutex
+	fds []int
+}
+
+func (f *passedFds) add(fds []int) {
+	if f == nil {
+		closeFds(fds)
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.fds = append(f.fds, fds...)
+}
+
+func (f *passedFds) take() []int {
+	if f == nil {
+		return nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	fds := f.fds
+	f.fds = nil
+	return fds
+}
+
+func withSentFds(ctx context.Context) (context.Context, *passedFds) {
+	f := &passedFds{}
+	return context.WithValue(ctx, sentFdsKey{}, f), f
+}
+
+// receivedFds returns the holder of the descriptors received by a client call
+// made with ctx, nil when the caller did not ask for them.
+func receivedFds(ctx context.Context) *passedFds {
+	f, _ := ctx.Value(receivedFdsKey{}).(*passedFds)
+	return f
+}
+
+// SendFds passes fds to the client with the response of the server call in the
+// context, over unix sockets only. The descriptors are owned by the server once
+// passed, it closes them after sending, so callers should pass duplicates of
+// the descriptors they keep using. Like response metadata, they must be set
+// before the handler returns. Clients only receive the descriptors when created
+// with WithFdPassing.
+func SendFds(ctx context.Context, fds []int) error {
+	f, ok := ctx.Value(sentFdsKey{}).(*passedFds)
+	if !ok {
+		return errors.New("ttrpc: file descriptors can only be sent on server calls")
+	}
+	f.add(fds)
+	return nil
+}
+
+// WithFdPassing makes the client receive the file descriptors passed by the
+// server with SendFds, which are otherwise discarded. The connection is then
+// read with recvmsg(2), so it only has an effect on unix sockets.
+func WithFdPassing() ClientOpts {
+	return func(c *Client) {
+		c.channel.acceptFds = true
+		c.channel.setReader(c.conn)
+	}
+}
+
+// WithRecvFds returns a context which collects the file descriptors passed by
+// the server with the responses of the calls made with it, see RecvFds. The
+// client must be created with WithFdPassing, descriptors passed to calls made
+// without such a context are closed.
+func WithRecvFds(ctx context.Context) context.Context {
+	return context.WithValue(ctx, receivedFdsKey{}, &passedFds{})
+}
+
+// RecvFds returns the file descriptors received so far by the calls made with a
+// context from WithRecvFds, in the order they were sent. The caller owns the
+// returned descriptors and must close them, they are only returned once.
+func RecvFds(ctx context.Context) []int {
+	return receivedFds(ctx).take()
+}
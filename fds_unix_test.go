@@ -0,0 +1,122 @@
+//go:build unix
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ttrpc
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/containerd/ttrpc/internal"
+	"golang.org/x/sys/unix"
+)
+
+func TestSendFds(t *testing.T) {
+	var (
+		ctx             = context.Background()
+		server          = mustServer(t)(NewServer())
+		addr, listener  = newTestListener(t)
+		client, cleanup = newTestClient(t, addr, WithFdPassing())
+	)
+	defer listener.Close()
+	defer cleanup()
+
+	server.RegisterService(serviceName, &ServiceDesc{
+		Methods: map[string]Method{
+			"Pipe": func(ctx context.Context, unmarshal func(interface{}) error) (interface{}, error) {
+				var req internal.EchoPayload
+				if err := unmarshal(&req); err != nil {
+					return nil, err
+				}
+				var p [2]int
+				if err := unix.Pipe(p[:]); err != nil {
+					return nil, err
+				}
+				defer unix.Close(p[1])
+				if _, err := unix.Write(p[1], []byte(req.Msg)); err != nil {
+					unix.Close(p[0])
+					return nil, err
+				}
+				// the read end is closed by the server once sent
+				if err := SendFds(ctx, []int{p[0]}); err != nil {
+					unix.Close(p[0])
+					return nil, err
+				}
+				return &req, nil
+			},
+		},
+	})
+
+	go server.Serve(ctx, listener)
+	defer server.Shutdown(ctx)
+
+	if err := SendFds(ctx, []int{0}); err == nil {
+		t.Fatal("expected an error sending file descriptors outside of a server call")
+	}
+
+	plain, plainCleanup := newTestClient(t, addr)
+	defer plainCleanup()
+	cctx := WithRecvFds(ctx)
+	if err := plain.Call(cctx, serviceName, "Pipe", &internal.EchoPayload{Msg: "discarded"}, &internal.EchoPayload{}); err != nil {
+		t.Fatal(err)
+	}
+	if fds := RecvFds(cctx); fds != nil {
+		t.Fatalf("unexpected file descriptors %v received without fd passing", fds)
+	}
+
+	for name, client := range map[string]interface {
+		Call(context.Context, string, string, interface{}, interface{}, ...CallOption) error
+	}{
+		"remote": client,
+		"local":  NewLocalClient(server),
+	} {
+		t.Run(name, func(t *testing.T) {
+			// descriptors nobody asked for are dropped without
+			// affecting the following calls
+			if err := client.Call(ctx, serviceName, "Pipe", &internal.EchoPayload{Msg: "dropped"}, &internal.EchoPayload{}); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, msg := range []string{"first", "second"} {
+				cctx := WithRecvFds(ctx)
+				if err := client.Call(cctx, serviceName, "Pipe", &internal.EchoPayload{Msg: msg}, &internal.EchoPayload{}); err != nil {
+					t.Fatal(err)
+				}
+				fds := RecvFds(cctx)
+				if len(fds) != 1 {
+					t.Fatalf("expected a file descriptor, got %v", fds)
+				}
+				if RecvFds(cctx) != nil {
+					t.Fatal("file descriptors must only be returned once")
+				}
+
+				f := os.NewFile(uintptr(fds[0]), "pipe")
+				b := make([]byte, 64)
+				n, err := f.Read(b)
+				f.Close()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(b[:n]) != msg {
+					t.Fatalf("unexpected data %q read from the passed pipe, expected %q", b[:n], msg)
+				}
+			}
+		})
+	}
+}
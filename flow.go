@@ -0,0 +1,98 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ttrpc
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"sync"
+)
+
+// window tracks the bytes a stream may still send before the receiver has to
+// grant more with a window update. The window may go negative since a single
+// message is always allowed through while any window remains, which avoids
+// deadlocking on messages larger than the whole window.
+type window struct {
+	mu      sync.Mutex
+	avail   int64
+	updated chan struct{}
+}
+
+func newWindow(size uint32) *window {
+	if size == 0 {
+		return nil
+	}
+	return &window{
+		avail:   int64(size),
+		updated: make(chan struct{}, 1),
+	}
+}
+
+// acquire takes n bytes from the window, blocking while the window is
+// exhausted until it is updated, the context is done or closed is closed.
+// A nil window never blocks.
+func (w *window) acquire(ctx context.Context, closed <-chan struct{}, n int) error {
+	if w == nil {
+		return nil
+	}
+	for {
+		w.mu.Lock()
+		if w.avail > 0 {
+			w.avail -= int64(n)
+			w.mu.Unlock()
+			return nil
+		}
+		w.mu.Unlock()
+
+		select {
+		case <-w.updated:
+		case <-ctx.Done():
+			return fromContextError(ctx.Err())
+		case <-closed:
+			return ErrStreamClosed
+		}
+	}
+}
+
+// release returns n bytes to the window as granted by a window update.
+func (w *window) release(n uint32) {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	w.avail += int64(n)
+	w.mu.Unlock()
+
+	select {
+	case w.updated <- struct{}{}:
+	default:
+	}
+}
+
+var errInvalidWindowUpdate = errors.New("ttrpc: invalid window update")
+
+func encodeWindowUpdate(n uint32) []byte {
+	return binary.BigEndian.AppendUint32(nil, n)
+}
+
+func decodeWindowUpdate(p []byte) (uint32, error) {
+	if len(p) != 4 {
+		return 0, errInvalidWindowUpdate
+	}
+	return binary.BigEndian.Uint32(p), nil
+}
@@ -0,0 +1,149 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ttrpc
+
+import (
+	"context"
+	"io"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/containerd/ttrpc/internal"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestStreamFlowControl(t *testing.T) {
+	const messages = 10
+
+	var (
+		ctx            = context.Background()
+		server         = mustServer(t)(NewServer())
+		addr, listener = newTestListener(t)
+		msg            = &internal.EchoPayload{Msg: strings.Repeat("a", 1024)}
+		window         = uint32(2 * proto.Size(msg))
+
+		serverSent atomic.Int32
+		serverRecv = make(chan struct{})
+		serverDone = make(chan error, 1)
+	)
+	defer listener.Close()
+
+	server.RegisterService(serviceName, &ServiceDesc{
+		Streams: map[string]Stream{
+			"Download": {
+				Handler: func(ctx context.Context, ss StreamServer) (interface{}, error) {
+					var req internal.EchoPayload
+					if err := ss.RecvMsg(&req); err != nil {
+						return nil, err
+					}
+					for i := 0; i < messages; i++ {
+						if err := ss.SendMsg(msg); err != nil {
+							return nil, err
+						}
+						serverSent.Add(1)
+					}
+					return nil, nil
+				},
+				StreamingServer: true,
+			},
+			"Upload": {
+				Handler: func(ctx context.Context, ss StreamServer) (interface{}, error) {
+					<-serverRecv
+					for {
+						var req internal.EchoPayload
+						if err := ss.RecvMsg(&req); err != nil {
+							if err == io.EOF {
+								err = nil
+							}
+							serverDone <- err
+							return &internal.EchoPayload{}, err
+						}
+					}
+				},
+				StreamingClient: true,
+			},
+		},
+	})
+
+	go server.Serve(ctx, listener)
+	defer server.Shutdown(ctx)
+
+	client, cleanup := newTestClient(t, addr, WithStreamWindowSize(window))
+	defer cleanup()
+
+	t.Run("ServerSend", func(t *testing.T) {
+		stream, err := client.NewStream(ctx, &StreamDesc{StreamingServer: true}, serviceName, "Download", &internal.EchoPayload{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the server must stop once the window is used up while the client
+		// is not receiving
+		time.Sleep(100 * time.Millisecond)
+		if sent := serverSent.Load(); sent != 2 {
+			t.Fatalf("expected the server to send 2 messages before blocking, sent %d", sent)
+		}
+
+		for i := 0; i < messages; i++ {
+			var resp internal.EchoPayload
+			if err := stream.RecvMsg(&resp); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := stream.RecvMsg(&internal.EchoPayload{}); err != io.EOF {
+			t.Fatalf("expected io.EOF, got %v", err)
+		}
+	})
+
+	t.Run("ClientSend", func(t *testing.T) {
+		stream, err := client.NewStream(ctx, &StreamDesc{StreamingClient: true}, serviceName, "Upload", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var sent atomic.Int32
+		sendErr := make(chan error, 1)
+		go func() {
+			for i := 0; i < messages; i++ {
+				if err := stream.SendMsg(msg); err != nil {
+					sendErr <- err
+					return
+				}
+				sent.Add(1)
+			}
+			sendErr <- stream.CloseSend()
+		}()
+
+		time.Sleep(100 * time.Millisecond)
+		if n := sent.Load(); n != 2 {
+			t.Fatalf("expected the client to send 2 messages before blocking, sent %d", n)
+		}
+
+		close(serverRecv)
+		if err := <-sendErr; err != nil {
+			t.Fatal(err)
+		}
+		if err := <-serverDone; err != nil {
+			t.Fatal(err)
+		}
+		if err := stream.RecvMsg(&internal.EchoPayload{}); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
@@ -31,7 +31,8 @@ type Handshaker interface {
 	// in place of the original connection.
 	//
 	// The second return value can contain credential specific data, such as
-	// unix socket credentials or TLS information.
+	// unix socket credentials or TLS information. The server makes it
+	// available to every call on the connection with ConnectionInfo.
 	//
 	// While we currently only have implementations on the server-side, this
 	// interface should be sufficient to implement similar handshakes on the
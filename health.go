@@ -0,0 +1,234 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ttrpc
+
+import (
+	"context"
+	"sync"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// HealthServiceName is the name of the health service, see health.proto.
+const HealthServiceName = "ttrpc.health.v1.Health"
+
+// HealthServer implements the health service, reporting the serving status
+// of the services of a server to probes. The status of the server as a whole
+// is reported for the empty service name and is SERVING by default.
+type HealthServer struct {
+	mu       sync.Mutex
+	shutdown bool
+	statuses map[string]HealthCheckResponse_ServingStatus
+	watchers map[string]map[chan HealthCheckResponse_ServingStatus]struct{}
+	done     chan struct{}
+}
+
+// NewHealthServer returns a health server, register it with a server using
+// RegisterHealthService.
+func NewHealthServer() *HealthServer {
+	return &HealthServer{
+		statuses: map[string]HealthCheckResponse_ServingStatus{
+			"": HealthCheckResponse_SERVING,
+		},
+		watchers: make(map[string]map[chan HealthCheckResponse_ServingStatus]struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// SetServingStatus sets the serving status of service and notifies the
+// watchers of the service. Updates are ignored once Shutdown is called.
+func (h *HealthServer) SetServingStatus(service string, status HealthCheckResponse_ServingStatus) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.shutdown {
+		return
+	}
+	h.setServingStatus(service, status)
+}
+
+func (h *HealthServer) setServingStatus(service string, status HealthCheckResponse_ServingStatus) {
+	h.statuses[service] = status
+	for ch := range h.watchers[service] {
+		// only the latest status is of interest to a slow watcher
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- status
+	}
+}
+
+// Shutdown sets all services to NOT_SERVING and ends the running watches, so
+// that they don't hold up the shutdown of the server.
+func (h *HealthServer) Shutdown() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.shutdown {
+		return
+	}
+	h.shutdown = true
+	for service := range h.statuses {
+		h.setServingStatus(service, HealthCheckResponse_NOT_SERVING)
+	}
+	close(h.done)
+}
+
+// Check returns the serving status of the requested service, unknown
+// services fail with codes.NotFound.
+func (h *HealthServer) Check(ctx context.Context, req *HealthCheckRequest) (*HealthCheckResponse, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s, ok := h.statuses[req.Service]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "unknown service %q", req.Service)
+	}
+	return &HealthCheckResponse{Status: s}, nil
+}
+
+// Watch sends the serving status of the requested service and then every
+// change to it, until the stream is done or the health server is shut down.
+// Unknown services are reported as SERVICE_UNKNOWN.
+func (h *HealthServer) Watch(ctx context.Context, req *HealthCheckRequest, stream StreamServer) error {
+	ch := make(chan HealthCheckResponse_ServingStatus, 1)
+
+	h.mu.Lock()
+	s, ok := h.statuses[req.Service]
+	if !ok {
+		s = HealthCheckResponse_SERVICE_UNKNOWN
+	}
+	ch <- s
+	watchers := h.watchers[req.Service]
+	if watchers == nil {
+		watchers = make(map[chan HealthCheckResponse_ServingStatus]struct{})
+		h.watchers[req.Service] = watchers
+	}
+	watchers[ch] = struct{}{}
+	h.mu.Unlock()
+
+	defer func() {
+		h.mu.Lock()
+		delete(watchers, ch)
+		if len(watchers) == 0 {
+			delete(h.watchers, req.Service)
+		}
+		h.mu.Unlock()
+	}()
+
+	last := HealthCheckResponse_ServingStatus(-1)
+	for {
+		select {
+		case s := <-ch:
+			if s == last {
+				continue
+			}
+			if err := stream.SendMsg(&HealthCheckResponse{Status: s}); err != nil {
+				return err
+			}
+			last = s
+		case <-h.done:
+			// the final status is queued before done is closed
+			select {
+			case s := <-ch:
+				if s != last {
+					return stream.SendMsg(&HealthCheckResponse{Status: s})
+				}
+			default:
+			}
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// RegisterHealthService registers the health service provided by h with srv.
+func RegisterHealthService(srv *Server, h *HealthServer) {
+	srv.RegisterService(HealthServiceName, &ServiceDesc{
+		Methods: map[string]Method{
+			"Check": func(ctx context.Context, unmarshal func(interface{}) error) (interface{}, error) {
+				var req HealthCheckRequest
+				if err := unmarshal(&req); err != nil {
+					return nil, err
+				}
+				return h.Check(ctx, &req)
+			},
+		},
+		Streams: map[string]Stream{
+			"Watch": {
+				Handler: func(ctx context.Context, stream StreamServer) (interface{}, error) {
+					var req HealthCheckRequest
+					if err := stream.RecvMsg(&req); err != nil {
+						return nil, err
+					}
+					return nil, h.Watch(ctx, &req, stream)
+				},
+				StreamingServer: true,
+			},
+		},
+	})
+}
+
+// HealthClient is a client of the health service.
+type HealthClient struct {
+	client *Client
+}
+
+// NewHealthClient returns a client of the health service served over client.
+func NewHealthClient(client *Client) *HealthClient {
+	return &HealthClient{
+		client: client,
+	}
+}
+
+// Check returns the serving status of the requested service.
+func (c *HealthClient) Check(ctx context.Context, req *HealthCheckRequest) (*HealthCheckResponse, error) {
+	var resp HealthCheckResponse
+	if err := c.client.Call(ctx, HealthServiceName, "Check", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Watch watches the serving status of the requested service.
+func (c *HealthClient) Watch(ctx context.Context, req *HealthCheckRequest) (*HealthWatchClient, error) {
+	stream, err := c.client.NewStream(ctx, &StreamDesc{
+		StreamingServer: true,
+	}, HealthServiceName, "Watch", req)
+	if err != nil {
+		return nil, err
+	}
+	return &HealthWatchClient{stream}, nil
+}
+
+// HealthWatchClient receives the serving statuses sent by Watch.
+type HealthWatchClient struct {
+	ClientStream
+}
+
+// Recv returns the next serving status, io.EOF is returned once the server
+// ended the watch.
+func (x *HealthWatchClient) Recv() (*HealthCheckResponse, error) {
+	m := new(HealthCheckResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
@@ -0,0 +1,108 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ttrpc
+
+import (
+	"context"
+	"io"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestHealthServer(t *testing.T) {
+	var (
+		ctx             = context.Background()
+		server          = mustServer(t)(NewServer())
+		health          = NewHealthServer()
+		addr, listener  = newTestListener(t)
+		client, cleanup = newTestClient(t, addr)
+		healthClient    = NewHealthClient(client)
+	)
+	defer listener.Close()
+	defer cleanup()
+
+	RegisterHealthService(server, health)
+	go server.Serve(ctx, listener)
+	defer server.Shutdown(ctx)
+
+	check := func(t *testing.T, service string, expected HealthCheckResponse_ServingStatus) {
+		t.Helper()
+		resp, err := healthClient.Check(ctx, &HealthCheckRequest{Service: service})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Status != expected {
+			t.Fatalf("expected %v for %q, got %v", expected, service, resp.Status)
+		}
+	}
+	recv := func(t *testing.T, watch *HealthWatchClient, expected HealthCheckResponse_ServingStatus) {
+		t.Helper()
+		resp, err := watch.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Status != expected {
+			t.Fatalf("expected %v, got %v", expected, resp.Status)
+		}
+	}
+
+	check(t, "", HealthCheckResponse_SERVING)
+	if _, err := healthClient.Check(ctx, &HealthCheckRequest{Service: "unknown"}); status.Code(err) != codes.NotFound {
+		t.Fatalf("expected not found error, got %v", err)
+	}
+
+	health.SetServingStatus("service", HealthCheckResponse_NOT_SERVING)
+	check(t, "service", HealthCheckResponse_NOT_SERVING)
+
+	watch, err := healthClient.Watch(ctx, &HealthCheckRequest{Service: "service"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	recv(t, watch, HealthCheckResponse_NOT_SERVING)
+	health.SetServingStatus("service", HealthCheckResponse_SERVING)
+	recv(t, watch, HealthCheckResponse_SERVING)
+	check(t, "service", HealthCheckResponse_SERVING)
+
+	// a separate connection, so that both watches are received independently
+	client2, cleanup2 := newTestClient(t, addr)
+	defer cleanup2()
+	unknown, err := NewHealthClient(client2).Watch(ctx, &HealthCheckRequest{Service: "later"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	recv(t, unknown, HealthCheckResponse_SERVICE_UNKNOWN)
+	health.SetServingStatus("later", HealthCheckResponse_SERVING)
+	recv(t, unknown, HealthCheckResponse_SERVING)
+
+	// shutting down ends the watches
+	health.Shutdown()
+	recv(t, watch, HealthCheckResponse_NOT_SERVING)
+	if _, err := watch.Recv(); err != io.EOF {
+		t.Fatalf("expected io.EOF, got %v", err)
+	}
+	recv(t, unknown, HealthCheckResponse_NOT_SERVING)
+	if _, err := unknown.Recv(); err != io.EOF {
+		t.Fatalf("expected io.EOF, got %v", err)
+	}
+	check(t, "", HealthCheckResponse_NOT_SERVING)
+
+	// updates are ignored once shut down
+	health.SetServingStatus("", HealthCheckResponse_SERVING)
+	check(t, "", HealthCheckResponse_NOT_SERVING)
+}
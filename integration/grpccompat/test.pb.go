@@ -0,0 +1,195 @@
+//
+//Copyright The containerd Authors.
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//http://www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.28.1
+// 	protoc        v3.20.1
+// source: github.com/containerd/ttrpc/integration/grpccompat/test.proto
+
+package grpccompat
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type Payload struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Msg string `protobuf:"bytes,1,opt,name=msg,proto3" json:"msg,omitempty"`
+}
+
+func (x *Payload) Reset() {
+	*x = Payload{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_github_com_containerd_ttrpc_integration_grpccompat_test_proto_msgTypes[0]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *Payload) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Payload) ProtoMessage() {}
+
+func (x *Payload) ProtoReflect() protoreflect.Message {
+	mi := &file_github_com_containerd_ttrpc_integration_grpccompat_test_proto_msgTypes[0]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Payload.ProtoReflect.Descriptor instead.
+func (*Payload) Descriptor() ([]byte, []int) {
+	return file_github_com_containerd_ttrpc_integration_grpccompat_test_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *Payload) GetMsg() string {
+	if x != nil {
+		return x.Msg
+	}
+	return ""
+}
+
+var File_github_com_containerd_ttrpc_integration_grpccompat_test_proto protoreflect.FileDescriptor
+
+var file_github_com_containerd_ttrpc_integration_grpccompat_test_proto_rawDesc = []byte{
+	0x0a, 0x3d, 0x67, 0x69, 0x74, 0x68, 0x75, 0x62, 0x2e, 0x63, 0x6f, 0x6d, 0x2f, 0x63, 0x6f, 0x6e,
+	0x74, 0x61, 0x69, 0x6e, 0x65, 0x72, 0x64, 0x2f, 0x74, 0x74, 0x72, 0x70, 0x63, 0x2f, 0x69, 0x6e,
+	0x74, 0x65, 0x67, 0x72, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x2f, 0x67, 0x72, 0x70, 0x63, 0x63, 0x6f,
+	0x6d, 0x70, 0x61, 0x74, 0x2f, 0x74, 0x65, 0x73, 0x74, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x12,
+	0x1c, 0x74, 0x74, 0x72, 0x70, 0x63, 0x2e, 0x69, 0x6e, 0x74, 0x65, 0x67, 0x72, 0x61, 0x74, 0x69,
+	0x6f, 0x6e, 0x2e, 0x67, 0x72, 0x70, 0x63, 0x63, 0x6f, 0x6d, 0x70, 0x61, 0x74, 0x22, 0x1b, 0x0a,
+	0x07, 0x50, 0x61, 0x79, 0x6c, 0x6f, 0x61, 0x64, 0x12, 0x10, 0x0a, 0x03, 0x6d, 0x73, 0x67, 0x18,
+	0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x03, 0x6d, 0x73, 0x67, 0x32, 0xef, 0x02, 0x0a, 0x06, 0x43,
+	0x6f, 0x6d, 0x70, 0x61, 0x74, 0x12, 0x54, 0x0a, 0x04, 0x45, 0x63, 0x68, 0x6f, 0x12, 0x25, 0x2e,
+	0x74, 0x74, 0x72, 0x70, 0x63, 0x2e, 0x69, 0x6e, 0x74, 0x65, 0x67, 0x72, 0x61, 0x74, 0x69, 0x6f,
+	0x6e, 0x2e, 0x67, 0x72, 0x70, 0x63, 0x63, 0x6f, 0x6d, 0x70, 0x61, 0x74, 0x2e, 0x50, 0x61, 0x79,
+	0x6c, 0x6f, 0x61, 0x64, 0x1a, 0x25, 0x2e, 0x74, 0x74, 0x72, 0x70, 0x63, 0x2e, 0x69, 0x6e, 0x74,
+	0x65, 0x67, 0x72, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x2e, 0x67, 0x72, 0x70, 0x63, 0x63, 0x6f, 0x6d,
+	0x70, 0x61, 0x74, 0x2e, 0x50, 0x61, 0x79, 0x6c, 0x6f, 0x61, 0x64, 0x12, 0x5e, 0x0a, 0x0a, 0x45,
+	0x63, 0x68, 0x6f, 0x53, 0x74, 0x72, 0x65, 0x61, 0x6d, 0x12, 0x25, 0x2e, 0x74, 0x74, 0x72, 0x70,
+	0x63, 0x2e, 0x69, 0x6e, 0x74, 0x65, 0x67, 0x72, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x2e, 0x67, 0x72,
+	0x70, 0x63, 0x63, 0x6f, 0x6d, 0x70, 0x61, 0x74, 0x2e, 0x50, 0x61, 0x79, 0x6c, 0x6f, 0x61, 0x64,
+	0x1a, 0x25, 0x2e, 0x74, 0x74, 0x72, 0x70, 0x63, 0x2e, 0x69, 0x6e, 0x74, 0x65, 0x67, 0x72, 0x61,
+	0x74, 0x69, 0x6f, 0x6e, 0x2e, 0x67, 0x72, 0x70, 0x63, 0x63, 0x6f, 0x6d, 0x70, 0x61, 0x74, 0x2e,
+	0x50, 0x61, 0x79, 0x6c, 0x6f, 0x61, 0x64, 0x28, 0x01, 0x30, 0x01, 0x12, 0x56, 0x0a, 0x04, 0x4a,
+	0x6f, 0x69, 0x6e, 0x12, 0x25, 0x2e, 0x74, 0x74, 0x72, 0x70, 0x63, 0x2e, 0x69, 0x6e, 0x74, 0x65,
+	0x67, 0x72, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x2e, 0x67, 0x72, 0x70, 0x63, 0x63, 0x6f, 0x6d, 0x70,
+	0x61, 0x74, 0x2e, 0x50, 0x61, 0x79, 0x6c, 0x6f, 0x61, 0x64, 0x1a, 0x25, 0x2e, 0x74, 0x74, 0x72,
+	0x70, 0x63, 0x2e, 0x69, 0x6e, 0x74, 0x65, 0x67, 0x72, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x2e, 0x67,
+	0x72, 0x70, 0x63, 0x63, 0x6f, 0x6d, 0x70, 0x61, 0x74, 0x2e, 0x50, 0x61, 0x79, 0x6c, 0x6f, 0x61,
+	0x64, 0x28, 0x01, 0x12, 0x57, 0x0a, 0x05, 0x53, 0x70, 0x6c, 0x69, 0x74, 0x12, 0x25, 0x2e, 0x74,
+	0x74, 0x72, 0x70, 0x63, 0x2e, 0x69, 0x6e, 0x74, 0x65, 0x67, 0x72, 0x61, 0x74, 0x69, 0x6f, 0x6e,
+	0x2e, 0x67, 0x72, 0x70, 0x63, 0x63, 0x6f, 0x6d, 0x70, 0x61, 0x74, 0x2e, 0x50, 0x61, 0x79, 0x6c,
+	0x6f, 0x61, 0x64, 0x1a, 0x25, 0x2e, 0x74, 0x74, 0x72, 0x70, 0x63, 0x2e, 0x69, 0x6e, 0x74, 0x65,
+	0x67, 0x72, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x2e, 0x67, 0x72, 0x70, 0x63, 0x63, 0x6f, 0x6d, 0x70,
+	0x61, 0x74, 0x2e, 0x50, 0x61, 0x79, 0x6c, 0x6f, 0x61, 0x64, 0x30, 0x01, 0x42, 0x3f, 0x5a, 0x3d,
+	0x67, 0x69, 0x74, 0x68, 0x75, 0x62, 0x2e, 0x63, 0x6f, 0x6d, 0x2f, 0x63, 0x6f, 0x6e, 0x74, 0x61,
+	0x69, 0x6e, 0x65, 0x72, 0x64, 0x2f, 0x74, 0x74, 0x72, 0x70, 0x63, 0x2f, 0x69, 0x6e, 0x74, 0x65,
+	0x67, 0x72, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x2f, 0x67, 0x72, 0x70, 0x63, 0x63, 0x6f, 0x6d, 0x70,
+	0x61, 0x74, 0x3b, 0x67, 0x72, 0x70, 0x63, 0x63, 0x6f, 0x6d, 0x70, 0x61, 0x74, 0x62, 0x06, 0x70,
+	0x72, 0x6f, 0x74, 0x6f, 0x33,
+}
+
+var (
+	file_github_com_containerd_ttrpc_integration_grpccompat_test_proto_rawDescOnce sync.Once
+	file_github_com_containerd_ttrpc_integration_grpccompat_test_proto_rawDescData = file_github_com_containerd_ttrpc_integration_grpccompat_test_proto_rawDesc
+)
+
+func file_github_com_containerd_ttrpc_integration_grpccompat_test_proto_rawDescGZIP() []byte {
+	file_github_com_containerd_ttrpc_integration_grpccompat_test_proto_rawDescOnce.Do(func() {
+		file_github_com_containerd_ttrpc_integration_grpccompat_test_proto_rawDescData = protoimpl.X.CompressGZIP(file_github_com_containerd_ttrpc_integration_grpccompat_test_proto_rawDescData)
+	})
+	return file_github_com_containerd_ttrpc_integration_grpccompat_test_proto_rawDescData
+}
+
+var file_github_com_containerd_ttrpc_integration_grpccompat_test_proto_msgTypes = make([]protoimpl.MessageInfo, 1)
+var file_github_com_containerd_ttrpc_integration_grpccompat_test_proto_goTypes = []interface{}{
+	(*Payload)(nil), // 0: ttrpc.integration.grpccompat.Payload
+}
+var file_github_com_containerd_ttrpc_integration_grpccompat_test_proto_depIdxs = []int32{
+	0, // 0: ttrpc.integration.grpccompat.Compat.Echo:input_type -> ttrpc.integration.grpccompat.Payload
+	0, // 1: ttrpc.integration.grpccompat.Compat.EchoStream:input_type -> ttrpc.integration.grpccompat.Payload
+	0, // 2: ttrpc.integration.grpccompat.Compat.Join:input_type -> ttrpc.integration.grpccompat.Payload
+	0, // 3: ttrpc.integration.grpccompat.Compat.Split:input_type -> ttrpc.integration.grpccompat.Payload
+	0, // 4: ttrpc.integration.grpccompat.Compat.Echo:output_type -> ttrpc.integration.grpccompat.Payload
+	0, // 5: ttrpc.integration.grpccompat.Compat.EchoStream:output_type -> ttrpc.integration.grpccompat.Payload
+	0, // 6: ttrpc.integration.grpccompat.Compat.Join:output_type -> ttrpc.integration.grpccompat.Payload
+	0, // 7: ttrpc.integration.grpccompat.Compat.Split:output_type -> ttrpc.integration.grpccompat.Payload
+	4, // [4:8] is the sub-list for method output_type
+	0, // [0:4] is the sub-list for method input_type
+	0, // [0:0] is the sub-list for extension type_name
+	0, // [0:0] is the sub-list for extension extendee
+	0, // [0:0] is the sub-list for field type_name
+}
+
+func init() { file_github_com_containerd_ttrpc_integration_grpccompat_test_proto_init() }
+func file_github_com_containerd_ttrpc_integration_grpccompat_test_proto_init() {
+	if File_github_com_containerd_ttrpc_integration_grpccompat_test_proto != nil {
+		return
+	}
+	if !protoimpl.UnsafeEnabled {
+		file_github_com_containerd_ttrpc_integration_grpccompat_test_proto_msgTypes[0].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*Payload); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: file_github_com_containerd_ttrpc_integration_grpccompat_test_proto_rawDesc,
+			NumEnums:      0,
+			NumMessages:   1,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_github_com_containerd_ttrpc_integration_grpccompat_test_proto_goTypes,
+		DependencyIndexes: file_github_com_containerd_ttrpc_integration_grpccompat_test_proto_depIdxs,
+		MessageInfos:      file_github_com_containerd_ttrpc_integration_grpccompat_test_proto_msgTypes,
+	}.Build()
+	File_github_com_containerd_ttrpc_integration_grpccompat_test_proto = out.File
+	file_github_com_containerd_ttrpc_integration_grpccompat_test_proto_rawDesc = nil
+	file_github_com_containerd_ttrpc_integration_grpccompat_test_proto_goTypes = nil
+	file_github_com_containerd_ttrpc_integration_grpccompat_test_proto_depIdxs = nil
+}
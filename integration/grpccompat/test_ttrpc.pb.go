@@ -0,0 +1,456 @@
+// Code generated by protoc-gen-go-ttrpc. DO NOT EDIT.
+// source: github.com/containerd/ttrpc/integration/grpccompat/test.proto
+package grpccompat
+
+import (
+	context "context"
+	ttrpc "github.com/containerd/ttrpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+const (
+	CompatServiceName                   = "ttrpc.integration.grpccompat.Compat"
+	CompatService_Echo_FullMethod       = "/ttrpc.integration.grpccompat.Compat/Echo"
+	CompatService_EchoStream_FullMethod = "/ttrpc.integration.grpccompat.Compat/EchoStream"
+	CompatService_Join_FullMethod       = "/ttrpc.integration.grpccompat.Compat/Join"
+	CompatService_Split_FullMethod      = "/ttrpc.integration.grpccompat.Compat/Split"
+)
+
+type CompatService interface {
+	Echo(context.Context, *Payload) (*Payload, error)
+	EchoStream(Compat_EchoStreamServer) error
+	Join(Compat_JoinServer) error
+	Split(*Payload, Compat_SplitServer) error
+}
+
+// UnimplementedCompatService can be embedded in implementations of CompatService for
+// forward compatibility, the methods it provides fail with codes.Unimplemented.
+type UnimplementedCompatService struct{}
+
+func (UnimplementedCompatService) Echo(context.Context, *Payload) (*Payload, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Echo not implemented")
+}
+
+func (UnimplementedCompatService) EchoStream(Compat_EchoStreamServer) error {
+	return status.Errorf(codes.Unimplemented, "method EchoStream not implemented")
+}
+
+func (UnimplementedCompatService) Join(Compat_JoinServer) error {
+	return status.Errorf(codes.Unimplemented, "method Join not implemented")
+}
+
+func (UnimplementedCompatService) Split(*Payload, Compat_SplitServer) error {
+	return status.Errorf(codes.Unimplemented, "method Split not implemented")
+}
+
+type Compat_EchoStreamServer interface {
+	Send(*Payload) error
+	Recv() (*Payload, error)
+	// SetHeader merges md into the header metadata, sent with the
+	// first message, by SendHeader or once the service method
+	// returns, whichever comes first.
+	SetHeader(ttrpc.MD) error
+	SendHeader(ttrpc.MD) error
+	SetTrailer(ttrpc.MD)
+	ttrpc.StreamServer
+}
+
+type compatEchoStreamServer struct {
+	ttrpc.StreamServer
+	header     ttrpc.MD
+	headerSent bool
+}
+
+func (x *compatEchoStreamServer) SetHeader(md ttrpc.MD) error {
+	if x.headerSent {
+		return ttrpc.ErrHeaderSent
+	}
+	if x.header == nil {
+		x.header = ttrpc.MD{}
+	}
+	for k, v := range md {
+		x.header.Append(k, v...)
+	}
+	return nil
+}
+
+func (x *compatEchoStreamServer) SendHeader(md ttrpc.MD) error {
+	if err := x.SetHeader(md); err != nil {
+		return err
+	}
+	return x.flushHeader()
+}
+
+func (x *compatEchoStreamServer) flushHeader() error {
+	if x.headerSent {
+		return nil
+	}
+	x.headerSent = true
+	if x.header == nil {
+		return nil
+	}
+	return x.StreamServer.SendHeader(x.header)
+}
+
+func (x *compatEchoStreamServer) SetTrailer(md ttrpc.MD) {
+	ttrpc.SetResponseMetadata(x.Context(), md)
+}
+
+func (x *compatEchoStreamServer) Send(m *Payload) error {
+	if err := x.flushHeader(); err != nil {
+		return err
+	}
+	return x.StreamServer.SendMsg(m)
+}
+
+func (x *compatEchoStreamServer) Recv() (*Payload, error) {
+	m := new(Payload)
+	if err := x.StreamServer.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+type Compat_JoinServer interface {
+	Recv() (*Payload, error)
+	// SendAndClose stores the response of the stream, it is only sent
+	// once the service method returns, and only when the method does
+	// not return a response of its own.
+	SendAndClose(*Payload) error
+	// SetHeader merges md into the header metadata, sent with the
+	// first message, by SendHeader or once the service method
+	// returns, whichever comes first.
+	SetHeader(ttrpc.MD) error
+	SendHeader(ttrpc.MD) error
+	SetTrailer(ttrpc.MD)
+	ttrpc.StreamServer
+}
+
+type compatJoinServer struct {
+	ttrpc.StreamServer
+	resp       *Payload
+	header     ttrpc.MD
+	headerSent bool
+}
+
+func (x *compatJoinServer) SendAndClose(m *Payload) error {
+	if x.resp != nil {
+		return ttrpc.ErrStreamClosed
+	}
+	x.resp = m
+	return nil
+}
+
+func (x *compatJoinServer) SetHeader(md ttrpc.MD) error {
+	if x.headerSent {
+		return ttrpc.ErrHeaderSent
+	}
+	if x.header == nil {
+		x.header = ttrpc.MD{}
+	}
+	for k, v := range md {
+		x.header.Append(k, v...)
+	}
+	return nil
+}
+
+func (x *compatJoinServer) SendHeader(md ttrpc.MD) error {
+	if err := x.SetHeader(md); err != nil {
+		return err
+	}
+	return x.flushHeader()
+}
+
+func (x *compatJoinServer) flushHeader() error {
+	if x.headerSent {
+		return nil
+	}
+	x.headerSent = true
+	if x.header == nil {
+		return nil
+	}
+	return x.StreamServer.SendHeader(x.header)
+}
+
+func (x *compatJoinServer) SetTrailer(md ttrpc.MD) {
+	ttrpc.SetResponseMetadata(x.Context(), md)
+}
+
+func (x *compatJoinServer) Recv() (*Payload, error) {
+	m := new(Payload)
+	if err := x.StreamServer.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+type Compat_SplitServer interface {
+	Send(*Payload) error
+	// SetHeader merges md into the header metadata, sent with the
+	// first message, by SendHeader or once the service method
+	// returns, whichever comes first.
+	SetHeader(ttrpc.MD) error
+	SendHeader(ttrpc.MD) error
+	SetTrailer(ttrpc.MD)
+	ttrpc.StreamServer
+}
+
+type compatSplitServer struct {
+	ttrpc.StreamServer
+	header     ttrpc.MD
+	headerSent bool
+}
+
+func (x *compatSplitServer) SetHeader(md ttrpc.MD) error {
+	if x.headerSent {
+		return ttrpc.ErrHeaderSent
+	}
+	if x.header == nil {
+		x.header = ttrpc.MD{}
+	}
+	for k, v := range md {
+		x.header.Append(k, v...)
+	}
+	return nil
+}
+
+func (x *compatSplitServer) SendHeader(md ttrpc.MD) error {
+	if err := x.SetHeader(md); err != nil {
+		return err
+	}
+	return x.flushHeader()
+}
+
+func (x *compatSplitServer) flushHeader() error {
+	if x.headerSent {
+		return nil
+	}
+	x.headerSent = true
+	if x.header == nil {
+		return nil
+	}
+	return x.StreamServer.SendHeader(x.header)
+}
+
+func (x *compatSplitServer) SetTrailer(md ttrpc.MD) {
+	ttrpc.SetResponseMetadata(x.Context(), md)
+}
+
+func (x *compatSplitServer) Send(m *Payload) error {
+	if err := x.flushHeader(); err != nil {
+		return err
+	}
+	return x.StreamServer.SendMsg(m)
+}
+
+func RegisterCompatService(srv *ttrpc.Server, svc CompatService) {
+	srv.RegisterService("ttrpc.integration.grpccompat.Compat", &ttrpc.ServiceDesc{
+		Methods: map[string]ttrpc.Method{
+			"Echo": func(ctx context.Context, unmarshal func(interface{}) error) (interface{}, error) {
+				var req Payload
+				if err := unmarshal(&req); err != nil {
+					return nil, err
+				}
+				return svc.Echo(ctx, &req)
+			},
+		},
+		Streams: map[string]ttrpc.Stream{
+			"EchoStream": {
+				Handler: func(ctx context.Context, stream ttrpc.StreamServer) (interface{}, error) {
+					x := &compatEchoStreamServer{StreamServer: stream}
+					err := svc.EchoStream(x)
+					if herr := x.flushHeader(); err == nil {
+						err = herr
+					}
+					return nil, err
+				},
+				StreamingClient: true,
+				StreamingServer: true,
+			},
+			"Join": {
+				Handler: func(ctx context.Context, stream ttrpc.StreamServer) (interface{}, error) {
+					x := &compatJoinServer{StreamServer: stream}
+					err := svc.Join(x)
+					if herr := x.flushHeader(); err == nil {
+						err = herr
+					}
+					if err != nil {
+						return nil, err
+					}
+					return x.resp, nil
+				},
+				StreamingClient: true,
+				StreamingServer: false,
+			},
+			"Split": {
+				Handler: func(ctx context.Context, stream ttrpc.StreamServer) (interface{}, error) {
+					m := new(Payload)
+					if err := stream.RecvMsg(m); err != nil {
+						return nil, err
+					}
+					x := &compatSplitServer{StreamServer: stream}
+					err := svc.Split(m, x)
+					if herr := x.flushHeader(); err == nil {
+						err = herr
+					}
+					return nil, err
+				},
+				StreamingClient: false,
+				StreamingServer: true,
+			},
+		},
+	})
+}
+
+type CompatClient interface {
+	Echo(context.Context, *Payload) (*Payload, error)
+	EchoStream(context.Context) (Compat_EchoStreamClient, error)
+	Join(context.Context) (Compat_JoinClient, error)
+	Split(context.Context, *Payload) (Compat_SplitClient, error)
+}
+
+type compatClient struct {
+	client *ttrpc.Client
+}
+
+func NewCompatClient(client *ttrpc.Client) CompatClient {
+	return &compatClient{
+		client: client,
+	}
+}
+
+func (c *compatClient) Echo(ctx context.Context, req *Payload) (*Payload, error) {
+	var resp Payload
+	if err := c.client.Call(ctx, "ttrpc.integration.grpccompat.Compat", "Echo", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (c *compatClient) EchoStream(ctx context.Context) (Compat_EchoStreamClient, error) {
+	trailer := new(ttrpc.MD)
+	ctx = ttrpc.WithResponseMetadata(ctx, trailer)
+	stream, err := c.client.NewStream(ctx, &ttrpc.StreamDesc{
+		StreamingClient: true,
+		StreamingServer: true,
+	}, "ttrpc.integration.grpccompat.Compat", "EchoStream", nil)
+	if err != nil {
+		return nil, err
+	}
+	x := &compatEchoStreamClient{ClientStream: stream, trailer: trailer}
+	return x, nil
+}
+
+type Compat_EchoStreamClient interface {
+	Send(*Payload) error
+	Recv() (*Payload, error)
+	Header() (ttrpc.MD, error)
+	Trailer() ttrpc.MD
+	ttrpc.ClientStream
+}
+
+type compatEchoStreamClient struct {
+	ttrpc.ClientStream
+	trailer *ttrpc.MD
+}
+
+func (x *compatEchoStreamClient) Trailer() ttrpc.MD {
+	return *x.trailer
+}
+
+func (x *compatEchoStreamClient) Send(m *Payload) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *compatEchoStreamClient) Recv() (*Payload, error) {
+	m := new(Payload)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *compatClient) Join(ctx context.Context) (Compat_JoinClient, error) {
+	trailer := new(ttrpc.MD)
+	ctx = ttrpc.WithResponseMetadata(ctx, trailer)
+	stream, err := c.client.NewStream(ctx, &ttrpc.StreamDesc{
+		StreamingClient: true,
+		StreamingServer: false,
+	}, "ttrpc.integration.grpccompat.Compat", "Join", nil)
+	if err != nil {
+		return nil, err
+	}
+	x := &compatJoinClient{ClientStream: stream, trailer: trailer}
+	return x, nil
+}
+
+type Compat_JoinClient interface {
+	Send(*Payload) error
+	CloseAndRecv() (*Payload, error)
+	Header() (ttrpc.MD, error)
+	Trailer() ttrpc.MD
+	ttrpc.ClientStream
+}
+
+type compatJoinClient struct {
+	ttrpc.ClientStream
+	trailer *ttrpc.MD
+}
+
+func (x *compatJoinClient) Trailer() ttrpc.MD {
+	return *x.trailer
+}
+
+func (x *compatJoinClient) Send(m *Payload) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *compatJoinClient) CloseAndRecv() (*Payload, error) {
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	m := new(Payload)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *compatClient) Split(ctx context.Context, req *Payload) (Compat_SplitClient, error) {
+	trailer := new(ttrpc.MD)
+	ctx = ttrpc.WithResponseMetadata(ctx, trailer)
+	stream, err := c.client.NewStream(ctx, &ttrpc.StreamDesc{
+		StreamingClient: false,
+		StreamingServer: true,
+	}, "ttrpc.integration.grpccompat.Compat", "Split", req)
+	if err != nil {
+		return nil, err
+	}
+	x := &compatSplitClient{ClientStream: stream, trailer: trailer}
+	return x, nil
+}
+
+type Compat_SplitClient interface {
+	Recv() (*Payload, error)
+	Header() (ttrpc.MD, error)
+	Trailer() ttrpc.MD
+	ttrpc.ClientStream
+}
+
+type compatSplitClient struct {
+	ttrpc.ClientStream
+	trailer *ttrpc.MD
+}
+
+func (x *compatSplitClient) Trailer() ttrpc.MD {
+	return *x.trailer
+}
+
+func (x *compatSplitClient) Recv() (*Payload, error) {
+	m := new(Payload)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
@@ -0,0 +1,214 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package integration
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/containerd/ttrpc"
+	"github.com/containerd/ttrpc/integration/grpccompat"
+)
+
+type compatService struct{}
+
+func (compatService) Echo(_ context.Context, p *grpccompat.Payload) (*grpccompat.Payload, error) {
+	return p, nil
+}
+
+func (compatService) EchoStream(stream grpccompat.Compat_EchoStreamServer) error {
+	if stream.Context() == nil {
+		return errors.New("stream has no context")
+	}
+	// sent along the first message
+	if err := stream.SetHeader(ttrpc.MD{"mode": {"echo"}}); err != nil {
+		return err
+	}
+	var n int
+	for {
+		p, err := stream.Recv()
+		if err != nil {
+			if err == io.EOF {
+				stream.SetTrailer(ttrpc.MD{"messages": {strconv.Itoa(n)}})
+				return nil
+			}
+			return err
+		}
+		if err := stream.Send(p); err != nil {
+			return err
+		}
+		n++
+	}
+}
+
+func (compatService) Join(stream grpccompat.Compat_JoinServer) error {
+	var parts []string
+	for {
+		p, err := stream.Recv()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		parts = append(parts, p.Msg)
+	}
+	// sent once the method returns, ahead of the response
+	if err := stream.SetHeader(ttrpc.MD{"mode": {"join"}}); err != nil {
+		return err
+	}
+	stream.SetTrailer(ttrpc.MD{"parts": {strconv.Itoa(len(parts))}})
+	return stream.SendAndClose(&grpccompat.Payload{Msg: strings.Join(parts, " ")})
+}
+
+func (compatService) Split(p *grpccompat.Payload, stream grpccompat.Compat_SplitServer) error {
+	parts := strings.Fields(p.Msg)
+	if err := stream.SendHeader(ttrpc.MD{"mode": {"split"}}); err != nil {
+		return err
+	}
+	if err := stream.SetHeader(ttrpc.MD{}); err != ttrpc.ErrHeaderSent {
+		return fmt.Errorf("expected ErrHeaderSent once the header is sent, got %v", err)
+	}
+	for _, part := range parts {
+		if err := stream.Send(&grpccompat.Payload{Msg: part}); err != nil {
+			return err
+		}
+	}
+	stream.SetTrailer(ttrpc.MD{"parts": {strconv.Itoa(len(parts))}})
+	return nil
+}
+
+func TestGRPCCompat(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	server, err := ttrpc.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	grpccompat.RegisterCompatService(server, compatService{})
+
+	addr := t.Name() + ".sock"
+	if err := os.RemoveAll(addr); err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("unix", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(ctx, listener)
+
+	conn, err := net.Dial("unix", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ttrpcClient := ttrpc.NewClient(conn)
+	defer ttrpcClient.Close()
+	client := grpccompat.NewCompatClient(ttrpcClient)
+
+	if resp, err := client.Echo(ctx, &grpccompat.Payload{Msg: "unary"}); err != nil {
+		t.Fatal(err)
+	} else if resp.Msg != "unary" {
+		t.Fatalf("unexpected echo: %q", resp.Msg)
+	}
+
+	echo, err := client.EchoStream(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if echo.Context() == nil {
+		t.Fatal("client stream has no context")
+	}
+	if err := echo.Send(&grpccompat.Payload{Msg: "stream"}); err != nil {
+		t.Fatal(err)
+	}
+	if resp, err := echo.Recv(); err != nil {
+		t.Fatal(err)
+	} else if resp.Msg != "stream" {
+		t.Fatalf("unexpected echo: %q", resp.Msg)
+	}
+	if err := echo.CloseSend(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := echo.Recv(); err != io.EOF {
+		t.Fatalf("expected io.EOF, got %v", err)
+	}
+	checkMD := func(name string, md ttrpc.MD, key, expected string) {
+		t.Helper()
+		if v, ok := md.Get(key); !ok || v[0] != expected {
+			t.Fatalf("unexpected %s: %v", name, md)
+		}
+	}
+	header, err := echo.Header()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkMD("header", header, "mode", "echo")
+	checkMD("trailer", echo.Trailer(), "messages", "1")
+
+	join, err := client.Join(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, part := range []string{"a", "b", "c"} {
+		if err := join.Send(&grpccompat.Payload{Msg: part}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if resp, err := join.CloseAndRecv(); err != nil {
+		t.Fatal(err)
+	} else if resp.Msg != "a b c" {
+		t.Fatalf("unexpected joined message: %q", resp.Msg)
+	}
+	header, err = join.Header()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkMD("header", header, "mode", "join")
+	checkMD("trailer", join.Trailer(), "parts", "3")
+
+	split, err := client.Split(ctx, &grpccompat.Payload{Msg: "a b c"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, err = split.Header()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkMD("header", header, "mode", "split")
+	var parts []string
+	for {
+		p, err := split.Recv()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		parts = append(parts, p.Msg)
+	}
+	if strings.Join(parts, " ") != "a b c" {
+		t.Fatalf("unexpected parts: %v", parts)
+	}
+	checkMD("trailer", split.Trailer(), "parts", "3")
+}
@@ -5,9 +5,22 @@ package streaming
 import (
 	context "context"
 	ttrpc "github.com/containerd/ttrpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
 	emptypb "google.golang.org/protobuf/types/known/emptypb"
 )
 
+const (
+	TTRPCStreamingServiceName                           = "ttrpc.integration.streaming.Streaming"
+	TTRPCStreamingService_Echo_FullMethod               = "/ttrpc.integration.streaming.Streaming/Echo"
+	TTRPCStreamingService_EchoStream_FullMethod         = "/ttrpc.integration.streaming.Streaming/EchoStream"
+	TTRPCStreamingService_SumStream_FullMethod          = "/ttrpc.integration.streaming.Streaming/SumStream"
+	TTRPCStreamingService_DivideStream_FullMethod       = "/ttrpc.integration.streaming.Streaming/DivideStream"
+	TTRPCStreamingService_EchoNull_FullMethod           = "/ttrpc.integration.streaming.Streaming/EchoNull"
+	TTRPCStreamingService_EchoNullStream_FullMethod     = "/ttrpc.integration.streaming.Streaming/EchoNullStream"
+	TTRPCStreamingService_EmptyPayloadStream_FullMethod = "/ttrpc.integration.streaming.Streaming/EmptyPayloadStream"
+)
+
 type TTRPCStreamingService interface {
 	Echo(context.Context, *EchoPayload) (*EchoPayload, error)
 	EchoStream(context.Context, TTRPCStreaming_EchoStreamServer) error
@@ -18,6 +31,38 @@ type TTRPCStreamingService interface {
 	EmptyPayloadStream(context.Context, *emptypb.Empty, TTRPCStreaming_EmptyPayloadStreamServer) error
 }
 
+// UnimplementedTTRPCStreamingService can be embedded in implementations of TTRPCStreamingService for
+// forward compatibility, the methods it provides fail with codes.Unimplemented.
+type UnimplementedTTRPCStreamingService struct{}
+
+func (UnimplementedTTRPCStreamingService) Echo(context.Context, *EchoPayload) (*EchoPayload, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Echo not implemented")
+}
+
+func (UnimplementedTTRPCStreamingService) EchoStream(context.Context, TTRPCStreaming_EchoStreamServer) error {
+	return status.Errorf(codes.Unimplemented, "method EchoStream not implemented")
+}
+
+func (UnimplementedTTRPCStreamingService) SumStream(context.Context, TTRPCStreaming_SumStreamServer) (*Sum, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SumStream not implemented")
+}
+
+func (UnimplementedTTRPCStreamingService) DivideStream(context.Context, *Sum, TTRPCStreaming_DivideStreamServer) error {
+	return status.Errorf(codes.Unimplemented, "method DivideStream not implemented")
+}
+
+func (UnimplementedTTRPCStreamingService) EchoNull(context.Context, TTRPCStreaming_EchoNullServer) (*emptypb.Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method EchoNull not implemented")
+}
+
+func (UnimplementedTTRPCStreamingService) EchoNullStream(context.Context, TTRPCStreaming_EchoNullStreamServer) error {
+	return status.Errorf(codes.Unimplemented, "method EchoNullStream not implemented")
+}
+
+func (UnimplementedTTRPCStreamingService) EmptyPayloadStream(context.Context, *emptypb.Empty, TTRPCStreaming_EmptyPayloadStreamServer) error {
+	return status.Errorf(codes.Unimplemented, "method EmptyPayloadStream not implemented")
+}
+
 type TTRPCStreaming_EchoStreamServer interface {
 	Send(*EchoPayload) error
 	Recv() (*EchoPayload, error)
@@ -42,11 +87,24 @@ func (x *ttrpcstreamingEchoStreamServer) Recv() (*EchoPayload, error) {
 
 type TTRPCStreaming_SumStreamServer interface {
 	Recv() (*Part, error)
+	// SendAndClose stores the response of the stream, it is only sent
+	// once the service method returns, and only when the method does
+	// not return a response of its own.
+	SendAndClose(*Sum) error
 	ttrpc.StreamServer
 }
 
 type ttrpcstreamingSumStreamServer struct {
 	ttrpc.StreamServer
+	resp *Sum
+}
+
+func (x *ttrpcstreamingSumStreamServer) SendAndClose(m *Sum) error {
+	if x.resp != nil {
+		return ttrpc.ErrStreamClosed
+	}
+	x.resp = m
+	return nil
 }
 
 func (x *ttrpcstreamingSumStreamServer) Recv() (*Part, error) {
@@ -72,11 +130,24 @@ func (x *ttrpcstreamingDivideStreamServer) Send(m *Part) error {
 
 type TTRPCStreaming_EchoNullServer interface {
 	Recv() (*EchoPayload, error)
+	// SendAndClose stores the response of the stream, it is only sent
+	// once the service method returns, and only when the method does
+	// not return a response of its own.
+	SendAndClose(*emptypb.Empty) error
 	ttrpc.StreamServer
 }
 
 type ttrpcstreamingEchoNullServer struct {
 	ttrpc.StreamServer
+	resp *emptypb.Empty
+}
+
+func (x *ttrpcstreamingEchoNullServer) SendAndClose(m *emptypb.Empty) error {
+	if x.resp != nil {
+		return ttrpc.ErrStreamClosed
+	}
+	x.resp = m
+	return nil
 }
 
 func (x *ttrpcstreamingEchoNullServer) Recv() (*EchoPayload, error) {
@@ -143,7 +214,15 @@ func RegisterTTRPCStreamingService(srv *ttrpc.Server, svc TTRPCStreamingService)
 			},
 			"SumStream": {
 				Handler: func(ctx context.Context, stream ttrpc.StreamServer) (interface{}, error) {
-					return svc.SumStream(ctx, &ttrpcstreamingSumStreamServer{stream})
+					x := &ttrpcstreamingSumStreamServer{StreamServer: stream}
+					resp, err := svc.SumStream(ctx, x)
+					if err != nil {
+						return nil, err
+					}
+					if resp == nil {
+						return x.resp, nil
+					}
+					return resp, nil
 				},
 				StreamingClient: true,
 				StreamingServer: false,
@@ -161,7 +240,15 @@ func RegisterTTRPCStreamingService(srv *ttrpc.Server, svc TTRPCStreamingService)
 			},
 			"EchoNull": {
 				Handler: func(ctx context.Context, stream ttrpc.StreamServer) (interface{}, error) {
-					return svc.EchoNull(ctx, &ttrpcstreamingEchoNullServer{stream})
+					x := &ttrpcstreamingEchoNullServer{StreamServer: stream}
+					resp, err := svc.EchoNull(ctx, x)
+					if err != nil {
+						return nil, err
+					}
+					if resp == nil {
+						return x.resp, nil
+					}
+					return resp, nil
 				},
 				StreamingClient: true,
 				StreamingServer: false,
@@ -415,3 +502,101 @@ func (x *ttrpcstreamingEmptyPayloadStreamClient) Recv() (*EchoPayload, error) {
 	}
 	return m, nil
 }
+
+// NewTTRPCStreamingClientFake returns a TTRPCStreamingClient which calls svc
+// in-process, without a connection. The server options are applied to the
+// server svc is registered on, for example to install interceptors.
+func NewTTRPCStreamingClientFake(svc TTRPCStreamingService, opts ...ttrpc.ServerOpt) (TTRPCStreamingClient, error) {
+	srv, err := ttrpc.NewServer(opts...)
+	if err != nil {
+		return nil, err
+	}
+	RegisterTTRPCStreamingService(srv, svc)
+	return &ttrpcstreamingClientFake{
+		client: ttrpc.NewLocalClient(srv),
+	}, nil
+}
+
+type ttrpcstreamingClientFake struct {
+	client *ttrpc.LocalClient
+}
+
+func (c *ttrpcstreamingClientFake) Echo(ctx context.Context, req *EchoPayload) (*EchoPayload, error) {
+	var resp EchoPayload
+	if err := c.client.Call(ctx, "ttrpc.integration.streaming.Streaming", "Echo", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (c *ttrpcstreamingClientFake) EchoStream(ctx context.Context) (TTRPCStreaming_EchoStreamClient, error) {
+	stream, err := c.client.NewStream(ctx, &ttrpc.StreamDesc{
+		StreamingClient: true,
+		StreamingServer: true,
+	}, "ttrpc.integration.streaming.Streaming", "EchoStream", nil)
+	if err != nil {
+		return nil, err
+	}
+	x := &ttrpcstreamingEchoStreamClient{stream}
+	return x, nil
+}
+
+func (c *ttrpcstreamingClientFake) SumStream(ctx context.Context) (TTRPCStreaming_SumStreamClient, error) {
+	stream, err := c.client.NewStream(ctx, &ttrpc.StreamDesc{
+		StreamingClient: true,
+		StreamingServer: false,
+	}, "ttrpc.integration.streaming.Streaming", "SumStream", nil)
+	if err != nil {
+		return nil, err
+	}
+	x := &ttrpcstreamingSumStreamClient{stream}
+	return x, nil
+}
+
+func (c *ttrpcstreamingClientFake) DivideStream(ctx context.Context, req *Sum) (TTRPCStreaming_DivideStreamClient, error) {
+	stream, err := c.client.NewStream(ctx, &ttrpc.StreamDesc{
+		StreamingClient: false,
+		StreamingServer: true,
+	}, "ttrpc.integration.streaming.Streaming", "DivideStream", req)
+	if err != nil {
+		return nil, err
+	}
+	x := &ttrpcstreamingDivideStreamClient{stream}
+	return x, nil
+}
+
+func (c *ttrpcstreamingClientFake) EchoNull(ctx context.Context) (TTRPCStreaming_EchoNullClient, error) {
+	stream, err := c.client.NewStream(ctx, &ttrpc.StreamDesc{
+		StreamingClient: true,
+		StreamingServer: false,
+	}, "ttrpc.integration.streaming.Streaming", "EchoNull", nil)
+	if err != nil {
+		return nil, err
+	}
+	x := &ttrpcstreamingEchoNullClient{stream}
+	return x, nil
+}
+
+func (c *ttrpcstreamingClientFake) EchoNullStream(ctx context.Context) (TTRPCStreaming_EchoNullStreamClient, error) {
+	stream, err := c.client.NewStream(ctx, &ttrpc.StreamDesc{
+		StreamingClient: true,
+		StreamingServer: true,
+	}, "ttrpc.integration.streaming.Streaming", "EchoNullStream", nil)
+	if err != nil {
+		return nil, err
+	}
+	x := &ttrpcstreamingEchoNullStreamClient{stream}
+	return x, nil
+}
+
+func (c *ttrpcstreamingClientFake) EmptyPayloadStream(ctx context.Context, req *emptypb.Empty) (TTRPCStreaming_EmptyPayloadStreamClient, error) {
+	stream, err := c.client.NewStream(ctx, &ttrpc.StreamDesc{
+		StreamingClient: false,
+		StreamingServer: true,
+	}, "ttrpc.integration.streaming.Streaming", "EmptyPayloadStream", req)
+	if err != nil {
+		return nil, err
+	}
+	x := &ttrpcstreamingEmptyPayloadStreamClient{stream}
+	return x, nil
+}
@@ -31,6 +31,8 @@ import (
 	"github.com/containerd/ttrpc"
 	"github.com/containerd/ttrpc/integration/streaming"
 	"github.com/golang/protobuf/ptypes/empty"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/types/known/emptypb"
 )
 
@@ -215,6 +217,132 @@ func TestStreamingService(t *testing.T) {
 	t.Run("EmptyPayloadStream", emptyPayloadStream(ctx, client))
 }
 
+func TestStreamingServiceFake(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	client, err := streaming.NewTTRPCStreamingClientFake(&testStreamingService{t})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("Echo", echoTest(ctx, client))
+	t.Run("EchoStream", echoStreamTest(ctx, client))
+	t.Run("SumStream", sumStreamTest(ctx, client))
+	t.Run("DivideStream", divideStreamTest(ctx, client))
+	t.Run("EchoNull", echoNullTest(ctx, client))
+	t.Run("EchoNullStream", echoNullStreamTest(ctx, client))
+	t.Run("EmptyPayloadStream", emptyPayloadStream(ctx, client))
+}
+
+func TestStreamingFullMethodConstants(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var unary, stream string
+	client, err := streaming.NewTTRPCStreamingClientFake(&testStreamingService{t},
+		ttrpc.WithUnaryServerInterceptor(func(ctx context.Context, unmarshal ttrpc.Unmarshaler, info *ttrpc.UnaryServerInfo, method ttrpc.Method) (interface{}, error) {
+			unary = info.FullMethod
+			return method(ctx, unmarshal)
+		}),
+		ttrpc.WithStreamServerInterceptor(func(ctx context.Context, ss ttrpc.StreamServer, info *ttrpc.StreamServerInfo, handler ttrpc.StreamHandler) (interface{}, error) {
+			stream = info.FullMethod
+			return handler(ctx, ss)
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("Echo", echoTest(ctx, client))
+	t.Run("EchoStream", echoStreamTest(ctx, client))
+
+	if streaming.TTRPCStreamingServiceName != "ttrpc.integration.streaming.Streaming" {
+		t.Errorf("unexpected service name %q", streaming.TTRPCStreamingServiceName)
+	}
+	if unary != streaming.TTRPCStreamingService_Echo_FullMethod {
+		t.Errorf("unexpected unary method %q, expected %q", unary, streaming.TTRPCStreamingService_Echo_FullMethod)
+	}
+	if stream != streaming.TTRPCStreamingService_EchoStream_FullMethod {
+		t.Errorf("unexpected stream method %q, expected %q", stream, streaming.TTRPCStreamingService_EchoStream_FullMethod)
+	}
+}
+
+// echoOnlyService only implements Echo, the other methods are provided by
+// the embedded UnimplementedTTRPCStreamingService.
+type echoOnlyService struct {
+	streaming.UnimplementedTTRPCStreamingService
+}
+
+func (echoOnlyService) Echo(_ context.Context, e *streaming.EchoPayload) (*streaming.EchoPayload, error) {
+	e.Seq++
+	return e, nil
+}
+
+func TestStreamingUnimplemented(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	client, err := streaming.NewTTRPCStreamingClientFake(echoOnlyService{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("Echo", echoTest(ctx, client))
+
+	sumStream, err := client.SumStream(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sumStream.CloseAndRecv(); status.Code(err) != codes.Unimplemented {
+		t.Fatalf("expected %v, got %v", codes.Unimplemented, err)
+	}
+	divideStream, err := client.DivideStream(ctx, &streaming.Sum{Sum: 1, Num: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := divideStream.Recv(); status.Code(err) != codes.Unimplemented {
+		t.Fatalf("expected %v, got %v", codes.Unimplemented, err)
+	}
+}
+
+// sendAndCloseService replies to SumStream with SendAndClose rather than by
+// returning the sum.
+type sendAndCloseService struct {
+	testStreamingService
+}
+
+func (s *sendAndCloseService) SumStream(ctx context.Context, ss streaming.TTRPCStreaming_SumStreamServer) (*streaming.Sum, error) {
+	sum, err := s.testStreamingService.SumStream(ctx, ss)
+	if err != nil {
+		return nil, err
+	}
+	if err := ss.SendAndClose(sum); err != nil {
+		return nil, err
+	}
+	if err := ss.SendAndClose(sum); !errors.Is(err, ttrpc.ErrStreamClosed) {
+		return nil, fmt.Errorf("expected %v from a second SendAndClose, got %v", ttrpc.ErrStreamClosed, err)
+	}
+	return nil, nil
+}
+
+func TestStreamingSendAndClose(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	client, cleanup := runService(ctx, t, &sendAndCloseService{testStreamingService{t}})
+	defer cleanup()
+
+	t.Run("SumStream", sumStreamTest(ctx, client))
+
+	fake, err := streaming.NewTTRPCStreamingClientFake(&sendAndCloseService{testStreamingService{t}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("SumStreamFake", sumStreamTest(ctx, fake))
+}
+
 func echoTest(ctx context.Context, client streaming.TTRPCStreamingClient) func(t *testing.T) {
 	return func(t *testing.T) {
 		echo1 := &streaming.EchoPayload{
@@ -16,16 +16,51 @@
 
 package ttrpc
 
-import "context"
+import (
+	"context"
+	"sync/atomic"
+)
 
 // UnaryServerInfo provides information about the server request
 type UnaryServerInfo struct {
 	FullMethod string
+
+	// Stats holds the sizes of the call's messages.
+	Stats *CallStats
+}
+
+// CallStats holds the sizes of the serialized messages of a unary call, for
+// example to account for the traffic of a call in a server interceptor.
+type CallStats struct {
+	// RequestSize is the size in bytes of the request payload.
+	RequestSize int
+
+	responseSize atomic.Int64
+}
+
+// ResponseSize returns the size in bytes of the response payload sent to the
+// client. The response is serialized once the outermost interceptor returned,
+// so the size is zero until then. The context of the call is done once the
+// response was handed to the connection, interceptors may read the size then,
+// for example with context.AfterFunc; it stays zero for calls which failed or
+// were canceled before responding.
+func (s *CallStats) ResponseSize() int {
+	return int(s.responseSize.Load())
 }
 
 // UnaryClientInfo provides information about the client request
 type UnaryClientInfo struct {
 	FullMethod string
+
+	// Service and Method are the components of FullMethod.
+	Service string
+	Method  string
+
+	// Request is the message passed to Call, before it is marshaled into the
+	// Request payload. Response is the message the reply will be unmarshaled
+	// into once the interceptor chain returns.
+	Request  interface{}
+	Response interface{}
 }
 
 // StreamServerInfo provides information about the server request
@@ -35,6 +70,23 @@ type StreamServerInfo struct {
 	StreamingServer bool
 }
 
+// MethodInfo describes the method of a call received by the server.
+type MethodInfo struct {
+	FullMethod string
+
+	// Service and Method are the components of FullMethod.
+	Service string
+	Method  string
+
+	// StreamingClient and StreamingServer are both false for unary calls.
+	StreamingClient bool
+	StreamingServer bool
+}
+
+// ContextDecorator derives the context a call is handled with from the context
+// of the request, see WithContextDecorator.
+type ContextDecorator func(ctx context.Context, info MethodInfo) context.Context
+
 // Unmarshaler contains the server request data and allows it to be unmarshaled
 // into a concrete type
 type Unmarshaler func(interface{}) error
@@ -43,9 +95,20 @@ type Unmarshaler func(interface{}) error
 type Invoker func(context.Context, *Request, *Response) error
 
 // UnaryServerInterceptor specifies the interceptor function for server request/response
+//
+// The value returned by the interceptor, rather than the one returned by the
+// method, is marshaled as the response. Interceptors may thus modify or replace
+// responses, for example to redact them.
 type UnaryServerInterceptor func(context.Context, Unmarshaler, *UnaryServerInfo, Method) (interface{}, error)
 
 // UnaryClientInterceptor specifies the interceptor function for client request/response
+//
+// The request message is marshaled before the interceptors are called, so the
+// Payload of the Request holds the exact bytes sent to the server. Interceptors
+// may add Metadata to the Request computed from the payload, such as a
+// signature, before calling the Invoker. The payload must not be modified
+// afterwards, and the message in UnaryClientInfo.Request is not marshaled
+// again.
 type UnaryClientInterceptor func(context.Context, *Request, *Response, *UnaryClientInfo, Invoker) error
 
 func defaultServerInterceptor(ctx context.Context, unmarshal Unmarshaler, _ *UnaryServerInfo, method Method) (interface{}, error) {
@@ -56,10 +119,19 @@ func defaultClientInterceptor(ctx context.Context, req *Request, resp *Response,
 	return invoker(ctx, req, resp)
 }
 
+// StreamServerInterceptor specifies the interceptor function for server streams
 type StreamServerInterceptor func(context.Context, StreamServer, *StreamServerInfo, StreamHandler) (interface{}, error)
 
 func defaultStreamServerInterceptor(ctx context.Context, ss StreamServer, _ *StreamServerInfo, stream StreamHandler) (interface{}, error) {
 	return stream(ctx, ss)
 }
 
-type StreamClientInterceptor func(context.Context)
+// Streamer creates the client stream to the ttrpc server
+type Streamer func(ctx context.Context, desc *StreamDesc, service, method string, req interface{}) (ClientStream, error)
+
+// StreamClientInterceptor specifies the interceptor function for client streams
+type StreamClientInterceptor func(ctx context.Context, desc *StreamDesc, service, method string, req interface{}, streamer Streamer) (ClientStream, error)
+
+func defaultStreamClientInterceptor(ctx context.Context, desc *StreamDesc, service, method string, req interface{}, streamer Streamer) (ClientStream, error) {
+	return streamer(ctx, desc, service, method, req)
+}
@@ -18,18 +18,26 @@ package ttrpc
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
 	"reflect"
 	"strings"
 	"testing"
 
 	"github.com/containerd/ttrpc/internal"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
 )
 
 func TestUnaryClientInterceptor(t *testing.T) {
 	var (
 		intercepted = false
-		interceptor = func(ctx context.Context, req *Request, reply *Response, _ *UnaryClientInfo, i Invoker) error {
+		callInfo    *UnaryClientInfo
+		interceptor = func(ctx context.Context, req *Request, reply *Response, info *UnaryClientInfo, i Invoker) error {
 			intercepted = true
+			callInfo = info
 			return i(ctx, req, reply)
 		}
 
@@ -63,11 +71,61 @@ func TestUnaryClientInterceptor(t *testing.T) {
 		t.Fatalf("ttrpc client call not intercepted")
 	}
 
+	if callInfo.FullMethod != fullPath(serviceName, "Test") || callInfo.Service != serviceName || callInfo.Method != "Test" {
+		t.Fatalf("unexpected call info: %+v", callInfo)
+	}
+	if callInfo.Request != request || callInfo.Response != response {
+		t.Fatal("call info does not carry the call's request and response")
+	}
+
 	if response.Foo != reply {
 		t.Fatalf("unexpected test service reply: %q != %q", response.Foo, reply)
 	}
 }
 
+func TestUnaryClientInterceptorSigning(t *testing.T) {
+	var (
+		ctx  = context.Background()
+		sign = func(ctx context.Context, req *Request, reply *Response, info *UnaryClientInfo, i Invoker) error {
+			// the payload is marshaled before the interceptor runs
+			sum := sha256.Sum256(req.Payload)
+			req.Metadata = append(req.Metadata, &KeyValue{Key: "signature", Value: hex.EncodeToString(sum[:])})
+			return i(ctx, req, reply)
+		}
+		server          = mustServer(t)(NewServer())
+		addr, listener  = newTestListener(t)
+		client, cleanup = newTestClient(t, addr, WithUnaryClientInterceptor(sign))
+	)
+	defer listener.Close()
+	defer cleanup()
+
+	server.RegisterMethod(serviceName, "Verify", func(ctx context.Context, unmarshal func(interface{}) error) (interface{}, error) {
+		var req internal.TestPayload
+		if err := unmarshal(&req); err != nil {
+			return nil, err
+		}
+		p, err := proto.Marshal(&req)
+		if err != nil {
+			return nil, err
+		}
+		md, _ := GetMetadata(ctx)
+		signature, _ := md.Get("signature")
+		sum := sha256.Sum256(p)
+		if len(signature) != 1 || signature[0] != hex.EncodeToString(sum[:]) {
+			return nil, status.Errorf(codes.Unauthenticated, "invalid signature %v", signature)
+		}
+		return &req, nil
+	})
+
+	go server.Serve(ctx, listener)
+	defer server.Shutdown(ctx)
+
+	var resp internal.TestPayload
+	if err := client.Call(ctx, serviceName, "Verify", &internal.TestPayload{Foo: "signed"}, &resp); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func TestChainUnaryClientInterceptor(t *testing.T) {
 	var (
 		orderIdx  = 0
@@ -136,19 +194,37 @@ func TestChainUnaryClientInterceptor(t *testing.T) {
 
 func TestUnaryServerInterceptor(t *testing.T) {
 	var (
-		intercepted = false
-		interceptor = func(ctx context.Context, unmarshal Unmarshaler, _ *UnaryServerInfo, method Method) (interface{}, error) {
+		intercepted       = false
+		requestSize, none int
+		responseSize      = make(chan int, 1)
+		interceptor       = func(ctx context.Context, unmarshal Unmarshaler, info *UnaryServerInfo, method Method) (interface{}, error) {
 			intercepted = true
-			return method(ctx, unmarshal)
+			requestSize = info.Stats.RequestSize
+			context.AfterFunc(ctx, func() {
+				responseSize <- info.Stats.ResponseSize()
+			})
+			resp, err := method(ctx, unmarshal)
+			none = info.Stats.ResponseSize()
+			return resp, err
+		}
+		// the size is the one of the response actually sent, returned by the
+		// outermost interceptor
+		double = func(ctx context.Context, unmarshal Unmarshaler, info *UnaryServerInfo, method Method) (interface{}, error) {
+			resp, err := method(ctx, unmarshal)
+			if err != nil {
+				return nil, err
+			}
+			foo := resp.(*internal.TestPayload).Foo
+			return &internal.TestPayload{Foo: foo + foo}, nil
 		}
 
 		ctx             = context.Background()
-		server          = mustServer(t)(NewServer(WithUnaryServerInterceptor(interceptor)))
+		server          = mustServer(t)(NewServer(WithChainUnaryServerInterceptor(double, interceptor)))
 		testImpl        = &testingServer{}
 		addr, listener  = newTestListener(t)
 		client, cleanup = newTestClient(t, addr)
 		message         = strings.Repeat("a", 16)
-		reply           = strings.Repeat(message, 2)
+		reply           = strings.Repeat(message, 4)
 	)
 
 	defer listener.Close()
@@ -174,6 +250,57 @@ func TestUnaryServerInterceptor(t *testing.T) {
 	if response.Foo != reply {
 		t.Fatalf("unexpected test service reply: %q != %q", response.Foo, reply)
 	}
+
+	if requestSize != proto.Size(request) {
+		t.Fatalf("unexpected request size %d, expected %d", requestSize, proto.Size(request))
+	}
+	if none != 0 {
+		t.Fatalf("unexpected response size %d before the response was sent", none)
+	}
+	if size := <-responseSize; size != proto.Size(response) {
+		t.Fatalf("unexpected response size %d, expected %d", size, proto.Size(response))
+	}
+}
+
+func TestUnaryServerInterceptorResponse(t *testing.T) {
+	var (
+		ctx    = context.Background()
+		redact = func(ctx context.Context, unmarshal Unmarshaler, info *UnaryServerInfo, method Method) (interface{}, error) {
+			resp, err := method(ctx, unmarshal)
+			if err != nil {
+				return nil, err
+			}
+			// replace the response of the handler with a modified copy
+			return &internal.TestPayload{Foo: strings.Repeat("*", len(resp.(*internal.TestPayload).Foo))}, nil
+		}
+		server          = mustServer(t)(NewServer(WithUnaryServerInterceptor(redact)))
+		addr, listener  = newTestListener(t)
+		client, cleanup = newTestClient(t, addr)
+	)
+	defer listener.Close()
+	defer cleanup()
+
+	registerTestingService(server, &testingServer{})
+
+	go server.Serve(ctx, listener)
+	defer server.Shutdown(ctx)
+
+	for name, c := range map[string]interface {
+		Call(context.Context, string, string, interface{}, interface{}, ...CallOption) error
+	}{
+		"Remote": client,
+		"Local":  NewLocalClient(server),
+	} {
+		t.Run(name, func(t *testing.T) {
+			var resp internal.TestPayload
+			if err := c.Call(ctx, serviceName, "Test", &internal.TestPayload{Foo: "secret"}, &resp); err != nil {
+				t.Fatal(err)
+			}
+			if expected := strings.Repeat("*", len("secretsecret")); resp.Foo != expected {
+				t.Fatalf("expected response of the interceptor %q, got %q", expected, resp.Foo)
+			}
+		})
+	}
 }
 
 func TestChainUnaryServerInterceptor(t *testing.T) {
@@ -243,3 +370,345 @@ func TestChainUnaryServerInterceptor(t *testing.T) {
 		t.Fatalf("unexpected test service reply: %q != %q", response.Foo, reply)
 	}
 }
+
+type countingServerStream struct {
+	StreamServer
+	recv int
+}
+
+func (s *countingServerStream) RecvMsg(m interface{}) error {
+	s.recv++
+	return s.StreamServer.RecvMsg(m)
+}
+
+func registerEchoStreamService(srv *Server, interceptors ...StreamServerInterceptor) {
+	srv.RegisterService(serviceName, &ServiceDesc{
+		StreamInterceptors: interceptors,
+		Streams: map[string]Stream{
+			"EchoStream": {
+				Handler: func(_ context.Context, ss StreamServer) (interface{}, error) {
+					for {
+						var req internal.EchoPayload
+						if err := ss.RecvMsg(&req); err != nil {
+							if err == io.EOF {
+								err = nil
+							}
+							return nil, err
+						}
+						req.Seq++
+						if err := ss.SendMsg(&req); err != nil {
+							return nil, err
+						}
+					}
+				},
+				StreamingClient: true,
+				StreamingServer: true,
+			},
+		},
+	})
+}
+
+func echoStream(ctx context.Context, t *testing.T, client *Client, n int) {
+	t.Helper()
+
+	stream, err := client.NewStream(ctx, &StreamDesc{true, true}, serviceName, "EchoStream", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		if err := stream.SendMsg(&internal.EchoPayload{Seq: int64(i)}); err != nil {
+			t.Fatal(err)
+		}
+		var resp internal.EchoPayload
+		if err := stream.RecvMsg(&resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.Seq != int64(i)+1 {
+			t.Fatalf("unexpected sequence value: %d, expected %d", resp.Seq, i+1)
+		}
+	}
+	if err := stream.CloseSend(); err != nil {
+		t.Fatal(err)
+	}
+	var resp internal.EchoPayload
+	if err := stream.RecvMsg(&resp); err != io.EOF {
+		t.Fatalf("expected io.EOF after close send, got %v", err)
+	}
+}
+
+func TestStreamServerInterceptor(t *testing.T) {
+	var (
+		intercepted = 0
+		counter     *countingServerStream
+		interceptor = func(ctx context.Context, ss StreamServer, info *StreamServerInfo, stream StreamHandler) (interface{}, error) {
+			intercepted++
+			if info.FullMethod != fullPath(serviceName, "EchoStream") {
+				t.Errorf("unexpected full method: %q", info.FullMethod)
+			}
+			if !info.StreamingClient || !info.StreamingServer {
+				t.Errorf("unexpected stream info: %+v", info)
+			}
+			counter = &countingServerStream{StreamServer: ss}
+			return stream(ctx, counter)
+		}
+
+		ctx             = context.Background()
+		server          = mustServer(t)(NewServer(WithStreamServerInterceptor(interceptor)))
+		addr, listener  = newTestListener(t)
+		client, cleanup = newTestClient(t, addr)
+	)
+
+	defer listener.Close()
+	defer cleanup()
+
+	registerEchoStreamService(server)
+
+	go server.Serve(ctx, listener)
+	defer server.Shutdown(ctx)
+
+	echoStream(ctx, t, client, 3)
+
+	if intercepted != 1 {
+		t.Fatalf("expected stream to be intercepted once, got %d", intercepted)
+	}
+	// three messages followed by io.EOF
+	if counter.recv != 4 {
+		t.Fatalf("expected wrapped stream to be used for 4 receives, got %d", counter.recv)
+	}
+}
+
+func TestChainStreamServerInterceptor(t *testing.T) {
+	var (
+		orderIdx  = 0
+		recorded  = []string{}
+		intercept = func(idx int, tag string) StreamServerInterceptor {
+			return func(ctx context.Context, ss StreamServer, info *StreamServerInfo, stream StreamHandler) (interface{}, error) {
+				if orderIdx != idx {
+					t.Errorf("unexpected interceptor invocation order (%d != %d)", orderIdx, idx)
+				}
+				recorded = append(recorded, tag)
+				orderIdx++
+				return stream(ctx, ss)
+			}
+		}
+
+		ctx    = context.Background()
+		server = mustServer(t)(NewServer(
+			WithStreamServerInterceptor(
+				intercept(0, "seen it"),
+			),
+			WithChainStreamServerInterceptor(
+				intercept(1, "been"),
+				intercept(2, "there"),
+				intercept(3, "done"),
+				intercept(4, "that"),
+			),
+		))
+		expected = []string{
+			"seen it",
+			"been",
+			"there",
+			"done",
+			"that",
+		}
+		addr, listener  = newTestListener(t)
+		client, cleanup = newTestClient(t, addr)
+	)
+
+	defer listener.Close()
+	defer cleanup()
+
+	registerEchoStreamService(server)
+
+	go server.Serve(ctx, listener)
+	defer server.Shutdown(ctx)
+
+	echoStream(ctx, t, client, 1)
+
+	if !reflect.DeepEqual(recorded, expected) {
+		t.Fatalf("unexpected ttrpc chained server stream interceptor order (%s != %s)",
+			strings.Join(recorded, " "), strings.Join(expected, " "))
+	}
+}
+
+func TestServiceInterceptors(t *testing.T) {
+	var (
+		recorded = []string{}
+		unary    = func(tag string) UnaryServerInterceptor {
+			return func(ctx context.Context, unmarshal Unmarshaler, _ *UnaryServerInfo, method Method) (interface{}, error) {
+				recorded = append(recorded, tag)
+				return method(ctx, unmarshal)
+			}
+		}
+		stream = func(tag string) StreamServerInterceptor {
+			return func(ctx context.Context, ss StreamServer, _ *StreamServerInfo, stream StreamHandler) (interface{}, error) {
+				recorded = append(recorded, tag)
+				return stream(ctx, ss)
+			}
+		}
+		echo = func(_ context.Context, unmarshal func(interface{}) error) (interface{}, error) {
+			var req internal.TestPayload
+			if err := unmarshal(&req); err != nil {
+				return nil, err
+			}
+			return &req, nil
+		}
+
+		ctx    = context.Background()
+		server = mustServer(t)(NewServer(
+			WithChainUnaryServerInterceptor(unary("global 1"), unary("global 2")),
+			WithStreamServerInterceptor(stream("global stream")),
+		))
+		addr, listener  = newTestListener(t)
+		client, cleanup = newTestClient(t, addr)
+	)
+
+	defer listener.Close()
+	defer cleanup()
+
+	registerEchoStreamService(server, stream("service stream 1"), stream("service stream 2"))
+	server.RegisterService("intercepted", &ServiceDesc{
+		Methods:           map[string]Method{"Echo": echo},
+		UnaryInterceptors: []UnaryServerInterceptor{unary("service 1"), unary("service 2")},
+	})
+	server.RegisterService("plain", &ServiceDesc{
+		Methods: map[string]Method{"Echo": echo},
+	})
+
+	go server.Serve(ctx, listener)
+	defer server.Shutdown(ctx)
+
+	for _, tc := range []struct {
+		service  string
+		expected []string
+	}{
+		{"intercepted", []string{"global 1", "global 2", "service 1", "service 2"}},
+		{"plain", []string{"global 1", "global 2"}},
+	} {
+		recorded = recorded[:0]
+		var resp internal.TestPayload
+		if err := client.Call(ctx, tc.service, "Echo", &internal.TestPayload{Foo: "foo"}, &resp); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(recorded, tc.expected) {
+			t.Fatalf("unexpected %s interceptor order (%s != %s)", tc.service,
+				strings.Join(recorded, ", "), strings.Join(tc.expected, ", "))
+		}
+	}
+
+	recorded = recorded[:0]
+	echoStream(ctx, t, client, 1)
+	expected := []string{"global stream", "service stream 1", "service stream 2"}
+	if !reflect.DeepEqual(recorded, expected) {
+		t.Fatalf("unexpected stream interceptor order (%s != %s)",
+			strings.Join(recorded, ", "), strings.Join(expected, ", "))
+	}
+}
+
+type countingClientStream struct {
+	ClientStream
+	sent int
+}
+
+func (s *countingClientStream) SendMsg(m interface{}) error {
+	s.sent++
+	return s.ClientStream.SendMsg(m)
+}
+
+func TestStreamClientInterceptor(t *testing.T) {
+	var (
+		intercepted = 0
+		counter     *countingClientStream
+		interceptor = func(ctx context.Context, desc *StreamDesc, service, method string, req interface{}, streamer Streamer) (ClientStream, error) {
+			intercepted++
+			if service != serviceName || method != "EchoStream" {
+				t.Errorf("unexpected stream method: %s/%s", service, method)
+			}
+			if !desc.StreamingClient || !desc.StreamingServer {
+				t.Errorf("unexpected stream desc: %+v", desc)
+			}
+			cs, err := streamer(ctx, desc, service, method, req)
+			if err != nil {
+				return nil, err
+			}
+			counter = &countingClientStream{ClientStream: cs}
+			return counter, nil
+		}
+
+		ctx             = context.Background()
+		server          = mustServer(t)(NewServer())
+		addr, listener  = newTestListener(t)
+		client, cleanup = newTestClient(t, addr, WithStreamClientInterceptor(interceptor))
+	)
+
+	defer listener.Close()
+	defer cleanup()
+
+	registerEchoStreamService(server)
+
+	go server.Serve(ctx, listener)
+	defer server.Shutdown(ctx)
+
+	echoStream(ctx, t, client, 3)
+
+	if intercepted != 1 {
+		t.Fatalf("expected stream to be intercepted once, got %d", intercepted)
+	}
+	if counter.sent != 3 {
+		t.Fatalf("expected wrapped stream to be used for 3 sends, got %d", counter.sent)
+	}
+}
+
+func TestChainStreamClientInterceptor(t *testing.T) {
+	var (
+		orderIdx  = 0
+		recorded  = []string{}
+		intercept = func(idx int, tag string) StreamClientInterceptor {
+			return func(ctx context.Context, desc *StreamDesc, service, method string, req interface{}, streamer Streamer) (ClientStream, error) {
+				if idx != orderIdx {
+					t.Errorf("unexpected interceptor invocation order (%d != %d)", orderIdx, idx)
+				}
+				recorded = append(recorded, tag)
+				orderIdx++
+				return streamer(ctx, desc, service, method, req)
+			}
+		}
+
+		ctx             = context.Background()
+		server          = mustServer(t)(NewServer())
+		addr, listener  = newTestListener(t)
+		client, cleanup = newTestClient(t, addr,
+			WithStreamClientInterceptor(
+				intercept(0, "seen it"),
+			),
+			WithChainStreamClientInterceptor(
+				intercept(1, "been"),
+				intercept(2, "there"),
+				intercept(3, "done"),
+				intercept(4, "that"),
+			),
+		)
+		expected = []string{
+			"seen it",
+			"been",
+			"there",
+			"done",
+			"that",
+		}
+	)
+
+	defer listener.Close()
+	defer cleanup()
+
+	registerEchoStreamService(server)
+
+	go server.Serve(ctx, listener)
+	defer server.Shutdown(ctx)
+
+	echoStream(ctx, t, client, 1)
+
+	if !reflect.DeepEqual(recorded, expected) {
+		t.Fatalf("unexpected ttrpc chained client stream interceptor order (%s != %s)",
+			strings.Join(recorded, " "), strings.Join(expected, " "))
+	}
+}
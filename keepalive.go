@@ -0,0 +1,89 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ttrpc
+
+import (
+	"errors"
+	"time"
+)
+
+var errKeepaliveTimeout = errors.New("ttrpc: keepalive timeout")
+
+// keepalive periodically pings the remote and fails when a ping is not
+// answered with a pong within the timeout.
+type keepalive struct {
+	interval time.Duration
+	timeout  time.Duration
+	pongs    chan struct{}
+}
+
+func newKeepalive(interval, timeout time.Duration) *keepalive {
+	return &keepalive{
+		interval: interval,
+		timeout:  timeout,
+		pongs:    make(chan struct{}, 1),
+	}
+}
+
+// pong records a pong received from the remote.
+func (k *keepalive) pong() {
+	select {
+	case k.pongs <- struct{}{}:
+	default:
+	}
+}
+
+// run sends a ping every interval until done is closed. An error is returned
+// when a ping could not be sent or was not answered in time.
+func (k *keepalive) run(done <-chan struct{}, ping func() error) error {
+	ticker := time.NewTicker(k.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return nil
+		case <-ticker.C:
+		}
+
+		// discard any unsolicited pong
+		select {
+		case <-k.pongs:
+		default:
+		}
+
+		if err := ping(); err != nil {
+			select {
+			case <-done:
+				return nil
+			default:
+			}
+			return err
+		}
+
+		timer := time.NewTimer(k.timeout)
+		select {
+		case <-k.pongs:
+			timer.Stop()
+		case <-timer.C:
+			return errKeepaliveTimeout
+		case <-done:
+			timer.Stop()
+			return nil
+		}
+	}
+}
@@ -0,0 +1,160 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ttrpc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/containerd/ttrpc/internal"
+)
+
+func TestKeepalive(t *testing.T) {
+	var (
+		ctx    = context.Background()
+		server = mustServer(t)(NewServer(
+			WithServerKeepalive(10*time.Millisecond, time.Second),
+		))
+		addr, listener  = newTestListener(t)
+		client, cleanup = newTestClient(t, addr, WithKeepalive(10*time.Millisecond, time.Second))
+		tclient         = newTestingClient(client)
+	)
+	defer listener.Close()
+	defer cleanup()
+
+	registerTestingService(server, &testingServer{})
+
+	go server.Serve(ctx, listener)
+	defer server.Shutdown(ctx)
+
+	for i := 0; i < 5; i++ {
+		time.Sleep(20 * time.Millisecond)
+		if _, err := tclient.Test(ctx, &internal.TestPayload{Foo: "ping"}); err != nil {
+			t.Fatalf("call %d failed with keepalive enabled: %v", i, err)
+		}
+	}
+}
+
+func TestClientKeepaliveTimeout(t *testing.T) {
+	var (
+		ctx            = context.Background()
+		addr, listener = newTestListener(t)
+	)
+	defer listener.Close()
+
+	// the server reads everything but never answers a ping
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(io.Discard, conn)
+	}()
+
+	client, cleanup := newTestClient(t, addr, WithKeepalive(10*time.Millisecond, 50*time.Millisecond))
+	defer cleanup()
+
+	wctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if err := client.UserOnCloseWait(wctx); err != nil {
+		t.Fatalf("client was not closed after keepalive timeout: %v", err)
+	}
+
+	if err := client.Call(ctx, serviceName, "Test", &internal.TestPayload{}, &internal.TestPayload{}); !errors.Is(err, ErrClosed) {
+		t.Fatalf("expected ErrClosed after keepalive timeout, got %v", err)
+	}
+}
+
+func TestServerKeepaliveTimeout(t *testing.T) {
+	var (
+		ctx    = context.Background()
+		server = mustServer(t)(NewServer(
+			WithServerKeepalive(10*time.Millisecond, 50*time.Millisecond),
+		))
+		addr, listener = newTestListener(t)
+	)
+	defer listener.Close()
+
+	go server.Serve(ctx, listener)
+	defer server.Shutdown(ctx)
+
+	conn, err := net.Dial("unix", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// receive pings without answering them until the server gives up
+	ch := newChannel(conn)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var pings int
+	for {
+		mh, _, err := ch.recv()
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				t.Fatalf("expected connection to be closed by server, got %v", err)
+			}
+			break
+		}
+		if mh.StreamID != controlStreamID || mh.Type != messageTypePing {
+			t.Fatalf("unexpected message %v on stream %d", mh.Type, mh.StreamID)
+		}
+		pings++
+	}
+	if pings != 1 {
+		t.Fatalf("expected a single unanswered ping, got %d", pings)
+	}
+}
+
+func TestServerRepliesToPing(t *testing.T) {
+	var (
+		ctx            = context.Background()
+		server         = mustServer(t)(NewServer())
+		addr, listener = newTestListener(t)
+	)
+	defer listener.Close()
+
+	go server.Serve(ctx, listener)
+	defer server.Shutdown(ctx)
+
+	conn, err := net.Dial("unix", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	ch := newChannel(conn)
+	if err := ch.send(controlStreamID, messageTypePing, 0, []byte("12345678")); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	mh, p, err := ch.recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mh.StreamID != controlStreamID || mh.Type != messageTypePong {
+		t.Fatalf("expected pong on control stream, got %v on stream %d", mh.Type, mh.StreamID)
+	}
+	if string(p) != "12345678" {
+		t.Fatalf("expected ping data to be echoed, got %q", p)
+	}
+}
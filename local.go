@@ -0,0 +1,304 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ttrpc
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// LocalClient makes calls to the services registered on a Server within the
+// same process, without a connection. Requests and responses are still
+// marshaled with the server's codec and go through the server's interceptors,
+// so handlers observe calls as they would from a remote client.
+//
+// It is mostly useful for testing code which uses generated clients against a
+// real service implementation, see the gen_testfake option of
+// protoc-gen-go-ttrpc.
+type LocalClient struct {
+	server *Server
+}
+
+// NewLocalClient returns a LocalClient for the services registered on s. The
+// server does not need to be serving.
+func NewLocalClient(s *Server) *LocalClient {
+	return &LocalClient{server: s}
+}
+
+type localResponse struct {
+	status      *status.Status
+	data        []byte
+	closeStream bool
+	header      bool // metadata sent ahead of the stream data
+	metadata    MD
+}
+
+// start dispatches the request to the server, returning the stream handler
+// for streaming methods along with the responses of the call.
+func (c *LocalClient) start(ctx context.Context, service, method string, req interface{}, o *callOptions) (*streamHandler, <-chan localResponse, func(), error) {
+	var payload []byte
+	if req != nil {
+		var err error
+		payload, err = marshal(o.codecOr(c.server.services.codec), req)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	request := &Request{
+		Service:     service,
+		Method:      method,
+		Payload:     payload,
+		TimeoutNano: timeoutNano(ctx),
+	}
+	if err := setRequestMetadata(ctx, o, request); err != nil {
+		return nil, nil, nil, err
+	}
+
+	// The handler must not observe the values of the caller's context, only
+	// its cancellation.
+	sctx, cancel := context.WithCancel(context.Background())
+	stop := context.AfterFunc(ctx, cancel)
+	sctx, rmd := withServerResponseMetadata(sctx)
+	sctx, sentFds := withSentFds(sctx)
+
+	responses := make(chan localResponse)
+	sctx = withStreamHeader(sctx, func(md MD) error {
+		select {
+		case responses <- localResponse{header: true, metadata: md}:
+			return nil
+		case <-sctx.Done():
+			return ErrClosed
+		}
+	})
+	respond := func(st *status.Status, data []byte, streaming, closeStream bool) error {
+		var md MD
+		if closeStream {
+			md = rmd.get()
+			// handed over to the caller directly, there is no socket
+			receivedFds(ctx).add(sentFds.take())
+		}
+		select {
+		case responses <- localResponse{status: st, data: data, closeStream: closeStream, metadata: md}:
+			return nil
+		case <-sctx.Done():
+			return ErrClosed
+		}
+	}
+	sh, err := c.server.services.handle(sctx, request, false, respond)
+	if err != nil {
+		stop()
+		cancel()
+		return nil, nil, nil, err
+	}
+	return sh, responses, func() {
+		stop()
+		cancel()
+	}, nil
+}
+
+// Call makes a unary call to the server in-process.
+func (c *LocalClient) Call(ctx context.Context, service, method string, req, resp interface{}, opts ...CallOption) error {
+	o := newCallOptions(opts)
+	_, responses, done, err := c.start(ctx, service, method, req, o)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	var r localResponse
+	select {
+	case r = <-responses:
+	case <-ctx.Done():
+		return fromContextError(ctx.Err())
+	}
+	storeResponseMetadata(ctx, r.metadata)
+	if r.status.Code() != codes.OK {
+		return r.status.Err()
+	}
+	return unmarshal(o.codecOr(c.server.services.codec), r.data, resp)
+}
+
+// NewStream creates a stream to the server in-process.
+func (c *LocalClient) NewStream(ctx context.Context, desc *StreamDesc, service, method string, req interface{}, opts ...CallOption) (ClientStream, error) {
+	o := newCallOptions(opts)
+	sh, responses, done, err := c.start(ctx, service, method, req, o)
+	if err != nil {
+		return nil, err
+	}
+	if sh == nil {
+		done()
+		return nil, fmt.Errorf("%w: %s is not a streaming method", ErrProtocol, fullPath(service, method))
+	}
+	streamCtx, cancel := context.WithCancelCause(ctx)
+	cs := &localClientStream{
+		ctx:       ctx,
+		streamCtx: streamCtx,
+		cancel:    cancel,
+		codec:     o.codecOr(c.server.services.codec),
+		desc:      desc,
+		sh:        sh,
+		responses: responses,
+		done:      done,
+	}
+	if !desc.StreamingClient {
+		sh.closeSend()
+	}
+	return cs, nil
+}
+
+type localClientStream struct {
+	ctx       context.Context
+	streamCtx context.Context
+	cancel    context.CancelCauseFunc
+	codec     Codec
+	desc      *StreamDesc
+	sh        *streamHandler
+	responses <-chan localResponse
+	done      func()
+
+	sendLock     sync.Mutex
+	localClosed  bool
+	remoteClosed bool
+
+	header  MD
+	pending *localResponse // received by Header before RecvMsg
+}
+
+func (cs *localClientStream) Context() context.Context {
+	return cs.streamCtx
+}
+
+func (cs *localClientStream) CloseSend() error {
+	cs.sendLock.Lock()
+	defer cs.sendLock.Unlock()
+	if !cs.desc.StreamingClient || cs.localClosed {
+		return nil
+	}
+	cs.localClosed = true
+	cs.sh.closeSend()
+	return nil
+}
+
+func (cs *localClientStream) SendMsg(m interface{}) error {
+	if !cs.desc.StreamingClient {
+		return fmt.Errorf("%w: cannot send data from non-streaming client", ErrProtocol)
+	}
+	cs.sendLock.Lock()
+	defer cs.sendLock.Unlock()
+	if cs.localClosed {
+		return ErrStreamClosed
+	}
+	p, err := marshal(cs.codec, m)
+	if err != nil {
+		return err
+	}
+	return cs.sh.data(func(obj interface{}) error {
+		return unmarshalPayload(cs.sh.codec, p, obj)
+	})
+}
+
+func (cs *localClientStream) SetMetadata(md MD) error {
+	if !cs.desc.StreamingClient {
+		return fmt.Errorf("%w: cannot send metadata from non-streaming client", ErrProtocol)
+	}
+	cs.sendLock.Lock()
+	defer cs.sendLock.Unlock()
+	if cs.localClosed {
+		return ErrStreamClosed
+	}
+	if err := md.checkReserved(); err != nil {
+		return err
+	}
+	// the metadata goes through the same conversion as on the wire
+	req := &Request{}
+	md.setRequest(req)
+	update := MD{}
+	update.fromRequest(req)
+	return cs.sh.updateMetadata(update)
+}
+
+func (cs *localClientStream) Header() (MD, error) {
+	if cs.header == nil && !cs.remoteClosed {
+		r, err := cs.recv()
+		if err != nil {
+			return nil, err
+		}
+		if r.header {
+			cs.header = r.metadata
+		} else {
+			// no header was sent, keep the message for RecvMsg
+			cs.pending = &r
+		}
+	}
+	if cs.header == nil {
+		cs.header = MD{}
+	}
+	return cs.header, nil
+}
+
+// recv returns the next response sent by the handler.
+func (cs *localClientStream) recv() (localResponse, error) {
+	if r := cs.pending; r != nil {
+		cs.pending = nil
+		return *r, nil
+	}
+	select {
+	case r := <-cs.responses:
+		return r, nil
+	case <-cs.ctx.Done():
+		return localResponse{}, fromContextError(cs.ctx.Err())
+	}
+}
+
+func (cs *localClientStream) RecvMsg(m interface{}) error {
+	if cs.remoteClosed {
+		return io.EOF
+	}
+
+	r, err := cs.recv()
+	if err != nil {
+		return err
+	}
+	if r.header {
+		cs.header = r.metadata
+		if r, err = cs.recv(); err != nil {
+			return err
+		}
+	}
+	if r.closeStream {
+		cs.remoteClosed = true
+		cs.done()
+		storeResponseMetadata(cs.ctx, r.metadata)
+		if err := r.status.Err(); err != nil {
+			cs.cancel(err)
+		} else {
+			cs.cancel(io.EOF)
+		}
+	}
+	if r.status.Code() != codes.OK {
+		return r.status.Err()
+	}
+	if r.closeStream && r.data == nil && cs.desc.StreamingServer {
+		return io.EOF
+	}
+	return unmarshal(cs.codec, r.data, m)
+}
@@ -0,0 +1,87 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ttrpc
+
+import (
+	"context"
+	"testing"
+
+	"github.com/containerd/ttrpc/internal"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestLocalClient(t *testing.T) {
+	var (
+		ctx         = context.Background()
+		intercepted = 0
+		server      = mustServer(t)(NewServer(WithUnaryServerInterceptor(
+			func(ctx context.Context, unmarshal Unmarshaler, info *UnaryServerInfo, method Method) (interface{}, error) {
+				intercepted++
+				return method(ctx, unmarshal)
+			},
+		)))
+		client = NewLocalClient(server)
+	)
+
+	registerEchoStreamService(server)
+	server.RegisterMethod(serviceName, "Test", func(ctx context.Context, unmarshal func(interface{}) error) (interface{}, error) {
+		var req internal.TestPayload
+		if err := unmarshal(&req); err != nil {
+			return nil, err
+		}
+		return (&testingServer{}).Test(ctx, &req)
+	})
+
+	md := MD{}
+	md.Set("foo", "bar")
+	var resp internal.TestPayload
+	if err := client.Call(WithMetadata(ctx, md), serviceName, "Test", &internal.TestPayload{Foo: "a"}, &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Foo != "aa" || resp.Metadata != "bar" {
+		t.Fatalf("unexpected response: %+v", &resp)
+	}
+	if intercepted != 1 {
+		t.Fatalf("expected the server interceptor to be called once, got %d", intercepted)
+	}
+
+	err := client.Call(ctx, serviceName, "Missing", &internal.TestPayload{}, &resp)
+	if status.Code(err) != codes.Unimplemented {
+		t.Fatalf("expected Unimplemented, got %v", err)
+	}
+
+	stream, err := client.NewStream(ctx, &StreamDesc{true, true}, serviceName, "EchoStream", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := int64(0); i < 3; i++ {
+		if err := stream.SendMsg(&internal.EchoPayload{Seq: i}); err != nil {
+			t.Fatal(err)
+		}
+		var resp internal.EchoPayload
+		if err := stream.RecvMsg(&resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.Seq != i+1 {
+			t.Fatalf("unexpected sequence value: %d, expected %d", resp.Seq, i+1)
+		}
+	}
+	if err := stream.CloseSend(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,37 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ttrpc
+
+import (
+	"context"
+
+	"github.com/containerd/log"
+)
+
+// Logger receives the messages logged by clients and servers, see WithLogger
+// and WithServerLogger. By default messages are logged with the logger of
+// github.com/containerd/log.
+type Logger interface {
+	Debugf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// defaultLogger returns the logger used when none is configured, the logger
+// carried by ctx.
+func defaultLogger(ctx context.Context) Logger {
+	return log.G(ctx)
+}
@@ -18,17 +18,50 @@ package ttrpc
 
 import (
 	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
 	"strings"
+	"sync"
 )
 
+// ReservedMetadataPrefix is the prefix of the metadata keys used by ttrpc
+// itself. Applications must not use keys with this prefix for their own
+// metadata, calls sending such keys fail with ErrReservedMetadataKey. Reserved
+// keys documented to be set by clients, such as RequestIDMetadataKey, are
+// accepted.
+const ReservedMetadataPrefix = "ttrpc-"
+
+// IsReservedMetadataKey returns whether key is reserved for ttrpc.
+func IsReservedMetadataKey(key string) bool {
+	return strings.HasPrefix(strings.ToLower(key), ReservedMetadataPrefix)
+}
+
+// BinaryMetadataSuffix is the suffix of the metadata keys carrying binary
+// values. As with gRPC, their values are base64 encoded on the wire and hold
+// the raw bytes in MD, see MD.SetBinary and MD.GetBinary.
+const BinaryMetadataSuffix = "-bin"
+
+func isBinaryKey(key string) bool {
+	return strings.HasSuffix(key, BinaryMetadataSuffix)
+}
+
 // MD is the user type for ttrpc metadata
+//
+// Keys are case-insensitive: Get, Set and Append canonicalize them to lower
+// case, and keys are lowercased when metadata is sent or received, so peers
+// always agree on them. Values must be valid UTF-8, except for the values of
+// keys ending with BinaryMetadataSuffix which may hold any bytes.
 type MD map[string][]string
 
 // Get returns the metadata for a given key when they exist.
 // If there is no metadata, a nil slice and false are returned.
 func (m MD) Get(key string) ([]string, bool) {
-	key = strings.ToLower(key)
-	list, ok := m[key]
+	list, ok := m[strings.ToLower(key)]
+	if !ok {
+		// keys of maps built directly may not be canonical
+		list, ok = m[key]
+	}
 	if !ok || len(list) == 0 {
 		return nil, false
 	}
@@ -62,6 +95,43 @@ func (m MD) Append(key string, values ...string) {
 	}
 }
 
+// SetBinary sets the provided binary values for a given key, adding
+// BinaryMetadataSuffix to the key when missing. The values will overwrite any
+// existing values.
+func (m MD) SetBinary(key string, values ...[]byte) {
+	key = binaryKey(key)
+	if len(values) == 0 {
+		m.Set(key)
+		return
+	}
+	list := make([]string, len(values))
+	for i, v := range values {
+		list[i] = string(v)
+	}
+	m.Set(key, list...)
+}
+
+// GetBinary returns the binary values for a given key when they exist,
+// adding BinaryMetadataSuffix to the key when missing.
+func (m MD) GetBinary(key string) ([][]byte, bool) {
+	list, ok := m.Get(binaryKey(key))
+	if !ok {
+		return nil, false
+	}
+	values := make([][]byte, len(list))
+	for i, v := range list {
+		values[i] = []byte(v)
+	}
+	return values, true
+}
+
+func binaryKey(key string) string {
+	if isBinaryKey(strings.ToLower(key)) {
+		return key
+	}
+	return key + BinaryMetadataSuffix
+}
+
 // Clone returns a copy of MD or nil if it's nil.
 // It's copied from golang's `http.Header.Clone` implementation:
 // https://cs.opensource.google/go/go/+/refs/tags/go1.23.4:src/net/http/header.go;l=94
@@ -91,20 +161,87 @@ func (m MD) Clone() MD {
 }
 
 func (m MD) setRequest(r *Request) {
+	r.Metadata = m.appendKeyValues(r.Metadata)
+}
+
+// checkReserved returns an error when m uses a reserved key which clients
+// may not set.
+func (m MD) checkReserved() error {
+	for k := range m {
+		if IsReservedMetadataKey(k) && strings.ToLower(k) != RequestIDMetadataKey {
+			return fmt.Errorf("%w: %q", ErrReservedMetadataKey, k)
+		}
+	}
+	return nil
+}
+
+// setRequestMetadata adds the metadata attached to ctx and the metadata of
+// the call options to the request.
+func setRequestMetadata(ctx context.Context, o *callOptions, r *Request) error {
+	md, _ := GetMetadata(ctx)
+	if err := md.checkReserved(); err != nil {
+		return err
+	}
+	if err := o.metadata.checkReserved(); err != nil {
+		return err
+	}
+	md.setRequest(r)
+	o.metadata.setRequest(r)
+	return nil
+}
+
+func (m MD) fromRequest(r *Request) {
+	m.addKeyValues(r.Metadata)
+}
+
+func (m MD) setResponse(r *Response) {
+	r.Metadata = m.appendKeyValues(r.Metadata)
+}
+
+func (m MD) fromResponse(r *Response) {
+	m.addKeyValues(r.Metadata)
+}
+
+// appendKeyValues appends the metadata to kvs as sent on the wire, with
+// canonical keys and binary values base64 encoded.
+func (m MD) appendKeyValues(kvs []*KeyValue) []*KeyValue {
 	for k, values := range m {
+		k = strings.ToLower(k)
+		binary := isBinaryKey(k)
 		for _, v := range values {
-			r.Metadata = append(r.Metadata, &KeyValue{
+			if binary {
+				v = base64.RawStdEncoding.EncodeToString([]byte(v))
+			}
+			kvs = append(kvs, &KeyValue{
 				Key:   k,
 				Value: v,
 			})
 		}
 	}
+	return kvs
 }
 
-func (m MD) fromRequest(r *Request) {
-	for _, kv := range r.Metadata {
-		m[kv.Key] = append(m[kv.Key], kv.Value)
+// addKeyValues adds the metadata received on the wire to m, decoding binary
+// values. Values which are not valid base64 are kept as is.
+func (m MD) addKeyValues(kvs []*KeyValue) {
+	for _, kv := range kvs {
+		k, v := strings.ToLower(kv.Key), kv.Value
+		if isBinaryKey(k) {
+			if b, err := decodeBinary(v); err == nil {
+				v = string(b)
+			}
+		}
+		m[k] = append(m[k], v)
+	}
+}
+
+// decodeBinary decodes a binary metadata value, accepting base64 with or
+// without padding as gRPC does.
+func decodeBinary(v string) ([]byte, error) {
+	if len(v)%4 == 0 {
+		return base64.StdEncoding.DecodeString(v)
 	}
+	return base64.RawStdEncoding.DecodeString(v)
 }
 
 type metadataKey struct{}
@@ -133,3 +270,113 @@ func GetMetadataValue(ctx context.Context, name string) (string, bool) {
 func WithMetadata(ctx context.Context, md MD) context.Context {
 	return context.WithValue(ctx, metadataKey{}, md)
 }
+
+type metadataUpdatesKey struct{}
+
+// metadataUpdates holds the function handling the metadata updates sent by
+// the client of a stream.
+type metadataUpdates struct {
+	mu sync.Mutex
+	fn func(MD)
+}
+
+func (u *metadataUpdates) call(md MD) {
+	u.mu.Lock()
+	fn := u.fn
+	u.mu.Unlock()
+	if fn != nil {
+		fn(md)
+	}
+}
+
+// OnMetadataUpdate sets fn to be called with the metadata sent by the client
+// with ClientStream.SetMetadata on the stream handled with ctx. fn is called
+// from RecvMsg, in order with the messages of the stream, so an update sent
+// before a message is handled before the message is returned. Updates
+// received before fn is set are dropped.
+func OnMetadataUpdate(ctx context.Context, fn func(MD)) error {
+	u, ok := ctx.Value(metadataUpdatesKey{}).(*metadataUpdates)
+	if !ok {
+		return errors.New("ttrpc: metadata updates can only be received by stream handlers")
+	}
+	u.mu.Lock()
+	u.fn = fn
+	u.mu.Unlock()
+	return nil
+}
+
+type (
+	responseMetadataKey       struct{}
+	clientResponseMetadataKey struct{}
+	streamHeaderKey           struct{}
+)
+
+// responseMetadata collects the metadata set by a server handler for the
+// response of its call.
+type responseMetadata struct {
+	mu sync.Mutex
+	md MD
+}
+
+func (rmd *responseMetadata) get() MD {
+	rmd.mu.Lock()
+	defer rmd.mu.Unlock()
+	return rmd.md.Clone()
+}
+
+func withServerResponseMetadata(ctx context.Context) (context.Context, *responseMetadata) {
+	rmd := &responseMetadata{}
+	return context.WithValue(ctx, responseMetadataKey{}, rmd), rmd
+}
+
+// withStreamHeader returns a context for a server call which sends the header
+// metadata of a stream with send.
+func withStreamHeader(ctx context.Context, send func(MD) error) context.Context {
+	return context.WithValue(ctx, streamHeaderKey{}, send)
+}
+
+// SetResponseMetadata appends md to the metadata sent back to the client with
+// the response of the server call in the context. Metadata is sent once the
+// call finishes, so it must be set before the handler returns.
+func SetResponseMetadata(ctx context.Context, md MD) error {
+	rmd, ok := ctx.Value(responseMetadataKey{}).(*responseMetadata)
+	if !ok {
+		return errors.New("ttrpc: response metadata can only be set on server calls")
+	}
+	rmd.mu.Lock()
+	defer rmd.mu.Unlock()
+	if rmd.md == nil {
+		rmd.md = MD{}
+	}
+	for k, values := range md {
+		rmd.md.Append(k, values...)
+	}
+	return nil
+}
+
+// WithResponseMetadata returns a context which records the metadata sent by
+// the server with the response of a client call into md. For unary calls md is
+// set once Call returns, including when the call fails with a status. For
+// streams it is set once RecvMsg returns the end of the stream or its status.
+func WithResponseMetadata(ctx context.Context, md *MD) context.Context {
+	return context.WithValue(ctx, clientResponseMetadataKey{}, md)
+}
+
+// setResponseMetadata stores the metadata of resp for the caller that asked
+// for it with WithResponseMetadata.
+func setResponseMetadata(ctx context.Context, resp *Response) {
+	md := MD{}
+	md.fromResponse(resp)
+	storeResponseMetadata(ctx, md)
+}
+
+func storeResponseMetadata(ctx context.Context, md MD) {
+	out, ok := ctx.Value(clientResponseMetadataKey{}).(*MD)
+	if !ok || out == nil {
+		return
+	}
+	if md == nil {
+		md = MD{}
+	}
+	*out = md
+}
@@ -17,10 +17,18 @@
 package ttrpc
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"io"
+	"strings"
 	"sync"
 	"testing"
+
+	"github.com/containerd/ttrpc/internal"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 func TestMetadataGet(t *testing.T) {
@@ -47,6 +55,24 @@ func TestMetadataGetInvalidKey(t *testing.T) {
 	}
 }
 
+func TestMetadataCaseInsensitive(t *testing.T) {
+	metadata := make(MD)
+	metadata.Set("Foo", "1")
+	metadata.Append("FOO", "2")
+
+	if list, ok := metadata.Get("fOO"); !ok || len(list) != 2 || list[0] != "1" || list[1] != "2" {
+		t.Errorf("unexpected values: %v", list)
+	}
+	if len(metadata) != 1 {
+		t.Errorf("expected a single key, got %v", metadata)
+	}
+
+	// keys of maps built directly are found as is
+	if _, ok := (MD{"Bar": {"1"}}).Get("Bar"); !ok {
+		t.Error("key not found")
+	}
+}
+
 func TestMetadataUnset(t *testing.T) {
 	metadata := make(MD)
 	metadata.Set("foo", "1", "2")
@@ -205,3 +231,414 @@ func BenchmarkSimpleMetadataClone(b *testing.B) {
 		})
 	}
 }
+
+func TestMetadataStream(t *testing.T) {
+	var (
+		ctx             = context.Background()
+		server          = mustServer(t)(NewServer())
+		addr, listener  = newTestListener(t)
+		client, cleanup = newTestClient(t, addr)
+	)
+	defer listener.Close()
+	defer cleanup()
+
+	server.RegisterService(serviceName, &ServiceDesc{
+		Streams: map[string]Stream{
+			"Metadata": {
+				Handler: func(ctx context.Context, ss StreamServer) (interface{}, error) {
+					v, _ := GetMetadataValue(ctx, "foo")
+					return &internal.EchoPayload{Msg: v}, nil
+				},
+			},
+			"Open": {
+				Handler: func(ctx context.Context, ss StreamServer) (interface{}, error) {
+					// metadata of the open frame stays available while
+					// messages are received
+					var req internal.EchoPayload
+					if err := ss.RecvMsg(&req); err != nil {
+						return nil, err
+					}
+					md, _ := GetMetadata(ss.Context())
+					foo, _ := md.Get("foo")
+					call, _ := md.Get("call")
+					return &internal.EchoPayload{Msg: fmt.Sprintf("%s %v %v", req.Msg, foo, call)}, nil
+				},
+				StreamingClient: true,
+			},
+		},
+	})
+
+	go server.Serve(ctx, listener)
+	defer server.Shutdown(ctx)
+
+	md := MD{}
+	md.Set("foo", "bar")
+	stream, err := client.NewStream(WithMetadata(ctx, md), &StreamDesc{}, serviceName, "Metadata", &internal.EchoPayload{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resp internal.EchoPayload
+	if err := stream.RecvMsg(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Msg != "bar" {
+		t.Fatalf("expected stream metadata to be sent, got %q", resp.Msg)
+	}
+
+	stream, err = client.NewStream(WithMetadata(ctx, md), &StreamDesc{StreamingClient: true}, serviceName, "Open", nil, WithCallMetadata(MD{"call": {"option"}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.SendMsg(&internal.EchoPayload{Msg: "msg"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.CloseSend(); err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.RecvMsg(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Msg != "msg [bar] [option]" {
+		t.Fatalf("expected open frame metadata in stream context, got %q", resp.Msg)
+	}
+}
+
+func TestResponseMetadata(t *testing.T) {
+	var (
+		ctx             = context.Background()
+		server          = mustServer(t)(NewServer())
+		addr, listener  = newTestListener(t)
+		client, cleanup = newTestClient(t, addr)
+	)
+	defer listener.Close()
+	defer cleanup()
+
+	setVersion := func(ctx context.Context) error {
+		md := MD{}
+		md.Set("server-version", "1.0")
+		return SetResponseMetadata(ctx, md)
+	}
+	server.RegisterService(serviceName, &ServiceDesc{
+		Methods: map[string]Method{
+			"Unary": func(ctx context.Context, unmarshal func(interface{}) error) (interface{}, error) {
+				if err := setVersion(ctx); err != nil {
+					return nil, err
+				}
+				return &internal.EchoPayload{}, nil
+			},
+			"Fail": func(ctx context.Context, unmarshal func(interface{}) error) (interface{}, error) {
+				if err := setVersion(ctx); err != nil {
+					return nil, err
+				}
+				return nil, status.Error(codes.ResourceExhausted, "rate limited")
+			},
+		},
+		Streams: map[string]Stream{
+			"Stream": {
+				Handler: func(ctx context.Context, ss StreamServer) (interface{}, error) {
+					if err := setVersion(ctx); err != nil {
+						return nil, err
+					}
+					return &internal.EchoPayload{}, nil
+				},
+			},
+			"ServerStream": {
+				Handler: func(ctx context.Context, ss StreamServer) (interface{}, error) {
+					if err := setVersion(ctx); err != nil {
+						return nil, err
+					}
+					return nil, ss.SendMsg(&internal.EchoPayload{})
+				},
+				StreamingServer: true,
+			},
+		},
+	})
+
+	go server.Serve(ctx, listener)
+	defer server.Shutdown(ctx)
+
+	check := func(md MD) {
+		t.Helper()
+		if v, ok := md.Get("server-version"); !ok || v[0] != "1.0" {
+			t.Fatalf("unexpected response metadata: %v", md)
+		}
+	}
+
+	var md MD
+	if err := client.Call(WithResponseMetadata(ctx, &md), serviceName, "Unary", &internal.EchoPayload{}, &internal.EchoPayload{}); err != nil {
+		t.Fatal(err)
+	}
+	check(md)
+
+	md = nil
+	err := client.Call(WithResponseMetadata(ctx, &md), serviceName, "Fail", &internal.EchoPayload{}, &internal.EchoPayload{})
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("expected ResourceExhausted, got %v", err)
+	}
+	check(md)
+
+	md = nil
+	stream, err := client.NewStream(WithResponseMetadata(ctx, &md), &StreamDesc{}, serviceName, "Stream", &internal.EchoPayload{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.RecvMsg(&internal.EchoPayload{}); err != nil {
+		t.Fatal(err)
+	}
+	check(md)
+
+	// the metadata of a server stream is sent ahead of its final message
+	md = nil
+	stream, err = client.NewStream(WithResponseMetadata(ctx, &md), &StreamDesc{StreamingServer: true}, serviceName, "ServerStream", &internal.EchoPayload{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.RecvMsg(&internal.EchoPayload{}); err != nil {
+		t.Fatal(err)
+	}
+	if md != nil {
+		t.Fatalf("unexpected response metadata before the end of the stream: %v", md)
+	}
+	if err := stream.RecvMsg(&internal.EchoPayload{}); err != io.EOF {
+		t.Fatalf("expected end of stream, got %v", err)
+	}
+	check(md)
+
+	if err := SetResponseMetadata(ctx, MD{}); err == nil {
+		t.Fatal("expected setting response metadata outside of a server call to fail")
+	}
+}
+
+func TestCallMetadata(t *testing.T) {
+	var (
+		ctx             = context.Background()
+		server          = mustServer(t)(NewServer())
+		addr, listener  = newTestListener(t)
+		client, cleanup = newTestClient(t, addr)
+		local           = NewLocalClient(server)
+	)
+	defer listener.Close()
+	defer cleanup()
+
+	foo := func(ctx context.Context) *internal.EchoPayload {
+		v, _ := GetMetadata(ctx)
+		list, _ := v.Get("foo")
+		return &internal.EchoPayload{Msg: strings.Join(list, ",")}
+	}
+	server.RegisterService(serviceName, &ServiceDesc{
+		Methods: map[string]Method{
+			"Unary": func(ctx context.Context, unmarshal func(interface{}) error) (interface{}, error) {
+				return foo(ctx), nil
+			},
+		},
+		Streams: map[string]Stream{
+			"Stream": {
+				Handler: func(ctx context.Context, ss StreamServer) (interface{}, error) {
+					return foo(ctx), nil
+				},
+			},
+		},
+	})
+
+	go server.Serve(ctx, listener)
+	defer server.Shutdown(ctx)
+
+	md := MD{}
+	md.Set("foo", "context")
+	mdctx := WithMetadata(ctx, md)
+	opts := []CallOption{WithCallMetadata(MD{"foo": {"call"}}), WithCallMetadata(MD{"foo": {"again"}})}
+
+	for _, tc := range []struct {
+		name     string
+		call     func(ctx context.Context, resp *internal.EchoPayload) error
+		expected string
+	}{
+		{"Call", func(ctx context.Context, resp *internal.EchoPayload) error {
+			return client.Call(ctx, serviceName, "Unary", &internal.EchoPayload{}, resp, opts...)
+		}, "context,call,again"},
+		{"CallWithoutContext", func(_ context.Context, resp *internal.EchoPayload) error {
+			return client.Call(ctx, serviceName, "Unary", &internal.EchoPayload{}, resp, opts...)
+		}, "call,again"},
+		{"NewStream", func(ctx context.Context, resp *internal.EchoPayload) error {
+			stream, err := client.NewStream(ctx, &StreamDesc{}, serviceName, "Stream", &internal.EchoPayload{}, opts...)
+			if err != nil {
+				return err
+			}
+			return stream.RecvMsg(resp)
+		}, "context,call,again"},
+		{"LocalCall", func(ctx context.Context, resp *internal.EchoPayload) error {
+			return local.Call(ctx, serviceName, "Unary", &internal.EchoPayload{}, resp, opts...)
+		}, "context,call,again"},
+		{"LocalNewStream", func(ctx context.Context, resp *internal.EchoPayload) error {
+			stream, err := local.NewStream(ctx, &StreamDesc{}, serviceName, "Stream", &internal.EchoPayload{}, opts...)
+			if err != nil {
+				return err
+			}
+			return stream.RecvMsg(resp)
+		}, "context,call,again"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var resp internal.EchoPayload
+			if err := tc.call(mdctx, &resp); err != nil {
+				t.Fatal(err)
+			}
+			if resp.Msg != tc.expected {
+				t.Fatalf("expected metadata %q, got %q", tc.expected, resp.Msg)
+			}
+		})
+	}
+
+	// the metadata of the context is left untouched
+	if list, _ := md.Get("foo"); len(list) != 1 {
+		t.Fatalf("context metadata was modified: %v", list)
+	}
+}
+
+func TestReservedMetadata(t *testing.T) {
+	var (
+		ctx             = context.Background()
+		server          = mustServer(t)(NewServer())
+		addr, listener  = newTestListener(t)
+		client, cleanup = newTestClient(t, addr)
+		local           = NewLocalClient(server)
+	)
+	defer listener.Close()
+	defer cleanup()
+
+	registerTestingService(server, &testingServer{})
+	server.RegisterService("streamService", &ServiceDesc{
+		Streams: map[string]Stream{
+			"Stream": {
+				Handler: func(ctx context.Context, ss StreamServer) (interface{}, error) {
+					return &internal.EchoPayload{}, nil
+				},
+			},
+		},
+	})
+
+	go server.Serve(ctx, listener)
+	defer server.Shutdown(ctx)
+
+	if !IsReservedMetadataKey("TTRPC-Foo") || IsReservedMetadataKey("foo-ttrpc") {
+		t.Fatal("unexpected reserved keys")
+	}
+
+	for _, tc := range []struct {
+		name string
+		ctx  context.Context
+		opts []CallOption
+	}{
+		{"Context", WithMetadata(ctx, MD{"ttrpc-foo": {"bar"}}), nil},
+		{"CallOption", ctx, []CallOption{WithCallMetadata(MD{"TTRPC-Foo": {"bar"}})}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req := &internal.TestPayload{Foo: "foo"}
+			if err := client.Call(tc.ctx, serviceName, "Test", req, &internal.TestPayload{}, tc.opts...); !errors.Is(err, ErrReservedMetadataKey) {
+				t.Fatalf("expected %v, got %v", ErrReservedMetadataKey, err)
+			}
+			if err := local.Call(tc.ctx, serviceName, "Test", req, &internal.TestPayload{}, tc.opts...); !errors.Is(err, ErrReservedMetadataKey) {
+				t.Fatalf("expected %v from the local client, got %v", ErrReservedMetadataKey, err)
+			}
+			if _, err := client.NewStream(tc.ctx, &StreamDesc{}, "streamService", "Stream", &internal.EchoPayload{}, tc.opts...); !errors.Is(err, ErrReservedMetadataKey) {
+				t.Fatalf("expected %v creating a stream, got %v", ErrReservedMetadataKey, err)
+			}
+		})
+	}
+
+	// clients may propagate their request ID
+	mdctx := WithMetadata(ctx, MD{RequestIDMetadataKey: {"id"}})
+	if err := client.Call(mdctx, serviceName, "Test", &internal.TestPayload{Foo: "foo"}, &internal.TestPayload{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMetadataCanonicalKeys(t *testing.T) {
+	var (
+		ctx             = context.Background()
+		server          = mustServer(t)(NewServer())
+		addr, listener  = newTestListener(t)
+		client, cleanup = newTestClient(t, addr)
+	)
+	defer listener.Close()
+	defer cleanup()
+
+	server.RegisterService(serviceName, &ServiceDesc{
+		Methods: map[string]Method{
+			"Unary": func(ctx context.Context, unmarshal func(interface{}) error) (interface{}, error) {
+				md, _ := GetMetadata(ctx)
+				return &internal.EchoPayload{Msg: strings.Join(md["foo-bar"], ",")}, nil
+			},
+		},
+	})
+
+	go server.Serve(ctx, listener)
+	defer server.Shutdown(ctx)
+
+	// mixed-case keys of a map built directly reach the server lowercased
+	mdctx := WithMetadata(ctx, MD{"Foo-Bar": {"1"}, "FOO-BAR": {"2"}})
+	var resp internal.EchoPayload
+	if err := client.Call(mdctx, serviceName, "Unary", &internal.EchoPayload{}, &resp); err != nil {
+		t.Fatal(err)
+	}
+	if values := strings.Split(resp.Msg, ","); len(values) != 2 {
+		t.Fatalf("expected both values under the canonical key, got %q", resp.Msg)
+	}
+}
+
+func TestMetadataBinary(t *testing.T) {
+	var (
+		ctx             = context.Background()
+		server          = mustServer(t)(NewServer())
+		addr, listener  = newTestListener(t)
+		client, cleanup = newTestClient(t, addr)
+		token           = []byte{0xff, 0x00, 0xfe, 'a'}
+	)
+	defer listener.Close()
+	defer cleanup()
+
+	md := MD{}
+	md.SetBinary("Token", token)
+	if values, ok := md.GetBinary("token-bin"); !ok || len(values) != 1 || !bytes.Equal(values[0], token) {
+		t.Fatalf("unexpected binary values %v", values)
+	}
+
+	// binary values are base64 encoded on the wire
+	req := &Request{}
+	md.setRequest(req)
+	if len(req.Metadata) != 1 || req.Metadata[0].Key != "token-bin" || req.Metadata[0].Value != "/wD+YQ" {
+		t.Fatalf("unexpected request metadata %v", req.Metadata)
+	}
+
+	server.RegisterService(serviceName, &ServiceDesc{
+		Methods: map[string]Method{
+			"Unary": func(ctx context.Context, unmarshal func(interface{}) error) (interface{}, error) {
+				md, _ := GetMetadata(ctx)
+				values, ok := md.GetBinary("token")
+				if !ok || len(values) != 1 || !bytes.Equal(values[0], token) {
+					return nil, status.Errorf(codes.InvalidArgument, "unexpected binary values %v", values)
+				}
+				resp := MD{}
+				resp.SetBinary("echo-bin", values[0])
+				return &internal.EchoPayload{}, SetResponseMetadata(ctx, resp)
+			},
+		},
+	})
+
+	go server.Serve(ctx, listener)
+	defer server.Shutdown(ctx)
+
+	result, err := client.CallWithResult(WithMetadata(ctx, md), serviceName, "Unary", &internal.EchoPayload{}, &internal.EchoPayload{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if values, ok := result.Metadata.GetBinary("echo"); !ok || len(values) != 1 || !bytes.Equal(values[0], token) {
+		t.Fatalf("unexpected binary response values %v", values)
+	}
+
+	// padded values are accepted as well
+	md = MD{}
+	md.fromRequest(&Request{Metadata: []*KeyValue{{Key: "token-bin", Value: "/wD+YQ=="}}})
+	if values, _ := md.GetBinary("token"); len(values) != 1 || !bytes.Equal(values[0], token) {
+		t.Fatalf("unexpected binary values %v", values)
+	}
+}
@@ -0,0 +1,64 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ttrpc
+
+import (
+	"context"
+	"net"
+)
+
+type peerKey struct{}
+
+// peer describes the client connection a call was received on.
+type peer struct {
+	conn      net.Conn
+	handshake interface{}
+	calls     *peerCalls // calls made to the client with CallPeer
+}
+
+func withPeer(ctx context.Context, conn net.Conn, handshake interface{}, calls *peerCalls) context.Context {
+	return context.WithValue(ctx, peerKey{}, &peer{conn: conn, handshake: handshake, calls: calls})
+}
+
+func getPeer(ctx context.Context) (*peer, bool) {
+	p, ok := ctx.Value(peerKey{}).(*peer)
+	return p, ok
+}
+
+// GetPeerAddress returns the remote address of the client connection the call
+// in the context was received on. It is only available to server handlers and
+// interceptors.
+func GetPeerAddress(ctx context.Context) (net.Addr, bool) {
+	p, ok := getPeer(ctx)
+	if !ok {
+		return nil, false
+	}
+	addr := p.conn.RemoteAddr()
+	return addr, addr != nil
+}
+
+// ConnectionInfo returns the value produced by the Handshaker of the server for
+// the connection the call in the context was received on, such as the
+// tls.ConnectionState returned by TLSHandshaker. It returns false outside of
+// server handlers and interceptors, or when the handshaker returned nil.
+func ConnectionInfo(ctx context.Context) (interface{}, bool) {
+	p, ok := getPeer(ctx)
+	if !ok || p.handshake == nil {
+		return nil, false
+	}
+	return p.handshake, true
+}
@@ -0,0 +1,74 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ttrpc
+
+import "sync"
+
+// handlerPool runs unary handlers on a bounded number of goroutines, see
+// WithHandlerPool. Workers are started on demand and keep taking queued
+// handlers until the queue is empty, so bursts of calls reuse goroutines
+// without the pool having to be stopped.
+type handlerPool struct {
+	size      int
+	queueSize int
+
+	mu      sync.Mutex
+	workers int
+	queue   []func()
+}
+
+func newHandlerPool(size, queueSize int) *handlerPool {
+	return &handlerPool{
+		size:      size,
+		queueSize: queueSize,
+	}
+}
+
+// submit runs fn on a worker, or queues it when all workers are busy. It
+// returns false when the queue is full.
+func (p *handlerPool) submit(fn func()) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.workers < p.size {
+		p.workers++
+		go p.work(fn)
+		return true
+	}
+	if len(p.queue) >= p.queueSize {
+		return false
+	}
+	p.queue = append(p.queue, fn)
+	return true
+}
+
+func (p *handlerPool) work(fn func()) {
+	for fn != nil {
+		fn()
+
+		p.mu.Lock()
+		if len(p.queue) == 0 {
+			p.workers--
+			fn = nil
+		} else {
+			fn = p.queue[0]
+			p.queue[0] = nil
+			p.queue = p.queue[1:]
+		}
+		p.mu.Unlock()
+	}
+}
@@ -0,0 +1,132 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ttrpc
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/containerd/ttrpc/internal"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestServerHandlerPool(t *testing.T) {
+	var (
+		ctx             = context.Background()
+		server          = mustServer(t)(NewServer(WithHandlerPool(1), WithHandlerQueueSize(1)))
+		addr, listener  = newTestListener(t)
+		client, cleanup = newTestClient(t, addr)
+		started         = make(chan struct{}, 3)
+		release         = make(chan struct{})
+	)
+	defer listener.Close()
+	defer cleanup()
+
+	server.RegisterService(serviceName, &ServiceDesc{
+		Methods: map[string]Method{
+			"Block": func(ctx context.Context, unmarshal func(interface{}) error) (interface{}, error) {
+				started <- struct{}{}
+				<-release
+				return &internal.TestPayload{}, nil
+			},
+		},
+	})
+	go server.Serve(ctx, listener)
+	defer server.Shutdown(ctx)
+
+	errs := make(chan error, 3)
+	call := func() {
+		errs <- client.Call(ctx, serviceName, "Block", &internal.TestPayload{}, &internal.TestPayload{})
+	}
+
+	// the first call takes the only worker, of the next two one is queued and
+	// the other is shed
+	go call()
+	<-started
+	go call()
+	go call()
+
+	select {
+	case err := <-errs:
+		if code := status.Code(err); code != codes.ResourceExhausted {
+			t.Fatalf("expected %v, got %v", codes.ResourceExhausted, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no call was shed")
+	}
+	select {
+	case <-started:
+		t.Fatal("queued call started while the worker was busy")
+	default:
+	}
+
+	close(release)
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := len(started); n != 1 {
+		t.Fatalf("expected the queued call to run, %d started", n)
+	}
+}
+
+func TestServerHandlerPoolStreams(t *testing.T) {
+	var (
+		ctx            = context.Background()
+		server         = mustServer(t)(NewServer(WithHandlerPool(1), WithHandlerQueueSize(0)))
+		addr, listener = newTestListener(t)
+		release        = make(chan struct{})
+	)
+	defer listener.Close()
+
+	server.RegisterService(serviceName, &ServiceDesc{
+		Methods: map[string]Method{
+			"Test": func(ctx context.Context, unmarshal func(interface{}) error) (interface{}, error) {
+				return &internal.TestPayload{}, nil
+			},
+		},
+		Streams: map[string]Stream{
+			"Hold": {
+				Handler: func(ctx context.Context, ss StreamServer) (interface{}, error) {
+					<-release
+					return &internal.TestPayload{}, nil
+				},
+			},
+		},
+	})
+	go server.Serve(ctx, listener)
+	defer server.Shutdown(ctx)
+	defer close(release)
+
+	streamClient, cleanup := newTestClient(t, addr)
+	defer cleanup()
+	for i := 0; i < 2; i++ {
+		if _, err := streamClient.NewStream(ctx, &StreamDesc{}, serviceName, "Hold", &internal.TestPayload{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// streams in progress do not hold the worker
+	client, cleanup := newTestClient(t, addr)
+	defer cleanup()
+	if err := client.Call(ctx, serviceName, "Test", &internal.TestPayload{}, &internal.TestPayload{}); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,80 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ttrpc
+
+import (
+	"context"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Limiter limits the rate of calls made by a client, see WithClientRateLimit.
+// It is satisfied by *rate.Limiter from golang.org/x/time/rate.
+type Limiter interface {
+	// Allow reports whether a call may be made now, consuming a token if so.
+	Allow() bool
+	// Wait blocks until a call may be made or ctx is done.
+	Wait(ctx context.Context) error
+}
+
+// WithClientRateLimit limits the rate of unary calls and stream opens made by
+// the client with limiter, blocking calls until the limiter allows them or
+// their context is done. The limit is applied by interceptors chained after
+// any interceptor set by previous options.
+func WithClientRateLimit(limiter Limiter) ClientOpts {
+	return withRateLimit(func(ctx context.Context) error {
+		if err := limiter.Wait(ctx); err != nil {
+			if ctx.Err() != nil {
+				return fromContextError(ctx.Err())
+			}
+			return status.Error(codes.ResourceExhausted, err.Error())
+		}
+		return nil
+	})
+}
+
+// WithClientRateLimitFailFast is like WithClientRateLimit but fails calls made
+// while the limiter does not allow them with codes.ResourceExhausted instead
+// of blocking.
+func WithClientRateLimitFailFast(limiter Limiter) ClientOpts {
+	return withRateLimit(func(context.Context) error {
+		if !limiter.Allow() {
+			return status.Error(codes.ResourceExhausted, "ttrpc: client rate limit exceeded")
+		}
+		return nil
+	})
+}
+
+func withRateLimit(limit func(context.Context) error) ClientOpts {
+	unary := WithChainUnaryClientInterceptor(func(ctx context.Context, req *Request, resp *Response, _ *UnaryClientInfo, invoker Invoker) error {
+		if err := limit(ctx); err != nil {
+			return err
+		}
+		return invoker(ctx, req, resp)
+	})
+	stream := WithChainStreamClientInterceptor(func(ctx context.Context, desc *StreamDesc, service, method string, req interface{}, streamer Streamer) (ClientStream, error) {
+		if err := limit(ctx); err != nil {
+			return nil, err
+		}
+		return streamer(ctx, desc, service, method, req)
+	})
+	return func(c *Client) {
+		unary(c)
+		stream(c)
+	}
+}
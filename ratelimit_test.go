@@ -0,0 +1,107 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ttrpc
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/containerd/ttrpc/internal"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// tokenLimiter allows a call for every token put into it.
+type tokenLimiter chan struct{}
+
+func (l tokenLimiter) Allow() bool {
+	select {
+	case <-l:
+		return true
+	default:
+		return false
+	}
+}
+
+func (l tokenLimiter) Wait(ctx context.Context) error {
+	select {
+	case <-l:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func TestClientRateLimit(t *testing.T) {
+	var (
+		ctx            = context.Background()
+		server         = mustServer(t)(NewServer())
+		addr, listener = newTestListener(t)
+	)
+	defer listener.Close()
+
+	registerTestingService(server, &testingServer{})
+
+	go server.Serve(ctx, listener)
+	defer server.Shutdown(ctx)
+
+	call := func(client *Client, ctx context.Context) error {
+		return client.Call(ctx, serviceName, "Test", &internal.TestPayload{Foo: "foo"}, &internal.TestPayload{})
+	}
+
+	t.Run("FailFast", func(t *testing.T) {
+		limiter := make(tokenLimiter, 2)
+		limiter <- struct{}{}
+		client, cleanup := newTestClient(t, addr, WithClientRateLimitFailFast(limiter))
+		defer cleanup()
+
+		if err := call(client, ctx); err != nil {
+			t.Fatal(err)
+		}
+		if err := call(client, ctx); status.Code(err) != codes.ResourceExhausted {
+			t.Fatalf("expected resource exhausted error, got %v", err)
+		}
+		if _, err := client.NewStream(ctx, &StreamDesc{StreamingServer: true}, serviceName, "Missing", nil); status.Code(err) != codes.ResourceExhausted {
+			t.Fatalf("expected resource exhausted error, got %v", err)
+		}
+		// the stream is opened, even though the server fails it
+		limiter <- struct{}{}
+		if _, err := client.NewStream(ctx, &StreamDesc{StreamingServer: true}, serviceName, "Missing", nil); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("Wait", func(t *testing.T) {
+		limiter := make(tokenLimiter)
+		client, cleanup := newTestClient(t, addr, WithClientRateLimit(limiter))
+		defer cleanup()
+
+		cctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+		defer cancel()
+		if err := call(client, cctx); status.Code(err) != codes.DeadlineExceeded {
+			t.Fatalf("expected deadline exceeded error, got %v", err)
+		}
+
+		go func() {
+			limiter <- struct{}{}
+		}()
+		if err := call(client, ctx); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
@@ -0,0 +1,254 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ttrpc
+
+import (
+	"context"
+	"math/rand"
+	"net"
+	"time"
+)
+
+// ClientState is the state of the connection of a Client.
+type ClientState int
+
+const (
+	// ClientConnecting is the state of a client waiting for a connection to
+	// be established. Calls block until the client is ready.
+	ClientConnecting ClientState = iota + 1
+	// ClientReady is the state of a client with an established connection.
+	ClientReady
+	// ClientShutdown is the state of a client after it has been closed.
+	ClientShutdown
+)
+
+func (s ClientState) String() string {
+	switch s {
+	case ClientConnecting:
+		return "connecting"
+	case ClientReady:
+		return "ready"
+	case ClientShutdown:
+		return "shutdown"
+	default:
+		return "unknown"
+	}
+}
+
+// Backoff returns how long to wait before the given reconnection attempt.
+// Attempts are counted from zero for every lost connection.
+type Backoff func(attempt int) time.Duration
+
+// ExponentialBackoff returns a Backoff doubling the delay after every attempt,
+// starting from base and capped at max. A random jitter is applied to each
+// delay so clients do not reconnect in lockstep.
+func ExponentialBackoff(base, max time.Duration) Backoff {
+	return func(attempt int) time.Duration {
+		backoff := base
+		for i := 0; i < attempt && backoff < max; i++ {
+			backoff *= 2
+		}
+		backoff = min(max, backoff)
+		if backoff <= 0 {
+			return 0
+		}
+		return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+	}
+}
+
+var defaultBackoff = ExponentialBackoff(100*time.Millisecond, 5*time.Second)
+
+// WithReconnectBackoff sets the backoff used between attempts to dial a new
+// connection for a client created with NewClientWithDialer.
+func WithReconnectBackoff(backoff Backoff) ClientOpts {
+	return func(c *Client) {
+		c.backoff = backoff
+	}
+}
+
+// NewClientWithDialer creates a new ttrpc client which uses dial to connect
+// to the server. Whenever the connection is lost, calls in flight fail and a
+// new connection is dialed, retrying with backoff. Calls made while the client
+// is connecting wait until it is ready or their context is done.
+func NewClientWithDialer(dial func(context.Context) (net.Conn, error), opts ...ClientOpts) *Client {
+	c := newClient(nil, ClientConnecting, opts...)
+	c.dialer = dial
+	if c.backoff == nil {
+		c.backoff = defaultBackoff
+	}
+	c.start()
+	return c
+}
+
+// State returns the current state of the client connection.
+func (c *Client) State() ClientState {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+
+	return c.state
+}
+
+// IsClosed returns true once the client has been closed, either with Close or
+// because its connection was lost and it does not reconnect. A closed client
+// fails all calls with ErrClosed.
+func (c *Client) IsClosed() bool {
+	return c.State() == ClientShutdown
+}
+
+// WaitForStateChange blocks until the state of the client differs from source
+// and returns true, or returns false when ctx is done first.
+func (c *Client) WaitForStateChange(ctx context.Context, source ClientState) bool {
+	for {
+		c.stateLock.Lock()
+		state, changed := c.state, c.stateCh
+		c.stateLock.Unlock()
+
+		if state != source {
+			return true
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+func (c *Client) setState(state ClientState) {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+
+	if c.state == state || c.state == ClientShutdown {
+		return
+	}
+	c.state = state
+	close(c.stateCh)
+	c.stateCh = make(chan struct{})
+}
+
+// waitReady blocks until the client is ready to create streams.
+func (c *Client) waitReady(ctx context.Context) error {
+	for {
+		c.stateLock.Lock()
+		state, changed := c.state, c.stateCh
+		c.stateLock.Unlock()
+
+		switch state {
+		case ClientReady:
+			return nil
+		case ClientShutdown:
+			return ErrClosed
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return fromContextError(ctx.Err())
+		case <-c.ctx.Done():
+			return ErrClosed
+		}
+	}
+}
+
+// connect dials until a connection is established, returning false if the
+// client was closed first.
+func (c *Client) connect() bool {
+	for attempt := 0; ; attempt++ {
+		select {
+		case <-c.ctx.Done():
+			return false
+		default:
+		}
+
+		conn, err := c.dialer(c.ctx)
+		if err == nil && c.connConfigurer != nil {
+			if err = c.connConfigurer(conn); err != nil {
+				conn.Close()
+			}
+		}
+		if err == nil && c.tlsConfig != nil {
+			conn, err = tlsHandshake(c.ctx, conn, c.tlsConfig)
+		}
+		if err == nil {
+			c.sendLock.Lock()
+			defer c.sendLock.Unlock()
+
+			c.connLock.Lock()
+			defer c.connLock.Unlock()
+
+			select {
+			case <-c.ctx.Done():
+				conn.Close()
+				return false
+			default:
+			}
+
+			c.conn = conn
+			c.connGen++
+			c.channel.reset(conn)
+			c.nextStreamID = 1
+			c.goingAway.Store(false)
+			c.setState(ClientReady)
+			return true
+		}
+
+		delay := c.backoff(attempt)
+		c.logger.Debugf("ttrpc: failed to dial; retrying in %v: %v", delay, err)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-c.ctx.Done():
+			timer.Stop()
+			return false
+		}
+	}
+}
+
+// disconnect fails all calls on the lost connection and holds new calls until
+// a new connection is established.
+func (c *Client) disconnect(err error) {
+	// closing the connection first unblocks any writer holding the send lock
+	c.connLock.Lock()
+	c.conn.Close()
+	c.connLock.Unlock()
+
+	c.sendLock.Lock()
+	c.setState(ClientConnecting)
+	c.sendLock.Unlock()
+
+	c.cleanupStreams(err)
+}
+
+func (c *Client) connGeneration() uint64 {
+	c.connLock.Lock()
+	defer c.connLock.Unlock()
+
+	return c.connGen
+}
+
+// closeConn closes the underlying connection if it is still the connection
+// of the given generation, leaving the client to handle the failure.
+func (c *Client) closeConn(gen uint64) {
+	c.connLock.Lock()
+	defer c.connLock.Unlock()
+
+	if c.connGen == gen && c.conn != nil {
+		c.conn.Close()
+	}
+}
@@ -0,0 +1,276 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ttrpc
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/containerd/ttrpc/internal"
+)
+
+type testDialer struct {
+	addr string
+
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+func (d *testDialer) dial(ctx context.Context) (net.Conn, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "unix", d.addr)
+	if err != nil {
+		return nil, err
+	}
+	d.mu.Lock()
+	d.conns = append(d.conns, conn)
+	d.mu.Unlock()
+	return conn, nil
+}
+
+func (d *testDialer) closeLast() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.conns[len(d.conns)-1].Close()
+}
+
+func (d *testDialer) count() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.conns)
+}
+
+func TestClientReconnect(t *testing.T) {
+	var (
+		ctx            = context.Background()
+		server         = mustServer(t)(NewServer())
+		addr, listener = newTestListener(t)
+		dialer         = &testDialer{addr: addr}
+		client         = NewClientWithDialer(dialer.dial, WithReconnectBackoff(func(int) time.Duration {
+			return time.Millisecond
+		}))
+		tclient = newTestingClient(client)
+		release = make(chan struct{})
+	)
+	defer listener.Close()
+	defer client.Close()
+
+	registerTestingService(server, &testingServer{})
+	server.RegisterService("streamService", &ServiceDesc{
+		Streams: map[string]Stream{
+			"Wait": {
+				Handler: func(ctx context.Context, ss StreamServer) (interface{}, error) {
+					select {
+					case <-release:
+					case <-ctx.Done():
+					}
+					return nil, nil
+				},
+				StreamingServer: true,
+			},
+		},
+	})
+	defer close(release)
+
+	go server.Serve(ctx, listener)
+	defer server.Shutdown(ctx)
+
+	if _, err := tclient.Test(ctx, &internal.TestPayload{Foo: "before"}); err != nil {
+		t.Fatal(err)
+	}
+	if state := client.State(); state != ClientReady {
+		t.Fatalf("expected client to be ready, got %v", state)
+	}
+
+	stream, err := client.NewStream(ctx, &StreamDesc{StreamingServer: true}, "streamService", "Wait", &internal.EchoPayload{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dialer.closeLast()
+
+	// the call in flight fails with the lost connection
+	var resp internal.EchoPayload
+	if err := stream.RecvMsg(&resp); !errors.Is(err, ErrClosed) {
+		t.Fatalf("expected in flight stream to fail with ErrClosed, got %v", err)
+	}
+
+	// new calls go through once reconnected
+	cctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	result, err := tclient.Test(cctx, &internal.TestPayload{Foo: "after"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Foo != "afterafter" {
+		t.Fatalf("unexpected result %q", result.Foo)
+	}
+	if n := dialer.count(); n != 2 {
+		t.Fatalf("expected 2 connections to be dialed, got %d", n)
+	}
+}
+
+func TestClientReconnectServerRestart(t *testing.T) {
+	var (
+		ctx            = context.Background()
+		server         = mustServer(t)(NewServer())
+		addr, listener = newTestListener(t)
+		dialer         = &testDialer{addr: addr}
+		client         = NewClientWithDialer(dialer.dial, WithReconnectBackoff(func(int) time.Duration {
+			return 10 * time.Millisecond
+		}))
+		tclient = newTestingClient(client)
+	)
+	defer client.Close()
+
+	registerTestingService(server, &testingServer{})
+	go server.Serve(ctx, listener)
+
+	if _, err := tclient.Test(ctx, &internal.TestPayload{Foo: "before"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := server.Close(); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return client.State() == ClientConnecting })
+
+	server = mustServer(t)(NewServer())
+	registerTestingService(server, &testingServer{})
+	listener, err := net.Listen("unix", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go server.Serve(ctx, listener)
+	defer server.Shutdown(ctx)
+
+	cctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	if _, err := tclient.Test(cctx, &internal.TestPayload{Foo: "after"}); err != nil {
+		t.Fatal(err)
+	}
+	if state := client.State(); state != ClientReady {
+		t.Fatalf("expected client to be ready, got %v", state)
+	}
+}
+
+func TestClientConnectingCallTimeout(t *testing.T) {
+	var (
+		ctx    = context.Background()
+		client = NewClientWithDialer(func(context.Context) (net.Conn, error) {
+			return nil, errors.New("no server")
+		}, WithReconnectBackoff(func(int) time.Duration {
+			return time.Millisecond
+		}))
+	)
+
+	cctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	err := client.Call(cctx, serviceName, "Test", &internal.TestPayload{}, &internal.TestPayload{})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected call to time out while connecting, got %v", err)
+	}
+	if state := client.State(); state != ClientConnecting {
+		t.Fatalf("expected client to be connecting, got %v", state)
+	}
+
+	client.Close()
+	if state := client.State(); state != ClientShutdown {
+		t.Fatalf("expected client to be shutdown, got %v", state)
+	}
+	if err := client.Call(ctx, serviceName, "Test", &internal.TestPayload{}, &internal.TestPayload{}); !errors.Is(err, ErrClosed) {
+		t.Fatalf("expected ErrClosed after close, got %v", err)
+	}
+}
+
+func TestClientIsClosed(t *testing.T) {
+	ctx := context.Background()
+	conn, peer := net.Pipe()
+	client := NewClient(conn)
+	defer client.Close()
+
+	if client.IsClosed() {
+		t.Fatal("expected a new client to be usable")
+	}
+
+	tctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if client.WaitForStateChange(tctx, ClientReady) {
+		t.Fatal("expected the state of the client to be unchanged")
+	}
+
+	// the client does not reconnect and is closed once its connection is lost
+	peer.Close()
+	tctx, cancel = context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	if !client.WaitForStateChange(tctx, ClientReady) {
+		t.Fatal("expected the state of the client to change")
+	}
+	if !client.IsClosed() {
+		t.Fatalf("expected client to be closed, state is %v", client.State())
+	}
+}
+
+func TestClientConnConfigurer(t *testing.T) {
+	var (
+		ctx            = context.Background()
+		server         = mustServer(t)(NewServer())
+		addr, listener = newTestListener(t)
+		dialer         = &testDialer{addr: addr}
+		attempts       atomic.Int32
+		client         = NewClientWithDialer(dialer.dial,
+			WithReconnectBackoff(func(int) time.Duration { return time.Millisecond }),
+			WithConnConfigurer(func(conn net.Conn) error {
+				if attempts.Add(1) == 1 {
+					return errors.New("configuration failed")
+				}
+				return conn.(*net.UnixConn).SetWriteBuffer(1 << 16)
+			}))
+	)
+	defer listener.Close()
+	defer client.Close()
+
+	registerTestingService(server, &testingServer{})
+	go server.Serve(ctx, listener)
+	defer server.Shutdown(ctx)
+
+	// the failed configuration is retried like a failed dial
+	var resp internal.TestPayload
+	if err := client.Call(ctx, serviceName, "Test", &internal.TestPayload{Foo: "foo"}, &resp); err != nil {
+		t.Fatal(err)
+	}
+	if n := attempts.Load(); n != 2 {
+		t.Fatalf("expected 2 configured connections, got %d", n)
+	}
+	if n := dialer.count(); n != 2 {
+		t.Fatalf("expected 2 dials, got %d", n)
+	}
+
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	refused := NewClient(conn, WithConnConfigurer(func(net.Conn) error {
+		return errors.New("configuration failed")
+	}))
+	defer refused.Close()
+	waitFor(t, refused.IsClosed)
+}
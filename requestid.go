@@ -0,0 +1,45 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ttrpc
+
+import "context"
+
+// RequestIDMetadataKey is the metadata key carrying the request ID of a call,
+// see WithRequestIDGenerator.
+const RequestIDMetadataKey = ReservedMetadataPrefix + "request-id"
+
+type requestIDKey struct{}
+
+// RequestID returns the ID of the server call in the context, assigned when the
+// server is created with WithRequestIDGenerator.
+func RequestID(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(requestIDKey{}).(string)
+	return id, ok
+}
+
+// requestIDDecorator assigns an ID to every call, preferring the one sent by
+// the client, and echoes it in the response metadata.
+func requestIDDecorator(generate func() string) ContextDecorator {
+	return func(ctx context.Context, info MethodInfo) context.Context {
+		id, ok := GetMetadataValue(ctx, RequestIDMetadataKey)
+		if !ok || id == "" {
+			id = generate()
+		}
+		SetResponseMetadata(ctx, MD{RequestIDMetadataKey: {id}})
+		return context.WithValue(ctx, requestIDKey{}, id)
+	}
+}
@@ -0,0 +1,108 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ttrpc
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"testing"
+
+	"github.com/containerd/ttrpc/internal"
+)
+
+func TestServerRequestID(t *testing.T) {
+	var (
+		ctx      = context.Background()
+		next     atomic.Int32
+		generate = func() string {
+			return fmt.Sprintf("generated-%d", next.Add(1))
+		}
+		server          = mustServer(t)(NewServer(WithRequestIDGenerator(generate)))
+		addr, listener  = newTestListener(t)
+		client, cleanup = newTestClient(t, addr)
+	)
+	defer listener.Close()
+	defer cleanup()
+
+	server.RegisterService(serviceName, &ServiceDesc{
+		Methods: map[string]Method{
+			"Test": func(ctx context.Context, unmarshal func(interface{}) error) (interface{}, error) {
+				id, _ := RequestID(ctx)
+				return &internal.TestPayload{Foo: id}, nil
+			},
+		},
+		Streams: map[string]Stream{
+			"Stream": {
+				Handler: func(ctx context.Context, ss StreamServer) (interface{}, error) {
+					id, _ := RequestID(ctx)
+					return nil, ss.SendMsg(&internal.TestPayload{Foo: id})
+				},
+				StreamingServer: true,
+			},
+		},
+	})
+	go server.Serve(ctx, listener)
+	defer server.Shutdown(ctx)
+
+	call := func(ctx context.Context, expected string) {
+		t.Helper()
+		var (
+			resp internal.TestPayload
+			rmd  MD
+		)
+		if err := client.Call(WithResponseMetadata(ctx, &rmd), serviceName, "Test", &internal.TestPayload{}, &resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.Foo != expected {
+			t.Fatalf("expected request ID %q in handler, got %q", expected, resp.Foo)
+		}
+		if ids, _ := rmd.Get(RequestIDMetadataKey); len(ids) != 1 || ids[0] != expected {
+			t.Fatalf("expected request ID %q in response metadata, got %v", expected, ids)
+		}
+	}
+
+	call(ctx, "generated-1")
+	call(ctx, "generated-2")
+
+	// the ID sent by the client is preferred
+	md := MD{}
+	md.Set(RequestIDMetadataKey, "client")
+	call(WithMetadata(ctx, md), "client")
+
+	// the ID is echoed when a server stream finishes
+	var rmd MD
+	stream, err := client.NewStream(WithResponseMetadata(WithMetadata(ctx, md), &rmd), &StreamDesc{StreamingServer: true}, serviceName, "Stream", &internal.TestPayload{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resp internal.TestPayload
+	if err := stream.RecvMsg(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.RecvMsg(&resp); err != io.EOF {
+		t.Fatalf("expected end of stream, got %v", err)
+	}
+	if ids, _ := rmd.Get(RequestIDMetadataKey); len(ids) != 1 || ids[0] != "client" {
+		t.Fatalf("expected request ID in stream response metadata, got %v", ids)
+	}
+
+	if _, ok := RequestID(ctx); ok {
+		t.Fatal("unexpected request ID outside of a call")
+	}
+}
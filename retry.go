@@ -0,0 +1,133 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ttrpc
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// RetryPolicy configures how unary calls are retried, see WithRetry. Calls are
+// retried whether or not the server handled them, so the policy should only
+// cover idempotent methods.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of attempts of a call, including the
+	// first one.
+	MaxAttempts int
+
+	// RetryableCodes are the status codes a call is retried on, Unavailable
+	// and ResourceExhausted when empty. Calls failing because the connection
+	// was lost are reported as Unavailable. Requests larger than the maximum
+	// message size, failing with an OversizedMessageErr, are never retried.
+	RetryableCodes []codes.Code
+
+	// Backoff returns how long to wait before the given retry, counted from
+	// zero. Defaults to an exponential backoff with jitter starting from
+	// 100ms and capped at 5s.
+	Backoff Backoff
+
+	// Retryable reports whether calls of the given method, such as
+	// "/service/Method", may be retried. All methods are retried when nil.
+	Retryable func(fullMethod string) bool
+}
+
+var defaultRetryableCodes = []codes.Code{codes.Unavailable, codes.ResourceExhausted}
+
+func (p *RetryPolicy) retryable(code codes.Code) bool {
+	retryableCodes := p.RetryableCodes
+	if len(retryableCodes) == 0 {
+		retryableCodes = defaultRetryableCodes
+	}
+	for _, c := range retryableCodes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// WithRetry retries unary calls failing with a transient error according to
+// policy, streams are never retried. The retries are made by an interceptor
+// chained after any interceptor set by previous options, see
+// WithChainUnaryClientInterceptor.
+func WithRetry(policy RetryPolicy) ClientOpts {
+	return WithChainUnaryClientInterceptor(RetryInterceptor(policy))
+}
+
+// RetryInterceptor returns a client interceptor retrying unary calls according
+// to policy. Retries stop once the context of the call is done or when the
+// next attempt would start after its deadline, the error of the last attempt
+// is returned then.
+func RetryInterceptor(policy RetryPolicy) UnaryClientInterceptor {
+	backoff := policy.Backoff
+	if backoff == nil {
+		backoff = defaultBackoff
+	}
+	return func(ctx context.Context, req *Request, resp *Response, info *UnaryClientInfo, invoker Invoker) error {
+		if policy.Retryable != nil && !policy.Retryable(info.FullMethod) {
+			return invoker(ctx, req, resp)
+		}
+
+		for attempt := 1; ; attempt++ {
+			err := invoker(ctx, req, resp)
+			var oerr *OversizedMessageErr
+			if errors.As(err, &oerr) {
+				// the same request would be refused again
+				return err
+			}
+			code := retryCode(err, resp)
+			if attempt >= policy.MaxAttempts || !policy.retryable(code) {
+				return err
+			}
+
+			delay := backoff(attempt - 1)
+			if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) <= delay {
+				return err
+			}
+			t := time.NewTimer(delay)
+			select {
+			case <-t.C:
+			case <-ctx.Done():
+				t.Stop()
+				return err
+			}
+
+			proto.Reset(resp)
+			req.TimeoutNano = timeoutNano(ctx)
+		}
+	}
+}
+
+// retryCode returns the status code of an attempt, given the error returned
+// by the invoker and the response it received.
+func retryCode(err error, resp *Response) codes.Code {
+	if err != nil {
+		if errors.Is(err, ErrClosed) {
+			return codes.Unavailable
+		}
+		return status.Code(err)
+	}
+	if resp.Status != nil {
+		return codes.Code(resp.Status.Code)
+	}
+	return codes.OK
+}
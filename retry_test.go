@@ -0,0 +1,196 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ttrpc
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/containerd/ttrpc/internal"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestRetry(t *testing.T) {
+	var (
+		ctx            = context.Background()
+		server         = mustServer(t)(NewServer())
+		addr, listener = newTestListener(t)
+		attempts       atomic.Int32
+		failures       atomic.Int32
+		code           = codes.Unavailable
+	)
+	defer listener.Close()
+
+	flaky := func(_ context.Context, unmarshal func(interface{}) error) (interface{}, error) {
+		var req internal.TestPayload
+		if err := unmarshal(&req); err != nil {
+			return nil, err
+		}
+		attempts.Add(1)
+		if failures.Add(-1) >= 0 {
+			return nil, status.Error(code, "try again")
+		}
+		return &req, nil
+	}
+	server.RegisterService(serviceName, &ServiceDesc{
+		Methods: map[string]Method{
+			"Flaky":      flaky,
+			"NotRetried": flaky,
+		},
+	})
+
+	go server.Serve(ctx, listener)
+	defer server.Shutdown(ctx)
+
+	client, cleanup := newTestClient(t, addr, WithRetry(RetryPolicy{
+		MaxAttempts: 3,
+		Backoff: func(int) time.Duration {
+			return time.Millisecond
+		},
+		Retryable: func(fullMethod string) bool {
+			return fullMethod != "/testService/NotRetried"
+		},
+	}))
+	defer cleanup()
+
+	call := func(t *testing.T, fail int32) error {
+		t.Helper()
+		attempts.Store(0)
+		failures.Store(fail)
+		var resp internal.TestPayload
+		err := client.Call(ctx, serviceName, "Flaky", &internal.TestPayload{Foo: "foo"}, &resp)
+		if err == nil && resp.Foo != "foo" {
+			t.Fatalf("unexpected response %v", &resp)
+		}
+		return err
+	}
+
+	if err := call(t, 2); err != nil {
+		t.Fatalf("expected call to succeed after retries: %v", err)
+	}
+	if n := attempts.Load(); n != 3 {
+		t.Fatalf("expected 3 attempts, got %d", n)
+	}
+
+	if err := call(t, 3); status.Code(err) != codes.Unavailable {
+		t.Fatalf("expected unavailable error, got %v", err)
+	}
+	if n := attempts.Load(); n != 3 {
+		t.Fatalf("expected 3 attempts, got %d", n)
+	}
+
+	code = codes.InvalidArgument
+	if err := call(t, 1); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected invalid argument error, got %v", err)
+	}
+	if n := attempts.Load(); n != 1 {
+		t.Fatalf("non-retryable code was retried, %d attempts", n)
+	}
+	code = codes.Unavailable
+
+	attempts.Store(0)
+	failures.Store(1)
+	if err := client.Call(ctx, serviceName, "NotRetried", &internal.TestPayload{}, &internal.TestPayload{}); status.Code(err) != codes.Unavailable {
+		t.Fatalf("expected unavailable error, got %v", err)
+	}
+	if n := attempts.Load(); n != 1 {
+		t.Fatalf("non-retryable method was retried, %d attempts", n)
+	}
+}
+
+func TestRetryDeadline(t *testing.T) {
+	var (
+		ctx            = context.Background()
+		server         = mustServer(t)(NewServer())
+		addr, listener = newTestListener(t)
+		attempts       atomic.Int32
+	)
+	defer listener.Close()
+
+	server.RegisterMethod(serviceName, "Unavailable", func(context.Context, func(interface{}) error) (interface{}, error) {
+		attempts.Add(1)
+		return nil, status.Error(codes.Unavailable, "try again")
+	})
+
+	go server.Serve(ctx, listener)
+	defer server.Shutdown(ctx)
+
+	client, cleanup := newTestClient(t, addr, WithRetry(RetryPolicy{
+		MaxAttempts: 5,
+		Backoff: func(int) time.Duration {
+			return time.Hour
+		},
+	}))
+	defer cleanup()
+
+	cctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+	start := time.Now()
+	if err := client.Call(cctx, serviceName, "Unavailable", &internal.TestPayload{}, &internal.TestPayload{}); status.Code(err) != codes.Unavailable {
+		t.Fatalf("expected unavailable error, got %v", err)
+	}
+	if time.Since(start) > 10*time.Second {
+		t.Fatal("retry waited past the deadline")
+	}
+	if n := attempts.Load(); n != 1 {
+		t.Fatalf("expected a single attempt, got %d", n)
+	}
+}
+
+func TestRetryOversizedMessage(t *testing.T) {
+	var (
+		ctx            = context.Background()
+		server         = mustServer(t)(NewServer())
+		addr, listener = newTestListener(t)
+		attempts       atomic.Int32
+	)
+	defer listener.Close()
+
+	registerTestingService(server, &testingServer{})
+	go server.Serve(ctx, listener)
+	defer server.Shutdown(ctx)
+
+	client, cleanup := newTestClient(t, addr,
+		WithMaxSendMessageSize(64),
+		WithRetry(RetryPolicy{
+			MaxAttempts: 3,
+			Backoff: func(int) time.Duration {
+				return time.Millisecond
+			},
+		}),
+		// chained after the retries, so it sees every attempt
+		WithChainUnaryClientInterceptor(func(ctx context.Context, req *Request, resp *Response, info *UnaryClientInfo, invoker Invoker) error {
+			attempts.Add(1)
+			return invoker(ctx, req, resp)
+		}),
+	)
+	defer cleanup()
+
+	tp := &internal.TestPayload{Foo: strings.Repeat("a", 128)}
+	var oerr *OversizedMessageErr
+	if err := client.Call(ctx, serviceName, "Test", tp, tp); !errors.As(err, &oerr) {
+		t.Fatalf("expected an oversized message error, got %v", err)
+	}
+	if n := attempts.Load(); n != 1 {
+		t.Fatalf("expected a single attempt, got %d", n)
+	}
+}
@@ -19,15 +19,16 @@ package ttrpc
 import (
 	"context"
 	"errors"
+	"fmt"
 	"io"
 	"math/rand"
 	"net"
+	"os"
 	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
 
-	"github.com/containerd/log"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
@@ -41,10 +42,17 @@ type Server struct {
 	listeners   map[net.Listener]struct{}
 	connections map[*serverConn]struct{} // all connections to current state
 	done        chan struct{}            // marks point at which we stop serving requests
+
+	stats stats
 }
 
 func NewServer(opts ...ServerOpt) (*Server, error) {
-	config := &serverConfig{}
+	config := &serverConfig{
+		maxRecvMsgSize:   messageLengthMax,
+		maxSendMsgSize:   messageLengthMax,
+		handlerQueueSize: -1, // defaults to the pool size
+		maxAcceptBackoff: time.Second,
+	}
 	for _, opt := range opts {
 		if err := opt(config); err != nil {
 			return nil, err
@@ -53,10 +61,16 @@ func NewServer(opts ...ServerOpt) (*Server, error) {
 	if config.interceptor == nil {
 		config.interceptor = defaultServerInterceptor
 	}
+	if config.streamInterceptor == nil {
+		config.streamInterceptor = defaultStreamServerInterceptor
+	}
+	if config.codec == nil {
+		config.codec = codec{}
+	}
 
 	return &Server{
 		config:      config,
-		services:    newServiceSet(config.interceptor),
+		services:    newServiceSet(config),
 		done:        make(chan struct{}),
 		listeners:   make(map[net.Listener]struct{}),
 		connections: make(map[*serverConn]struct{}),
@@ -69,10 +83,54 @@ func (s *Server) Register(name string, methods map[string]Method) {
 	s.services.register(name, &ServiceDesc{Methods: methods})
 }
 
+// RegisterService registers the methods and streams of a service. It panics
+// if a service with the same name is already registered, or if a method name
+// is used by both a unary method and a stream.
 func (s *Server) RegisterService(name string, desc *ServiceDesc) {
 	s.services.register(name, desc)
 }
 
+// RegisterMethod registers a single unary method handler, adding it to the
+// named service. This allows serving methods without generated code, for
+// example when services are only known at runtime. It panics if the method is
+// already registered.
+func (s *Server) RegisterMethod(service, method string, fn Method) {
+	s.services.registerMethod(service, method, fn)
+}
+
+// RegisterAlias makes calls to oldFullMethod be served by the handler of
+// newFullMethod, both of the form /service/method. This keeps renamed methods
+// working for existing clients. Interceptors and handlers see the call as made
+// to newFullMethod, and the first call to the alias is logged as deprecated. It
+// panics if a name is malformed or the alias is already registered.
+func (s *Server) RegisterAlias(oldFullMethod, newFullMethod string) {
+	s.services.registerAlias(oldFullMethod, newFullMethod)
+}
+
+// UnregisterService removes a registered service while the server is running,
+// new calls to it fail with codes.Unimplemented while other services keep being
+// served. Calls of the service already in flight are not interrupted and run
+// to completion. It returns an error if no service with the name is
+// registered.
+func (s *Server) UnregisterService(name string) error {
+	return s.services.unregister(name)
+}
+
+// ServiceInfo returns the names of the registered services mapped to the
+// names of their unary and streaming methods, which is useful to check what a
+// running server serves.
+func (s *Server) ServiceInfo() map[string][]string {
+	return s.services.info()
+}
+
+// Serve accepts connections on l and serves them until the server is closed.
+// After Shutdown or Close, Serve returns ErrServerClosed; any other error comes
+// from the listener.
+//
+// Serve may be called concurrently with several listeners, for example a unix
+// socket and a TCP port, which then share the registered services and the
+// limits of the server. Shutdown and Close stop all of them, Shutdown waiting
+// for the calls of every listener to finish.
 func (s *Server) Serve(ctx context.Context, l net.Listener) error {
 	s.mu.Lock()
 	s.addListenerLocked(l)
@@ -89,6 +147,7 @@ func (s *Server) Serve(ctx context.Context, l net.Listener) error {
 	var (
 		backoff    time.Duration
 		handshaker = s.config.handshaker
+		logger     = s.logger(ctx)
 	)
 
 	if handshaker == nil {
@@ -113,10 +172,10 @@ func (s *Server) Serve(ctx context.Context, l net.Listener) error {
 					backoff *= 2
 				}
 
-				backoff = min(time.Second, backoff)
+				backoff = min(s.config.maxAcceptBackoff, backoff)
 
 				sleep := time.Duration(rand.Int63n(int64(backoff)))
-				log.G(ctx).WithError(err).Errorf("ttrpc: failed accept; backoff %v", sleep)
+				logger.Errorf("ttrpc: failed accept; backoff %v: %v", sleep, err)
 				time.Sleep(sleep)
 				continue
 			}
@@ -126,17 +185,36 @@ func (s *Server) Serve(ctx context.Context, l net.Listener) error {
 
 		backoff = 0
 
+		if s.atConnectionLimit() {
+			// shed the connection without spending a handshake on it
+			logger.Errorf("ttrpc: refusing connection from %v, connection limit reached", conn.RemoteAddr())
+			conn.Close()
+			s.connectionError(ErrTooManyConnections, conn)
+			continue
+		}
+
+		wrapped, err := s.configureConn(conn)
+		if err != nil {
+			logger.Errorf("ttrpc: refusing connection from %v, configuring it failed: %v", conn.RemoteAddr(), err)
+			conn.Close()
+			s.connectionError(err, conn)
+			continue
+		}
+		conn = wrapped
+
 		approved, handshake, err := handshaker.Handshake(ctx, conn)
 		if err != nil {
-			log.G(ctx).WithError(err).Error("ttrpc: refusing connection after handshake")
+			logger.Errorf("ttrpc: refusing connection after handshake: %v", err)
 			conn.Close()
+			s.connectionError(err, conn)
 			continue
 		}
 
 		sc, err := s.newConn(approved, handshake)
 		if err != nil {
-			log.G(ctx).WithError(err).Error("ttrpc: create connection failed")
+			logger.Errorf("ttrpc: create connection failed: %v", err)
 			conn.Close()
+			s.connectionError(err, conn)
 			continue
 		}
 
@@ -144,6 +222,58 @@ func (s *Server) Serve(ctx context.Context, l net.Listener) error {
 	}
 }
 
+// ServeConn serves a single connection that was accepted, and possibly
+// authenticated, outside of the server, for example one inherited through
+// socket activation or fd passing. The handshaker of the server is not run.
+// ServeConn blocks until the connection is closed, and closes conn if the
+// server refuses it.
+func (s *Server) ServeConn(ctx context.Context, conn net.Conn) error {
+	wrapped, err := s.configureConn(conn)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	conn = wrapped
+	sc, err := s.newConn(conn, nil)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	sc.run(ctx)
+	return nil
+}
+
+// configureConn calls the functions set with WithServerConnConfigurer and
+// WithConnWrapper with a new connection, returning the connection to serve.
+func (s *Server) configureConn(conn net.Conn) (net.Conn, error) {
+	if s.config.connConfigurer != nil {
+		if err := s.config.connConfigurer(conn); err != nil {
+			return nil, err
+		}
+	}
+	if s.config.connWrapper == nil {
+		return conn, nil
+	}
+	return s.config.connWrapper(conn)
+}
+
+// logger returns the logger of the server, defaulting to the logger carried by
+// ctx.
+func (s *Server) logger(ctx context.Context) Logger {
+	if s.config.logger != nil {
+		return s.config.logger
+	}
+	return defaultLogger(ctx)
+}
+
+// connectionError reports an error refusing or dropping a connection to the
+// error handler of the server.
+func (s *Server) connectionError(err error, conn net.Conn) {
+	if s.config.errorHandler != nil {
+		s.config.errorHandler(err, conn)
+	}
+}
+
 func (s *Server) Shutdown(ctx context.Context) error {
 	s.mu.Lock()
 	select {
@@ -153,6 +283,9 @@ func (s *Server) Shutdown(ctx context.Context) error {
 		close(s.done)
 	}
 	lnerr := s.closeListeners()
+	for c := range s.connections {
+		c.goAway()
+	}
 	s.mu.Unlock()
 
 	ticker := time.NewTicker(200 * time.Millisecond)
@@ -174,6 +307,50 @@ func (s *Server) Shutdown(ctx context.Context) error {
 	return lnerr
 }
 
+// ActiveStreams returns the number of requests, unary or streaming, currently
+// being handled by the server.
+func (s *Server) ActiveStreams() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var n int
+	for c := range s.connections {
+		n += int(atomic.LoadInt32(&c.active))
+	}
+	return n
+}
+
+// pendingReads returns the number of messages queued for the streams of all
+// connections.
+func (s *Server) pendingReads() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var n int
+	for c := range s.connections {
+		c.streams.Range(func(_, sh interface{}) bool {
+			// unary calls are stored without a handler
+			if sh := sh.(*streamHandler); sh != nil {
+				n += len(sh.recv)
+			}
+			return true
+		})
+	}
+	return n
+}
+
+// Connections returns the number of client connections currently open on the
+// server.
+func (s *Server) Connections() int {
+	return s.countConnection()
+}
+
+// Stats returns a snapshot of the counters for all connections handled by the
+// server.
+func (s *Server) Stats() Stats {
+	return s.stats.snapshot(s.ActiveStreams(), s.pendingReads())
+}
+
 // Close the server without waiting for active connections.
 func (s *Server) Close() error {
 	s.mu.Lock()
@@ -231,10 +408,21 @@ func (s *Server) addConnection(c *serverConn) error {
 	default:
 	}
 
+	if max := s.config.maxConnections; max > 0 && len(s.connections) >= max {
+		return ErrTooManyConnections
+	}
+
 	s.connections[c] = struct{}{}
 	return nil
 }
 
+// atConnectionLimit returns whether the server has as many connections as it
+// allows.
+func (s *Server) atConnectionLimit() bool {
+	max := s.config.maxConnections
+	return max > 0 && s.countConnection() >= max
+}
+
 func (s *Server) delConnection(c *serverConn) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -254,7 +442,7 @@ func (s *Server) closeIdleConns() {
 	defer s.mu.Unlock()
 
 	for c := range s.connections {
-		if st, ok := c.getState(); !ok || st == connStateActive {
+		if st, ok := c.getState(); !ok || st == connStateActive || atomic.LoadInt32(&c.active) > 0 {
 			continue
 		}
 		c.close()
@@ -289,6 +477,7 @@ func (s *Server) newConn(conn net.Conn, handshake interface{}) (*serverConn, err
 		conn:      conn,
 		handshake: handshake,
 		shutdown:  make(chan struct{}),
+		goaway:    make(chan struct{}),
 	}
 	c.setState(connStateIdle)
 	if err := s.addConnection(c); err != nil {
@@ -301,11 +490,17 @@ func (s *Server) newConn(conn net.Conn, handshake interface{}) (*serverConn, err
 type serverConn struct {
 	server    *Server
 	conn      net.Conn
-	handshake interface{} // data from handshake, not used for now
+	handshake interface{} // data from handshake
 	state     atomic.Value
+	active    int32 // outstanding requests
+	streams   sync.Map
 
 	shutdownOnce sync.Once
 	shutdown     chan struct{} // forced shutdown, used by close
+
+	goawayOnce sync.Once
+	goaway     chan struct{} // graceful shutdown, no new requests accepted
+	draining   atomic.Bool
 }
 
 func (c *serverConn) getState() (connState, bool) {
@@ -325,6 +520,15 @@ func (c *serverConn) close() error {
 	return nil
 }
 
+// goAway stops the connection from accepting new requests and lets the client
+// know it should not start any more.
+func (c *serverConn) goAway() {
+	c.goawayOnce.Do(func() {
+		c.draining.Store(true)
+		close(c.goaway)
+	})
+}
+
 func (c *serverConn) run(sctx context.Context) {
 	type (
 		response struct {
@@ -333,23 +537,77 @@ func (c *serverConn) run(sctx context.Context) {
 			data        []byte
 			closeStream bool
 			streaming   bool
+			header      bool // metadata sent ahead of the stream data
+			metadata    MD
+			fds         []int // passed to the client before the final message
+		}
+		control struct {
+			id   uint32
+			mt   messageType
+			data []byte
+		}
+		observedCall struct {
+			req   *Request
+			start time.Time
 		}
 	)
 
 	var (
-		ch                     = newChannel(c.conn)
-		ctx, cancel            = context.WithCancel(sctx)
+		ch                     = c.server.newChannel(c.conn)
+		calls                  = newPeerCalls(c.server.codec, ch.maxSendMsgSize)
+		ctx, cancel            = context.WithCancel(withPeer(sctx, c.conn, c.handshake, calls))
+		logger                 = c.server.logger(ctx)
 		state        connState = connStateIdle
 		responses              = make(chan response)
+		controls               = make(chan control)
 		recvErr                = make(chan error, 1)
+		keepaliveErr           = make(chan error, 1)
 		done                   = make(chan struct{})
-		streams                = sync.Map{}
-		active       int32
+		streams                = &c.streams
+		cancels                = sync.Map{}
+		observed               = sync.Map{} // unary calls reported to the call observer
 		lastStreamID uint32
+		ka           *keepalive
+		lastRecv     atomic.Int64 // unix nanoseconds of the last frame received
+		idleTimeout  = c.server.config.idleTimeout
+		idle         <-chan time.Time
 	)
 
+	// cancelStreams cancels the context of every call still running on the
+	// connection, recording the stream which was interrupted as the cause.
+	cancelStreams := func() {
+		cancels.Range(func(id, cancel interface{}) bool {
+			cancel.(context.CancelCauseFunc)(fmt.Errorf("ttrpc: stream %d interrupted: %w", id, ErrClosed))
+			return true
+		})
+	}
+
+	ch.untimed = func(id uint32) bool {
+		sh, ok := streams.Load(id)
+		return ok && sh.(*streamHandler) != nil && sh.(*streamHandler).untimed
+	}
+
+	// observeCall reports a unary call to the call observer once its response
+	// has been written.
+	observeCall := func(id uint32, st *status.Status, data []byte) {
+		v, ok := observed.LoadAndDelete(id)
+		if !ok {
+			return
+		}
+		call := v.(*observedCall)
+		c.server.config.callObserver(CallSummary{
+			FullMethod:   fullPath(call.req.Service, call.req.Method),
+			Duration:     time.Since(call.start),
+			Code:         st.Code(),
+			RequestSize:  len(call.req.Payload),
+			ResponseSize: len(data),
+		})
+	}
+
 	defer c.conn.Close()
 	defer cancel()
+	defer calls.close()
+	defer cancelStreams()
 	defer close(done)
 	defer c.server.delConnection(c)
 
@@ -371,6 +629,33 @@ func (c *serverConn) run(sctx context.Context) {
 		}
 	}
 
+	sendControl := func(id uint32, mt messageType, data []byte) error {
+		select {
+		case controls <- control{id: id, mt: mt, data: data}:
+			return nil
+		case <-c.shutdown:
+			return ErrClosed
+		case <-done:
+			return ErrClosed
+		}
+	}
+
+	// calls made to the client with CallPeer are sent as control messages
+	calls.send = func(id uint32, p []byte) error {
+		return sendControl(id, messageTypeRequest, p)
+	}
+
+	if c.server.config.keepaliveInterval > 0 {
+		ka = newKeepalive(c.server.config.keepaliveInterval, c.server.config.keepaliveTimeout)
+		go func() {
+			if err := ka.run(done, func() error {
+				return sendControl(controlStreamID, messageTypePing, nil)
+			}); err != nil {
+				keepaliveErr <- err
+			}
+		}()
+	}
+
 	go func(recvErr chan error) {
 		defer close(recvErr)
 		for {
@@ -383,6 +668,11 @@ func (c *serverConn) run(sctx context.Context) {
 			}
 
 			mh, p, err := ch.recv()
+			if mh.Type != messageTypePong {
+				// replies to the server's own pings do not keep the
+				// connection from being idle
+				lastRecv.Store(time.Now().UnixNano())
+			}
 			if err != nil {
 				status, ok := status.FromError(err)
 				if !ok {
@@ -399,6 +689,49 @@ func (c *serverConn) run(sctx context.Context) {
 				continue
 			}
 
+			if mh.StreamID == controlStreamID && (mh.Type == messageTypePing || mh.Type == messageTypePong) {
+				var data []byte
+				if len(p) > 0 {
+					data = append(data, p...)
+					ch.putmbuf(p)
+				}
+				if mh.Type == messageTypePing {
+					if sendControl(controlStreamID, messageTypePong, data) != nil {
+						return
+					}
+				} else if ka != nil {
+					ka.pong()
+				}
+				continue
+			}
+
+			if mh.StreamID == controlStreamID && mh.Type == messageTypeCompression {
+				name := string(p[:mh.Length])
+				ch.putmbuf(p)
+				var accepted []byte
+				if compressor, ok := c.server.config.compressors[name]; ok {
+					// the client only compresses once it has the reply,
+					// the server may start right away
+					ch.recvCompressor = compressor
+					ch.setSendCompressor(compressor)
+					accepted = []byte(name)
+				}
+				if sendControl(controlStreamID, messageTypeCompression, accepted) != nil {
+					return
+				}
+				continue
+			}
+
+			if mh.Type == messageTypeResponse && mh.StreamID%2 == 0 {
+				// reply to a call made with CallPeer
+				err := calls.receive(mh.StreamID, p[:mh.Length])
+				ch.putmbuf(p)
+				if err != nil {
+					logger.Errorf("ttrpc: failed to handle response on stream %d: %v", mh.StreamID, err)
+				}
+				continue
+			}
+
 			if mh.StreamID%2 != 1 {
 				// enforce odd client initiated identifiers.
 				if !sendStatus(mh.StreamID, status.Newf(codes.InvalidArgument, "StreamID must be odd for client initiated streams")) {
@@ -407,22 +740,60 @@ func (c *serverConn) run(sctx context.Context) {
 				continue
 			}
 
-			if mh.Type == messageTypeData {
+			if mh.Type == messageTypeWindowUpdate {
+				n, err := decodeWindowUpdate(p[:mh.Length])
+				ch.putmbuf(p)
+				if err != nil {
+					if !sendStatus(mh.StreamID, status.Newf(codes.InvalidArgument, "%v", err)) {
+						return
+					}
+					continue
+				}
+				// unary calls are stored without a handler
+				if i, ok := streams.Load(mh.StreamID); ok && i.(*streamHandler) != nil {
+					i.(*streamHandler).window.release(n)
+				}
+			} else if mh.Type == messageTypeData {
 				i, ok := streams.Load(mh.StreamID)
 				if !ok {
+					ch.putmbuf(p)
+					if mh.StreamID <= lastStreamID {
+						// the server already finished the stream, data
+						// sent by the client before it received the final
+						// response is dropped, later sends fail on the
+						// client with ErrStreamClosed
+						continue
+					}
 					if !sendStatus(mh.StreamID, status.Newf(codes.InvalidArgument, "StreamID is no longer active")) {
 						return
 					}
+					continue
 				}
 				sh := i.(*streamHandler)
+				if sh == nil {
+					// unary calls are stored without a handler
+					ch.putmbuf(p)
+					if !sendStatus(mh.StreamID, status.Newf(codes.InvalidArgument, "data message not allowed on unary stream")) {
+						return
+					}
+					continue
+				}
 				if mh.Flags&flagNoData != flagNoData {
+					id, n := mh.StreamID, len(p)
 					unmarshal := func(obj interface{}) error {
-						err := protoUnmarshal(p, obj)
+						err := unmarshalPayload(sh.codec, p, obj)
 						ch.putmbuf(p)
+						if err == nil && sh.window != nil && n > 0 {
+							// the message has been consumed, allow the
+							// client to send more
+							err = sendControl(id, messageTypeWindowUpdate, encodeWindowUpdate(uint32(n)))
+						}
 						return err
 					}
 
-					if err := sh.data(unmarshal); err != nil {
+					// data for a stream whose handler already returned is
+					// dropped, the client gets the final response anyway
+					if err := sh.data(unmarshal); err != nil && sh.ctx.Err() == nil {
 						if !sendStatus(mh.StreamID, status.Newf(codes.InvalidArgument, "data handling error: %v", err)) {
 							return
 						}
@@ -437,6 +808,26 @@ func (c *serverConn) run(sctx context.Context) {
 						}
 					}
 				}
+			} else if mh.Type == messageTypeMetadata {
+				var req Request
+				err := c.server.codec.Unmarshal(p, &req)
+				ch.putmbuf(p)
+				i, ok := streams.Load(mh.StreamID)
+				if !ok || i.(*streamHandler) == nil {
+					// the stream already finished or is unary, the update
+					// is of no use
+					continue
+				}
+				if err != nil {
+					if !sendStatus(mh.StreamID, status.Newf(codes.InvalidArgument, "unmarshal metadata error: %v", err)) {
+						return
+					}
+					continue
+				}
+				md := MD{}
+				md.fromRequest(&req)
+				// fails once the client closed its side, like data would
+				i.(*streamHandler).updateMetadata(md)
 			} else if mh.Type == messageTypeRequest {
 				if mh.StreamID <= lastStreamID {
 					// enforce odd client initiated identifiers.
@@ -448,8 +839,25 @@ func (c *serverConn) run(sctx context.Context) {
 				}
 				lastStreamID = mh.StreamID
 
+				if c.draining.Load() {
+					ch.putmbuf(p)
+					if !sendStatus(mh.StreamID, status.Newf(codes.Unavailable, "ttrpc: server is shutting down")) {
+						return
+					}
+					continue
+				}
+
+				if max := c.server.config.maxConcurrentStreams; max > 0 && atomic.LoadInt32(&c.active) >= int32(max) {
+					ch.putmbuf(p)
+					if !sendStatus(mh.StreamID, status.Newf(codes.ResourceExhausted, "ttrpc: too many concurrent calls, limit is %d", max)) {
+						return
+					}
+					continue
+				}
+
 				// TODO: Make request type configurable
 				// Unmarshaller which takes in a byte array and returns an interface?
+				start := time.Now()
 				var req Request
 				if err := c.server.codec.Unmarshal(p, &req); err != nil {
 					ch.putmbuf(p)
@@ -461,22 +869,83 @@ func (c *serverConn) run(sctx context.Context) {
 				ch.putmbuf(p)
 
 				id := mh.StreamID
-				respond := func(status *status.Status, data []byte, streaming, closeStream bool) error {
+				if accept := c.server.config.acceptVersion; accept != nil {
+					if st := checkVersion(accept, &req); st != nil {
+						if !sendStatus(id, st) {
+							return
+						}
+						continue
+					}
+				}
+				if c.server.config.callObserver != nil {
+					// streams are told apart before dispatching, as they may
+					// finish before handle returns
+					c.server.services.resolveAlias(ctx, &req)
+					if _, method, stream, _ := c.server.services.lookup(req.Service, req.Method); method != nil || stream == nil {
+						observed.Store(id, &observedCall{req: &req, start: start})
+					}
+				}
+				sctx, scancel := context.WithCancelCause(ctx)
+				sctx, rmd := withServerResponseMetadata(sctx)
+				sctx, sentFds := withSentFds(sctx)
+				respond := func(st *status.Status, data []byte, streaming, closeStream bool) error {
+					if streaming && st.Code() == codes.OK {
+						if err := oversizedMessageError(len(data), ch.maxSendMsgSize); err != nil {
+							if !closeStream {
+								return err
+							}
+							// terminate the stream with the error instead
+							st, _ = status.FromError(err)
+							data = nil
+						}
+					}
+					var (
+						md  MD
+						fds []int
+					)
+					if closeStream {
+						md = rmd.get()
+						fds = sentFds.take()
+					}
 					select {
 					case responses <- response{
 						id:          id,
-						status:      status,
+						status:      st,
 						data:        data,
 						closeStream: closeStream,
 						streaming:   streaming,
+						metadata:    md,
+						fds:         fds,
 					}:
 					case <-done:
+						closeFds(fds)
 						return ErrClosed
 					}
 					return nil
 				}
-				sh, err := c.server.services.handle(ctx, &req, respond)
+				sctx = withStreamHeader(sctx, func(md MD) error {
+					select {
+					case responses <- response{id: id, header: true, metadata: md}:
+					case <-done:
+						return ErrClosed
+					}
+					return nil
+				})
+				// the call is counted as active before it is handled, as it
+				// may finish before handle returns; only the calls found in
+				// cancels are released once their response is sent
+				atomic.AddInt32(&c.active, 1)
+				cancels.Store(id, scancel)
+				sh, err := c.server.services.handle(sctx, &req, mh.Flags == flagRemoteClosed, respond)
 				if err != nil {
+					if _, ok := cancels.LoadAndDelete(id); ok {
+						// rejected, the call never started
+						atomic.AddInt32(&c.active, -1)
+					} else {
+						// the handler already finished and was released
+						c.server.stats.callStarted()
+					}
+					scancel(nil)
 					status, _ := status.FromError(err)
 					if !sendStatus(mh.StreamID, status) {
 						return
@@ -485,19 +954,28 @@ func (c *serverConn) run(sctx context.Context) {
 				}
 
 				streams.Store(id, sh)
-				atomic.AddInt32(&active, 1)
+				c.server.stats.callStarted()
 			}
 			// TODO: else we must ignore this for future compat. log this?
 		}
 	}(recvErr)
 
+	var idleTimer *time.Timer
+	if idleTimeout > 0 {
+		lastRecv.Store(time.Now().UnixNano())
+		idleTimer = time.NewTimer(idleTimeout)
+		defer idleTimer.Stop()
+		idle = idleTimer.C
+	}
+
+	goaway := c.goaway
 	for {
 		var (
 			newstate connState
 			shutdown chan struct{}
 		)
 
-		activeN := atomic.LoadInt32(&active)
+		activeN := atomic.LoadInt32(&c.active)
 		if activeN > 0 {
 			newstate = connStateActive
 			shutdown = nil
@@ -506,27 +984,94 @@ func (c *serverConn) run(sctx context.Context) {
 			shutdown = c.shutdown // only enable this branch in idle mode
 		}
 		if newstate != state {
+			if newstate == connStateIdle {
+				// write out coalesced responses before the connection may
+				// be closed as idle
+				ch.flush()
+			}
 			c.setState(newstate)
 			state = newstate
 		}
 
 		select {
 		case response := <-responses:
+			if response.header {
+				resp := &Response{}
+				response.metadata.setResponse(resp)
+				p, err := c.server.codec.Marshal(resp)
+				if err == nil {
+					err = ch.send(response.id, messageTypeHeader, 0, p)
+				}
+				if err != nil {
+					logger.Errorf("failed sending header on channel: %v", err)
+					c.server.connectionError(err, c.conn)
+					return
+				}
+				continue
+			}
+			if response.closeStream {
+				// The ttrpc protocol currently does not support the case where
+				// the server is localClosed but not remoteClosed. Once the server
+				// is closing, the whole stream may be considered finished.
+				// The stream is released before the response is sent so
+				// the client may start another call as soon as it is received.
+				streams.Delete(response.id)
+				// rejected requests were never counted as active
+				if scancel, ok := cancels.LoadAndDelete(response.id); ok {
+					scancel.(context.CancelCauseFunc)(nil)
+					atomic.AddInt32(&c.active, -1)
+					c.server.stats.callCompleted()
+				}
+			}
+			if len(response.fds) > 0 {
+				err := ch.sendFds(response.id, response.fds)
+				closeFds(response.fds)
+				if err != nil {
+					logger.Errorf("failed sending file descriptors on channel: %v", err)
+					c.server.connectionError(err, c.conn)
+					return
+				}
+			}
 			if !response.streaming || response.status.Code() != codes.OK {
-				p, err := c.server.codec.Marshal(&Response{
+				resp := &Response{
 					Status:  response.status.Proto(),
 					Payload: response.data,
-				})
+				}
+				response.metadata.setResponse(resp)
+				p, err := c.server.codec.Marshal(resp)
+				if err == nil && len(p) > ch.maxSendMsgSize {
+					// Report the oversized response to the client rather
+					// than failing the whole connection.
+					st, _ := status.FromError(oversizedMessageError(len(p), ch.maxSendMsgSize))
+					p, err = c.server.codec.Marshal(&Response{Status: st.Proto()})
+				}
 				if err != nil {
-					log.G(ctx).WithError(err).Error("failed marshaling response")
+					logger.Errorf("failed marshaling response: %v", err)
+					c.server.connectionError(err, c.conn)
 					return
 				}
 
 				if err := ch.send(response.id, messageTypeResponse, 0, p); err != nil {
-					log.G(ctx).WithError(err).Error("failed sending message on channel")
+					logger.Errorf("failed sending message on channel: %v", err)
+					c.server.connectionError(err, c.conn)
 					return
 				}
 			} else {
+				if len(response.metadata) > 0 {
+					// the final data message cannot carry the metadata of
+					// the response, send it ahead in a trailer
+					resp := &Response{}
+					response.metadata.setResponse(resp)
+					p, err := c.server.codec.Marshal(resp)
+					if err == nil {
+						err = ch.send(response.id, messageTypeTrailer, 0, p)
+					}
+					if err != nil {
+						logger.Errorf("failed sending trailer on channel: %v", err)
+						c.server.connectionError(err, c.conn)
+						return
+					}
+				}
 				var flags uint8
 				if response.closeStream {
 					flags = flagRemoteClosed
@@ -535,42 +1080,103 @@ func (c *serverConn) run(sctx context.Context) {
 					flags = flags | flagNoData
 				}
 				if err := ch.send(response.id, messageTypeData, flags, response.data); err != nil {
-					log.G(ctx).WithError(err).Error("failed sending message on channel")
+					logger.Errorf("failed sending message on channel: %v", err)
+					c.server.connectionError(err, c.conn)
 					return
 				}
 			}
-
 			if response.closeStream {
-				// The ttrpc protocol currently does not support the case where
-				// the server is localClosed but not remoteClosed. Once the server
-				// is closing, the whole stream may be considered finished
-				streams.Delete(response.id)
-				atomic.AddInt32(&active, -1)
+				observeCall(response.id, response.status, response.data)
+			}
+		case ctrl := <-controls:
+			if err := ch.send(ctrl.id, ctrl.mt, 0, ctrl.data); err != nil {
+				logger.Errorf("failed sending message on channel: %v", err)
+				c.server.connectionError(err, c.conn)
+				return
+			}
+		case <-goaway:
+			goaway = nil
+			if err := ch.send(controlStreamID, messageTypeGoAway, 0, nil); err != nil {
+				logger.Errorf("failed sending message on channel: %v", err)
+				c.server.connectionError(err, c.conn)
+				return
+			}
+		case <-idle:
+			if atomic.LoadInt32(&c.active) > 0 {
+				// calls in progress keep the connection alive
+				lastRecv.Store(time.Now().UnixNano())
+				idleTimer.Reset(idleTimeout)
+				continue
+			}
+			if remaining := idleTimeout - time.Since(time.Unix(0, lastRecv.Load())); remaining > 0 {
+				idleTimer.Reset(remaining)
+				continue
 			}
+			logger.Debugf("ttrpc: closing idle connection")
+			return
+		case err := <-keepaliveErr:
+			logger.Errorf("ttrpc: keepalive failed, closing connection: %v", err)
+			c.server.connectionError(err, c.conn)
+			return
 		case err := <-recvErr:
 			// TODO(stevvooe): Not wildly clear what we should do in this
 			// branch. Basically, it means that we are no longer receiving
 			// requests due to a terminal error.
 			recvErr = nil // connection is now "closing"
+			cancelStreams()
 			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNRESET) {
 				// The client went away and we should stop processing
 				// requests, so that the client connection is closed
+				if err != io.EOF {
+					// the client did not close the connection cleanly
+					c.server.connectionError(err, c.conn)
+				}
 				return
 			}
-			log.G(ctx).WithError(err).Error("error receiving message")
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				// the client stalled in the middle of a frame
+				logger.Errorf("ttrpc: read timed out, closing connection: %v", err)
+				c.server.connectionError(err, c.conn)
+				return
+			}
+			logger.Errorf("error receiving message: %v", err)
+			c.server.connectionError(err, c.conn)
 			// else, initiate shutdown
 		case <-shutdown:
+			if atomic.LoadInt32(&c.active) > 0 {
+				// a request arrived since the state was last updated
+				continue
+			}
 			return
 		}
 	}
 }
 
+func (s *Server) newChannel(conn net.Conn) *channel {
+	ch := newChannel(conn)
+	ch.maxRecvMsgSize = s.config.maxRecvMsgSize
+	ch.maxSendMsgSize = s.config.maxSendMsgSize
+	if s.config.writeBufferSize > 0 {
+		ch.setWriteBufferSize(s.config.writeBufferSize)
+	}
+	ch.coalesceWindow = s.config.writeCoalesceWindow
+	ch.stats = &s.stats
+	ch.tracer = s.config.frameTracer
+	ch.compressMinSize = s.config.compressMinSize
+	ch.readTimeout = s.config.readTimeout
+	ch.writeTimeout = s.config.writeTimeout
+	return ch
+}
+
 var noopFunc = func() {}
 
 func getRequestContext(ctx context.Context, req *Request) (retCtx context.Context, cancel func()) {
 	if len(req.Metadata) > 0 {
 		md := MD{}
 		md.fromRequest(req)
+		// the version was checked by the server, dropping it lets handlers
+		// send their metadata with calls of their own clients
+		delete(md, VersionMetadataKey)
 		ctx = WithMetadata(ctx, md)
 	}
 
@@ -18,6 +18,9 @@ package ttrpc
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"os"
 	"strings"
 	"testing"
 	"time"
@@ -49,6 +52,88 @@ func TestUnixSocketHandshake(t *testing.T) {
 	}
 }
 
+func TestUnixSocketRequireAny(t *testing.T) {
+	var (
+		other = os.Geteuid() + 1
+		self  = UnixSocketRequireSameUser()
+	)
+	for _, tc := range []struct {
+		name   string
+		check  UnixCredentialsFunc
+		refuse bool
+	}{
+		{name: "Allowed", check: UnixSocketRequireAny(UnixSocketRequireUidGid(other, -1), self)},
+		{name: "Refused", check: UnixSocketRequireAny(UnixSocketRequireUidGid(other, -1)), refuse: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var (
+				ctx            = context.Background()
+				server         = mustServer(t)(NewServer(WithServerHandshaker(tc.check)))
+				addr, listener = newTestListener(t)
+			)
+			defer listener.Close()
+
+			registerTestingService(server, &testingServer{})
+
+			go server.Serve(ctx, listener)
+			defer server.Shutdown(ctx)
+
+			client, cleanup := newTestClient(t, addr)
+			defer cleanup()
+
+			var tp internal.TestPayload
+			err := client.Call(ctx, serviceName, "Test", &tp, &tp)
+			if tc.refuse && !errors.Is(err, ErrClosed) {
+				t.Fatalf("expected refused connection to be closed, got %v", err)
+			}
+			if !tc.refuse && err != nil {
+				t.Fatalf("unexpected error making call: %v", err)
+			}
+		})
+	}
+}
+
+func TestUnixPeerCredentials(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		opts []ServerOpt
+	}{
+		{name: "NoHandshaker"},
+		{name: "Handshaker", opts: []ServerOpt{WithServerHandshaker(UnixSocketRequireSameUser())}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var (
+				ctx             = context.Background()
+				server          = mustServer(t)(NewServer(tc.opts...))
+				addr, listener  = newTestListener(t)
+				client, cleanup = newTestClient(t, addr)
+			)
+			defer cleanup()
+			defer listener.Close()
+
+			server.RegisterMethod(serviceName, "Creds", func(ctx context.Context, unmarshal func(interface{}) error) (interface{}, error) {
+				ucred, ok := GetUnixPeerCredentials(ctx)
+				if !ok {
+					return nil, errors.New("no peer credentials")
+				}
+				return &internal.TestPayload{Foo: fmt.Sprintf("%d:%d:%d", ucred.Pid, ucred.Uid, ucred.Gid)}, nil
+			})
+
+			go server.Serve(ctx, listener)
+			defer server.Shutdown(ctx)
+
+			var resp internal.TestPayload
+			if err := client.Call(ctx, serviceName, "Creds", &internal.TestPayload{}, &resp); err != nil {
+				t.Fatal(err)
+			}
+			expected := fmt.Sprintf("%d:%d:%d", os.Getpid(), os.Geteuid(), os.Getegid())
+			if resp.Foo != expected {
+				t.Fatalf("unexpected peer credentials: %q != %q", resp.Foo, expected)
+			}
+		})
+	}
+}
+
 func BenchmarkRoundTripUnixSocketCreds(b *testing.B) {
 	// TODO(stevvooe): Right now, there is a 5x performance decrease when using
 	// unix socket credentials. See (UnixCredentialsFunc).Handshake for
@@ -17,19 +17,24 @@
 package ttrpc
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"net"
+	"reflect"
 	"runtime"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"testing"
 	"time"
 
 	"github.com/containerd/ttrpc/internal"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/proto"
@@ -159,6 +164,8 @@ func TestServerUnimplemented(t *testing.T) {
 		errs <- server.Serve(ctx, listener)
 	}()
 
+	registerTestingService(server, &testingServer{})
+
 	var tp internal.TestPayload
 	if err := client.Call(ctx, "Not", "Found", &tp, &tp); err == nil {
 		t.Fatalf("expected error from non-existent service call")
@@ -166,6 +173,33 @@ func TestServerUnimplemented(t *testing.T) {
 		t.Fatalf("expected status present in error: %v", err)
 	} else if status.Code() != codes.Unimplemented {
 		t.Fatalf("expected not found for method")
+	} else if !strings.Contains(status.Message(), "Not") {
+		t.Fatalf("expected the service in the error: %v", err)
+	}
+
+	for _, desc := range []*StreamDesc{nil, {StreamingServer: true}} {
+		var err error
+		if desc == nil {
+			err = client.Call(ctx, serviceName, "Bogus", &tp, &tp)
+		} else {
+			var stream ClientStream
+			stream, err = client.NewStream(ctx, desc, serviceName, "Bogus", &tp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = stream.RecvMsg(&tp)
+		}
+		if code := status.Code(err); code != codes.Unimplemented {
+			t.Fatalf("expected %v, got %v", codes.Unimplemented, err)
+		}
+		if !strings.Contains(err.Error(), "/"+serviceName+"/Bogus") {
+			t.Fatalf("expected the method in the error: %v", err)
+		}
+	}
+
+	// the connection remains usable
+	if err := client.Call(ctx, serviceName, "Test", &internal.TestPayload{Foo: "foo"}, &tp); err != nil {
+		t.Fatal(err)
 	}
 
 	if err := server.Shutdown(ctx); err != nil {
@@ -176,6 +210,251 @@ func TestServerUnimplemented(t *testing.T) {
 	}
 }
 
+func TestServerRegisterMethod(t *testing.T) {
+	var (
+		ctx             = context.Background()
+		server          = mustServer(t)(NewServer())
+		addr, listener  = newTestListener(t)
+		client, cleanup = newTestClient(t, addr)
+	)
+	defer cleanup()
+	defer listener.Close()
+
+	echo := func(prefix string) Method {
+		return func(_ context.Context, unmarshal func(interface{}) error) (interface{}, error) {
+			var req internal.TestPayload
+			if err := unmarshal(&req); err != nil {
+				return nil, err
+			}
+			return &internal.TestPayload{Foo: prefix + req.Foo}, nil
+		}
+	}
+	server.RegisterService(serviceName, &ServiceDesc{
+		Methods: map[string]Method{"Generated": echo("generated ")},
+	})
+	server.RegisterMethod(serviceName, "Dynamic", echo("dynamic "))
+	server.RegisterMethod("dynamic.Service", "Echo", echo("new "))
+
+	go server.Serve(ctx, listener)
+	defer server.Shutdown(ctx)
+
+	for _, tc := range []struct {
+		service, method, expected string
+	}{
+		{serviceName, "Generated", "generated call"},
+		{serviceName, "Dynamic", "dynamic call"},
+		{"dynamic.Service", "Echo", "new call"},
+	} {
+		var resp internal.TestPayload
+		if err := client.Call(ctx, tc.service, tc.method, &internal.TestPayload{Foo: "call"}, &resp); err != nil {
+			t.Fatalf("%s/%s: %v", tc.service, tc.method, err)
+		}
+		if resp.Foo != tc.expected {
+			t.Fatalf("%s/%s: unexpected response %q", tc.service, tc.method, resp.Foo)
+		}
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected duplicate method registration to panic")
+		}
+	}()
+	server.RegisterMethod(serviceName, "Dynamic", echo(""))
+}
+
+func TestServerUnregisterService(t *testing.T) {
+	var (
+		ctx             = context.Background()
+		server          = mustServer(t)(NewServer())
+		addr, listener  = newTestListener(t)
+		client, cleanup = newTestClient(t, addr)
+		started         = make(chan struct{})
+		release         = make(chan struct{})
+	)
+	defer cleanup()
+	defer listener.Close()
+
+	registerTestingService(server, &testingServer{})
+	server.RegisterMethod("drained.Service", "Wait", func(ctx context.Context, unmarshal func(interface{}) error) (interface{}, error) {
+		close(started)
+		<-release
+		return &internal.TestPayload{Foo: "done"}, nil
+	})
+
+	go server.Serve(ctx, listener)
+	defer server.Shutdown(ctx)
+
+	inflight := make(chan error, 1)
+	go func() {
+		var resp internal.TestPayload
+		inflight <- client.Call(ctx, "drained.Service", "Wait", &internal.TestPayload{}, &resp)
+	}()
+	<-started
+
+	if err := server.UnregisterService("drained.Service"); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.UnregisterService("drained.Service"); err == nil {
+		t.Fatal("expected unregistering an unknown service to fail")
+	}
+
+	var resp internal.TestPayload
+	err := client.Call(ctx, "drained.Service", "Wait", &internal.TestPayload{}, &resp)
+	if code := status.Code(err); code != codes.Unimplemented {
+		t.Fatalf("expected %v, got %v", codes.Unimplemented, err)
+	}
+	if err := client.Call(ctx, serviceName, "Test", &internal.TestPayload{Foo: "foo"}, &resp); err != nil {
+		t.Fatal(err)
+	}
+
+	close(release)
+	if err := <-inflight; err != nil {
+		t.Fatalf("expected the call in flight to complete, got %v", err)
+	}
+}
+
+func TestServerRegisterAlias(t *testing.T) {
+	var (
+		ctx     = context.Background()
+		logger  = &recordingLogger{}
+		methods = make(chan string, 2)
+		server  = mustServer(t)(NewServer(
+			WithServerLogger(logger),
+			WithUnaryServerInterceptor(func(ctx context.Context, unmarshal Unmarshaler, info *UnaryServerInfo, method Method) (interface{}, error) {
+				methods <- info.FullMethod
+				return method(ctx, unmarshal)
+			}),
+		))
+		addr, listener  = newTestListener(t)
+		client, cleanup = newTestClient(t, addr)
+	)
+	defer cleanup()
+	defer listener.Close()
+
+	registerTestingService(server, &testingServer{})
+	server.RegisterAlias("/old.Service/OldTest", "/"+serviceName+"/Test")
+
+	go server.Serve(ctx, listener)
+	defer server.Shutdown(ctx)
+
+	for i := 0; i < 2; i++ {
+		var resp internal.TestPayload
+		if err := client.Call(ctx, "old.Service", "OldTest", &internal.TestPayload{Foo: "foo"}, &resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.Foo != "foofoo" {
+			t.Fatalf("unexpected response %q", resp.Foo)
+		}
+		if method := <-methods; method != "/"+serviceName+"/Test" {
+			t.Fatalf("unexpected method %q", method)
+		}
+	}
+
+	var warnings int
+	logger.mu.Lock()
+	for _, m := range logger.messages {
+		if strings.Contains(m, "deprecated method /old.Service/OldTest") {
+			warnings++
+		}
+	}
+	logger.mu.Unlock()
+	if warnings != 1 {
+		t.Fatalf("expected the alias to be logged once, got %d", warnings)
+	}
+
+	for _, names := range [][2]string{
+		{"/old.Service/OldTest", "/" + serviceName + "/Test"},
+		{"old.Service/Other", "/" + serviceName + "/Test"},
+		{"/old.Service/Other", "/" + serviceName},
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Fatalf("expected registering alias %v to panic", names)
+				}
+			}()
+			server.RegisterAlias(names[0], names[1])
+		}()
+	}
+}
+
+func TestServerPeerAddress(t *testing.T) {
+	var (
+		ctx             = context.Background()
+		server          = mustServer(t)(NewServer())
+		addr, listener  = newTestListener(t)
+		client, cleanup = newTestClient(t, addr)
+	)
+	defer cleanup()
+	defer listener.Close()
+
+	server.RegisterMethod(serviceName, "Peer", func(ctx context.Context, unmarshal func(interface{}) error) (interface{}, error) {
+		peer, ok := GetPeerAddress(ctx)
+		if !ok {
+			return nil, status.Error(codes.NotFound, "no peer address")
+		}
+		return &internal.TestPayload{Foo: peer.Network()}, nil
+	})
+
+	go server.Serve(ctx, listener)
+	defer server.Shutdown(ctx)
+
+	var resp internal.TestPayload
+	if err := client.Call(ctx, serviceName, "Peer", &internal.TestPayload{}, &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Foo != "unix" {
+		t.Fatalf("unexpected peer network: %q", resp.Foo)
+	}
+
+	if _, ok := GetPeerAddress(ctx); ok {
+		t.Fatal("expected no peer address outside of a call")
+	}
+}
+
+type testConnInfo struct {
+	user string
+}
+
+func TestServerConnectionInfo(t *testing.T) {
+	var (
+		ctx            = context.Background()
+		addr, listener = newTestListener(t)
+		handshaker     = handshakerFunc(func(_ context.Context, conn net.Conn) (net.Conn, interface{}, error) {
+			return conn, testConnInfo{user: "alice"}, nil
+		})
+		server          = mustServer(t)(NewServer(WithServerHandshaker(handshaker)))
+		client, cleanup = newTestClient(t, addr)
+	)
+	defer cleanup()
+	defer listener.Close()
+
+	server.RegisterMethod(serviceName, "Info", func(ctx context.Context, unmarshal func(interface{}) error) (interface{}, error) {
+		info, ok := ConnectionInfo(ctx)
+		if !ok {
+			return nil, status.Error(codes.NotFound, "no connection info")
+		}
+		return &internal.TestPayload{Foo: info.(testConnInfo).user}, nil
+	})
+
+	go server.Serve(ctx, listener)
+	defer server.Shutdown(ctx)
+
+	for i := 0; i < 2; i++ {
+		var resp internal.TestPayload
+		if err := client.Call(ctx, serviceName, "Info", &internal.TestPayload{}, &resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.Foo != "alice" {
+			t.Fatalf("unexpected connection info: %q", resp.Foo)
+		}
+	}
+
+	if _, ok := ConnectionInfo(ctx); ok {
+		t.Fatal("expected no connection info outside of a call")
+	}
+}
+
 func TestServerListenerClosed(t *testing.T) {
 	var (
 		ctx         = context.Background()
@@ -271,121 +550,592 @@ func TestServerShutdown(t *testing.T) {
 	checkServerShutdown(t, server)
 }
 
-func TestServerClose(t *testing.T) {
+func TestServerMultipleListeners(t *testing.T) {
 	var (
-		ctx         = context.Background()
-		server      = mustServer(t)(NewServer())
-		_, listener = newTestListener(t)
-		startClose  = make(chan struct{})
-		errs        = make(chan error, 1)
+		ctx                    = context.Background()
+		server                 = mustServer(t)(NewServer())
+		unixAddr, unixListener = newTestListener(t)
+		handlersStarted        sync.WaitGroup
+		proceed                = make(chan struct{})
+		serveErrs              = make(chan error, 2)
+		callErrs               = make(chan error, 2)
+		shutdownErrs           = make(chan error, 1)
 	)
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	go func() {
-		close(startClose)
-		errs <- server.Serve(ctx, listener)
-	}()
+	server.Register(serviceName, map[string]Method{
+		"Test": func(_ context.Context, unmarshal func(interface{}) error) (interface{}, error) {
+			var req internal.TestPayload
+			if err := unmarshal(&req); err != nil {
+				return nil, err
+			}
+			handlersStarted.Done()
+			<-proceed
+			return &req, nil
+		},
+	})
 
-	<-startClose
-	if err := server.Close(); err != nil {
-		t.Fatal(err)
+	for _, l := range []net.Listener{unixListener, tcpListener} {
+		go func(l net.Listener) {
+			serveErrs <- server.Serve(ctx, l)
+		}(l)
 	}
 
-	err := <-errs
-	if err != ErrServerClosed {
-		t.Fatal("expected an error from a closed server", err)
+	unixClient, cleanup := newTestClient(t, unixAddr)
+	defer cleanup()
+	conn, err := net.Dial("tcp", tcpListener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
 	}
+	tcpClient := NewClient(conn)
+	defer tcpClient.Close()
 
-	checkServerShutdown(t, server)
-}
+	for _, client := range []*Client{unixClient, tcpClient} {
+		handlersStarted.Add(1)
+		go func(client *Client) {
+			tp := internal.TestPayload{Foo: "listener"}
+			callErrs <- client.Call(ctx, serviceName, "Test", &tp, &tp)
+		}(client)
+	}
+	handlersStarted.Wait()
 
-func TestImmediateServerShutdown(t *testing.T) {
-	var (
-		ctx            = context.Background()
-		server         = mustServer(t)(NewServer())
-		addr, listener = newTestListener(t)
-		errs           = make(chan error, 1)
-		_, cleanup     = newTestClient(t, addr)
-	)
-	defer cleanup()
-	defer listener.Close()
 	go func() {
-		time.Sleep(1 * time.Millisecond)
-		errs <- server.Serve(ctx, listener)
+		shutdownErrs <- server.Shutdown(ctx)
 	}()
+	select {
+	case err := <-shutdownErrs:
+		t.Fatalf("shutdown finished before the calls on both listeners: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
 
-	registerTestingService(server, &testingServer{})
-
-	if err := server.Shutdown(ctx); err != nil {
+	close(proceed)
+	for i := 0; i < 2; i++ {
+		if err := <-callErrs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := <-shutdownErrs; err != nil {
 		t.Fatal(err)
 	}
-	select {
-	case err := <-errs:
-		if err != ErrServerClosed {
-			t.Fatal(err)
+	for i := 0; i < 2; i++ {
+		if err := <-serveErrs; err != ErrServerClosed {
+			t.Fatalf("expected %v, got %v", ErrServerClosed, err)
 		}
-	case <-time.After(2 * time.Second):
-		t.Fatal("retreiving error from server.Shutdown() timed out")
 	}
+	checkServerShutdown(t, server)
 }
 
-func TestOversizeCall(t *testing.T) {
+func TestServerShutdownDrainsStreams(t *testing.T) {
 	var (
 		ctx             = context.Background()
 		server          = mustServer(t)(NewServer())
 		addr, listener  = newTestListener(t)
-		errs            = make(chan error, 1)
 		client, cleanup = newTestClient(t, addr)
+		release         = make(chan struct{})
+		shutdownErr     = make(chan error, 1)
 	)
 	defer cleanup()
 	defer listener.Close()
-	go func() {
-		errs <- server.Serve(ctx, listener)
-	}()
 
 	registerTestingService(server, &testingServer{})
+	server.RegisterService("streamService", &ServiceDesc{
+		Streams: map[string]Stream{
+			"Wait": {
+				Handler: func(_ context.Context, ss StreamServer) (interface{}, error) {
+					<-release
+					return nil, ss.SendMsg(&internal.EchoPayload{Msg: "released"})
+				},
+				StreamingServer: true,
+			},
+		},
+	})
 
-	tp := &internal.TestPayload{
-		Foo: strings.Repeat("a", 1+messageLengthMax),
-	}
-	if err := client.Call(ctx, serviceName, "Test", tp, tp); err == nil {
-		t.Fatalf("expected error from oversized message")
-	} else if status, ok := status.FromError(err); !ok {
-		t.Fatalf("expected status present in error: %v", err)
-	} else if status.Code() != codes.ResourceExhausted {
-		t.Fatalf("expected code: %v != %v", status.Code(), codes.ResourceExhausted)
-	}
+	go server.Serve(ctx, listener)
 
-	if err := server.Shutdown(ctx); err != nil {
+	stream, err := client.NewStream(ctx, &StreamDesc{StreamingServer: true}, "streamService", "Wait", &internal.EchoPayload{})
+	if err != nil {
 		t.Fatal(err)
 	}
-	if err := <-errs; err != ErrServerClosed {
-		t.Fatal(err)
+	waitFor(t, func() bool { return server.ActiveStreams() == 1 })
+
+	// rejected calls leave the stream counted as active, so that the
+	// connection is not closed as idle
+	err = client.Call(ctx, "streamService", "Unknown", &internal.EchoPayload{}, &internal.EchoPayload{})
+	if status.Code(err) != codes.Unimplemented {
+		t.Fatalf("expected unimplemented error, got %v", err)
+	}
+	if n := server.ActiveStreams(); n != 1 {
+		t.Fatalf("expected 1 active stream after a rejected call, got %d", n)
 	}
-}
 
-func TestClientEOF(t *testing.T) {
-	var (
-		ctx             = context.Background()
-		server          = mustServer(t)(NewServer())
-		addr, listener  = newTestListener(t)
-		errs            = make(chan error, 1)
-		client, cleanup = newTestClient(t, addr)
-	)
-	defer cleanup()
-	defer listener.Close()
 	go func() {
-		errs <- server.Serve(ctx, listener)
+		sctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		defer cancel()
+		shutdownErr <- server.Shutdown(sctx)
 	}()
 
-	registerTestingService(server, &testingServer{})
+	// new calls are refused once the server is draining
+	waitFor(t, func() bool {
+		_, err := newTestingClient(client).Test(ctx, &internal.TestPayload{})
+		if err == nil {
+			t.Fatal("expected call to fail while server is shutting down")
+		}
+		if !errors.Is(err, ErrGoAway) && status.Code(err) != codes.Unavailable {
+			t.Fatalf("unexpected error while server is shutting down: %v", err)
+		}
+		return errors.Is(err, ErrGoAway)
+	})
+	if n := server.ActiveStreams(); n != 1 {
+		t.Fatalf("expected 1 active stream while draining, got %d", n)
+	}
 
-	tp := &internal.TestPayload{}
-	// do a regular call
-	if err := client.Call(ctx, serviceName, "Test", tp, tp); err != nil {
-		t.Fatalf("unexpected error: %v", err)
+	select {
+	case err := <-shutdownErr:
+		t.Fatalf("shutdown returned before active stream finished: %v", err)
+	default:
 	}
 
-	// shutdown the server so the client stops receiving stuff.
+	close(release)
+	var resp internal.EchoPayload
+	if err := stream.RecvMsg(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Msg != "released" {
+		t.Fatalf("unexpected stream message %q", resp.Msg)
+	}
+
+	select {
+	case err := <-shutdownErr:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown did not complete after stream finished")
+	}
+	if n := server.ActiveStreams(); n != 0 {
+		t.Fatalf("expected no active streams after shutdown, got %d", n)
+	}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	for i := 0; i < 500; i++ {
+		if cond() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("timed out waiting for condition")
+}
+
+func TestServerClose(t *testing.T) {
+	var (
+		ctx         = context.Background()
+		server      = mustServer(t)(NewServer())
+		_, listener = newTestListener(t)
+		startClose  = make(chan struct{})
+		errs        = make(chan error, 1)
+	)
+
+	go func() {
+		close(startClose)
+		errs <- server.Serve(ctx, listener)
+	}()
+
+	<-startClose
+	if err := server.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	err := <-errs
+	if err != ErrServerClosed {
+		t.Fatal("expected an error from a closed server", err)
+	}
+
+	checkServerShutdown(t, server)
+}
+
+func TestServerListenerError(t *testing.T) {
+	var (
+		ctx         = context.Background()
+		server      = mustServer(t)(NewServer())
+		_, listener = newTestListener(t)
+		errs        = make(chan error, 1)
+	)
+	defer server.Close()
+
+	go func() {
+		errs <- server.Serve(ctx, listener)
+	}()
+
+	// closing the listener behind the server's back is a listener failure
+	listener.Close()
+	err := <-errs
+	if err == nil || errors.Is(err, ErrServerClosed) {
+		t.Fatalf("expected a listener error, got %v", err)
+	}
+}
+
+func TestServerServeConn(t *testing.T) {
+	var (
+		ctx                = context.Background()
+		server             = mustServer(t)(NewServer())
+		clientConn, served = net.Pipe()
+		errs               = make(chan error, 1)
+	)
+	defer server.Close()
+	registerTestingService(server, &testingServer{})
+
+	go func() {
+		errs <- server.ServeConn(ctx, served)
+	}()
+
+	client := NewClient(clientConn)
+	var resp internal.TestPayload
+	if err := client.Call(ctx, serviceName, "Test", &internal.TestPayload{Foo: "foo"}, &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Foo != "foofoo" {
+		t.Fatalf("unexpected response %q", resp.Foo)
+	}
+
+	client.Close()
+	select {
+	case err := <-errs:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ServeConn did not return after the connection closed")
+	}
+
+	server.Close()
+	_, served = net.Pipe()
+	if err := server.ServeConn(ctx, served); err != ErrServerClosed {
+		t.Fatalf("expected %v, got %v", ErrServerClosed, err)
+	}
+}
+
+func TestServerConnConfigurer(t *testing.T) {
+	var (
+		ctx            = context.Background()
+		refuse         atomic.Bool
+		configured     = make(chan net.Conn, 2)
+		refused        = errors.New("refused")
+		errs           = make(chan error, 1)
+		addr, listener = newTestListener(t)
+		server         = mustServer(t)(NewServer(
+			WithServerConnConfigurer(func(conn net.Conn) error {
+				configured <- conn
+				if refuse.Load() {
+					return refused
+				}
+				return conn.(*net.UnixConn).SetWriteBuffer(1 << 16)
+			}),
+			WithServerErrorHandler(func(err error, _ net.Conn) {
+				errs <- err
+			}),
+		))
+	)
+	defer listener.Close()
+	registerTestingService(server, &testingServer{})
+
+	go server.Serve(ctx, listener)
+	defer server.Shutdown(ctx)
+
+	client, cleanup := newTestClient(t, addr)
+	var resp internal.TestPayload
+	if err := client.Call(ctx, serviceName, "Test", &internal.TestPayload{Foo: "foo"}, &resp); err != nil {
+		t.Fatal(err)
+	}
+	cleanup()
+	if _, ok := (<-configured).(*net.UnixConn); !ok {
+		t.Fatal("expected the accepted connection to be configured")
+	}
+
+	refuse.Store(true)
+	client, cleanup = newTestClient(t, addr)
+	defer cleanup()
+	if err := client.Call(ctx, serviceName, "Test", &internal.TestPayload{Foo: "foo"}, &resp); err == nil {
+		t.Fatal("expected the call to fail on a refused connection")
+	}
+	<-configured
+	if err := <-errs; !errors.Is(err, refused) {
+		t.Fatalf("expected %v, got %v", refused, err)
+	}
+}
+
+// proxyConn serves a connection which started with a PROXY protocol header,
+// reporting the client address found in the header.
+type proxyConn struct {
+	net.Conn
+	r      *bufio.Reader
+	remote net.Addr
+}
+
+func (c *proxyConn) Read(p []byte) (int, error) { return c.r.Read(p) }
+func (c *proxyConn) RemoteAddr() net.Addr       { return c.remote }
+
+// readProxyHeader consumes a PROXY protocol v1 header from conn.
+func readProxyHeader(conn net.Conn) (net.Conn, error) {
+	r := bufio.NewReader(conn)
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Fields(line)
+	if len(fields) != 6 || fields[0] != "PROXY" {
+		return nil, fmt.Errorf("invalid PROXY header %q", line)
+	}
+	addr, err := net.ResolveTCPAddr("tcp", net.JoinHostPort(fields[2], fields[4]))
+	if err != nil {
+		return nil, err
+	}
+	return &proxyConn{Conn: conn, r: r, remote: addr}, nil
+}
+
+func TestServerConnWrapper(t *testing.T) {
+	var (
+		ctx            = context.Background()
+		errs           = make(chan error, 1)
+		addr, listener = newTestListener(t)
+		server         = mustServer(t)(NewServer(
+			WithConnWrapper(readProxyHeader),
+			WithServerErrorHandler(func(err error, _ net.Conn) {
+				errs <- err
+			}),
+		))
+	)
+	defer listener.Close()
+	server.RegisterService(serviceName, &ServiceDesc{
+		Methods: map[string]Method{
+			"Peer": func(ctx context.Context, unmarshal func(interface{}) error) (interface{}, error) {
+				addr, _ := GetPeerAddress(ctx)
+				return &internal.EchoPayload{Msg: addr.String()}, nil
+			},
+		},
+	})
+
+	go server.Serve(ctx, listener)
+	defer server.Shutdown(ctx)
+
+	dial := func(header string) *Client {
+		conn, err := net.Dial("unix", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := conn.Write([]byte(header)); err != nil {
+			t.Fatal(err)
+		}
+		return NewClient(conn)
+	}
+
+	client := dial("PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n")
+	defer client.Close()
+	var resp internal.EchoPayload
+	if err := client.Call(ctx, serviceName, "Peer", &internal.EchoPayload{}, &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Msg != "192.0.2.1:56324" {
+		t.Fatalf("expected the address of the PROXY header, got %q", resp.Msg)
+	}
+
+	client = dial("GARBAGE\n")
+	defer client.Close()
+	if err := client.Call(ctx, serviceName, "Peer", &internal.EchoPayload{}, &resp); err == nil {
+		t.Fatal("expected the call to fail on a refused connection")
+	}
+	if err := <-errs; err == nil || !strings.Contains(err.Error(), "invalid PROXY header") {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+// temporaryError is a temporary accept error, like running out of file
+// descriptors.
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "temporary error" }
+func (temporaryError) Temporary() bool { return true }
+
+// flakyListener fails to accept with a temporary error a number of times
+// before accepting from the wrapped listener.
+type flakyListener struct {
+	net.Listener
+	failures atomic.Int32
+}
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	if l.failures.Add(-1) >= 0 {
+		return nil, temporaryError{}
+	}
+	return l.Listener.Accept()
+}
+
+func TestServerAcceptBackoff(t *testing.T) {
+	var (
+		ctx            = context.Background()
+		server         = mustServer(t)(NewServer(WithMaxAcceptBackoff(time.Millisecond)))
+		addr, listener = newTestListener(t)
+		flaky          = &flakyListener{Listener: listener}
+	)
+	defer listener.Close()
+	registerTestingService(server, &testingServer{})
+
+	// with the default cap of a second this many failures take seconds
+	flaky.failures.Store(50)
+	start := time.Now()
+	go server.Serve(ctx, flaky)
+	defer server.Shutdown(ctx)
+
+	client, cleanup := newTestClient(t, addr)
+	defer cleanup()
+	var resp internal.TestPayload
+	if err := client.Call(ctx, serviceName, "Test", &internal.TestPayload{Foo: "foo"}, &resp); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("accept backoff was not capped, took %v", elapsed)
+	}
+
+	if _, err := NewServer(WithMaxAcceptBackoff(0)); err == nil {
+		t.Fatal("expected a zero accept backoff to be rejected")
+	}
+}
+
+func TestImmediateServerShutdown(t *testing.T) {
+	var (
+		ctx            = context.Background()
+		server         = mustServer(t)(NewServer())
+		addr, listener = newTestListener(t)
+		errs           = make(chan error, 1)
+		_, cleanup     = newTestClient(t, addr)
+	)
+	defer cleanup()
+	defer listener.Close()
+	go func() {
+		time.Sleep(1 * time.Millisecond)
+		errs <- server.Serve(ctx, listener)
+	}()
+
+	registerTestingService(server, &testingServer{})
+
+	if err := server.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-errs:
+		if err != ErrServerClosed {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("retreiving error from server.Shutdown() timed out")
+	}
+}
+
+func TestOversizeCall(t *testing.T) {
+	var (
+		ctx             = context.Background()
+		server          = mustServer(t)(NewServer())
+		addr, listener  = newTestListener(t)
+		errs            = make(chan error, 1)
+		client, cleanup = newTestClient(t, addr)
+	)
+	defer cleanup()
+	defer listener.Close()
+	go func() {
+		errs <- server.Serve(ctx, listener)
+	}()
+
+	registerTestingService(server, &testingServer{})
+
+	tp := &internal.TestPayload{
+		Foo: strings.Repeat("a", 1+messageLengthMax),
+	}
+	if err := client.Call(ctx, serviceName, "Test", tp, tp); err == nil {
+		t.Fatalf("expected error from oversized message")
+	} else if status, ok := status.FromError(err); !ok {
+		t.Fatalf("expected status present in error: %v", err)
+	} else if status.Code() != codes.ResourceExhausted {
+		t.Fatalf("expected code: %v != %v", status.Code(), codes.ResourceExhausted)
+	}
+
+	if err := server.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errs; err != ErrServerClosed {
+		t.Fatal(err)
+	}
+}
+
+func TestOversizeCallConfigured(t *testing.T) {
+	var (
+		ctx             = context.Background()
+		server          = mustServer(t)(NewServer(WithMaxReceiveMessageSize(2 * messageLengthMax)))
+		addr, listener  = newTestListener(t)
+		client, cleanup = newTestClient(t, addr, WithMaxSendMessageSize(2*messageLengthMax))
+	)
+	defer cleanup()
+	defer listener.Close()
+
+	registerTestingService(server, &testingServer{})
+
+	go server.Serve(ctx, listener)
+	defer server.Shutdown(ctx)
+
+	// The request fits the raised limits, but the doubled response exceeds
+	// the default send limit of the server.
+	tp := &internal.TestPayload{
+		Foo: strings.Repeat("a", 1+messageLengthMax),
+	}
+	if err := client.Call(ctx, serviceName, "Test", tp, tp); status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("expected code %v, got %v", codes.ResourceExhausted, err)
+	}
+
+	tp = &internal.TestPayload{
+		Foo: strings.Repeat("a", 1+2*messageLengthMax),
+	}
+	err := client.Call(ctx, serviceName, "Test", tp, tp)
+	var oerr *OversizedMessageErr
+	if !errors.As(err, &oerr) {
+		t.Fatalf("expected local oversized message error, got %v", err)
+	}
+	if oerr.MaximumLength() != 2*messageLengthMax {
+		t.Fatalf("unexpected maximum length: %d", oerr.MaximumLength())
+	}
+
+	// the connection must remain usable
+	tp = &internal.TestPayload{Foo: "a"}
+	if err := client.Call(ctx, serviceName, "Test", tp, tp); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientEOF(t *testing.T) {
+	var (
+		ctx             = context.Background()
+		server          = mustServer(t)(NewServer())
+		addr, listener  = newTestListener(t)
+		errs            = make(chan error, 1)
+		client, cleanup = newTestClient(t, addr)
+	)
+	defer cleanup()
+	defer listener.Close()
+	go func() {
+		errs <- server.Serve(ctx, listener)
+	}()
+
+	registerTestingService(server, &testingServer{})
+
+	tp := &internal.TestPayload{}
+	// do a regular call
+	if err := client.Call(ctx, serviceName, "Test", tp, tp); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// shutdown the server so the client stops receiving stuff.
 	if err := server.Close(); err != nil {
 		t.Fatal(err)
 	}
@@ -404,35 +1154,526 @@ func TestClientEOF(t *testing.T) {
 			t.Logf("errno=%d", errno)
 		}
 
-		t.Fatalf("expected to have a cause of ErrClosed, got %v", err)
+		t.Fatalf("expected to have a cause of ErrClosed, got %v", err)
+	}
+}
+
+func TestServerRequestTimeout(t *testing.T) {
+	var (
+		ctx, cancel     = context.WithDeadline(context.Background(), time.Now().Add(10*time.Minute))
+		server          = mustServer(t)(NewServer())
+		addr, listener  = newTestListener(t)
+		testImpl        = &testingServer{}
+		client, cleanup = newTestClient(t, addr)
+		result          internal.TestPayload
+	)
+	defer cancel()
+	defer cleanup()
+	defer listener.Close()
+
+	registerTestingService(server, testImpl)
+
+	go server.Serve(ctx, listener)
+	defer server.Shutdown(ctx)
+
+	if err := client.Call(ctx, serviceName, "Test", &internal.TestPayload{}, &result); err != nil {
+		t.Fatalf("unexpected error making call: %v", err)
+	}
+
+	dl, _ := ctx.Deadline()
+	if result.Deadline != dl.UnixNano() {
+		t.Fatalf("expected deadline %v, actual: %v", dl, time.Unix(0, result.Deadline))
+	}
+}
+
+func TestServerStreamRequestTimeout(t *testing.T) {
+	var (
+		ctx             = context.Background()
+		server          = mustServer(t)(NewServer())
+		addr, listener  = newTestListener(t)
+		client, cleanup = newTestClient(t, addr)
+		handlerErr      = make(chan error, 1)
+	)
+	defer cleanup()
+	defer listener.Close()
+
+	server.RegisterService(serviceName, &ServiceDesc{
+		Streams: map[string]Stream{
+			"Wait": {
+				Handler: func(ctx context.Context, ss StreamServer) (interface{}, error) {
+					if _, ok := ctx.Deadline(); !ok {
+						handlerErr <- errors.New("stream context has no deadline")
+						return nil, nil
+					}
+					<-ctx.Done()
+					handlerErr <- ctx.Err()
+					return nil, ctx.Err()
+				},
+				StreamingServer: true,
+			},
+		},
+	})
+
+	go server.Serve(ctx, listener)
+	defer server.Shutdown(ctx)
+
+	cctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	if _, err := client.NewStream(cctx, &StreamDesc{StreamingServer: true}, serviceName, "Wait", &internal.TestPayload{}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-handlerErr:
+		if err != context.DeadlineExceeded {
+			t.Fatalf("expected handler context to exceed its deadline, got %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("server handler was not cancelled by the propagated deadline")
+	}
+}
+
+func TestServerCancelsCallsOnDisconnect(t *testing.T) {
+	var (
+		ctx            = context.Background()
+		server         = mustServer(t)(NewServer())
+		addr, listener = newTestListener(t)
+		started        = make(chan context.Context, 2)
+	)
+	defer listener.Close()
+
+	server.RegisterService(serviceName, &ServiceDesc{
+		Methods: map[string]Method{
+			"Block": func(ctx context.Context, unmarshal func(interface{}) error) (interface{}, error) {
+				started <- ctx
+				<-ctx.Done()
+				return nil, context.Cause(ctx)
+			},
+		},
+	})
+
+	go server.Serve(ctx, listener)
+	defer server.Shutdown(ctx)
+
+	disconnected, cleanup := newTestClient(t, addr)
+	defer cleanup()
+	connected, cleanup := newTestClient(t, addr)
+	defer cleanup()
+
+	for _, client := range []*Client{disconnected, connected} {
+		go client.Call(ctx, serviceName, "Block", &internal.TestPayload{}, &internal.TestPayload{})
+	}
+	var handlerCtxs []context.Context
+	for i := 0; i < 2; i++ {
+		select {
+		case hctx := <-started:
+			handlerCtxs = append(handlerCtxs, hctx)
+		case <-time.After(10 * time.Second):
+			t.Fatal("handler was not called")
+		}
+	}
+
+	if err := disconnected.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var canceled context.Context
+	select {
+	case <-handlerCtxs[0].Done():
+		canceled = handlerCtxs[0]
+	case <-handlerCtxs[1].Done():
+		canceled = handlerCtxs[1]
+	case <-time.After(10 * time.Second):
+		t.Fatal("handler context was not canceled after the client disconnected")
+	}
+	cause := context.Cause(canceled)
+	if !errors.Is(cause, ErrClosed) || !strings.Contains(cause.Error(), "stream 1 ") {
+		t.Fatalf("unexpected cancellation cause: %v", cause)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	remaining := 0
+	for _, hctx := range handlerCtxs {
+		if hctx.Err() == nil {
+			remaining++
+		}
+	}
+	if remaining != 1 {
+		t.Fatalf("expected the call on the other connection to keep running, %d still running", remaining)
+	}
+}
+
+func TestServerContextDecorator(t *testing.T) {
+	type requestIDKey struct{}
+	var (
+		ctx       = context.Background()
+		decorated []MethodInfo
+		decorator = func(ctx context.Context, info MethodInfo) context.Context {
+			decorated = append(decorated, info)
+			id, _ := GetMetadataValue(ctx, "request-id")
+			return context.WithValue(ctx, requestIDKey{}, id)
+		}
+		requestID = func(ctx context.Context) string {
+			id, _ := ctx.Value(requestIDKey{}).(string)
+			return id
+		}
+		intercepted []string
+		server      = mustServer(t)(NewServer(
+			WithContextDecorator(decorator),
+			WithUnaryServerInterceptor(func(ctx context.Context, unmarshal Unmarshaler, info *UnaryServerInfo, method Method) (interface{}, error) {
+				intercepted = append(intercepted, requestID(ctx))
+				return method(ctx, unmarshal)
+			}),
+		))
+		addr, listener  = newTestListener(t)
+		client, cleanup = newTestClient(t, addr)
+	)
+	defer listener.Close()
+	defer cleanup()
+
+	server.RegisterService(serviceName, &ServiceDesc{
+		Methods: map[string]Method{
+			"Unary": func(ctx context.Context, unmarshal func(interface{}) error) (interface{}, error) {
+				return &internal.TestPayload{Foo: requestID(ctx)}, nil
+			},
+		},
+		Streams: map[string]Stream{
+			"Stream": {
+				Handler: func(ctx context.Context, ss StreamServer) (interface{}, error) {
+					return &internal.TestPayload{Foo: requestID(ss.Context())}, nil
+				},
+			},
+		},
+	})
+
+	go server.Serve(ctx, listener)
+	defer server.Shutdown(ctx)
+
+	md := MD{}
+	md.Set("request-id", "unary")
+	var resp internal.TestPayload
+	if err := client.Call(WithMetadata(ctx, md), serviceName, "Unary", &internal.TestPayload{}, &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Foo != "unary" {
+		t.Fatalf("unexpected request id %q in handler", resp.Foo)
+	}
+	if len(intercepted) != 1 || intercepted[0] != "unary" {
+		t.Fatalf("unexpected request ids in interceptor: %v", intercepted)
+	}
+
+	md.Set("request-id", "stream")
+	stream, err := client.NewStream(WithMetadata(ctx, md), &StreamDesc{}, serviceName, "Stream", &internal.TestPayload{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.RecvMsg(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Foo != "stream" {
+		t.Fatalf("unexpected request id %q in stream handler", resp.Foo)
+	}
+
+	expected := []MethodInfo{
+		{FullMethod: "/" + serviceName + "/Unary", Service: serviceName, Method: "Unary"},
+		{FullMethod: "/" + serviceName + "/Stream", Service: serviceName, Method: "Stream"},
+	}
+	if !reflect.DeepEqual(decorated, expected) {
+		t.Fatalf("unexpected decorated methods %v, expected %v", decorated, expected)
+	}
+}
+
+func TestServerErrorHandler(t *testing.T) {
+	type connError struct {
+		err  error
+		addr net.Addr
+	}
+	var (
+		ctx    = context.Background()
+		errs   = make(chan connError, 10)
+		refuse atomic.Bool
+		server = mustServer(t)(NewServer(
+			WithServerHandshaker(handshakerFunc(func(ctx context.Context, conn net.Conn) (net.Conn, interface{}, error) {
+				if refuse.Load() {
+					return nil, nil, errors.New("refused")
+				}
+				return conn, nil, nil
+			})),
+			WithServerErrorHandler(func(err error, conn net.Conn) {
+				errs <- connError{err: err, addr: conn.RemoteAddr()}
+			}),
+		))
+		addr, listener = newTestListener(t)
+	)
+	defer listener.Close()
+
+	go server.Serve(ctx, listener)
+	defer server.Shutdown(ctx)
+
+	next := func(t *testing.T) connError {
+		t.Helper()
+		select {
+		case e := <-errs:
+			if e.addr == nil {
+				t.Fatal("connection without remote address")
+			}
+			return e
+		case <-time.After(10 * time.Second):
+			t.Fatal("error handler was not called")
+		}
+		return connError{}
+	}
+
+	// a message cut short by the client closing the connection
+	conn, err := net.Dial("unix", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeMessageHeader(conn, make([]byte, messageHeaderLength), messageHeader{Length: 100, StreamID: 1, Type: messageTypeRequest}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write([]byte("truncated")); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if e := next(t); !errors.Is(e.err, io.ErrUnexpectedEOF) {
+		t.Fatalf("unexpected error %v", e.err)
+	}
+
+	// clean disconnects are not reported
+	client, cleanup := newTestClient(t, addr)
+	if err := client.Call(ctx, serviceName, "Missing", &internal.TestPayload{}, &internal.TestPayload{}); status.Code(err) != codes.Unimplemented {
+		t.Fatalf("expected unimplemented error, got %v", err)
+	}
+	cleanup()
+
+	refuse.Store(true)
+	conn, err = net.Dial("unix", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if e := next(t); e.err.Error() != "refused" {
+		t.Fatalf("unexpected error %v", e.err)
+	}
+
+	select {
+	case e := <-errs:
+		t.Fatalf("unexpected error reported: %v", e.err)
+	default:
+	}
+}
+
+func TestServerMaxConcurrentStreams(t *testing.T) {
+	var (
+		ctx             = context.Background()
+		server          = mustServer(t)(NewServer(WithMaxConcurrentStreams(2)))
+		addr, listener  = newTestListener(t)
+		client, cleanup = newTestClient(t, addr)
+		started         = make(chan struct{}, 2)
+		release         = make(chan struct{})
+	)
+	defer listener.Close()
+	defer cleanup()
+
+	server.RegisterService(serviceName, &ServiceDesc{
+		Methods: map[string]Method{
+			"Block": func(ctx context.Context, unmarshal func(interface{}) error) (interface{}, error) {
+				started <- struct{}{}
+				<-release
+				return &internal.TestPayload{}, nil
+			},
+			"Test": func(ctx context.Context, unmarshal func(interface{}) error) (interface{}, error) {
+				return &internal.TestPayload{}, nil
+			},
+		},
+	})
+
+	go server.Serve(ctx, listener)
+	defer server.Shutdown(ctx)
+	unblock := sync.OnceFunc(func() { close(release) })
+	defer unblock()
+
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			errs <- client.Call(ctx, serviceName, "Block", &internal.TestPayload{}, &internal.TestPayload{})
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-started:
+		case <-time.After(10 * time.Second):
+			t.Fatal("handler was not called")
+		}
+	}
+
+	// rejected calls do not free the slots of the running ones
+	for i := 0; i < 5; i++ {
+		err := client.Call(ctx, serviceName, "Test", &internal.TestPayload{}, &internal.TestPayload{})
+		if status.Code(err) != codes.ResourceExhausted {
+			t.Fatalf("%d: expected resource exhausted error, got %v", i, err)
+		}
+	}
+	if n := server.ActiveStreams(); n != 2 {
+		t.Fatalf("expected 2 active streams, got %d", n)
+	}
+
+	// other connections have their own limit
+	other, cleanup := newTestClient(t, addr)
+	defer cleanup()
+	if err := other.Call(ctx, serviceName, "Test", &internal.TestPayload{}, &internal.TestPayload{}); err != nil {
+		t.Fatal(err)
+	}
+
+	unblock()
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a finished call immediately frees its slot
+	for i := 0; i < 100; i++ {
+		if err := client.Call(ctx, serviceName, "Test", &internal.TestPayload{}, &internal.TestPayload{}); err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+	}
+}
+
+func TestServerMaxConnections(t *testing.T) {
+	var (
+		ctx     = context.Background()
+		refused = make(chan error, 1)
+		server  = mustServer(t)(NewServer(
+			WithMaxConnections(1),
+			WithServerErrorHandler(func(err error, conn net.Conn) {
+				refused <- err
+			}),
+		))
+		testImpl       = &testingServer{}
+		addr, listener = newTestListener(t)
+	)
+	defer listener.Close()
+
+	registerTestingService(server, testImpl)
+
+	go server.Serve(ctx, listener)
+	defer server.Shutdown(ctx)
+
+	client, cleanup := newTestClient(t, addr)
+	if _, err := newTestingClient(client).Test(ctx, &internal.TestPayload{}); err != nil {
+		t.Fatal(err)
+	}
+	if n := server.Connections(); n != 1 {
+		t.Fatalf("unexpected number of connections %d", n)
+	}
+
+	conn, err := net.Dial("unix", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	select {
+	case err := <-refused:
+		if !errors.Is(err, ErrTooManyConnections) {
+			t.Fatalf("unexpected error %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("connection over the limit was not refused")
+	}
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected refused connection to be closed, got %v", err)
+	}
+
+	cleanup()
+	waitFor(t, func() bool { return server.Connections() == 0 })
+
+	client, cleanup = newTestClient(t, addr)
+	defer cleanup()
+	if _, err := newTestingClient(client).Test(ctx, &internal.TestPayload{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServerConnectionIdleTimeout(t *testing.T) {
+	var (
+		ctx            = context.Background()
+		server         = mustServer(t)(NewServer(WithConnectionIdleTimeout(100 * time.Millisecond)))
+		addr, listener = newTestListener(t)
+	)
+	defer listener.Close()
+
+	server.RegisterService(serviceName, &ServiceDesc{
+		Methods: map[string]Method{
+			"Test": func(ctx context.Context, unmarshal func(interface{}) error) (interface{}, error) {
+				return &internal.TestPayload{}, nil
+			},
+			"Sleep": func(ctx context.Context, unmarshal func(interface{}) error) (interface{}, error) {
+				time.Sleep(300 * time.Millisecond)
+				return &internal.TestPayload{}, nil
+			},
+		},
+	})
+
+	go server.Serve(ctx, listener)
+	defer server.Shutdown(ctx)
+
+	client, cleanup := newTestClient(t, addr)
+	defer cleanup()
+
+	// requests keep resetting the timeout
+	for i := 0; i < 10; i++ {
+		if err := client.Call(ctx, serviceName, "Test", &internal.TestPayload{}, &internal.TestPayload{}); err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		time.Sleep(30 * time.Millisecond)
+	}
+
+	// a call in progress keeps the connection open
+	if err := client.Call(ctx, serviceName, "Sleep", &internal.TestPayload{}, &internal.TestPayload{}); err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, func() bool { return server.Connections() == 0 })
+	if err := client.Call(ctx, serviceName, "Test", &internal.TestPayload{}, &internal.TestPayload{}); !errors.Is(err, ErrClosed) {
+		t.Fatalf("expected %v on idle connection, got %v", ErrClosed, err)
 	}
 }
 
-func TestServerRequestTimeout(t *testing.T) {
+func TestServerReadTimeout(t *testing.T) {
 	var (
-		ctx, cancel     = context.WithDeadline(context.Background(), time.Now().Add(10*time.Minute))
-		server          = mustServer(t)(NewServer())
-		addr, listener  = newTestListener(t)
-		testImpl        = &testingServer{}
-		client, cleanup = newTestClient(t, addr)
-		result          internal.TestPayload
+		ctx            = context.Background()
+		server         = mustServer(t)(NewServer(WithServerReadTimeout(100 * time.Millisecond)))
+		addr, listener = newTestListener(t)
 	)
-	defer cancel()
-	defer cleanup()
 	defer listener.Close()
-
-	registerTestingService(server, testImpl)
+	registerTestingService(server, &testingServer{})
 
 	go server.Serve(ctx, listener)
 	defer server.Shutdown(ctx)
 
-	if err := client.Call(ctx, serviceName, "Test", &internal.TestPayload{}, &result); err != nil {
-		t.Fatalf("unexpected error making call: %v", err)
+	client, cleanup := newTestClient(t, addr)
+	defer cleanup()
+
+	// idle connections are kept open
+	time.Sleep(300 * time.Millisecond)
+	if err := client.Call(ctx, serviceName, "Test", &internal.TestPayload{Foo: "foo"}, &internal.TestPayload{}); err != nil {
+		t.Fatal(err)
 	}
 
-	dl, _ := ctx.Deadline()
-	if result.Deadline != dl.UnixNano() {
-		t.Fatalf("expected deadline %v, actual: %v", dl, time.Unix(0, result.Deadline))
+	// a client stalling in the middle of a frame is disconnected
+	conn, err := net.Dial("unix", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte{0, 0, 0}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return server.Connections() == 1 })
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected the connection to be closed, got %v", err)
 	}
 }
 
@@ -606,3 +1847,510 @@ func mustServer(t testing.TB) func(server *Server, err error) *Server {
 		return server
 	}
 }
+
+type recordingLogger struct {
+	mu       sync.Mutex
+	messages []string
+}
+
+func (l *recordingLogger) Debugf(format string, args ...interface{}) {
+	l.record("debug: "+format, args...)
+}
+
+func (l *recordingLogger) Errorf(format string, args ...interface{}) {
+	l.record("error: "+format, args...)
+}
+
+func (l *recordingLogger) record(format string, args ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.messages = append(l.messages, fmt.Sprintf(format, args...))
+}
+
+func (l *recordingLogger) contains(s string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, m := range l.messages {
+		if strings.Contains(m, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestServerLogger(t *testing.T) {
+	var (
+		ctx    = context.Background()
+		logger = &recordingLogger{}
+		server = mustServer(t)(NewServer(
+			WithServerHandshaker(handshakerFunc(func(ctx context.Context, conn net.Conn) (net.Conn, interface{}, error) {
+				return nil, nil, errors.New("refused")
+			})),
+			WithServerLogger(logger),
+		))
+		addr, listener = newTestListener(t)
+	)
+	defer listener.Close()
+
+	go server.Serve(ctx, listener)
+	defer server.Shutdown(ctx)
+
+	conn, err := net.Dial("unix", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	waitFor(t, func() bool {
+		return logger.contains("error: ttrpc: refusing connection after handshake: refused")
+	})
+
+	if _, err := NewServer(WithServerLogger(nil)); err == nil {
+		t.Fatal("expected error for nil logger")
+	}
+}
+
+func TestServerPanicRecovery(t *testing.T) {
+	var (
+		ctx             = context.Background()
+		logger          = &recordingLogger{}
+		server          = mustServer(t)(NewServer(WithPanicRecovery(), WithServerLogger(logger)))
+		addr, listener  = newTestListener(t)
+		client, cleanup = newTestClient(t, addr)
+	)
+	defer listener.Close()
+	defer cleanup()
+
+	registerTestingService(server, &testingServer{})
+	server.RegisterService("panic.Service", &ServiceDesc{
+		Methods: map[string]Method{
+			"Unary": func(ctx context.Context, unmarshal func(interface{}) error) (interface{}, error) {
+				panic("unary handler")
+			},
+		},
+		Streams: map[string]Stream{
+			"Stream": {
+				Handler: func(ctx context.Context, ss StreamServer) (interface{}, error) {
+					panic("stream handler")
+				},
+				StreamingServer: true,
+			},
+		},
+	})
+
+	go server.Serve(ctx, listener)
+	defer server.Shutdown(ctx)
+
+	var resp internal.TestPayload
+	err := client.Call(ctx, "panic.Service", "Unary", &internal.TestPayload{}, &resp)
+	if code := status.Code(err); code != codes.Internal {
+		t.Fatalf("expected %v, got %v", codes.Internal, err)
+	}
+	stream, err := client.NewStream(ctx, &StreamDesc{StreamingServer: true}, "panic.Service", "Stream", &internal.TestPayload{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.RecvMsg(&resp); status.Code(err) != codes.Internal {
+		t.Fatalf("expected %v, got %v", codes.Internal, err)
+	}
+
+	// the server keeps serving
+	if err := client.Call(ctx, serviceName, "Test", &internal.TestPayload{Foo: "foo"}, &resp); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []string{
+		"error: ttrpc: panic handling /panic.Service/Unary: unary handler",
+		"error: ttrpc: panic handling /panic.Service/Stream: stream handler",
+		"runtime/debug.Stack",
+	} {
+		if !logger.contains(expected) {
+			t.Errorf("expected %q to be logged", expected)
+		}
+	}
+}
+
+func TestServerStatusDetails(t *testing.T) {
+	var (
+		ctx             = context.Background()
+		server          = mustServer(t)(NewServer())
+		addr, listener  = newTestListener(t)
+		client, cleanup = newTestClient(t, addr)
+		info            = &errdetails.ErrorInfo{Reason: "QUOTA", Domain: "ttrpc.test", Metadata: map[string]string{"limit": "3"}}
+	)
+	defer listener.Close()
+	defer cleanup()
+
+	st, err := status.New(codes.ResourceExhausted, "quota exceeded").WithDetails(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.RegisterService(serviceName, &ServiceDesc{
+		Methods: map[string]Method{
+			"Unary": func(context.Context, func(interface{}) error) (interface{}, error) {
+				return nil, st.Err()
+			},
+			"Wrapped": func(context.Context, func(interface{}) error) (interface{}, error) {
+				return nil, fmt.Errorf("wrapped: %w", st.Err())
+			},
+		},
+		Streams: map[string]Stream{
+			"Stream": {
+				Handler: func(context.Context, StreamServer) (interface{}, error) {
+					return nil, st.Err()
+				},
+				StreamingServer: true,
+			},
+		},
+	})
+
+	go server.Serve(ctx, listener)
+	defer server.Shutdown(ctx)
+
+	check := func(t *testing.T, err error) {
+		t.Helper()
+		st, ok := status.FromError(err)
+		if !ok {
+			t.Fatalf("expected status error, got %v", err)
+		}
+		if st.Code() != codes.ResourceExhausted {
+			t.Fatalf("unexpected code %v", st.Code())
+		}
+		details := st.Details()
+		if len(details) != 1 {
+			t.Fatalf("expected one detail, got %v", details)
+		}
+		detail, ok := details[0].(*errdetails.ErrorInfo)
+		if !ok || !proto.Equal(detail, info) {
+			t.Fatalf("unexpected detail %v", details[0])
+		}
+	}
+
+	local := NewLocalClient(server)
+	for _, method := range []string{"Unary", "Wrapped"} {
+		check(t, client.Call(ctx, serviceName, method, &internal.TestPayload{}, &internal.TestPayload{}))
+		check(t, local.Call(ctx, serviceName, method, &internal.TestPayload{}, &internal.TestPayload{}))
+	}
+
+	stream, err := client.NewStream(ctx, &StreamDesc{StreamingServer: true}, serviceName, "Stream", &internal.TestPayload{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(t, stream.RecvMsg(&internal.TestPayload{}))
+}
+
+func TestServerMethodConcurrencyLimit(t *testing.T) {
+	var (
+		ctx             = context.Background()
+		server          = mustServer(t)(NewServer(WithMethodConcurrencyLimit("/"+serviceName+"/Block", 1)))
+		addr, listener  = newTestListener(t)
+		client, cleanup = newTestClient(t, addr)
+		started         = make(chan struct{}, 1)
+		release         = make(chan struct{})
+	)
+	defer listener.Close()
+	defer cleanup()
+
+	server.RegisterService(serviceName, &ServiceDesc{
+		Methods: map[string]Method{
+			"Block": func(ctx context.Context, unmarshal func(interface{}) error) (interface{}, error) {
+				started <- struct{}{}
+				<-release
+				return &internal.TestPayload{}, nil
+			},
+			"Test": func(ctx context.Context, unmarshal func(interface{}) error) (interface{}, error) {
+				return &internal.TestPayload{}, nil
+			},
+		},
+	})
+
+	go server.Serve(ctx, listener)
+	defer server.Shutdown(ctx)
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- client.Call(ctx, serviceName, "Block", &internal.TestPayload{}, &internal.TestPayload{})
+	}()
+	select {
+	case <-started:
+	case <-time.After(10 * time.Second):
+		t.Fatal("handler was not called")
+	}
+
+	// the limit applies across connections
+	other, cleanup := newTestClient(t, addr)
+	defer cleanup()
+	err := other.Call(ctx, serviceName, "Block", &internal.TestPayload{}, &internal.TestPayload{})
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("expected resource exhausted error, got %v", err)
+	}
+	st, _ := status.FromError(err)
+	if details := st.Details(); len(details) != 1 {
+		t.Fatalf("expected retry info, got %v", details)
+	} else if _, ok := details[0].(*errdetails.RetryInfo); !ok {
+		t.Fatalf("expected retry info, got %v", details[0])
+	}
+
+	// other methods are not limited
+	if err := other.Call(ctx, serviceName, "Test", &internal.TestPayload{}, &internal.TestPayload{}); err != nil {
+		t.Fatal(err)
+	}
+
+	close(release)
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := other.Call(ctx, serviceName, "Block", &internal.TestPayload{}, &internal.TestPayload{}); err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		<-started
+	}
+
+	for _, opt := range []ServerOpt{
+		WithMethodConcurrencyLimit("/"+serviceName+"/Block", 0),
+		WithMethodConcurrencyLimit("Block", 1),
+	} {
+		if _, err := NewServer(opt); err == nil {
+			t.Fatal("expected invalid option to fail")
+		}
+	}
+}
+
+func TestAppError(t *testing.T) {
+	var (
+		ctx             = context.Background()
+		server          = mustServer(t)(NewServer())
+		addr, listener  = newTestListener(t)
+		client, cleanup = newTestClient(t, addr)
+	)
+	defer listener.Close()
+	defer cleanup()
+
+	server.RegisterService(serviceName, &ServiceDesc{
+		Methods: map[string]Method{
+			"Unary": func(context.Context, func(interface{}) error) (interface{}, error) {
+				return nil, fmt.Errorf("wrapped: %w", NewAppError(42, "example.com/shim", "container busy"))
+			},
+			"Plain": func(context.Context, func(interface{}) error) (interface{}, error) {
+				return nil, status.Error(codes.NotFound, "not found")
+			},
+		},
+	})
+
+	go server.Serve(ctx, listener)
+	defer server.Shutdown(ctx)
+
+	for name, client := range map[string]interface {
+		Call(context.Context, string, string, interface{}, interface{}, ...CallOption) error
+	}{
+		"remote": client,
+		"local":  NewLocalClient(server),
+	} {
+		t.Run(name, func(t *testing.T) {
+			err := client.Call(ctx, serviceName, "Unary", &internal.EchoPayload{}, &internal.EchoPayload{})
+			ae, ok := AppErrorFromError(err)
+			if !ok {
+				t.Fatalf("expected an application error, got %v", err)
+			}
+			if ae.Code != 42 || ae.Domain != "example.com/shim" {
+				t.Fatalf("unexpected application error %v", ae)
+			}
+			if st, _ := status.FromError(err); st.Code() != codes.Unknown || !strings.Contains(st.Message(), "container busy") {
+				t.Fatalf("unexpected status %v", st)
+			}
+
+			err = client.Call(ctx, serviceName, "Plain", &internal.EchoPayload{}, &internal.EchoPayload{})
+			if _, ok := AppErrorFromError(err); ok {
+				t.Fatalf("unexpected application error in %v", err)
+			}
+		})
+	}
+
+	if _, ok := AppErrorFromError(errors.New("plain")); ok {
+		t.Fatal("unexpected application error in a plain error")
+	}
+}
+
+func TestCallObserver(t *testing.T) {
+	var (
+		ctx            = context.Background()
+		calls          = make(chan CallSummary, 4)
+		server         = mustServer(t)(NewServer(WithCallObserver(func(cs CallSummary) { calls <- cs })))
+		addr, listener = newTestListener(t)
+	)
+	defer listener.Close()
+
+	server.RegisterService(serviceName, &ServiceDesc{
+		Methods: map[string]Method{
+			"Echo": func(_ context.Context, unmarshal func(interface{}) error) (interface{}, error) {
+				var req internal.EchoPayload
+				if err := unmarshal(&req); err != nil {
+					return nil, err
+				}
+				return &internal.EchoPayload{Seq: req.Seq, Msg: req.Msg + req.Msg}, nil
+			},
+			"Fail": func(context.Context, func(interface{}) error) (interface{}, error) {
+				return nil, status.Error(codes.NotFound, "not found")
+			},
+		},
+		Streams: map[string]Stream{
+			"Stream": {
+				Handler: func(context.Context, StreamServer) (interface{}, error) {
+					return &internal.EchoPayload{}, nil
+				},
+			},
+		},
+	})
+
+	go server.Serve(ctx, listener)
+	defer server.Shutdown(ctx)
+
+	client, cleanup := newTestClient(t, addr)
+	defer cleanup()
+
+	req := &internal.EchoPayload{Seq: 1, Msg: "hello"}
+	var resp internal.EchoPayload
+	if err := client.Call(ctx, serviceName, "Echo", req, &resp); err != nil {
+		t.Fatal(err)
+	}
+	stream, err := client.NewStream(ctx, &StreamDesc{}, serviceName, "Stream", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.RecvMsg(&internal.EchoPayload{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Call(ctx, serviceName, "Fail", req, &internal.EchoPayload{}); status.Code(err) != codes.NotFound {
+		t.Fatalf("expected not found error, got %v", err)
+	}
+
+	for _, expected := range []CallSummary{
+		{FullMethod: "/" + serviceName + "/Echo", Code: codes.OK, RequestSize: proto.Size(req), ResponseSize: proto.Size(&resp)},
+		{FullMethod: "/" + serviceName + "/Fail", Code: codes.NotFound, RequestSize: proto.Size(req)},
+	} {
+		// the stream is not observed, the failed call is reported next
+		cs := <-calls
+		if cs.Duration <= 0 {
+			t.Errorf("expected a duration for %s, got %v", cs.FullMethod, cs.Duration)
+		}
+		cs.Duration = 0
+		if cs != expected {
+			t.Fatalf("unexpected call summary %+v, expected %+v", cs, expected)
+		}
+	}
+}
+
+func TestServerAcceptVersions(t *testing.T) {
+	var (
+		ctx    = context.Background()
+		server = mustServer(t)(NewServer(WithServerAcceptVersions(func(v string) bool {
+			return v == "v2" || v == "v3"
+		})))
+		addr, listener = newTestListener(t)
+		testImpl       = &testingServer{}
+	)
+	defer listener.Close()
+
+	registerTestingService(server, testImpl)
+	server.RegisterService(serviceName+"Streams", &ServiceDesc{
+		Streams: map[string]Stream{
+			"Echo": {
+				Handler: func(context.Context, StreamServer) (interface{}, error) {
+					return &internal.EchoPayload{}, nil
+				},
+			},
+		},
+	})
+
+	go server.Serve(ctx, listener)
+	defer server.Shutdown(ctx)
+
+	for _, tc := range []struct {
+		opts    []ClientOpts
+		allowed bool
+	}{
+		{opts: []ClientOpts{WithClientVersion("v2")}, allowed: true},
+		{opts: []ClientOpts{WithClientVersion("v3")}, allowed: true},
+		{opts: []ClientOpts{WithClientVersion("v1")}},
+		{},
+	} {
+		client, cleanup := newTestClient(t, addr, tc.opts...)
+
+		// rejected calls keep the connection usable, so a second call gets
+		// the same answer
+		for i := 0; i < 2; i++ {
+			tp := &internal.TestPayload{Foo: "version"}
+			err := client.Call(ctx, serviceName, "Test", tp, tp)
+			if tc.allowed && err != nil {
+				t.Fatalf("unexpected error with %d options: %v", len(tc.opts), err)
+			}
+			if !tc.allowed && status.Code(err) != codes.FailedPrecondition {
+				t.Fatalf("expected failed precondition error, got %v", err)
+			}
+
+			stream, err := client.NewStream(ctx, &StreamDesc{}, serviceName+"Streams", "Echo", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = stream.RecvMsg(&internal.EchoPayload{})
+			if tc.allowed && err != nil {
+				t.Fatalf("unexpected stream error with %d options: %v", len(tc.opts), err)
+			}
+			if !tc.allowed && status.Code(err) != codes.FailedPrecondition {
+				t.Fatalf("expected failed precondition error from the stream, got %v", err)
+			}
+		}
+		cleanup()
+	}
+
+	if _, err := NewServer(WithServerAcceptVersions(nil)); err == nil {
+		t.Fatal("expected an error for a nil version predicate")
+	}
+}
+
+func TestServerForwardVersionMetadata(t *testing.T) {
+	var (
+		ctx    = context.Background()
+		server = mustServer(t)(NewServer(WithServerAcceptVersions(func(v string) bool {
+			return v == "v1"
+		})))
+		addr, listener = newTestListener(t)
+	)
+	defer listener.Close()
+
+	forward, cleanupForward := newTestClient(t, addr, WithClientVersion("v1"))
+	defer cleanupForward()
+
+	registerTestingService(server, &testingServer{})
+	server.RegisterService(serviceName+"Forward", &ServiceDesc{
+		Methods: map[string]Method{
+			"Forward": func(ctx context.Context, unmarshal func(interface{}) error) (interface{}, error) {
+				md, ok := GetMetadata(ctx)
+				if !ok {
+					return nil, errors.New("no metadata")
+				}
+				if _, ok := md.Get(VersionMetadataKey); ok {
+					return nil, errors.New("unexpected version metadata in the handler")
+				}
+				// the metadata of the handler can be sent with another call
+				tp := &internal.TestPayload{Foo: "forwarded"}
+				if err := forward.Call(WithMetadata(ctx, md), serviceName, "Test", tp, tp); err != nil {
+					return nil, err
+				}
+				return &internal.EchoPayload{}, nil
+			},
+		},
+	})
+
+	go server.Serve(ctx, listener)
+	defer server.Shutdown(ctx)
+
+	client, cleanup := newTestClient(t, addr, WithClientVersion("v1"))
+	defer cleanup()
+
+	mdctx := WithMetadata(ctx, MD{"forward": {"yes"}})
+	if err := client.Call(mdctx, serviceName+"Forward", "Forward", &internal.EchoPayload{}, &internal.EchoPayload{}); err != nil {
+		t.Fatal(err)
+	}
+}
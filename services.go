@@ -23,61 +23,314 @@ import (
 	"io"
 	"os"
 	"path"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"unsafe"
 
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
-	"google.golang.org/protobuf/proto"
 )
 
+// Method handles a unary call. The request is decoded by calling unmarshal
+// with a pointer to the request type, and the returned value is encoded as the
+// response. The context is canceled when the client's connection is lost, with
+// a cause wrapping ErrClosed that names the interrupted stream.
 type Method func(ctx context.Context, unmarshal func(interface{}) error) (interface{}, error)
 
+// StreamHandler handles a stream. Messages are exchanged through the
+// StreamServer; a non-nil return value is sent as the final message of a
+// non-streaming server. The metadata sent by the client when opening the
+// stream is available from the context, and from the context of the
+// StreamServer, with GetMetadata for the whole life of the stream; messages
+// sent later on the stream do not carry metadata.
 type StreamHandler func(context.Context, StreamServer) (interface{}, error)
 
+// Stream describes a streaming method and which sides of it stream.
+//
+// NoFrameTimeouts exempts the frames of the stream from the read and write
+// timeouts of the server, for streams where the client may legitimately stop
+// reading for a while.
 type Stream struct {
 	Handler         StreamHandler
 	StreamingClient bool
 	StreamingServer bool
+	NoFrameTimeouts bool
 }
 
+// ServiceDesc describes the methods and streams of a service, keyed by method
+// name. It is normally built by generated code but may be built directly for
+// services that are only known at runtime.
+//
+// UnaryInterceptors and StreamInterceptors only apply to calls of this
+// service. They run after the server's interceptors, in the order given, so the
+// server interceptors always wrap the service interceptors which in turn wrap
+// the handler.
 type ServiceDesc struct {
 	Methods map[string]Method
 	Streams map[string]Stream
+
+	UnaryInterceptors  []UnaryServerInterceptor
+	StreamInterceptors []StreamServerInterceptor
 }
 
 type serviceSet struct {
+	mu                sync.RWMutex
 	services          map[string]*ServiceDesc
+	aliases           map[string]*methodAlias
 	unaryInterceptor  UnaryServerInterceptor
 	streamInterceptor StreamServerInterceptor
+	codec             Codec
+	codecs            map[string]Codec
+	decorators        []ContextDecorator
+	limits            map[string]*methodLimit
+	pool              *handlerPool // runs unary handlers when set
+	logger            Logger
+	recoverPanics     bool
+}
+
+// methodAlias is the method called in place of a method registered as an alias
+// with RegisterAlias.
+type methodAlias struct {
+	service, method string
+	warned          atomic.Bool
 }
 
-func newServiceSet(interceptor UnaryServerInterceptor) *serviceSet {
+// methodLimit tracks the calls of a method limited by
+// WithMethodConcurrencyLimit.
+type methodLimit struct {
+	max    int64
+	active atomic.Int64
+}
+
+func newServiceSet(config *serverConfig) *serviceSet {
+	limits := make(map[string]*methodLimit, len(config.methodLimits))
+	for method, n := range config.methodLimits {
+		limits[method] = &methodLimit{max: int64(n)}
+	}
+	var pool *handlerPool
+	if config.handlerPoolSize > 0 {
+		queueSize := config.handlerQueueSize
+		if queueSize < 0 {
+			queueSize = config.handlerPoolSize
+		}
+		pool = newHandlerPool(config.handlerPoolSize, queueSize)
+	}
 	return &serviceSet{
 		services:          make(map[string]*ServiceDesc),
-		unaryInterceptor:  interceptor,
-		streamInterceptor: defaultStreamServerInterceptor,
+		aliases:           make(map[string]*methodAlias),
+		unaryInterceptor:  config.interceptor,
+		streamInterceptor: config.streamInterceptor,
+		codec:             config.codec,
+		codecs:            config.codecs,
+		decorators:        config.decorators,
+		limits:            limits,
+		pool:              pool,
+		logger:            config.logger,
+		recoverPanics:     config.recoverPanics,
+	}
+}
+
+// dispatch runs the handler of a unary call, on the handler pool when one is
+// set. It fails when the pool cannot take the call.
+func (s *serviceSet) dispatch(fn func()) error {
+	if s.pool == nil {
+		go fn()
+		return nil
+	}
+	if !s.pool.submit(fn) {
+		return status.Errorf(codes.ResourceExhausted, "ttrpc: too many calls waiting for a handler")
+	}
+	return nil
+}
+
+// acquire reserves a call of the method for the duration of the call, release
+// must be called once the call is handled. It fails if the method reached the
+// limit set with WithMethodConcurrencyLimit.
+func (s *serviceSet) acquire(fullMethod string) (release func(), err error) {
+	limit, ok := s.limits[fullMethod]
+	if !ok {
+		return func() {}, nil
 	}
+	if limit.active.Add(1) > limit.max {
+		limit.active.Add(-1)
+		st, err := status.Newf(codes.ResourceExhausted, "ttrpc: too many concurrent calls of %s, limit is %d", fullMethod, limit.max).
+			WithDetails(&errdetails.RetryInfo{})
+		if err != nil {
+			return nil, err
+		}
+		return nil, st.Err()
+	}
+	return func() {
+		limit.active.Add(-1)
+	}, nil
 }
 
 func (s *serviceSet) register(name string, desc *ServiceDesc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	if _, ok := s.services[name]; ok {
 		panic(fmt.Errorf("duplicate service %v registered", name))
 	}
+	for method := range desc.Streams {
+		if _, ok := desc.Methods[method]; ok {
+			panic(fmt.Errorf("method %v registered as both unary and streaming", fullPath(name, method)))
+		}
+	}
 
 	s.services[name] = desc
 }
 
-func (s *serviceSet) unaryCall(ctx context.Context, method Method, info *UnaryServerInfo, data []byte) (p []byte, st *status.Status) {
+func (s *serviceSet) registerMethod(service, method string, fn Method) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	desc, ok := s.services[service]
+	if !ok {
+		desc = &ServiceDesc{}
+		s.services[service] = desc
+	}
+	if _, ok := desc.Methods[method]; ok {
+		panic(fmt.Errorf("duplicate method %v registered", fullPath(service, method)))
+	}
+	if _, ok := desc.Streams[method]; ok {
+		panic(fmt.Errorf("duplicate method %v registered", fullPath(service, method)))
+	}
+	if desc.Methods == nil {
+		desc.Methods = make(map[string]Method)
+	}
+	desc.Methods[method] = fn
+}
+
+func (s *serviceSet) unregister(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.services[name]; !ok {
+		return fmt.Errorf("service %v not registered", name)
+	}
+	delete(s.services, name)
+	return nil
+}
+
+func (s *serviceSet) registerAlias(oldFullMethod, newFullMethod string) {
+	if _, _, ok := splitFullPath(oldFullMethod); !ok {
+		panic(fmt.Errorf("invalid method %q, must be of the form /service/method", oldFullMethod))
+	}
+	service, method, ok := splitFullPath(newFullMethod)
+	if !ok {
+		panic(fmt.Errorf("invalid method %q, must be of the form /service/method", newFullMethod))
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.aliases[oldFullMethod]; ok {
+		panic(fmt.Errorf("duplicate alias %v registered", oldFullMethod))
+	}
+	s.aliases[oldFullMethod] = &methodAlias{service: service, method: method}
+}
+
+// resolveAlias rewrites a request made to an alias to call the method the
+// alias refers to.
+func (s *serviceSet) resolveAlias(ctx context.Context, req *Request) {
+	s.mu.RLock()
+	alias, ok := s.aliases[fullPath(req.Service, req.Method)]
+	s.mu.RUnlock()
+	if !ok {
+		return
+	}
+
+	if !alias.warned.Swap(true) {
+		logger := s.logger
+		if logger == nil {
+			logger = defaultLogger(ctx)
+		}
+		logger.Errorf("ttrpc: deprecated method %v called, calls are served by %v",
+			fullPath(req.Service, req.Method), fullPath(alias.service, alias.method))
+	}
+	req.Service, req.Method = alias.service, alias.method
+}
+
+// lookup returns the service of a call along with either its unary method or
+// its stream, both are nil when the service has no such method.
+func (s *serviceSet) lookup(service, method string) (srv *ServiceDesc, fn Method, stream *Stream, ok bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	srv, ok = s.services[service]
+	if !ok {
+		return nil, nil, nil, false
+	}
+	if st, ok := srv.Streams[method]; ok {
+		stream = &st
+	}
+	return srv, srv.Methods[method], stream, true
+}
+
+// info returns the names of the registered services and their methods, the
+// method names are sorted.
+func (s *serviceSet) info() map[string][]string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	info := make(map[string][]string, len(s.services))
+	for name, desc := range s.services {
+		methods := make([]string, 0, len(desc.Methods)+len(desc.Streams))
+		for method := range desc.Methods {
+			methods = append(methods, method)
+		}
+		for method := range desc.Streams {
+			methods = append(methods, method)
+		}
+		sort.Strings(methods)
+		info[name] = methods
+	}
+	return info
+}
+
+// decorate applies the context decorators of the server to the context of a
+// call.
+func (s *serviceSet) decorate(ctx context.Context, info MethodInfo) context.Context {
+	for _, d := range s.decorators {
+		ctx = d(ctx, info)
+	}
+	return ctx
+}
+
+// codecFor returns the codec registered for the content type of a request.
+func (s *serviceSet) codecFor(contentType string) (Codec, error) {
+	if contentType == "" {
+		return s.codec, nil
+	}
+	codec, ok := s.codecs[contentType]
+	if !ok {
+		return nil, status.Errorf(codes.InvalidArgument, "ttrpc: unsupported content type %q", contentType)
+	}
+	return codec, nil
+}
+
+func (s *serviceSet) unaryCall(ctx context.Context, codec Codec, method Method, info *UnaryServerInfo, data []byte) (p []byte, st *status.Status) {
+	defer s.recoverPanic(ctx, info.FullMethod, &p, &st)
+
 	unmarshal := func(obj interface{}) error {
-		return protoUnmarshal(data, obj)
+		return unmarshalPayload(codec, data, obj)
 	}
 
 	resp, err := s.unaryInterceptor(ctx, unmarshal, info, method)
 	if err == nil {
 		if isNil(resp) {
-			err = errors.New("ttrpc: marshal called with nil")
+			// a call upgraded to a stream may end without a last message
+			if !upgradedToStream(ctx) {
+				err = errors.New("ttrpc: marshal called with nil")
+			}
 		} else {
-			p, err = protoMarshal(resp)
+			p, err = marshalPayload(codec, resp)
+			info.Stats.responseSize.Store(int64(len(p)))
 		}
 	}
 
@@ -89,10 +342,12 @@ func (s *serviceSet) unaryCall(ctx context.Context, method Method, info *UnarySe
 	return p, st
 }
 
-func (s *serviceSet) streamCall(ctx context.Context, stream StreamHandler, info *StreamServerInfo, ss StreamServer) (p []byte, st *status.Status) {
+func (s *serviceSet) streamCall(ctx context.Context, codec Codec, stream StreamHandler, info *StreamServerInfo, ss StreamServer) (p []byte, st *status.Status) {
+	defer s.recoverPanic(ctx, info.FullMethod, &p, &st)
+
 	resp, err := s.streamInterceptor(ctx, ss, info, stream)
 	if err == nil {
-		p, err = protoMarshal(resp)
+		p, err = marshalPayload(codec, resp)
 	}
 	st, ok := status.FromError(err)
 	if !ok {
@@ -101,28 +356,105 @@ func (s *serviceSet) streamCall(ctx context.Context, stream StreamHandler, info
 	return
 }
 
-func (s *serviceSet) handle(ctx context.Context, req *Request, respond func(*status.Status, []byte, bool, bool) error) (*streamHandler, error) {
-	srv, ok := s.services[req.Service]
+// recoverPanic fails a call with codes.Internal when its handler or
+// interceptors panic, if enabled with WithPanicRecovery. It must be deferred.
+func (s *serviceSet) recoverPanic(ctx context.Context, fullMethod string, p *[]byte, st **status.Status) {
+	if !s.recoverPanics {
+		return
+	}
+	r := recover()
+	if r == nil {
+		return
+	}
+
+	logger := s.logger
+	if logger == nil {
+		logger = defaultLogger(ctx)
+	}
+	logger.Errorf("ttrpc: panic handling %v: %v\n%s", fullMethod, r, debug.Stack())
+	*p, *st = nil, status.Newf(codes.Internal, "ttrpc: panic handling %v", fullMethod)
+}
+
+// handle starts handling the request, upgradable tells whether the client
+// accepts a streamed response to a unary call, see UpgradeToStream.
+func (s *serviceSet) handle(ctx context.Context, req *Request, upgradable bool, respond func(*status.Status, []byte, bool, bool) error) (*streamHandler, error) {
+	s.resolveAlias(ctx, req)
+	srv, method, stream, ok := s.lookup(req.Service, req.Method)
 	if !ok {
-		return nil, status.Errorf(codes.Unimplemented, "service %v", req.Service)
+		return nil, status.Errorf(codes.Unimplemented, "ttrpc: unknown service %v", req.Service)
 	}
 
-	if method, ok := srv.Methods[req.Method]; ok {
-		go func() {
+	codec, err := s.codecFor(req.ContentType)
+	if err != nil {
+		return nil, err
+	}
+
+	if method != nil {
+		release, err := s.acquire(fullPath(req.Service, req.Method))
+		if err != nil {
+			return nil, err
+		}
+		if err := s.dispatch(func() {
 			ctx, cancel := getRequestContext(ctx, req)
 			defer cancel()
+			ctx = s.decorate(ctx, MethodInfo{
+				FullMethod: fullPath(req.Service, req.Method),
+				Service:    req.Service,
+				Method:     req.Method,
+			})
+
+			var upgrade *unaryUpgrade
+			if upgradable {
+				upgrade = &unaryUpgrade{
+					stream: &streamHandler{
+						ctx:     ctx,
+						codec:   codec,
+						respond: respond,
+						recv:    make(chan Unmarshaler),
+						info: &StreamServerInfo{
+							FullMethod:      fullPath(req.Service, req.Method),
+							StreamingServer: true,
+						},
+					},
+				}
+				// the request is the only message sent by the client
+				upgrade.stream.closeSend()
+				ctx = context.WithValue(ctx, unaryUpgradeKey{}, upgrade)
+			}
 
 			info := &UnaryServerInfo{
 				FullMethod: fullPath(req.Service, req.Method),
+				Stats:      &CallStats{RequestSize: len(req.Payload)},
 			}
-			p, st := s.unaryCall(ctx, method, info, req.Payload)
-
-			respond(st, p, false, true)
-		}()
+			method := chainUnaryServerInterceptors(info, method, srv.UnaryInterceptors)
+			p, st := s.unaryCall(ctx, codec, method, info, req.Payload)
+
+			// released before responding, so that the client may call again
+			// as soon as it has the response
+			release()
+			respond(st, p, upgrade != nil && upgrade.upgraded.Load(), true)
+		}); err != nil {
+			release()
+			return nil, err
+		}
 		return nil, nil
 	}
-	if stream, ok := srv.Streams[req.Method]; ok {
+	if stream != nil {
+		release, err := s.acquire(fullPath(req.Service, req.Method))
+		if err != nil {
+			return nil, err
+		}
 		ctx, cancel := getRequestContext(ctx, req)
+		ctx = s.decorate(ctx, MethodInfo{
+			FullMethod:      fullPath(req.Service, req.Method),
+			Service:         req.Service,
+			Method:          req.Method,
+			StreamingClient: stream.StreamingClient,
+			StreamingServer: stream.StreamingServer,
+		})
+		ctx, finish := context.WithCancelCause(ctx)
+		updates := &metadataUpdates{}
+		ctx = context.WithValue(ctx, metadataUpdatesKey{}, updates)
 		info := &StreamServerInfo{
 			FullMethod:      fullPath(req.Service, req.Method),
 			StreamingClient: stream.StreamingClient,
@@ -130,13 +462,24 @@ func (s *serviceSet) handle(ctx context.Context, req *Request, respond func(*sta
 		}
 		sh := &streamHandler{
 			ctx:     ctx,
+			codec:   codec,
 			respond: respond,
 			recv:    make(chan Unmarshaler, 5),
 			info:    info,
+			window:  newWindow(req.StreamWindow),
+			untimed: stream.NoFrameTimeouts,
+			updates: updates,
 		}
 		go func() {
 			defer cancel()
-			p, st := s.streamCall(ctx, stream.Handler, info, sh)
+			handler := chainStreamServerInterceptors(info, stream.Handler, srv.StreamInterceptors)
+			p, st := s.streamCall(ctx, codec, handler, info, sh)
+			if err := st.Err(); err != nil {
+				finish(err)
+			} else {
+				finish(io.EOF)
+			}
+			release()
 			respond(st, p, stream.StreamingServer, true)
 		}()
 
@@ -146,26 +489,35 @@ func (s *serviceSet) handle(ctx context.Context, req *Request, respond func(*sta
 		// See https://github.com/containerd/ttrpc/issues/126
 		if req.Payload != nil || !info.StreamingClient {
 			unmarshal := func(obj interface{}) error {
-				return protoUnmarshal(req.Payload, obj)
+				return unmarshalPayload(codec, req.Payload, obj)
 			}
 			if err := sh.data(unmarshal); err != nil {
 				return nil, err
 			}
 		}
+		if !info.StreamingClient {
+			// the request is the only message sent by the client
+			sh.closeSend()
+		}
 
 		return sh, nil
 	}
-	return nil, status.Errorf(codes.Unimplemented, "method %v", req.Method)
+	return nil, status.Errorf(codes.Unimplemented, "ttrpc: unknown method %v", fullPath(req.Service, req.Method))
 }
 
 type streamHandler struct {
 	ctx     context.Context
+	codec   Codec
 	respond func(*status.Status, []byte, bool, bool) error
 	recv    chan Unmarshaler
 	info    *StreamServerInfo
+	window  *window // send window, nil without flow control
+	untimed bool    // exempt from the read and write timeouts
+	updates *metadataUpdates
 
 	remoteClosed bool
 	localClosed  bool
+	headerSent   atomic.Bool // set once the header or a message was sent
 }
 
 func (s *streamHandler) closeSend() {
@@ -179,66 +531,101 @@ func (s *streamHandler) data(unmarshal Unmarshaler) error {
 	if s.remoteClosed {
 		return ErrStreamClosed
 	}
+	if s.ctx.Err() != nil {
+		// the handler returned, nothing receives the message anymore
+		return ErrStreamClosed
+	}
 	select {
 	case s.recv <- unmarshal:
 		return nil
 	case <-s.ctx.Done():
-		return s.ctx.Err()
+		return ErrStreamClosed
 	}
 }
 
+// errMetadataUpdate is returned by the queued function handling a metadata
+// update, so that RecvMsg moves on to the next message.
+var errMetadataUpdate = errors.New("ttrpc: metadata update")
+
+// updateMetadata queues a metadata update sent by the client, which is passed
+// to the OnMetadataUpdate function by RecvMsg.
+func (s *streamHandler) updateMetadata(md MD) error {
+	return s.data(func(interface{}) error {
+		if s.updates != nil {
+			s.updates.call(md)
+		}
+		return errMetadataUpdate
+	})
+}
+
 func (s *streamHandler) SendMsg(m interface{}) error {
 	if s.localClosed {
 		return ErrStreamClosed
 	}
-	p, err := protoMarshal(m)
+	p, err := marshalPayload(s.codec, m)
 	if err != nil {
 		return err
 	}
+	if err := s.window.acquire(s.ctx, nil, len(p)); err != nil {
+		return err
+	}
+	s.headerSent.Store(true)
 	return s.respond(nil, p, true, false)
 }
 
+func (s *streamHandler) SendHeader(md MD) error {
+	send, ok := s.ctx.Value(streamHeaderKey{}).(func(MD) error)
+	if !ok {
+		return errors.New("ttrpc: stream header not supported")
+	}
+	if s.localClosed || s.headerSent.Swap(true) {
+		return ErrHeaderSent
+	}
+	if md == nil {
+		md = MD{}
+	}
+	return send(md.Clone())
+}
+
+func (s *streamHandler) Context() context.Context {
+	return s.ctx
+}
+
 func (s *streamHandler) RecvMsg(m interface{}) error {
-	select {
-	case unmarshal, ok := <-s.recv:
-		if !ok {
-			return io.EOF
-		}
-		return unmarshal(m)
-	case <-s.ctx.Done():
-		return s.ctx.Err()
+	for {
+		select {
+		case unmarshal, ok := <-s.recv:
+			if !ok {
+				return io.EOF
+			}
+			if err := unmarshal(m); err != errMetadataUpdate {
+				return err
+			}
+		case <-s.ctx.Done():
+			return s.ctx.Err()
 
+		}
 	}
 }
 
-func protoUnmarshal(p []byte, obj interface{}) error {
-	switch v := obj.(type) {
-	case proto.Message:
-		if err := proto.Unmarshal(p, v); err != nil {
-			return status.Errorf(codes.Internal, "ttrpc: error unmarshalling payload: %v", err.Error())
-		}
-	default:
-		return status.Errorf(codes.Internal, "ttrpc: error unsupported request type: %T", v)
+func unmarshalPayload(codec Codec, p []byte, obj interface{}) error {
+	if err := unmarshal(codec, p, obj); err != nil {
+		return status.Errorf(codes.Internal, "ttrpc: error unmarshalling payload: %v", err.Error())
 	}
 	return nil
 }
 
-func protoMarshal(obj interface{}) ([]byte, error) {
+func marshalPayload(codec Codec, obj interface{}) ([]byte, error) {
 	if obj == nil {
 		return nil, nil
 	}
 
-	switch v := obj.(type) {
-	case proto.Message:
-		r, err := proto.Marshal(v)
-		if err != nil {
-			return nil, status.Errorf(codes.Internal, "ttrpc: error marshaling payload: %v", err.Error())
-		}
-
-		return r, nil
-	default:
-		return nil, status.Errorf(codes.Internal, "ttrpc: error unsupported response type: %T", v)
+	r, err := marshal(codec, obj)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "ttrpc: error marshaling payload: %v", err.Error())
 	}
+
+	return r, nil
 }
 
 // convertCode maps stdlib go errors into grpc space.
@@ -254,12 +641,12 @@ func convertCode(err error) codes.Code {
 		return codes.FailedPrecondition
 	case os.ErrInvalid:
 		return codes.InvalidArgument
-	case context.Canceled:
-		return codes.Canceled
-	case context.DeadlineExceeded:
-		return codes.DeadlineExceeded
 	}
 	switch {
+	case errors.Is(err, context.Canceled):
+		return codes.Canceled
+	case errors.Is(err, context.DeadlineExceeded):
+		return codes.DeadlineExceeded
 	case os.IsExist(err):
 		return codes.AlreadyExists
 	case os.IsNotExist(err):
@@ -274,6 +661,15 @@ func fullPath(service, method string) string {
 	return "/" + path.Join(service, method)
 }
 
+// splitFullPath splits a full method name of the form /service/method.
+func splitFullPath(fullMethod string) (service, method string, ok bool) {
+	if !strings.HasPrefix(fullMethod, "/") {
+		return "", "", false
+	}
+	service, method, ok = strings.Cut(fullMethod[1:], "/")
+	return service, method, ok && service != "" && method != "" && !strings.Contains(method, "/")
+}
+
 func isNil(resp interface{}) bool {
 	return (*[2]uintptr)(unsafe.Pointer(&resp))[1] == 0
 }
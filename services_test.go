@@ -17,6 +17,8 @@
 package ttrpc
 
 import (
+	"context"
+	"reflect"
 	"testing"
 )
 
@@ -27,3 +29,59 @@ func Test_MethodFullNameGeneration(t *testing.T) {
 		t.Fatalf("Service name does not match. Expected: %q, Actual: %q", expectedName, name)
 	}
 }
+
+func TestServiceInfo(t *testing.T) {
+	server := mustServer(t)(NewServer())
+	RegisterHealthService(server, NewHealthServer())
+	server.RegisterMethod("test.v1.service", "Foo", func(context.Context, func(interface{}) error) (interface{}, error) {
+		return nil, nil
+	})
+	server.RegisterMethod("test.v1.service", "Bar", func(context.Context, func(interface{}) error) (interface{}, error) {
+		return nil, nil
+	})
+
+	expected := map[string][]string{
+		HealthServiceName: {"Check", "Watch"},
+		"test.v1.service": {"Bar", "Foo"},
+	}
+	if info := server.ServiceInfo(); !reflect.DeepEqual(info, expected) {
+		t.Fatalf("unexpected service info %v, expected %v", info, expected)
+	}
+}
+
+func TestRegisterServiceConflicts(t *testing.T) {
+	method := func(context.Context, func(interface{}) error) (interface{}, error) {
+		return nil, nil
+	}
+	stream := Stream{
+		Handler: func(context.Context, StreamServer) (interface{}, error) {
+			return nil, nil
+		},
+	}
+
+	for name, register := range map[string]func(*Server){
+		"duplicate service": func(server *Server) {
+			server.RegisterService("test.v1.service", &ServiceDesc{Methods: map[string]Method{"Foo": method}})
+			server.RegisterService("test.v1.service", &ServiceDesc{Methods: map[string]Method{"Bar": method}})
+		},
+		"method and stream": func(server *Server) {
+			server.RegisterService("test.v1.service", &ServiceDesc{
+				Methods: map[string]Method{"Foo": method},
+				Streams: map[string]Stream{"Foo": stream},
+			})
+		},
+		"duplicate method": func(server *Server) {
+			server.RegisterService("test.v1.service", &ServiceDesc{Streams: map[string]Stream{"Foo": stream}})
+			server.RegisterMethod("test.v1.service", "Foo", method)
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			defer func() {
+				if recover() == nil {
+					t.Fatal("expected registration to panic")
+				}
+			}()
+			register(mustServer(t)(NewServer()))
+		})
+	}
+}
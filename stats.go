@@ -0,0 +1,114 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ttrpc
+
+import (
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc/codes"
+)
+
+// Stats contains counters for the traffic handled by a Client or Server.
+// Counters only ever increase, so the difference between two snapshots gives
+// the traffic in between.
+type Stats struct {
+	// BytesSent is the number of bytes written to connections, including
+	// message headers.
+	BytesSent uint64
+	// BytesReceived is the number of bytes read from connections, including
+	// message headers.
+	BytesReceived uint64
+	// CallsStarted is the number of unary calls and streams started.
+	CallsStarted uint64
+	// CallsCompleted is the number of unary calls and streams finished.
+	CallsCompleted uint64
+	// StreamsActive is the number of unary calls and streams in progress.
+	StreamsActive int
+	// PendingWrites is the number of frames waiting to be written to
+	// connections, either for another write to finish or in the buffer of
+	// coalesced writes.
+	PendingWrites int
+	// PendingReads is the number of messages received from connections and
+	// queued for calls and streams, which were not received by them yet.
+	PendingReads int
+}
+
+// stats holds the counters updated while handling connections.
+type stats struct {
+	bytesSent      uint64
+	bytesReceived  uint64
+	callsStarted   uint64
+	callsCompleted uint64
+	pendingWrites  int64
+}
+
+func (s *stats) sent(n int) {
+	if s != nil {
+		atomic.AddUint64(&s.bytesSent, uint64(n))
+	}
+}
+
+func (s *stats) received(n int) {
+	if s != nil {
+		atomic.AddUint64(&s.bytesReceived, uint64(n))
+	}
+}
+
+// writesPending adds n to the frames waiting to be written.
+func (s *stats) writesPending(n int) {
+	if s != nil {
+		atomic.AddInt64(&s.pendingWrites, int64(n))
+	}
+}
+
+func (s *stats) callStarted() {
+	atomic.AddUint64(&s.callsStarted, 1)
+}
+
+func (s *stats) callCompleted() {
+	atomic.AddUint64(&s.callsCompleted, 1)
+}
+
+func (s *stats) snapshot(active, pendingReads int) Stats {
+	return Stats{
+		BytesSent:      atomic.LoadUint64(&s.bytesSent),
+		BytesReceived:  atomic.LoadUint64(&s.bytesReceived),
+		CallsStarted:   atomic.LoadUint64(&s.callsStarted),
+		CallsCompleted: atomic.LoadUint64(&s.callsCompleted),
+		StreamsActive:  active,
+		PendingWrites:  int(atomic.LoadInt64(&s.pendingWrites)),
+		PendingReads:   pendingReads,
+	}
+}
+
+// CallSummary describes a unary call handled by a Server, it is passed to the
+// observer set with WithCallObserver.
+type CallSummary struct {
+	// FullMethod is the full name of the method called, in the form
+	// "/service/method".
+	FullMethod string
+	// Duration is the time from receiving the request to writing the
+	// response.
+	Duration time.Duration
+	// Code is the status code of the response.
+	Code codes.Code
+	// RequestSize is the size of the request payload in bytes.
+	RequestSize int
+	// ResponseSize is the size of the response payload in bytes.
+	ResponseSize int
+}
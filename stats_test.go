@@ -0,0 +1,262 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ttrpc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/containerd/ttrpc/internal"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestStats(t *testing.T) {
+	var (
+		ctx             = context.Background()
+		server          = mustServer(t)(NewServer())
+		addr, listener  = newTestListener(t)
+		client, cleanup = newTestClient(t, addr)
+		tclient         = newTestingClient(client)
+	)
+	defer listener.Close()
+	defer cleanup()
+
+	registerTestingService(server, &testingServer{})
+	server.RegisterService("streamService", &ServiceDesc{
+		Streams: map[string]Stream{
+			"Echo": {
+				Handler: func(_ context.Context, ss StreamServer) (interface{}, error) {
+					var req internal.EchoPayload
+					if err := ss.RecvMsg(&req); err != nil {
+						return nil, err
+					}
+					return &req, nil
+				},
+			},
+		},
+	})
+
+	go server.Serve(ctx, listener)
+	defer server.Shutdown(ctx)
+
+	if _, err := tclient.Test(ctx, &internal.TestPayload{Foo: "stats"}); err != nil {
+		t.Fatal(err)
+	}
+
+	stream, err := client.NewStream(ctx, &StreamDesc{}, "streamService", "Echo", &internal.EchoPayload{Msg: "stats"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st := client.Stats(); st.StreamsActive != 1 || st.CallsStarted != 2 || st.CallsCompleted != 1 {
+		t.Fatalf("unexpected client stats with stream open: %+v", st)
+	}
+	var resp internal.EchoPayload
+	if err := stream.RecvMsg(&resp); err != nil {
+		t.Fatal(err)
+	}
+
+	cs := client.Stats()
+	if cs.StreamsActive != 0 || cs.CallsStarted != 2 || cs.CallsCompleted != 2 {
+		t.Fatalf("unexpected client stats: %+v", cs)
+	}
+	if cs.BytesSent == 0 || cs.BytesReceived == 0 {
+		t.Fatalf("expected client bytes to be counted: %+v", cs)
+	}
+
+	// the server counts a call as completed once its response is written
+	waitFor(t, func() bool { return server.Stats().CallsCompleted == 2 })
+	ss := server.Stats()
+	if ss.StreamsActive != 0 || ss.CallsStarted != 2 {
+		t.Fatalf("unexpected server stats: %+v", ss)
+	}
+	if ss.BytesReceived != cs.BytesSent || ss.BytesSent != cs.BytesReceived {
+		t.Fatalf("client and server byte counts do not match: client %+v, server %+v", cs, ss)
+	}
+}
+
+func TestStatsRejectedCalls(t *testing.T) {
+	var (
+		ctx             = context.Background()
+		server          = mustServer(t)(NewServer(WithMaxConcurrentStreams(1)))
+		addr, listener  = newTestListener(t)
+		client, cleanup = newTestClient(t, addr, WithMaxSendMessageSize(64))
+		started         = make(chan struct{})
+		release         = make(chan struct{})
+	)
+	defer listener.Close()
+	defer cleanup()
+
+	server.RegisterService(serviceName, &ServiceDesc{
+		Methods: map[string]Method{
+			"Block": func(ctx context.Context, unmarshal func(interface{}) error) (interface{}, error) {
+				close(started)
+				<-release
+				return &internal.TestPayload{}, nil
+			},
+		},
+	})
+
+	go server.Serve(ctx, listener)
+	defer server.Shutdown(ctx)
+	unblock := sync.OnceFunc(func() { close(release) })
+	defer unblock()
+
+	// rejected by the server before the call is started
+	err := client.Call(ctx, serviceName, "Unknown", &internal.TestPayload{}, &internal.TestPayload{})
+	if status.Code(err) != codes.Unimplemented {
+		t.Fatalf("expected unimplemented error, got %v", err)
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- client.Call(ctx, serviceName, "Block", &internal.TestPayload{}, &internal.TestPayload{})
+	}()
+	<-started
+
+	// rejected by the concurrency limit of the server
+	err = client.Call(ctx, serviceName, "Block", &internal.TestPayload{}, &internal.TestPayload{})
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("expected resource exhausted error, got %v", err)
+	}
+	if st := server.Stats(); st.StreamsActive != 1 || st.CallsStarted != 1 || st.CallsCompleted != 0 {
+		t.Fatalf("unexpected server stats after rejected calls: %+v", st)
+	}
+
+	// failed before the request is sent
+	err = client.Call(ctx, serviceName, "Block", &internal.TestPayload{Foo: strings.Repeat("a", 128)}, &internal.TestPayload{})
+	var oerr *OversizedMessageErr
+	if !errors.As(err, &oerr) {
+		t.Fatalf("expected an oversized message error, got %v", err)
+	}
+	if st := client.Stats(); st.StreamsActive != 1 || st.CallsStarted != st.CallsCompleted+1 {
+		t.Fatalf("unexpected client stats after a failed send: %+v", st)
+	}
+
+	unblock()
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	if st := client.Stats(); st.StreamsActive != 0 || st.CallsStarted != st.CallsCompleted {
+		t.Fatalf("unexpected client stats: %+v", st)
+	}
+	waitFor(t, func() bool { return server.Stats().CallsCompleted == 1 })
+	if st := server.Stats(); st.StreamsActive != 0 || st.CallsStarted != 1 {
+		t.Fatalf("unexpected server stats: %+v", st)
+	}
+}
+
+func TestStatsPendingWrites(t *testing.T) {
+	var (
+		w, r = net.Pipe()
+		ch   = newChannel(w)
+		st   stats
+	)
+	defer w.Close()
+	defer r.Close()
+	go io.Copy(io.Discard, r)
+
+	ch.stats = &st
+	ch.coalesceWindow = time.Hour
+	for i := 0; i < 3; i++ {
+		if err := ch.send(1, messageTypeData, 0, []byte("pending")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if s := st.snapshot(0, 0); s.PendingWrites != 3 {
+		t.Fatalf("expected 3 pending writes, got %+v", s)
+	}
+	ch.flush()
+	if s := st.snapshot(0, 0); s.PendingWrites != 0 {
+		t.Fatalf("expected no pending writes once flushed, got %+v", s)
+	}
+}
+
+func TestStatsPendingReads(t *testing.T) {
+	var (
+		ctx             = context.Background()
+		server          = mustServer(t)(NewServer())
+		addr, listener  = newTestListener(t)
+		client, cleanup = newTestClient(t, addr)
+		read            = make(chan struct{})
+	)
+	defer listener.Close()
+	defer cleanup()
+
+	server.RegisterService("streamService", &ServiceDesc{
+		Streams: map[string]Stream{
+			"Echo": {
+				Handler: func(_ context.Context, ss StreamServer) (interface{}, error) {
+					if err := ss.SendMsg(&internal.EchoPayload{}); err != nil {
+						return nil, err
+					}
+					<-read
+					for {
+						var req internal.EchoPayload
+						if err := ss.RecvMsg(&req); err != nil {
+							if err == io.EOF {
+								err = nil
+							}
+							return nil, err
+						}
+					}
+				},
+				StreamingClient: true,
+				StreamingServer: true,
+			},
+		},
+	})
+
+	go server.Serve(ctx, listener)
+	defer server.Shutdown(ctx)
+
+	stream, err := client.NewStream(ctx, &StreamDesc{true, true}, "streamService", "Echo", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := stream.SendMsg(&internal.EchoPayload{Seq: int64(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// messages wait in the queues until they are received
+	waitFor(t, func() bool { return server.Stats().PendingReads == 3 })
+	waitFor(t, func() bool { return client.Stats().PendingReads == 1 })
+	close(read)
+	waitFor(t, func() bool { return server.Stats().PendingReads == 0 })
+
+	var resp internal.EchoPayload
+	if err := stream.RecvMsg(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if st := client.Stats(); st.PendingReads != 0 {
+		t.Fatalf("expected no pending reads, got %+v", st)
+	}
+	if err := stream.CloseSend(); err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.RecvMsg(&resp); err != io.EOF {
+		t.Fatalf("expected end of stream, got %v", err)
+	}
+}
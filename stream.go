@@ -18,11 +18,18 @@ package ttrpc
 
 import (
 	"context"
+	"io"
+	"math"
 	"sync"
+	"sync/atomic"
 )
 
 type streamID uint32
 
+// maxStreamID is the identifier of the last stream a client can create on a
+// connection, since identifiers always increase and are never reused.
+const maxStreamID streamID = math.MaxUint32
+
 type streamMessage struct {
 	header  messageHeader
 	payload []byte
@@ -32,21 +39,53 @@ type stream struct {
 	id     streamID
 	sender sender
 	recv   chan *streamMessage
+	window *window // send window, nil without flow control
+	// untimed streams are exempt from the read and write timeouts of the
+	// connection
+	untimed bool
+	// fds collects the file descriptors passed to the stream, nil when the
+	// caller did not ask for them
+	fds *passedFds
 
 	closeOnce sync.Once
 	recvErr   error
 	recvClose chan struct{}
+
+	// remoteDone is closed once the server finished the stream, which sets
+	// finished, or the stream failed. Nothing can be sent on it from then on.
+	remoteDoneOnce sync.Once
+	remoteDone     chan struct{}
+	finished       atomic.Bool
+
+	headerOnce sync.Once
+	header     MD
+	headerDone chan struct{} // closed once the header is known
+
+	// trailer is the metadata sent by the server before the final data
+	// message of the stream
+	trailer MD
 }
 
 func newStream(id streamID, send sender) *stream {
 	return &stream{
-		id:        id,
-		sender:    send,
-		recv:      make(chan *streamMessage, 1),
-		recvClose: make(chan struct{}),
+		id:         id,
+		sender:     send,
+		recv:       make(chan *streamMessage, 1),
+		recvClose:  make(chan struct{}),
+		remoteDone: make(chan struct{}),
+		headerDone: make(chan struct{}),
 	}
 }
 
+// setHeader records the header metadata of the stream. Only the first call
+// has an effect, a stream receiving data before any header has an empty one.
+func (s *stream) setHeader(md MD) {
+	s.headerOnce.Do(func() {
+		s.header = md
+		close(s.headerDone)
+	})
+}
+
 func (s *stream) closeWithError(err error) error {
 	s.closeOnce.Do(func() {
 		if err != nil {
@@ -56,9 +95,21 @@ func (s *stream) closeWithError(err error) error {
 		}
 		close(s.recvClose)
 	})
+	s.remoteDoneOnce.Do(func() {
+		close(s.remoteDone)
+	})
 	return nil
 }
 
+// closeRemote records that the server finished the stream, its final message
+// may still be waiting to be received.
+func (s *stream) closeRemote() {
+	s.finished.Store(true)
+	s.remoteDoneOnce.Do(func() {
+		close(s.remoteDone)
+	})
+}
+
 func (s *stream) send(mt messageType, flags uint8, b []byte) error {
 	return s.sender.send(uint32(s.id), mt, flags, b)
 }
@@ -82,3 +133,16 @@ func (s *stream) receive(ctx context.Context, msg *streamMessage) error {
 type sender interface {
 	send(uint32, messageType, uint8, []byte) error
 }
+
+// StreamError returns the error which terminated a stream, given the context
+// returned by the Context method of its ClientStream or StreamServer. It
+// returns nil while the stream is active or once it completed successfully.
+func StreamError(ctx context.Context) error {
+	if ctx.Err() == nil {
+		return nil
+	}
+	if err := context.Cause(ctx); err != io.EOF {
+		return err
+	}
+	return nil
+}
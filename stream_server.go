@@ -16,7 +16,61 @@
 
 package ttrpc
 
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+)
+
 type StreamServer interface {
 	SendMsg(m interface{}) error
+	// RecvMsg receives the next message into m, with the same reuse
+	// semantics as ClientStream.RecvMsg.
 	RecvMsg(m interface{}) error
+	// Context returns the context of the stream, which is done once the
+	// handler returns or the stream is interrupted. StreamError returns the
+	// error which terminated the stream.
+	Context() context.Context
+	// SendHeader sends header metadata to the client before any message,
+	// see ClientStream.Header. It may be called once, before the first call
+	// to SendMsg, and requires a client supporting stream headers.
+	SendHeader(md MD) error
+}
+
+// ErrNotUpgradable is returned by UpgradeToStream for calls which cannot be
+// upgraded to a stream.
+var ErrNotUpgradable = errors.New("ttrpc: call cannot be upgraded to a stream, the client must open it with NewStream and a StreamDesc with only StreamingServer set")
+
+type unaryUpgradeKey struct{}
+
+// unaryUpgrade allows the handler of a unary call to stream its response.
+type unaryUpgrade struct {
+	stream   *streamHandler
+	upgraded atomic.Bool
+}
+
+// UpgradeToStream upgrades the unary call handled with ctx to a stream, the
+// handler may then send any number of messages on the returned StreamServer.
+// The value returned by the handler, if not nil, is sent as the last message
+// of the stream. The stream is not flow controlled.
+//
+// Only calls opened by the client with NewStream and a StreamDesc with
+// StreamingServer but not StreamingClient set can be upgraded, any other call,
+// including calls made with Call or through a LocalClient, fails with
+// ErrNotUpgradable. Such clients receive the response like a stream with a
+// single message when the handler does not upgrade the call.
+func UpgradeToStream(ctx context.Context) (StreamServer, error) {
+	u, ok := ctx.Value(unaryUpgradeKey{}).(*unaryUpgrade)
+	if !ok {
+		return nil, ErrNotUpgradable
+	}
+	u.upgraded.Store(true)
+	return u.stream, nil
+}
+
+// upgradedToStream reports whether the unary call handled with ctx was
+// upgraded to a stream.
+func upgradedToStream(ctx context.Context) bool {
+	u, ok := ctx.Value(unaryUpgradeKey{}).(*unaryUpgrade)
+	return ok && u.upgraded.Load()
 }
@@ -17,11 +17,17 @@
 package ttrpc
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"fmt"
 	"io"
 	"testing"
+	"time"
 
 	"github.com/containerd/ttrpc/internal"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 func TestStreamClient(t *testing.T) {
@@ -116,3 +122,951 @@ func TestStreamClient(t *testing.T) {
 		t.Fatalf("expected io.EOF after close send, got %v", err)
 	}
 }
+
+func TestStreamHalfClose(t *testing.T) {
+	var (
+		ctx             = context.Background()
+		server          = mustServer(t)(NewServer())
+		addr, listener  = newTestListener(t)
+		client, cleanup = newTestClient(t, addr)
+		serviceName     = "streamService"
+	)
+
+	defer listener.Close()
+	defer cleanup()
+
+	server.RegisterService(serviceName, &ServiceDesc{
+		Streams: map[string]Stream{
+			"Collect": {
+				Handler: func(_ context.Context, ss StreamServer) (interface{}, error) {
+					var received []*internal.EchoPayload
+					for {
+						var req internal.EchoPayload
+						if err := ss.RecvMsg(&req); err != nil {
+							if err != io.EOF {
+								return nil, err
+							}
+							break
+						}
+						received = append(received, &req)
+					}
+					// the client has half-closed the stream, receiving
+					// again still reports the end of the stream
+					if err := ss.RecvMsg(&internal.EchoPayload{}); err != io.EOF {
+						return nil, fmt.Errorf("expected io.EOF, got %v", err)
+					}
+					for _, req := range received {
+						req.Seq++
+						if err := ss.SendMsg(req); err != nil {
+							return nil, err
+						}
+					}
+					return nil, nil
+				},
+				StreamingClient: true,
+				StreamingServer: true,
+			},
+		},
+	})
+
+	go server.Serve(ctx, listener)
+	defer server.Shutdown(ctx)
+
+	stream, err := client.NewStream(ctx, &StreamDesc{true, true}, serviceName, "Collect", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const n = 10
+	for i := 0; i < n; i++ {
+		if err := stream.SendMsg(&internal.EchoPayload{Seq: int64(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := stream.CloseSend(); err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.SendMsg(&internal.EchoPayload{}); !errors.Is(err, ErrStreamClosed) {
+		t.Fatalf("expected %v sending after close send, got %v", ErrStreamClosed, err)
+	}
+
+	for i := 0; i < n; i++ {
+		var resp internal.EchoPayload
+		if err := stream.RecvMsg(&resp); err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		if resp.Seq != int64(i)+1 {
+			t.Fatalf("%d: unexpected sequence value: %d, expected %d", i, resp.Seq, i+1)
+		}
+	}
+	if err := stream.RecvMsg(&internal.EchoPayload{}); err != io.EOF {
+		t.Fatalf("expected io.EOF after server finished, got %v", err)
+	}
+}
+
+func TestStreamServerFinishesFirst(t *testing.T) {
+	var (
+		ctx             = context.Background()
+		server          = mustServer(t)(NewServer())
+		addr, listener  = newTestListener(t)
+		client, cleanup = newTestClient(t, addr)
+		serviceName     = "streamService"
+	)
+
+	defer listener.Close()
+	defer cleanup()
+
+	server.RegisterService(serviceName, &ServiceDesc{
+		Streams: map[string]Stream{
+			"Greet": {
+				Handler: func(_ context.Context, ss StreamServer) (interface{}, error) {
+					return nil, ss.SendMsg(&internal.EchoPayload{Msg: "hello"})
+				},
+				StreamingClient: true,
+				StreamingServer: true,
+			},
+			"Split": {
+				Handler: func(_ context.Context, ss StreamServer) (interface{}, error) {
+					var req internal.EchoPayload
+					if err := ss.RecvMsg(&req); err != nil {
+						return nil, err
+					}
+					// the client only sends the request
+					if err := ss.RecvMsg(&internal.EchoPayload{}); err != io.EOF {
+						return nil, fmt.Errorf("expected io.EOF, got %v", err)
+					}
+					return nil, ss.SendMsg(&req)
+				},
+				StreamingServer: true,
+			},
+		},
+	})
+
+	go server.Serve(ctx, listener)
+	defer server.Shutdown(ctx)
+
+	stream, err := client.NewStream(ctx, &StreamDesc{true, true}, serviceName, "Greet", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resp internal.EchoPayload
+	if err := stream.RecvMsg(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.RecvMsg(&resp); err != io.EOF {
+		t.Fatalf("expected io.EOF after server finished, got %v", err)
+	}
+	// the server is done with the stream, sending fails but the client may
+	// still close its side
+	if err := stream.SendMsg(&internal.EchoPayload{}); !errors.Is(err, ErrStreamClosed) {
+		t.Fatalf("expected %v after server finished, got %v", ErrStreamClosed, err)
+	}
+	if err := stream.CloseSend(); err != nil {
+		t.Fatal(err)
+	}
+
+	stream, err = client.NewStream(ctx, &StreamDesc{false, true}, serviceName, "Split", &internal.EchoPayload{Msg: "split"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.RecvMsg(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Msg != "split" {
+		t.Fatalf("unexpected message %q", resp.Msg)
+	}
+	if err := stream.RecvMsg(&resp); err != io.EOF {
+		t.Fatalf("expected io.EOF after server finished, got %v", err)
+	}
+
+	// the connection is still usable
+	if err := client.Call(ctx, serviceName, "Missing", &internal.EchoPayload{}, &internal.EchoPayload{}); status.Code(err) != codes.Unimplemented {
+		t.Fatalf("expected unimplemented error, got %v", err)
+	}
+}
+
+func TestStreamContext(t *testing.T) {
+	var (
+		ctx             = context.Background()
+		server          = mustServer(t)(NewServer())
+		addr, listener  = newTestListener(t)
+		client, cleanup = newTestClient(t, addr)
+		serviceName     = "streamService"
+		serverCtx       = make(chan context.Context, 1)
+	)
+
+	defer listener.Close()
+	defer cleanup()
+
+	server.RegisterService(serviceName, &ServiceDesc{
+		Streams: map[string]Stream{
+			"Stream": {
+				Handler: func(_ context.Context, ss StreamServer) (interface{}, error) {
+					serverCtx <- ss.Context()
+					var req internal.EchoPayload
+					if err := ss.RecvMsg(&req); err != nil {
+						return nil, err
+					}
+					switch req.Msg {
+					case "fail":
+						return nil, status.Error(codes.Aborted, "failed")
+					case "wait":
+						<-ss.Context().Done()
+						return nil, ss.Context().Err()
+					}
+					return nil, ss.SendMsg(&req)
+				},
+				StreamingClient: true,
+				StreamingServer: true,
+			},
+		},
+	})
+
+	go server.Serve(ctx, listener)
+	defer server.Shutdown(ctx)
+
+	done := func(t *testing.T, ctx context.Context) {
+		t.Helper()
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Second):
+			t.Fatal("stream context is not done")
+		}
+	}
+
+	t.Run("Success", func(t *testing.T) {
+		stream, err := client.NewStream(ctx, &StreamDesc{true, true}, serviceName, "Stream", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sctx := <-serverCtx
+		if err := stream.SendMsg(&internal.EchoPayload{Msg: "ok"}); err != nil {
+			t.Fatal(err)
+		}
+		var resp internal.EchoPayload
+		if err := stream.RecvMsg(&resp); err != nil {
+			t.Fatal(err)
+		}
+		if stream.Context().Err() != nil {
+			t.Fatal("stream context done before the stream finished")
+		}
+		if err := stream.RecvMsg(&resp); err != io.EOF {
+			t.Fatalf("expected io.EOF, got %v", err)
+		}
+		done(t, stream.Context())
+		if err := StreamError(stream.Context()); err != nil {
+			t.Fatalf("unexpected client stream error: %v", err)
+		}
+		done(t, sctx)
+		if err := StreamError(sctx); err != nil {
+			t.Fatalf("unexpected server stream error: %v", err)
+		}
+	})
+
+	t.Run("Failure", func(t *testing.T) {
+		stream, err := client.NewStream(ctx, &StreamDesc{true, true}, serviceName, "Stream", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sctx := <-serverCtx
+		if err := stream.SendMsg(&internal.EchoPayload{Msg: "fail"}); err != nil {
+			t.Fatal(err)
+		}
+		done(t, sctx)
+		if err := StreamError(sctx); status.Code(err) != codes.Aborted {
+			t.Fatalf("unexpected server stream error: %v", err)
+		}
+		if err := stream.RecvMsg(&internal.EchoPayload{}); status.Code(err) != codes.Aborted {
+			t.Fatalf("expected aborted error, got %v", err)
+		}
+		done(t, stream.Context())
+		if err := StreamError(stream.Context()); status.Code(err) != codes.Aborted {
+			t.Fatalf("unexpected client stream error: %v", err)
+		}
+	})
+
+	t.Run("Disconnect", func(t *testing.T) {
+		stream, err := client.NewStream(ctx, &StreamDesc{true, true}, serviceName, "Stream", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sctx := <-serverCtx
+		if err := stream.SendMsg(&internal.EchoPayload{Msg: "wait"}); err != nil {
+			t.Fatal(err)
+		}
+		cctx := stream.Context()
+		client.Close()
+
+		done(t, cctx)
+		if err := StreamError(cctx); !errors.Is(err, ErrClosed) {
+			t.Fatalf("expected %v, got %v", ErrClosed, err)
+		}
+		done(t, sctx)
+		if err := StreamError(sctx); !errors.Is(err, ErrClosed) {
+			t.Fatalf("expected %v, got %v", ErrClosed, err)
+		}
+	})
+}
+
+func TestStreamRecvCancel(t *testing.T) {
+	var (
+		ctx             = context.Background()
+		server          = mustServer(t)(NewServer())
+		addr, listener  = newTestListener(t)
+		client, cleanup = newTestClient(t, addr)
+		serviceName     = "streamService"
+		release         = make(chan struct{})
+	)
+
+	defer listener.Close()
+	defer cleanup()
+
+	server.RegisterService(serviceName, &ServiceDesc{
+		Streams: map[string]Stream{
+			"Block": {
+				Handler: func(ctx context.Context, ss StreamServer) (interface{}, error) {
+					select {
+					case <-release:
+					case <-ctx.Done():
+					}
+					return nil, nil
+				},
+				StreamingServer: true,
+			},
+		},
+	})
+
+	go server.Serve(ctx, listener)
+	defer server.Shutdown(ctx)
+	defer close(release)
+
+	sctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := client.NewStream(sctx, &StreamDesc{false, true}, serviceName, "Block", &internal.EchoPayload{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- stream.RecvMsg(&internal.EchoPayload{})
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-errs:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("expected %v, got %v", context.Canceled, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("RecvMsg did not return after cancellation")
+	}
+	if err := stream.RecvMsg(&internal.EchoPayload{}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected %v, got %v", context.Canceled, err)
+	}
+	if err := StreamError(stream.Context()); !errors.Is(err, context.Canceled) {
+		t.Fatalf("unexpected stream error: %v", err)
+	}
+}
+
+func TestUpgradeToStream(t *testing.T) {
+	var (
+		ctx             = context.Background()
+		server          = mustServer(t)(NewServer())
+		addr, listener  = newTestListener(t)
+		client, cleanup = newTestClient(t, addr)
+		serviceName     = "streamService"
+	)
+
+	defer listener.Close()
+	defer cleanup()
+
+	server.RegisterService(serviceName, &ServiceDesc{
+		Methods: map[string]Method{
+			"Count": func(ctx context.Context, unmarshal func(interface{}) error) (interface{}, error) {
+				var req internal.EchoPayload
+				if err := unmarshal(&req); err != nil {
+					return nil, err
+				}
+				ss, err := UpgradeToStream(ctx)
+				if err != nil {
+					if !errors.Is(err, ErrNotUpgradable) {
+						return nil, err
+					}
+					return &internal.EchoPayload{Seq: req.Seq, Msg: "unary"}, nil
+				}
+				for i := int64(1); i < req.Seq; i++ {
+					if err := ss.SendMsg(&internal.EchoPayload{Seq: i}); err != nil {
+						return nil, err
+					}
+				}
+				if req.Msg == "last" {
+					return &internal.EchoPayload{Seq: req.Seq, Msg: "last"}, nil
+				}
+				return nil, nil
+			},
+		},
+	})
+
+	go server.Serve(ctx, listener)
+	defer server.Shutdown(ctx)
+
+	var resp internal.EchoPayload
+	if err := client.Call(ctx, serviceName, "Count", &internal.EchoPayload{Seq: 3}, &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Msg != "unary" {
+		t.Fatalf("unexpected response %v", &resp)
+	}
+
+	recvAll := func(t *testing.T, req *internal.EchoPayload) []*internal.EchoPayload {
+		t.Helper()
+		stream, err := client.NewStream(ctx, &StreamDesc{StreamingServer: true}, serviceName, "Count", req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var msgs []*internal.EchoPayload
+		for {
+			var m internal.EchoPayload
+			if err := stream.RecvMsg(&m); err == io.EOF {
+				return msgs
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			msgs = append(msgs, &m)
+		}
+	}
+
+	msgs := recvAll(t, &internal.EchoPayload{Seq: 4})
+	if len(msgs) != 3 {
+		t.Fatalf("expected 3 messages, got %v", msgs)
+	}
+	for i, m := range msgs {
+		if m.Seq != int64(i+1) {
+			t.Fatalf("unexpected message %d: %v", i, m)
+		}
+	}
+
+	msgs = recvAll(t, &internal.EchoPayload{Seq: 2, Msg: "last"})
+	if len(msgs) != 2 || msgs[1].Msg != "last" {
+		t.Fatalf("expected the returned message last, got %v", msgs)
+	}
+
+	// calls through a local client cannot be upgraded
+	local := NewLocalClient(server)
+	if err := local.Call(ctx, serviceName, "Count", &internal.EchoPayload{Seq: 3}, &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Msg != "unary" {
+		t.Fatalf("unexpected response %v", &resp)
+	}
+}
+
+func TestStreamHeader(t *testing.T) {
+	var (
+		ctx             = context.Background()
+		server          = mustServer(t)(NewServer())
+		addr, listener  = newTestListener(t)
+		client, cleanup = newTestClient(t, addr)
+		headerRead      = make(chan struct{})
+		sendErrs        = make(chan error, 1)
+	)
+	defer listener.Close()
+	defer cleanup()
+
+	server.RegisterService(serviceName, &ServiceDesc{
+		Streams: map[string]Stream{
+			"Header": {
+				Handler: func(ctx context.Context, ss StreamServer) (interface{}, error) {
+					if err := ss.SendHeader(MD{"encoding": {"json"}}); err != nil {
+						return nil, err
+					}
+					sendErrs <- ss.SendHeader(MD{})
+					// the header reaches the client before any message
+					select {
+					case <-headerRead:
+					case <-ctx.Done():
+						return nil, ctx.Err()
+					}
+					return nil, ss.SendMsg(&internal.EchoPayload{Msg: "data"})
+				},
+				StreamingServer: true,
+			},
+			"NoHeader": {
+				Handler: func(ctx context.Context, ss StreamServer) (interface{}, error) {
+					return nil, ss.SendMsg(&internal.EchoPayload{Msg: "data"})
+				},
+				StreamingServer: true,
+			},
+		},
+	})
+	go server.Serve(ctx, listener)
+	defer server.Shutdown(ctx)
+
+	for name, client := range map[string]interface {
+		NewStream(context.Context, *StreamDesc, string, string, interface{}, ...CallOption) (ClientStream, error)
+	}{
+		"remote": client,
+		"local":  NewLocalClient(server),
+	} {
+		t.Run(name, func(t *testing.T) {
+			stream, err := client.NewStream(ctx, &StreamDesc{StreamingServer: true}, serviceName, "Header", &internal.EchoPayload{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if name == "remote" {
+				// a local stream delivers the header when it is read
+				if err := <-sendErrs; err != ErrHeaderSent {
+					t.Fatalf("expected %v sending the header twice, got %v", ErrHeaderSent, err)
+				}
+			}
+			md, err := stream.Header()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if v, _ := md.Get("encoding"); len(v) != 1 || v[0] != "json" {
+				t.Fatalf("unexpected header %v", md)
+			}
+			if name == "local" {
+				if err := <-sendErrs; err != ErrHeaderSent {
+					t.Fatalf("expected %v sending the header twice, got %v", ErrHeaderSent, err)
+				}
+			}
+			headerRead <- struct{}{}
+
+			var resp internal.EchoPayload
+			if err := stream.RecvMsg(&resp); err != nil {
+				t.Fatal(err)
+			}
+			if resp.Msg != "data" {
+				t.Fatalf("unexpected message %q", resp.Msg)
+			}
+			if err := stream.RecvMsg(&resp); err != io.EOF {
+				t.Fatalf("expected end of stream, got %v", err)
+			}
+
+			// without a header, Header returns once the first message is
+			// received
+			stream, err = client.NewStream(ctx, &StreamDesc{StreamingServer: true}, serviceName, "NoHeader", &internal.EchoPayload{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if md, err := stream.Header(); err != nil || len(md) != 0 {
+				t.Fatalf("expected an empty header, got %v, %v", md, err)
+			}
+			if err := stream.RecvMsg(&resp); err != nil || resp.Msg != "data" {
+				t.Fatalf("unexpected message %q: %v", resp.Msg, err)
+			}
+		})
+	}
+}
+
+func TestStreamChunked(t *testing.T) {
+	var (
+		ctx             = context.Background()
+		server          = mustServer(t)(NewServer())
+		addr, listener  = newTestListener(t)
+		client, cleanup = newTestClient(t, addr)
+		serviceName     = "chunkService"
+		blob            = make([]byte, 3*messageLengthMax+17)
+	)
+	defer listener.Close()
+	defer cleanup()
+
+	for i := range blob {
+		blob[i] = byte(i % 251)
+	}
+
+	server.RegisterService(serviceName, &ServiceDesc{
+		Streams: map[string]Stream{
+			"Upload": {
+				Handler: func(_ context.Context, ss StreamServer) (interface{}, error) {
+					var buf bytes.Buffer
+					if _, err := RecvChunked(ss, &buf); err != nil {
+						return nil, err
+					}
+					if !bytes.Equal(buf.Bytes(), blob) {
+						return nil, status.Errorf(codes.DataLoss, "received %d bytes which differ from the sent blob", buf.Len())
+					}
+					return &internal.EchoPayload{Seq: int64(buf.Len())}, nil
+				},
+				StreamingClient: true,
+			},
+			"Download": {
+				Handler: func(_ context.Context, ss StreamServer) (interface{}, error) {
+					var req internal.EchoPayload
+					if err := ss.RecvMsg(&req); err != nil {
+						return nil, err
+					}
+					if _, err := SendChunked(ss, bytes.NewReader(blob), int(req.Seq)); err != nil {
+						return nil, err
+					}
+					return nil, nil
+				},
+				StreamingServer: true,
+			},
+		},
+	})
+
+	go server.Serve(ctx, listener)
+	defer server.Shutdown(ctx)
+
+	chunkSize := messageLengthMax / 2
+
+	stream, err := client.NewStream(ctx, &StreamDesc{StreamingClient: true}, serviceName, "Upload", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := SendChunked(stream, bytes.NewReader(blob), chunkSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(len(blob)) {
+		t.Fatalf("sent %d bytes, expected %d", n, len(blob))
+	}
+	if err := stream.CloseSend(); err != nil {
+		t.Fatal(err)
+	}
+	var resp internal.EchoPayload
+	if err := stream.RecvMsg(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Seq != int64(len(blob)) {
+		t.Fatalf("server received %d bytes, expected %d", resp.Seq, len(blob))
+	}
+
+	stream, err = client.NewStream(ctx, &StreamDesc{StreamingServer: true}, serviceName, "Download", &internal.EchoPayload{Seq: int64(chunkSize)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if n, err := RecvChunked(stream, &buf); err != nil {
+		t.Fatal(err)
+	} else if n != int64(len(blob)) {
+		t.Fatalf("received %d bytes, expected %d", n, len(blob))
+	}
+	if !bytes.Equal(buf.Bytes(), blob) {
+		t.Fatal("received data differs from the sent blob")
+	}
+
+	if _, err := SendChunked(stream, bytes.NewReader(blob), 0); err == nil {
+		t.Fatal("expected an error sending with a zero chunk size")
+	}
+}
+
+func TestStreamSetMetadata(t *testing.T) {
+	var (
+		ctx             = context.Background()
+		server          = mustServer(t)(NewServer())
+		addr, listener  = newTestListener(t)
+		client, cleanup = newTestClient(t, addr)
+		serviceName     = "metadataService"
+	)
+	defer listener.Close()
+	defer cleanup()
+
+	server.RegisterService(serviceName, &ServiceDesc{
+		Streams: map[string]Stream{
+			"Token": {
+				// echoes each message along with the latest token
+				Handler: func(ctx context.Context, ss StreamServer) (interface{}, error) {
+					token, _ := GetMetadataValue(ctx, "token")
+					if err := OnMetadataUpdate(ctx, func(md MD) {
+						if v, ok := md.Get("token"); ok {
+							token = v[0]
+						}
+					}); err != nil {
+						return nil, err
+					}
+					for {
+						var req internal.EchoPayload
+						if err := ss.RecvMsg(&req); err != nil {
+							if err == io.EOF {
+								err = nil
+							}
+							return nil, err
+						}
+						req.Msg = token
+						if err := ss.SendMsg(&req); err != nil {
+							return nil, err
+						}
+					}
+				},
+				StreamingClient: true,
+				StreamingServer: true,
+			},
+		},
+	})
+
+	go server.Serve(ctx, listener)
+	defer server.Shutdown(ctx)
+
+	if err := OnMetadataUpdate(ctx, func(MD) {}); err == nil {
+		t.Fatal("expected an error outside of a stream handler")
+	}
+
+	for name, client := range map[string]interface {
+		NewStream(context.Context, *StreamDesc, string, string, interface{}, ...CallOption) (ClientStream, error)
+	}{
+		"remote": client,
+		"local":  NewLocalClient(server),
+	} {
+		t.Run(name, func(t *testing.T) {
+			mdctx := WithMetadata(ctx, MD{"token": {"first"}})
+			stream, err := client.NewStream(mdctx, &StreamDesc{true, true}, serviceName, "Token", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, expected := range []string{"first", "second", "third"} {
+				if i > 0 {
+					if err := stream.SetMetadata(MD{"token": {expected}}); err != nil {
+						t.Fatal(err)
+					}
+				}
+				if err := stream.SendMsg(&internal.EchoPayload{Seq: int64(i)}); err != nil {
+					t.Fatal(err)
+				}
+				var resp internal.EchoPayload
+				if err := stream.RecvMsg(&resp); err != nil {
+					t.Fatal(err)
+				}
+				if resp.Msg != expected {
+					t.Fatalf("%d: expected token %q, got %q", i, expected, resp.Msg)
+				}
+			}
+
+			if err := stream.SetMetadata(MD{"ttrpc-token": {"x"}}); !errors.Is(err, ErrReservedMetadataKey) {
+				t.Fatalf("expected %v, got %v", ErrReservedMetadataKey, err)
+			}
+			if err := stream.CloseSend(); err != nil {
+				t.Fatal(err)
+			}
+			if err := stream.SetMetadata(MD{"token": {"late"}}); err != ErrStreamClosed {
+				t.Fatalf("expected %v after close send, got %v", ErrStreamClosed, err)
+			}
+			var resp internal.EchoPayload
+			if err := stream.RecvMsg(&resp); err != io.EOF {
+				t.Fatalf("expected end of stream, got %v", err)
+			}
+		})
+	}
+}
+
+// registerSequenceService registers a service streaming Seq messages numbered
+// from 1, the second one without a Msg.
+func registerSequenceService(server *Server) {
+	server.RegisterService("sequenceService", &ServiceDesc{
+		Streams: map[string]Stream{
+			"Sequence": {
+				Handler: func(_ context.Context, ss StreamServer) (interface{}, error) {
+					var req internal.EchoPayload
+					if err := ss.RecvMsg(&req); err != nil {
+						return nil, err
+					}
+					for i := int64(1); i <= req.Seq; i++ {
+						resp := &internal.EchoPayload{Seq: i}
+						if i != 2 {
+							resp.Msg = fmt.Sprintf("message %d", i)
+						}
+						if err := ss.SendMsg(resp); err != nil {
+							return nil, err
+						}
+					}
+					return nil, nil
+				},
+				StreamingServer: true,
+			},
+		},
+	})
+}
+
+func TestStreamRecvReuse(t *testing.T) {
+	var (
+		ctx             = context.Background()
+		server          = mustServer(t)(NewServer())
+		addr, listener  = newTestListener(t)
+		client, cleanup = newTestClient(t, addr)
+	)
+	defer listener.Close()
+	defer cleanup()
+
+	registerSequenceService(server)
+
+	go server.Serve(ctx, listener)
+	defer server.Shutdown(ctx)
+
+	stream, err := client.NewStream(ctx, &StreamDesc{StreamingServer: true}, "sequenceService", "Sequence", &internal.EchoPayload{Seq: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var kept, msg internal.EchoPayload
+	if err := stream.RecvMsg(&kept); err != nil {
+		t.Fatal(err)
+	}
+	// the message is reset before being decoded
+	msg.Msg = "stale"
+	if err := stream.RecvMsg(&msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Seq != 2 || msg.Msg != "" {
+		t.Fatalf("unexpected reused message %v", &msg)
+	}
+	if err := stream.RecvMsg(&msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Seq != 3 || msg.Msg != "message 3" {
+		t.Fatalf("unexpected reused message %v", &msg)
+	}
+	// and messages received earlier are left untouched
+	if kept.Seq != 1 || kept.Msg != "message 1" {
+		t.Fatalf("retained message was modified: %v", &kept)
+	}
+}
+
+func BenchmarkStreamRecv(b *testing.B) {
+	var (
+		ctx             = context.Background()
+		server          = mustServer(b)(NewServer())
+		addr, listener  = newTestListener(b)
+		client, cleanup = newTestClient(b, addr)
+	)
+	defer listener.Close()
+	defer cleanup()
+
+	registerSequenceService(server)
+
+	go server.Serve(ctx, listener)
+	defer server.Shutdown(ctx)
+
+	for _, reuse := range []bool{true, false} {
+		b.Run(fmt.Sprintf("reuse=%v", reuse), func(b *testing.B) {
+			stream, err := client.NewStream(ctx, &StreamDesc{StreamingServer: true}, "sequenceService", "Sequence", &internal.EchoPayload{Seq: int64(b.N)})
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			var msg internal.EchoPayload
+			for i := 0; i < b.N; i++ {
+				m := &msg
+				if !reuse {
+					m = &internal.EchoPayload{}
+				}
+				if err := stream.RecvMsg(m); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestStreamSendAfterClose(t *testing.T) {
+	var (
+		ctx             = context.Background()
+		server          = mustServer(t)(NewServer())
+		addr, listener  = newTestListener(t)
+		client, cleanup = newTestClient(t, addr)
+		serviceName     = "streamService"
+	)
+
+	defer listener.Close()
+	defer cleanup()
+
+	server.RegisterService(serviceName, &ServiceDesc{
+		Streams: map[string]Stream{
+			"Finish": {
+				Handler: func(context.Context, StreamServer) (interface{}, error) {
+					return &internal.EchoPayload{Msg: "done"}, nil
+				},
+				StreamingClient: true,
+			},
+			"Fail": {
+				Handler: func(context.Context, StreamServer) (interface{}, error) {
+					return nil, status.Error(codes.Aborted, "aborted")
+				},
+				StreamingClient: true,
+			},
+			"Echo": {
+				Handler: func(_ context.Context, ss StreamServer) (interface{}, error) {
+					for {
+						var req internal.EchoPayload
+						if err := ss.RecvMsg(&req); err != nil {
+							if err == io.EOF {
+								return &internal.EchoPayload{}, nil
+							}
+							return nil, err
+						}
+					}
+				},
+				StreamingClient: true,
+			},
+		},
+	})
+
+	go server.Serve(ctx, listener)
+	defer server.Shutdown(ctx)
+
+	for name, client := range map[string]interface {
+		NewStream(context.Context, *StreamDesc, string, string, interface{}, ...CallOption) (ClientStream, error)
+	}{
+		"remote": client,
+		"local":  NewLocalClient(server),
+	} {
+		t.Run(name, func(t *testing.T) {
+			desc := &StreamDesc{StreamingClient: true}
+
+			// the final response was received
+			for _, method := range []string{"Finish", "Fail"} {
+				stream, err := client.NewStream(ctx, desc, serviceName, method, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				stream.RecvMsg(&internal.EchoPayload{})
+				if err := stream.SendMsg(&internal.EchoPayload{}); !errors.Is(err, ErrStreamClosed) {
+					t.Fatalf("expected %v sending on stream finished by %s, got %v", ErrStreamClosed, method, err)
+				}
+				if err := stream.SetMetadata(MD{"key": {"value"}}); !errors.Is(err, ErrStreamClosed) {
+					t.Fatalf("expected %v updating metadata of stream finished by %s, got %v", ErrStreamClosed, method, err)
+				}
+			}
+
+			// the server finished without the client receiving the response
+			stream, err := client.NewStream(ctx, desc, serviceName, "Finish", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			waitFor(t, func() bool {
+				err := stream.SendMsg(&internal.EchoPayload{})
+				if err != nil && !errors.Is(err, ErrStreamClosed) {
+					t.Fatalf("expected %v sending on finished stream, got %v", ErrStreamClosed, err)
+				}
+				return err != nil
+			})
+			var resp internal.EchoPayload
+			if err := stream.RecvMsg(&resp); err != nil || resp.Msg != "done" {
+				t.Fatalf("expected the final response, got %v", err)
+			}
+
+			// the client closed its side
+			stream, err = client.NewStream(ctx, desc, serviceName, "Echo", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := stream.SendMsg(&internal.EchoPayload{}); err != nil {
+				t.Fatal(err)
+			}
+			if err := stream.CloseSend(); err != nil {
+				t.Fatal(err)
+			}
+			if err := stream.SendMsg(&internal.EchoPayload{}); !errors.Is(err, ErrStreamClosed) {
+				t.Fatalf("expected %v sending after CloseSend, got %v", ErrStreamClosed, err)
+			}
+			if err := stream.RecvMsg(&internal.EchoPayload{}); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
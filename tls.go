@@ -0,0 +1,92 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ttrpc
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"time"
+)
+
+// tlsHandshakeTimeout bounds the TLS handshake of an accepted connection, since
+// handshakes are performed before the server accepts the next connection.
+const tlsHandshakeTimeout = 10 * time.Second
+
+// TLSHandshaker returns a Handshaker which performs a TLS handshake with cfg on
+// every accepted connection, serving the call over the resulting TLS
+// connection. To require mutual TLS, set cfg.ClientAuth to
+// tls.RequireAndVerifyClientCert. The certificates of the client are available
+// to handlers with GetPeerCertificates.
+//
+// Connections failing the handshake are closed and reported to the handler set
+// with WithServerErrorHandler.
+func TLSHandshaker(cfg *tls.Config) Handshaker {
+	return handshakerFunc(func(ctx context.Context, conn net.Conn) (net.Conn, interface{}, error) {
+		ctx, cancel := context.WithTimeout(ctx, tlsHandshakeTimeout)
+		defer cancel()
+
+		tconn := tls.Server(conn, cfg)
+		if err := tconn.HandshakeContext(ctx); err != nil {
+			return nil, nil, fmt.Errorf("ttrpc: tls handshake with %v failed: %w", conn.RemoteAddr(), err)
+		}
+		return tconn, tconn.ConnectionState(), nil
+	})
+}
+
+// GetPeerCertificates returns the verified certificate chain presented by the
+// client of the call in the context, starting with the client's certificate. It
+// is only available to server handlers and interceptors of a server using
+// TLSHandshaker, and only when the client certificate was verified.
+func GetPeerCertificates(ctx context.Context) ([]*x509.Certificate, bool) {
+	p, ok := getPeer(ctx)
+	if !ok {
+		return nil, false
+	}
+	state, ok := p.handshake.(tls.ConnectionState)
+	if !ok || len(state.VerifiedChains) == 0 {
+		return nil, false
+	}
+	return state.VerifiedChains[0], true
+}
+
+// WithTLS makes the client use TLS with cfg over its connection, for servers
+// using TLSHandshaker. Since the client is not aware of the address it is
+// connected to, cfg.ServerName must be set to the name the server certificate
+// is verified against. For mutual TLS, set the client certificate in
+// cfg.Certificates.
+//
+// For clients created with NewClientWithDialer, the handshake is performed
+// after each dial and failures are retried like failed dials.
+func WithTLS(cfg *tls.Config) ClientOpts {
+	return func(c *Client) {
+		c.tlsConfig = cfg
+	}
+}
+
+// tlsHandshake performs the client side TLS handshake on conn, closing it on
+// failure.
+func tlsHandshake(ctx context.Context, conn net.Conn, cfg *tls.Config) (net.Conn, error) {
+	tconn := tls.Client(conn, cfg)
+	if err := tconn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("ttrpc: tls handshake failed: %w", err)
+	}
+	return tconn, nil
+}
@@ -0,0 +1,180 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ttrpc
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/containerd/ttrpc/internal"
+)
+
+// newTestCertificate returns a certificate for name signed by parent, or a
+// self-signed CA certificate when parent is nil.
+func newTestCertificate(t testing.TB, name string, parent *tls.Certificate) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	signer, signerKey := template, interface{}(key)
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestTLSHandshaker(t *testing.T) {
+	var (
+		ctx        = context.Background()
+		ca         = newTestCertificate(t, "ca", nil)
+		serverCert = newTestCertificate(t, "server", &ca)
+		clientCert = newTestCertificate(t, "client", &ca)
+		pool       = x509.NewCertPool()
+		refused    = make(chan error, 1)
+	)
+	pool.AddCert(ca.Leaf)
+
+	server := mustServer(t)(NewServer(
+		WithServerHandshaker(TLSHandshaker(&tls.Config{
+			Certificates: []tls.Certificate{serverCert},
+			ClientCAs:    pool,
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+		})),
+		WithServerErrorHandler(func(err error, conn net.Conn) {
+			select {
+			case refused <- err:
+			default:
+			}
+		}),
+	))
+	server.RegisterService(serviceName, &ServiceDesc{
+		Methods: map[string]Method{
+			"Test": func(ctx context.Context, unmarshal func(interface{}) error) (interface{}, error) {
+				certs, ok := GetPeerCertificates(ctx)
+				if !ok {
+					return &internal.TestPayload{}, nil
+				}
+				return &internal.TestPayload{Foo: certs[0].Subject.CommonName}, nil
+			},
+		},
+	})
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go server.Serve(ctx, listener)
+	defer server.Shutdown(ctx)
+
+	dial := func(ctx context.Context) (net.Conn, error) {
+		return net.Dial("tcp", listener.Addr().String())
+	}
+
+	t.Run("MutualTLS", func(t *testing.T) {
+		conn, err := dial(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client := NewClient(conn, WithTLS(&tls.Config{
+			Certificates: []tls.Certificate{clientCert},
+			RootCAs:      pool,
+			ServerName:   "server",
+		}))
+		defer client.Close()
+
+		var resp internal.TestPayload
+		if err := client.Call(ctx, serviceName, "Test", &internal.TestPayload{}, &resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.Foo != "client" {
+			t.Fatalf("unexpected peer certificate %q", resp.Foo)
+		}
+	})
+
+	t.Run("Dialer", func(t *testing.T) {
+		client := NewClientWithDialer(dial, WithTLS(&tls.Config{
+			Certificates: []tls.Certificate{clientCert},
+			RootCAs:      pool,
+			ServerName:   "server",
+		}))
+		defer client.Close()
+
+		var resp internal.TestPayload
+		if err := client.Call(ctx, serviceName, "Test", &internal.TestPayload{}, &resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.Foo != "client" {
+			t.Fatalf("unexpected peer certificate %q", resp.Foo)
+		}
+	})
+
+	t.Run("NoClientCertificate", func(t *testing.T) {
+		conn, err := dial(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client := NewClient(conn, WithTLS(&tls.Config{
+			RootCAs:    pool,
+			ServerName: "server",
+		}))
+		defer client.Close()
+
+		if err := client.Call(ctx, serviceName, "Test", &internal.TestPayload{}, &internal.TestPayload{}); err == nil {
+			t.Fatal("expected call without client certificate to fail")
+		}
+		select {
+		case err := <-refused:
+			if err == nil {
+				t.Fatal("expected handshake error")
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatal("handshake failure was not reported")
+		}
+	})
+}
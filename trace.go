@@ -0,0 +1,93 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ttrpc
+
+import (
+	"fmt"
+	"io"
+)
+
+// Direction tells whether a traced frame was sent or received.
+type Direction int
+
+const (
+	// FrameReceived is the direction of a frame read from the connection.
+	FrameReceived Direction = iota
+	// FrameSent is the direction of a frame written to the connection.
+	FrameSent
+)
+
+func (d Direction) String() string {
+	switch d {
+	case FrameReceived:
+		return "received"
+	case FrameSent:
+		return "sent"
+	default:
+		return "unknown"
+	}
+}
+
+// FrameHeader is the header of a frame, as described in PROTOCOL.md.
+type FrameHeader struct {
+	Length   uint32 // length of the frame data
+	StreamID uint32
+	Type     uint8
+	Flags    uint8
+}
+
+// TypeName returns the name of the message type of the frame.
+func (h FrameHeader) TypeName() string {
+	return messageType(h.Type).String()
+}
+
+func (h FrameHeader) String() string {
+	return fmt.Sprintf("%s stream=%d length=%d flags=%#x", h.TypeName(), h.StreamID, h.Length, h.Flags)
+}
+
+// ReadFrameHeader reads the header of a frame from r, exposing the decoding of
+// frame headers in isolation, for example to fuzz it. The frame data is left
+// unread.
+func ReadFrameHeader(r io.Reader) (FrameHeader, error) {
+	var p [messageHeaderLength]byte
+	mh, err := readMessageHeader(p[:], r)
+	if err != nil {
+		return FrameHeader{}, err
+	}
+	return frameHeader(mh), nil
+}
+
+// FrameTracer is called with the header of every frame read from or written
+// to a connection. It is called synchronously while receiving or sending, so
+// it must return quickly.
+type FrameTracer func(dir Direction, h FrameHeader)
+
+// trace calls the tracer of the channel, if any, with the header mh.
+func (ch *channel) trace(dir Direction, mh messageHeader) {
+	if ch.tracer != nil {
+		ch.tracer(dir, frameHeader(mh))
+	}
+}
+
+func frameHeader(mh messageHeader) FrameHeader {
+	return FrameHeader{
+		Length:   mh.Length,
+		StreamID: mh.StreamID,
+		Type:     uint8(mh.Type),
+		Flags:    mh.Flags,
+	}
+}
@@ -0,0 +1,112 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ttrpc
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/containerd/ttrpc/internal"
+)
+
+// frameRecorder records the frames passed to its tracer.
+type frameRecorder struct {
+	mu     sync.Mutex
+	frames []string
+}
+
+func (r *frameRecorder) trace(dir Direction, h FrameHeader) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.frames = append(r.frames, fmt.Sprintf("%v %s %d", dir, h.TypeName(), h.StreamID))
+}
+
+func (r *frameRecorder) get() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.frames...)
+}
+
+func TestFrameTracer(t *testing.T) {
+	var (
+		ctx             = context.Background()
+		serverFrames    = &frameRecorder{}
+		clientFrames    = &frameRecorder{}
+		server          = mustServer(t)(NewServer(WithServerFrameTracer(serverFrames.trace)))
+		addr, listener  = newTestListener(t)
+		client, cleanup = newTestClient(t, addr, WithFrameTracer(clientFrames.trace))
+	)
+	defer listener.Close()
+	defer cleanup()
+
+	registerTestingService(server, &testingServer{})
+	go server.Serve(ctx, listener)
+	defer server.Shutdown(ctx)
+
+	var resp internal.TestPayload
+	if err := client.Call(ctx, serviceName, "Test", &internal.TestPayload{Foo: "foo"}, &resp); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"sent request 1", "received response 1"}
+	if frames := clientFrames.get(); !reflect.DeepEqual(frames, expected) {
+		t.Fatalf("unexpected client frames %v, expected %v", frames, expected)
+	}
+	// the response is traced once written, the client may see it first
+	expected = []string{"received request 1", "sent response 1"}
+	waitFor(t, func() bool {
+		return reflect.DeepEqual(serverFrames.get(), expected)
+	})
+}
+
+func TestFrameHeaderString(t *testing.T) {
+	h := FrameHeader{Length: 12, StreamID: 3, Type: uint8(messageTypeData), Flags: flagRemoteClosed}
+	if s := h.String(); s != "data stream=3 length=12 flags=0x1" {
+		t.Fatalf("unexpected frame header string %q", s)
+	}
+}
+
+func FuzzReadFrameHeader(f *testing.F) {
+	f.Add([]byte{0, 0, 0, 4, 0, 0, 0, 1, 1, 0})
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+	f.Add([]byte{0, 0, 0})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		h, err := ReadFrameHeader(bytes.NewReader(data))
+		if len(data) < messageHeaderLength {
+			if err == nil {
+				t.Fatalf("expected short header to fail, got %v", h)
+			}
+			return
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the header is encoded back to the same bytes
+		var buf bytes.Buffer
+		p := make([]byte, messageHeaderLength)
+		writeMessageHeader(&buf, p, messageHeader{Length: h.Length, StreamID: h.StreamID, Type: messageType(h.Type), Flags: h.Flags})
+		if !bytes.Equal(buf.Bytes(), data[:messageHeaderLength]) {
+			t.Fatalf("header %v encoded to %x, expected %x", h, buf.Bytes(), data[:messageHeaderLength])
+		}
+	})
+}
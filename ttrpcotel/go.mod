@@ -0,0 +1,25 @@
+module github.com/containerd/ttrpc/ttrpcotel
+
+go 1.22
+
+require (
+	github.com/containerd/ttrpc v1.2.5
+	go.opentelemetry.io/otel v1.31.0
+	go.opentelemetry.io/otel/sdk v1.31.0
+	go.opentelemetry.io/otel/trace v1.31.0
+	google.golang.org/grpc v1.69.2
+	google.golang.org/protobuf v1.36.0
+)
+
+require (
+	github.com/containerd/log v0.1.0 // indirect
+	github.com/go-logr/logr v1.4.2 // indirect
+	github.com/go-logr/stdr v1.2.2 // indirect
+	github.com/google/uuid v1.6.0 // indirect
+	github.com/sirupsen/logrus v1.9.3 // indirect
+	go.opentelemetry.io/otel/metric v1.31.0 // indirect
+	golang.org/x/sys v0.26.0 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20241021214115-324edc3d5d38 // indirect
+)
+
+replace github.com/containerd/ttrpc => ../
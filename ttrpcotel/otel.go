@@ -0,0 +1,253 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package ttrpcotel provides ttrpc interceptors creating OpenTelemetry spans
+// for calls and propagating the trace context through ttrpc metadata.
+package ttrpcotel
+
+import (
+	"context"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/containerd/ttrpc"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const instrumentationName = "github.com/containerd/ttrpc/ttrpcotel"
+
+type config struct {
+	tracerProvider trace.TracerProvider
+	propagator     propagation.TextMapPropagator
+}
+
+// Option configures the interceptors.
+type Option func(*config)
+
+// WithTracerProvider sets the tracer provider used to create spans. The global
+// tracer provider is used by default.
+func WithTracerProvider(tp trace.TracerProvider) Option {
+	return func(c *config) {
+		c.tracerProvider = tp
+	}
+}
+
+// WithPropagator sets the propagator used to carry the trace context in the
+// call metadata. By default the W3C trace context is propagated using the
+// traceparent and tracestate keys.
+func WithPropagator(p propagation.TextMapPropagator) Option {
+	return func(c *config) {
+		c.propagator = p
+	}
+}
+
+func newConfig(opts []Option) *config {
+	c := &config{
+		propagator: propagation.TraceContext{},
+	}
+	for _, o := range opts {
+		o(c)
+	}
+	if c.tracerProvider == nil {
+		c.tracerProvider = otel.GetTracerProvider()
+	}
+	return c
+}
+
+func (c *config) tracer() trace.Tracer {
+	return c.tracerProvider.Tracer(instrumentationName)
+}
+
+// UnaryClientInterceptor returns an interceptor creating a client span for
+// every unary call and injecting its context into the request metadata.
+func UnaryClientInterceptor(opts ...Option) ttrpc.UnaryClientInterceptor {
+	c := newConfig(opts)
+	tracer := c.tracer()
+	return func(ctx context.Context, req *ttrpc.Request, resp *ttrpc.Response, info *ttrpc.UnaryClientInfo, invoker ttrpc.Invoker) error {
+		name, attrs := spanInfo(info.FullMethod)
+		ctx, span := tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+		defer span.End()
+
+		md := ttrpc.MD{}
+		c.propagator.Inject(ctx, metadataCarrier(md))
+		for k, values := range md {
+			for _, v := range values {
+				req.Metadata = append(req.Metadata, &ttrpc.KeyValue{Key: k, Value: v})
+			}
+		}
+
+		err := invoker(ctx, req, resp)
+		if err == nil && resp.Status != nil {
+			err = status.ErrorProto(resp.Status)
+		}
+		setStatus(span, err)
+		return err
+	}
+}
+
+// StreamClientInterceptor returns an interceptor creating a client span for
+// every stream, ended once the stream is finished.
+func StreamClientInterceptor(opts ...Option) ttrpc.StreamClientInterceptor {
+	c := newConfig(opts)
+	tracer := c.tracer()
+	return func(ctx context.Context, desc *ttrpc.StreamDesc, service, method string, req interface{}, streamer ttrpc.Streamer) (ttrpc.ClientStream, error) {
+		name, attrs := spanInfo("/" + service + "/" + method)
+		ctx, span := tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+
+		md, ok := ttrpc.GetMetadata(ctx)
+		if ok {
+			md = md.Clone()
+		} else {
+			md = ttrpc.MD{}
+		}
+		c.propagator.Inject(ctx, metadataCarrier(md))
+
+		cs, err := streamer(ttrpc.WithMetadata(ctx, md), desc, service, method, req)
+		if err != nil {
+			setStatus(span, err)
+			span.End()
+			return nil, err
+		}
+		s := &clientStream{ClientStream: cs, desc: desc, span: span}
+		// streams the caller abandons or cancels never have RecvMsg return
+		// their end, the span ends once their context is done instead
+		streamCtx := cs.Context()
+		context.AfterFunc(streamCtx, func() {
+			s.end(ttrpc.StreamError(streamCtx))
+		})
+		return s, nil
+	}
+}
+
+// UnaryServerInterceptor returns an interceptor creating a server span for
+// every unary call, as a child of the trace context found in the metadata.
+func UnaryServerInterceptor(opts ...Option) ttrpc.UnaryServerInterceptor {
+	c := newConfig(opts)
+	tracer := c.tracer()
+	return func(ctx context.Context, unmarshal ttrpc.Unmarshaler, info *ttrpc.UnaryServerInfo, method ttrpc.Method) (interface{}, error) {
+		ctx, span := c.startServerSpan(ctx, tracer, info.FullMethod)
+		defer span.End()
+
+		resp, err := method(ctx, unmarshal)
+		setStatus(span, err)
+		return resp, err
+	}
+}
+
+// StreamServerInterceptor returns an interceptor creating a server span for
+// every stream, as a child of the trace context found in the metadata.
+func StreamServerInterceptor(opts ...Option) ttrpc.StreamServerInterceptor {
+	c := newConfig(opts)
+	tracer := c.tracer()
+	return func(ctx context.Context, ss ttrpc.StreamServer, info *ttrpc.StreamServerInfo, stream ttrpc.StreamHandler) (interface{}, error) {
+		ctx, span := c.startServerSpan(ctx, tracer, info.FullMethod)
+		defer span.End()
+
+		resp, err := stream(ctx, ss)
+		setStatus(span, err)
+		return resp, err
+	}
+}
+
+func (c *config) startServerSpan(ctx context.Context, tracer trace.Tracer, fullMethod string) (context.Context, trace.Span) {
+	if md, ok := ttrpc.GetMetadata(ctx); ok {
+		ctx = c.propagator.Extract(ctx, metadataCarrier(md))
+	}
+	name, attrs := spanInfo(fullMethod)
+	return tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(attrs...))
+}
+
+type clientStream struct {
+	ttrpc.ClientStream
+	desc    *ttrpc.StreamDesc
+	span    trace.Span
+	endOnce sync.Once
+}
+
+func (s *clientStream) RecvMsg(m interface{}) error {
+	err := s.ClientStream.RecvMsg(m)
+	switch {
+	case err == io.EOF:
+		s.end(nil)
+	case err != nil:
+		s.end(err)
+	case !s.desc.StreamingServer:
+		// a single response finishes the stream
+		s.end(nil)
+	}
+	return err
+}
+
+// end ends the span of the stream with the status of err, only the first call
+// has an effect.
+func (s *clientStream) end(err error) {
+	s.endOnce.Do(func() {
+		setStatus(s.span, err)
+		s.span.End()
+	})
+}
+
+// metadataCarrier adapts ttrpc metadata to carry the trace context.
+type metadataCarrier ttrpc.MD
+
+func (c metadataCarrier) Get(key string) string {
+	if values, ok := ttrpc.MD(c).Get(key); ok && len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+func (c metadataCarrier) Set(key, value string) {
+	ttrpc.MD(c).Set(key, value)
+}
+
+func (c metadataCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for k := range c {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// spanInfo returns the span name and attributes for a full method of the form
+// "/service/method".
+func spanInfo(fullMethod string) (string, []attribute.KeyValue) {
+	name := strings.TrimPrefix(fullMethod, "/")
+	attrs := []attribute.KeyValue{attribute.String("rpc.system", "ttrpc")}
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		attrs = append(attrs,
+			attribute.String("rpc.service", name[:i]),
+			attribute.String("rpc.method", name[i+1:]),
+		)
+	}
+	return name, attrs
+}
+
+// setStatus records the gRPC status code of err on the span.
+func setStatus(span trace.Span, err error) {
+	code := status.Code(err)
+	span.SetAttributes(attribute.Int64("rpc.ttrpc.status_code", int64(code)))
+	if code != codes.OK {
+		span.SetStatus(otelcodes.Error, status.Convert(err).Message())
+	}
+}
@@ -0,0 +1,200 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ttrpcotel
+
+import (
+	"context"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/containerd/ttrpc"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+const serviceName = "ttrpc.test.v1.Traced"
+
+func TestTracing(t *testing.T) {
+	var (
+		ctx      = context.Background()
+		recorder = tracetest.NewSpanRecorder()
+		tp       = sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	)
+
+	server, err := ttrpc.NewServer(
+		ttrpc.WithUnaryServerInterceptor(UnaryServerInterceptor(WithTracerProvider(tp))),
+		ttrpc.WithStreamServerInterceptor(StreamServerInterceptor(WithTracerProvider(tp))),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.RegisterService(serviceName, &ttrpc.ServiceDesc{
+		Methods: map[string]ttrpc.Method{
+			"Ok": func(_ context.Context, unmarshal func(interface{}) error) (interface{}, error) {
+				return &emptypb.Empty{}, unmarshal(&emptypb.Empty{})
+			},
+			"Fail": func(context.Context, func(interface{}) error) (interface{}, error) {
+				return nil, status.Error(codes.NotFound, "not found")
+			},
+		},
+		Streams: map[string]ttrpc.Stream{
+			"Stream": {
+				Handler: func(_ context.Context, ss ttrpc.StreamServer) (interface{}, error) {
+					return nil, ss.SendMsg(&emptypb.Empty{})
+				},
+				StreamingServer: true,
+			},
+		},
+	})
+
+	addr := filepath.Join(t.TempDir(), "ttrpc.sock")
+	listener, err := net.Listen("unix", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go server.Serve(ctx, listener)
+	defer server.Shutdown(ctx)
+
+	conn, err := net.Dial("unix", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := ttrpc.NewClient(conn,
+		ttrpc.WithUnaryClientInterceptor(UnaryClientInterceptor(WithTracerProvider(tp))),
+		ttrpc.WithStreamClientInterceptor(StreamClientInterceptor(WithTracerProvider(tp))),
+	)
+	defer client.Close()
+
+	if err := client.Call(ctx, serviceName, "Ok", &emptypb.Empty{}, &emptypb.Empty{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Call(ctx, serviceName, "Fail", &emptypb.Empty{}, &emptypb.Empty{}); status.Code(err) != codes.NotFound {
+		t.Fatalf("expected NotFound, got %v", err)
+	}
+	stream, err := client.NewStream(ctx, &ttrpc.StreamDesc{StreamingServer: true}, serviceName, "Stream", &emptypb.Empty{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.RecvMsg(&emptypb.Empty{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.RecvMsg(&emptypb.Empty{}); err != io.EOF {
+		t.Fatalf("expected io.EOF, got %v", err)
+	}
+
+	spans := map[trace.SpanKind]map[string]sdktrace.ReadOnlySpan{
+		trace.SpanKindClient: {},
+		trace.SpanKindServer: {},
+	}
+	for _, span := range recorder.Ended() {
+		spans[span.SpanKind()][span.Name()] = span
+	}
+
+	for _, method := range []string{"Ok", "Fail", "Stream"} {
+		name := serviceName + "/" + method
+		client, server := spans[trace.SpanKindClient][name], spans[trace.SpanKindServer][name]
+		if client == nil || server == nil {
+			t.Fatalf("missing spans for %s: client %v, server %v", name, client, server)
+		}
+		if server.Parent().SpanID() != client.SpanContext().SpanID() ||
+			server.SpanContext().TraceID() != client.SpanContext().TraceID() {
+			t.Errorf("%s: server span is not a child of the client span", name)
+		}
+
+		expected := otelcodes.Unset
+		if method == "Fail" {
+			expected = otelcodes.Error
+		}
+		if client.Status().Code != expected || server.Status().Code != expected {
+			t.Errorf("%s: unexpected span status: client %v, server %v", name, client.Status(), server.Status())
+		}
+	}
+}
+
+func TestTracingAbandonedStream(t *testing.T) {
+	var (
+		ctx      = context.Background()
+		recorder = tracetest.NewSpanRecorder()
+		tp       = sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+		release  = make(chan struct{})
+	)
+	defer close(release)
+
+	server, err := ttrpc.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.RegisterService(serviceName, &ttrpc.ServiceDesc{
+		Streams: map[string]ttrpc.Stream{
+			"Stream": {
+				Handler: func(ctx context.Context, ss ttrpc.StreamServer) (interface{}, error) {
+					select {
+					case <-release:
+					case <-ctx.Done():
+					}
+					return nil, nil
+				},
+				StreamingServer: true,
+			},
+		},
+	})
+
+	addr := filepath.Join(t.TempDir(), "ttrpc.sock")
+	listener, err := net.Listen("unix", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go server.Serve(ctx, listener)
+	defer server.Shutdown(ctx)
+
+	conn, err := net.Dial("unix", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := ttrpc.NewClient(conn, ttrpc.WithStreamClientInterceptor(StreamClientInterceptor(WithTracerProvider(tp))))
+	defer client.Close()
+
+	sctx, cancel := context.WithCancel(ctx)
+	if _, err := client.NewStream(sctx, &ttrpc.StreamDesc{StreamingServer: true}, serviceName, "Stream", &emptypb.Empty{}); err != nil {
+		t.Fatal(err)
+	}
+	// the stream is abandoned without RecvMsg ever returning its end
+	cancel()
+
+	for i := 0; ; i++ {
+		if spans := recorder.Ended(); len(spans) > 0 {
+			if spans[0].Status().Code != otelcodes.Error {
+				t.Fatalf("expected an error status for the cancelled stream, got %v", spans[0].Status())
+			}
+			return
+		}
+		if i == 500 {
+			t.Fatal("span of the abandoned stream was not ended")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
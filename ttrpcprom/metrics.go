@@ -0,0 +1,119 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package ttrpcprom provides ttrpc server interceptors recording prometheus
+// metrics for every call.
+package ttrpcprom
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/containerd/ttrpc"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc/status"
+)
+
+// ServerMetrics records the number of calls, the number of failed calls by
+// status code and the call latency for a ttrpc server. Metrics are labeled by
+// service and method.
+type ServerMetrics struct {
+	requests *prometheus.CounterVec
+	errors   *prometheus.CounterVec
+	latency  *prometheus.HistogramVec
+}
+
+// NewServerMetrics creates the server metrics and registers them with reg. The
+// default prometheus registerer is used when reg is nil.
+func NewServerMetrics(reg prometheus.Registerer) (*ServerMetrics, error) {
+	if reg == nil {
+		reg = prometheus.DefaultRegisterer
+	}
+
+	m := &ServerMetrics{
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "ttrpc",
+			Subsystem: "server",
+			Name:      "requests_total",
+			Help:      "Total number of calls started on the server.",
+		}, []string{"service", "method"}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "ttrpc",
+			Subsystem: "server",
+			Name:      "errors_total",
+			Help:      "Total number of calls which returned an error, by status code.",
+		}, []string{"service", "method", "code"}),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "ttrpc",
+			Subsystem: "server",
+			Name:      "request_duration_seconds",
+			Help:      "Time taken to handle calls, streams included.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"service", "method"}),
+	}
+
+	for _, c := range []prometheus.Collector{m.requests, m.errors, m.latency} {
+		if err := reg.Register(c); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// UnaryServerInterceptor returns an interceptor recording metrics for unary
+// calls.
+func (m *ServerMetrics) UnaryServerInterceptor() ttrpc.UnaryServerInterceptor {
+	return func(ctx context.Context, unmarshal ttrpc.Unmarshaler, info *ttrpc.UnaryServerInfo, method ttrpc.Method) (interface{}, error) {
+		done := m.start(info.FullMethod)
+		resp, err := method(ctx, unmarshal)
+		done(err)
+		return resp, err
+	}
+}
+
+// StreamServerInterceptor returns an interceptor recording metrics for
+// streams. The latency covers the whole lifetime of the stream.
+func (m *ServerMetrics) StreamServerInterceptor() ttrpc.StreamServerInterceptor {
+	return func(ctx context.Context, ss ttrpc.StreamServer, info *ttrpc.StreamServerInfo, stream ttrpc.StreamHandler) (interface{}, error) {
+		done := m.start(info.FullMethod)
+		resp, err := stream(ctx, ss)
+		done(err)
+		return resp, err
+	}
+}
+
+func (m *ServerMetrics) start(fullMethod string) func(error) {
+	service, method := splitMethod(fullMethod)
+	m.requests.WithLabelValues(service, method).Inc()
+
+	start := time.Now()
+	return func(err error) {
+		m.latency.WithLabelValues(service, method).Observe(time.Since(start).Seconds())
+		if err != nil {
+			m.errors.WithLabelValues(service, method, status.Code(err).String()).Inc()
+		}
+	}
+}
+
+// splitMethod splits a full method of the form "/service/method".
+func splitMethod(fullMethod string) (string, string) {
+	fullMethod = strings.TrimPrefix(fullMethod, "/")
+	if i := strings.LastIndex(fullMethod, "/"); i >= 0 {
+		return fullMethod[:i], fullMethod[i+1:]
+	}
+	return "unknown", fullMethod
+}
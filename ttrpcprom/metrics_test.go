@@ -0,0 +1,99 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ttrpcprom
+
+import (
+	"context"
+	"testing"
+
+	"github.com/containerd/ttrpc"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestServerMetrics(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	m, err := NewServerMetrics(reg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		ctx   = context.Background()
+		unary = m.UnaryServerInterceptor()
+		info  = &ttrpc.UnaryServerInfo{FullMethod: "/ttrpc.test.v1.Service/Unary"}
+		fail  = false
+	)
+	method := func(context.Context, func(interface{}) error) (interface{}, error) {
+		if fail {
+			return nil, status.Error(codes.NotFound, "missing")
+		}
+		return struct{}{}, nil
+	}
+	unmarshal := func(interface{}) error { return nil }
+
+	if _, err := unary(ctx, unmarshal, info, method); err != nil {
+		t.Fatal(err)
+	}
+	fail = true
+	if _, err := unary(ctx, unmarshal, info, method); status.Code(err) != codes.NotFound {
+		t.Fatalf("expected interceptor to return the handler error, got %v", err)
+	}
+
+	stream := m.StreamServerInterceptor()
+	sinfo := &ttrpc.StreamServerInfo{FullMethod: "/ttrpc.test.v1.Service/Stream"}
+	if _, err := stream(ctx, nil, sinfo, func(context.Context, ttrpc.StreamServer) (interface{}, error) {
+		return nil, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		collector prometheus.Collector
+		labels    []string
+		expected  float64
+	}{
+		{m.requests, []string{"ttrpc.test.v1.Service", "Unary"}, 2},
+		{m.errors, []string{"ttrpc.test.v1.Service", "Unary", "NotFound"}, 1},
+		{m.requests, []string{"ttrpc.test.v1.Service", "Stream"}, 1},
+	} {
+		c := tc.collector.(*prometheus.CounterVec).WithLabelValues(tc.labels...)
+		if v := testutil.ToFloat64(c); v != tc.expected {
+			t.Errorf("unexpected value for %v: %v != %v", tc.labels, v, tc.expected)
+		}
+	}
+
+	if n := testutil.CollectAndCount(m.latency); n != 2 {
+		t.Fatalf("expected latency for 2 methods, got %d", n)
+	}
+}
+
+func TestSplitMethod(t *testing.T) {
+	for _, tc := range []struct {
+		full, service, method string
+	}{
+		{"/ttrpc.test.v1.Service/Method", "ttrpc.test.v1.Service", "Method"},
+		{"Method", "unknown", "Method"},
+	} {
+		service, method := splitMethod(tc.full)
+		if service != tc.service || method != tc.method {
+			t.Errorf("splitMethod(%q) = %q, %q", tc.full, service, method)
+		}
+	}
+}
@@ -27,6 +27,11 @@ import (
 	"golang.org/x/sys/unix"
 )
 
+// UnixCredentialsFunc is a Handshaker which only accepts unix socket
+// connections, passing the peer credentials reported by SO_PEERCRED to the
+// function. The connection is refused when the function returns an error, and
+// the credentials are otherwise made available to handlers through
+// GetUnixPeerCredentials.
 type UnixCredentialsFunc func(*unix.Ucred) error
 
 func (fn UnixCredentialsFunc) Handshake(_ context.Context, conn net.Conn) (net.Conn, interface{}, error) {
@@ -35,9 +40,45 @@ func (fn UnixCredentialsFunc) Handshake(_ context.Context, conn net.Conn) (net.C
 		return nil, nil, fmt.Errorf("ttrpc.UnixCredentialsFunc: require unix socket: %w", err)
 	}
 
+	ucred, err := unixPeerCredentials(uc)
+	if err != nil {
+		return nil, nil, fmt.Errorf("ttrpc.UnixCredentialsFunc: %w", err)
+	}
+
+	if err := fn(ucred); err != nil {
+		return nil, nil, fmt.Errorf("ttrpc.UnixCredentialsFunc: credential check failed: %w", err)
+	}
+
+	return uc, ucred, nil
+}
+
+// GetUnixPeerCredentials returns the credentials of the process which connected
+// the unix socket the call in the context was received on, as reported by
+// SO_PEERCRED at the time of connect(2). It is only available to server handlers
+// and interceptors, and returns false for other kinds of connections.
+func GetUnixPeerCredentials(ctx context.Context) (*unix.Ucred, bool) {
+	p, ok := getPeer(ctx)
+	if !ok {
+		return nil, false
+	}
+	if ucred, ok := p.handshake.(*unix.Ucred); ok {
+		return ucred, true
+	}
+	uc, err := requireUnixSocket(p.conn)
+	if err != nil {
+		return nil, false
+	}
+	ucred, err := unixPeerCredentials(uc)
+	if err != nil {
+		return nil, false
+	}
+	return ucred, true
+}
+
+func unixPeerCredentials(uc *net.UnixConn) (*unix.Ucred, error) {
 	rs, err := uc.SyscallConn()
 	if err != nil {
-		return nil, nil, fmt.Errorf("ttrpc.UnixCredentialsFunc: (net.UnixConn).SyscallConn failed: %w", err)
+		return nil, fmt.Errorf("(net.UnixConn).SyscallConn failed: %w", err)
 	}
 	var (
 		ucred    *unix.Ucred
@@ -46,18 +87,13 @@ func (fn UnixCredentialsFunc) Handshake(_ context.Context, conn net.Conn) (net.C
 	if err := rs.Control(func(fd uintptr) {
 		ucred, ucredErr = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
 	}); err != nil {
-		return nil, nil, fmt.Errorf("ttrpc.UnixCredentialsFunc: (*syscall.RawConn).Control failed: %w", err)
+		return nil, fmt.Errorf("(*syscall.RawConn).Control failed: %w", err)
 	}
 
 	if ucredErr != nil {
-		return nil, nil, fmt.Errorf("ttrpc.UnixCredentialsFunc: failed to retrieve socket peer credentials: %w", ucredErr)
-	}
-
-	if err := fn(ucred); err != nil {
-		return nil, nil, fmt.Errorf("ttrpc.UnixCredentialsFunc: credential check failed: %w", err)
+		return nil, fmt.Errorf("failed to retrieve socket peer credentials: %w", ucredErr)
 	}
-
-	return uc, ucred, nil
+	return ucred, nil
 }
 
 // UnixSocketRequireUidGid requires specific *effective* UID/GID, rather than the real UID/GID.
@@ -88,6 +124,20 @@ func UnixSocketRequireSameUser() UnixCredentialsFunc {
 	return UnixSocketRequireUidGid(euid, egid)
 }
 
+// UnixSocketRequireAny accepts a connection when any of the provided checks
+// accepts its credentials, allowing an allowlist of users, groups or processes
+// to be built from several checks.
+func UnixSocketRequireAny(fns ...UnixCredentialsFunc) UnixCredentialsFunc {
+	return func(ucred *unix.Ucred) error {
+		for _, fn := range fns {
+			if fn(ucred) == nil {
+				return nil
+			}
+		}
+		return fmt.Errorf("ttrpc: invalid credentials: %v", syscall.EPERM)
+	}
+}
+
 func requireUidGid(ucred *unix.Ucred, uid, gid int) error {
 	if (uid != -1 && uint32(uid) != ucred.Uid) || (gid != -1 && uint32(gid) != ucred.Gid) {
 		return fmt.Errorf("ttrpc: invalid credentials: %v", syscall.EPERM)
@@ -0,0 +1,74 @@
+//go:build !linux
+// +build !linux
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ttrpc
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+// errUnixCredentialsUnsupported is returned by the unix credential handshakers
+// on platforms without SO_PEERCRED, so that connections are refused rather than
+// accepted without being checked.
+var errUnixCredentialsUnsupported = errors.New("ttrpc: unix socket credentials are not supported on this platform")
+
+// ucred has the fields of unix.Ucred, which is only defined on some platforms.
+type ucred = struct {
+	Pid int32
+	Uid uint32
+	Gid uint32
+}
+
+// UnixCredentialsFunc is a Handshaker refusing every connection, as peer
+// credentials are only supported on Linux. The function is never called.
+type UnixCredentialsFunc func(*ucred) error
+
+func (fn UnixCredentialsFunc) Handshake(context.Context, net.Conn) (net.Conn, interface{}, error) {
+	return nil, nil, errUnixCredentialsUnsupported
+}
+
+// UnixSocketRequireUidGid refuses every connection, as peer credentials are
+// only supported on Linux.
+func UnixSocketRequireUidGid(uid, gid int) UnixCredentialsFunc {
+	return refuseUnixCredentials
+}
+
+// UnixSocketRequireRoot refuses every connection, as peer credentials are only
+// supported on Linux.
+func UnixSocketRequireRoot() UnixCredentialsFunc {
+	return refuseUnixCredentials
+}
+
+// UnixSocketRequireSameUser refuses every connection, as peer credentials are
+// only supported on Linux.
+func UnixSocketRequireSameUser() UnixCredentialsFunc {
+	return refuseUnixCredentials
+}
+
+// UnixSocketRequireAny refuses every connection, as peer credentials are only
+// supported on Linux.
+func UnixSocketRequireAny(fns ...UnixCredentialsFunc) UnixCredentialsFunc {
+	return refuseUnixCredentials
+}
+
+func refuseUnixCredentials(*ucred) error {
+	return errUnixCredentialsUnsupported
+}
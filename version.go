@@ -0,0 +1,53 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ttrpc
+
+import (
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// VersionMetadataKey is the metadata key carrying the API version of a client,
+// see WithClientVersion and WithServerAcceptVersions. It is not part of the
+// metadata of the handlers.
+const VersionMetadataKey = ReservedMetadataPrefix + "version"
+
+// setVersion adds the API version of the client to the metadata of r.
+func (c *Client) setVersion(r *Request) {
+	if c.version != "" {
+		r.Metadata = append(r.Metadata, &KeyValue{Key: VersionMetadataKey, Value: c.version})
+	}
+}
+
+// checkVersion returns a FailedPrecondition status when the API version sent
+// with r is not accepted, nil otherwise.
+func checkVersion(accept func(string) bool, r *Request) *status.Status {
+	var version string
+	for _, kv := range r.Metadata {
+		if kv.Key == VersionMetadataKey {
+			version = kv.Value
+			break
+		}
+	}
+	if accept(version) {
+		return nil
+	}
+	if version == "" {
+		return status.Newf(codes.FailedPrecondition, "ttrpc: client API version required by the server is missing")
+	}
+	return status.Newf(codes.FailedPrecondition, "ttrpc: client API version %q is not accepted by the server", version)
+}
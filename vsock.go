@@ -0,0 +1,52 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ttrpc
+
+import "fmt"
+
+// Well known vsock context identifiers and ports.
+const (
+	// VsockCIDAny binds a listener to every context identifier of the local
+	// machine. It cannot be dialed.
+	VsockCIDAny = 0xffffffff
+	// VsockCIDHypervisor is the context identifier of the hypervisor.
+	VsockCIDHypervisor = 0
+	// VsockCIDLocal is the context identifier for loopback connections on
+	// the local machine.
+	VsockCIDLocal = 1
+	// VsockCIDHost is the context identifier of the host, as seen from a
+	// guest.
+	VsockCIDHost = 2
+	// VsockPortAny binds a listener to a port chosen by the kernel.
+	VsockPortAny = 0xffffffff
+)
+
+// VsockAddr is the address of a vsock socket.
+type VsockAddr struct {
+	CID  uint32
+	Port uint32
+}
+
+// Network returns "vsock".
+func (a *VsockAddr) Network() string {
+	return "vsock"
+}
+
+// String returns the address as "cid:port".
+func (a *VsockAddr) String() string {
+	return fmt.Sprintf("%d:%d", a.CID, a.Port)
+}
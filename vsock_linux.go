@@ -0,0 +1,240 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ttrpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// vsockConn is a connected vsock socket. The net package does not support
+// vsock, the socket is served by the runtime poller through an os.File.
+type vsockConn struct {
+	*os.File
+	local, remote *VsockAddr
+}
+
+func (c *vsockConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *vsockConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// DialVsock connects to the vsock address cid:port. The returned connection
+// may be used with NewClient.
+func DialVsock(ctx context.Context, cid, port uint32) (net.Conn, error) {
+	return dialVsock(ctx, cid, port)
+}
+
+// ListenVsock announces on the vsock port of the local context identifier cid.
+// Use VsockCIDAny to accept connections on any context identifier and
+// VsockPortAny to let the kernel pick the port. The returned listener may be
+// used with Server.Serve.
+func ListenVsock(cid, port uint32) (net.Listener, error) {
+	fd, err := unix.Socket(unix.AF_VSOCK, unix.SOCK_STREAM|unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	f := os.NewFile(uintptr(fd), fmt.Sprintf("vsock:%d:%d", cid, port))
+
+	if err := unix.Bind(fd, &unix.SockaddrVM{CID: cid, Port: port}); err != nil {
+		f.Close()
+		return nil, os.NewSyscallError("bind", err)
+	}
+	if err := unix.Listen(fd, unix.SOMAXCONN); err != nil {
+		f.Close()
+		return nil, os.NewSyscallError("listen", err)
+	}
+
+	addr, err := vsockSockname(fd)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if addr.CID == VsockCIDAny {
+		// report the address peers can reach, when the machine has one
+		if local, err := localVsockCID(); err == nil {
+			addr.CID = local
+		}
+	}
+	return &vsockListener{f: f, addr: addr}, nil
+}
+
+// vsockListener is a listening vsock socket.
+type vsockListener struct {
+	f      *os.File
+	addr   *VsockAddr
+	closed atomic.Bool
+}
+
+func (l *vsockListener) Accept() (net.Conn, error) {
+	rc, err := l.f.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var (
+		nfd       int
+		sa        unix.Sockaddr
+		acceptErr error
+	)
+	if err := rc.Read(func(fd uintptr) bool {
+		nfd, sa, acceptErr = unix.Accept4(int(fd), unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC)
+		// wait for a pending connection
+		return !errors.Is(acceptErr, unix.EAGAIN)
+	}); err != nil {
+		if l.closed.Load() {
+			return nil, net.ErrClosed
+		}
+		return nil, err
+	}
+	if acceptErr != nil {
+		return nil, os.NewSyscallError("accept4", acceptErr)
+	}
+
+	remote := &VsockAddr{}
+	if vm, ok := sa.(*unix.SockaddrVM); ok {
+		remote.CID, remote.Port = vm.CID, vm.Port
+	}
+	local, err := vsockSockname(nfd)
+	if err != nil {
+		unix.Close(nfd)
+		return nil, err
+	}
+	f := os.NewFile(uintptr(nfd), "vsock:"+remote.String())
+	return &vsockConn{File: f, local: local, remote: remote}, nil
+}
+
+func (l *vsockListener) Close() error {
+	l.closed.Store(true)
+	return l.f.Close()
+}
+
+func (l *vsockListener) Addr() net.Addr {
+	return l.addr
+}
+
+// vsockSockname returns the local address of the vsock socket fd.
+func vsockSockname(fd int) (*VsockAddr, error) {
+	sa, err := unix.Getsockname(fd)
+	if err != nil {
+		return nil, os.NewSyscallError("getsockname", err)
+	}
+	addr := &VsockAddr{}
+	if vm, ok := sa.(*unix.SockaddrVM); ok {
+		addr.CID, addr.Port = vm.CID, vm.Port
+	}
+	return addr, nil
+}
+
+// localVsockCID returns the context identifier of the local machine.
+func localVsockCID() (uint32, error) {
+	f, err := os.Open("/dev/vsock")
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	cid, err := unix.IoctlGetUint32(int(f.Fd()), unix.IOCTL_VM_SOCKETS_GET_LOCAL_CID)
+	if err != nil {
+		return 0, os.NewSyscallError("ioctl", err)
+	}
+	return cid, nil
+}
+
+func dialVsock(ctx context.Context, cid, port uint32) (net.Conn, error) {
+	if cid == VsockCIDAny || port == VsockPortAny {
+		return nil, fmt.Errorf("ttrpc: cannot dial vsock address %d:%d", cid, port)
+	}
+	fd, err := unix.Socket(unix.AF_VSOCK, unix.SOCK_STREAM|unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	remote := &VsockAddr{CID: cid, Port: port}
+	// a non-blocking file is registered with the runtime poller
+	f := os.NewFile(uintptr(fd), "vsock:"+remote.String())
+
+	if err := unix.Connect(fd, &unix.SockaddrVM{CID: cid, Port: port}); err != nil {
+		if !errors.Is(err, unix.EINPROGRESS) {
+			f.Close()
+			return nil, os.NewSyscallError("connect", err)
+		}
+		if err := waitConnect(ctx, f); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+
+	local, err := vsockSockname(fd)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &vsockConn{File: f, local: local, remote: remote}, nil
+}
+
+// waitConnect waits for the non-blocking connect of f to complete, or for ctx
+// to be done.
+func waitConnect(ctx context.Context, f *os.File) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		f.SetWriteDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() {
+		// unblock the wait below
+		f.SetWriteDeadline(time.Unix(1, 0))
+	})
+	defer stop()
+
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var (
+		waited  bool
+		sockErr error
+	)
+	if err := rc.Write(func(fd uintptr) bool {
+		// the socket is only known to be connected once writable
+		if !waited {
+			waited = true
+			return false
+		}
+		n, err := unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_ERROR)
+		if err != nil {
+			sockErr = os.NewSyscallError("getsockopt", err)
+		} else if n != 0 {
+			sockErr = os.NewSyscallError("connect", unix.Errno(n))
+		}
+		return true
+	}); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return fmt.Errorf("connect: %w", err)
+	}
+	if sockErr != nil {
+		return sockErr
+	}
+	return f.SetWriteDeadline(time.Time{})
+}
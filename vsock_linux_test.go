@@ -0,0 +1,93 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ttrpc
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/containerd/ttrpc/internal"
+)
+
+func TestVsock(t *testing.T) {
+	listener, err := ListenVsock(VsockCIDAny, VsockPortAny)
+	if err != nil {
+		t.Skipf("vsock is not available: %v", err)
+	}
+	defer listener.Close()
+
+	addr := listener.Addr().(*VsockAddr)
+	if addr.Port == VsockPortAny {
+		t.Fatalf("expected the kernel to assign a port, got %v", addr)
+	}
+
+	ctx := context.Background()
+	server := mustServer(t)(NewServer())
+	registerTestingService(server, &testingServer{})
+	go server.Serve(ctx, listener)
+	defer server.Shutdown(ctx)
+
+	dctx, cancel := context.WithTimeout(ctx, 500*time.Millisecond)
+	defer cancel()
+	conn, err := DialVsock(dctx, VsockCIDLocal, addr.Port)
+	if err != nil {
+		t.Skipf("vsock loopback is not available: %v", err)
+	}
+	client := NewClient(conn)
+	defer client.Close()
+
+	var resp internal.TestPayload
+	if err := client.Call(ctx, serviceName, "Test", &internal.TestPayload{Foo: "foo"}, &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Foo != "foofoo" {
+		t.Fatalf("unexpected response %q", resp.Foo)
+	}
+}
+
+func TestVsockListenerClose(t *testing.T) {
+	listener, err := ListenVsock(VsockCIDAny, VsockPortAny)
+	if err != nil {
+		t.Skipf("vsock is not available: %v", err)
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := listener.Accept()
+		errs <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	listener.Close()
+
+	select {
+	case err := <-errs:
+		if !errors.Is(err, net.ErrClosed) {
+			t.Fatalf("expected %v, got %v", net.ErrClosed, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("accept was not unblocked by close")
+	}
+}
+
+func TestDialVsockAny(t *testing.T) {
+	if _, err := DialVsock(context.Background(), VsockCIDAny, 1024); err == nil {
+		t.Fatal("expected dialing VsockCIDAny to fail")
+	}
+}